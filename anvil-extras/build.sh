@@ -40,8 +40,8 @@ function parse_opts() {
 }
 
 function clean() {
-  rm -f Rt mdtoc wrap awin aad
-  rm -f Rt.exe mdtoc.exe wrap.exe awin.exe aad.exe
+  rm -f Rt mdtoc wrap awin aad anvilctl
+  rm -f Rt.exe mdtoc.exe wrap.exe awin.exe aad.exe anvilctl.exe
 }
 
 function move_if_exists() {
@@ -66,6 +66,7 @@ function build() {
   go build -ldflags "$ldflags" $go_build_flags ./cmd/wrap
   go build -o $aad_name -ldflags "$ldflags" $go_build_flags ./cmd/autodump
   go build -ldflags "$ldflags" $go_build_flags ./cmd/awin
+  go build -ldflags "$ldflags" $go_build_flags ./cmd/anvilctl
 }
 
 function build_all() {
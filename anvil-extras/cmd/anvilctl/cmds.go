@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	api "anvil-go-api"
+
+	"github.com/ddkwork/golibrary/mylog"
+	"github.com/ogier/pflag"
+)
+
+func newFlagSet(name string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(name, pflag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: anvilctl %s\n%s\n", subcommands[name].usage, subcommands[name].help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func requireArgs(fs *pflag.FlagSet, n int) {
+	if fs.NArg() < n {
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+// copyResponse writes the body of the response to stdout.
+func copyResponse(rsp *http.Response) {
+	defer rsp.Body.Close()
+	mylog.Check2(io.Copy(os.Stdout, rsp.Body))
+}
+
+func cmdWins(args []string) {
+	fs := newFlagSet("wins")
+	fs.Parse(args)
+
+	anvil := connect()
+	copyResponse(mylog.Check2(anvil.Get("/wins")))
+}
+
+func cmdCat(args []string) {
+	fs := newFlagSet("cat")
+	fs.Parse(args)
+	requireArgs(fs, 1)
+
+	anvil := connect()
+	id := parseWinId(fs.Arg(0))
+	copyResponse(mylog.Check2(anvil.Get(fmt.Sprintf("/wins/%d/body", id))))
+}
+
+func cmdWrite(args []string) {
+	fs := newFlagSet("write")
+	optAppend := fs.BoolP("append", "a", false, "Append to the body instead of replacing it")
+	fs.Parse(args)
+	requireArgs(fs, 1)
+
+	anvil := connect()
+	id := parseWinId(fs.Arg(0))
+	path := fmt.Sprintf("/wins/%d/body", id)
+
+	if *optAppend {
+		mylog.Check2(anvil.Post(path, os.Stdin)).Body.Close()
+	} else {
+		mylog.Check2(anvil.Put(path, os.Stdin)).Body.Close()
+	}
+}
+
+func cmdTag(args []string) {
+	fs := newFlagSet("tag")
+	fs.Parse(args)
+	requireArgs(fs, 1)
+
+	anvil := connect()
+	id := parseWinId(fs.Arg(0))
+	path := fmt.Sprintf("/wins/%d/tag", id)
+
+	if fs.NArg() == 1 {
+		copyResponse(mylog.Check2(anvil.Get(path)))
+		return
+	}
+
+	var body io.Reader
+	if fs.NArg() == 2 && fs.Arg(1) == "-" {
+		body = os.Stdin
+	} else {
+		body = strings.NewReader(strings.Join(fs.Args()[1:], " "))
+	}
+	mylog.Check2(anvil.Put(path, body)).Body.Close()
+}
+
+func cmdExec(args []string) {
+	fs := newFlagSet("exec")
+	optWin := fs.IntP("win", "w", 0, "Execute the command in the tag of the window with this id")
+	fs.Parse(args)
+	requireArgs(fs, 1)
+
+	execute(connect(), api.ExecuteReq{
+		Cmd:   fs.Arg(0),
+		Args:  fs.Args()[1:],
+		WinId: *optWin,
+	})
+}
+
+func cmdExpr(args []string) {
+	fs := newFlagSet("expr")
+	optWin := fs.IntP("win", "w", 0, "Id of the window whose body the expression is applied to")
+	fs.Parse(args)
+	requireArgs(fs, 1)
+
+	if *optWin == 0 {
+		die("anvilctl: expr requires a window id (-w)\n")
+	}
+
+	// Commands starting with ! are Edit expressions
+	execute(connect(), api.ExecuteReq{
+		Cmd:   "!" + strings.Join(fs.Args(), " "),
+		WinId: *optWin,
+	})
+}
+
+func execute(anvil api.Anvil, req api.ExecuteReq) {
+	body := mylog.Check2(json.Marshal(req))
+	mylog.Check2(anvil.WithEncoding(api.EncodingJson).Post("/execute", bytes.NewReader(body))).Body.Close()
+}
+
+func cmdSel(args []string) {
+	fs := newFlagSet("sel")
+	optText := fs.BoolP("text", "t", false, "Print the selected text rather than the selection offsets")
+	fs.Parse(args)
+	requireArgs(fs, 1)
+
+	anvil := connect()
+	id := parseWinId(fs.Arg(0))
+	path := fmt.Sprintf("/wins/%d/selections", id)
+
+	if !*optText {
+		copyResponse(mylog.Check2(anvil.Get(path)))
+		return
+	}
+
+	var sels []api.Selection
+	mylog.Check(anvil.GetInto(path, &sels))
+
+	rsp := mylog.Check2(anvil.Get(fmt.Sprintf("/wins/%d/body", id)))
+	defer rsp.Body.Close()
+	body := []rune(string(mylog.Check2(io.ReadAll(rsp.Body))))
+
+	for _, s := range sels {
+		if s.Start < 0 || s.End > len(body) || s.Start > s.End {
+			continue
+		}
+		fmt.Println(string(body[s.Start:s.End]))
+	}
+}
+
+func cmdWatch(args []string) {
+	fs := newFlagSet("watch")
+	optOps := fs.StringP("ops", "o", "", "Comma-separated notification ops to watch (insert, delete, exec, open, close, save, focus, select, complete, completeword, plumb). Default is all")
+	optWin := fs.IntP("win", "w", 0, "Only print notifications for the window with this id")
+	optInterval := fs.IntP("interval", "i", 500, "Polling interval in milliseconds")
+	fs.Parse(args)
+
+	ops, err := parseOps(*optOps)
+	if err != nil {
+		die("anvilctl: %v\n", err)
+	}
+
+	err = watch(connect(), ops, *optWin, time.Duration(*optInterval)*time.Millisecond)
+	if err != nil {
+		die("anvilctl: %v\n", err)
+	}
+}
+
+// watch prints the notifications for the ops, or all ops if ops is empty, until interrupted or until
+// the notifications can't be read.
+func watch(anvil api.Anvil, ops []api.NotificationOp, winId int, interval time.Duration) (err error) {
+	// The user token session is shared by all tools, so make our own session for the notifications.
+	if usingUserToken {
+		anvil = mylog.Check2(anvil.NewSession("anvilctl watch"))
+		defer closeSession(anvil)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	// Without a filter only some ops are sent, so ask for all of them
+	if len(ops) == 0 {
+		ops = allOps()
+	}
+	if err = anvil.SetNotificationFilter(ops...); err != nil {
+		return
+	}
+
+	out := newNotificationWriter(os.Stdout)
+	for {
+		var notifs []api.Notification
+		if err = anvil.GetInto("/notifs", &notifs); err != nil {
+			return
+		}
+
+		for _, n := range notifs {
+			if winId != 0 && n.WinId != winId {
+				continue
+			}
+			out.Write(n)
+		}
+		out.Flush()
+
+		select {
+		case <-sigs:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// closeSession closes the API session. Anvil may already have exited, taking the session with it,
+// so failures are ignored.
+func closeSession(anvil api.Anvil) {
+	defer func() {
+		recover()
+	}()
+	anvil.CloseSession()
+}
+
+// allOps returns every notification op that the api package knows the name of.
+func allOps() (ops []api.NotificationOp) {
+	for op := api.NotificationOpInsert; op.String() != "unknown"; op++ {
+		ops = append(ops, op)
+	}
+	return
+}
+
+// parseOps parses a comma-separated list of notification op names. An empty list gives no ops.
+func parseOps(s string) (ops []api.NotificationOp, err error) {
+	if s == "" {
+		return
+	}
+
+outer:
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for _, op := range allOps() {
+			if op.String() == name {
+				ops = append(ops, op)
+				continue outer
+			}
+		}
+		return nil, fmt.Errorf("unknown notification op '%s'", name)
+	}
+	return
+}
+
+// notificationWriter writes notifications one per line in the selected output format.
+type notificationWriter struct {
+	json *json.Encoder
+	csv  *csv.Writer
+}
+
+func newNotificationWriter(w io.Writer) notificationWriter {
+	if *optFormat == "csv" {
+		c := csv.NewWriter(w)
+		c.Write([]string{"WinId", "Op", "Offset", "Len", "Cmd"})
+		return notificationWriter{csv: c}
+	}
+	return notificationWriter{json: json.NewEncoder(w)}
+}
+
+func (n notificationWriter) Write(notif api.Notification) {
+	if n.csv != nil {
+		n.csv.Write([]string{
+			strconv.Itoa(notif.WinId),
+			notif.Op.String(),
+			strconv.Itoa(notif.Offset),
+			strconv.Itoa(notif.Len),
+			strings.Join(notif.Cmd, " "),
+		})
+		return
+	}
+
+	n.json.Encode(struct {
+		WinId  int
+		Op     string
+		Offset int
+		Len    int
+		Cmd    []string `json:",omitempty"`
+	}{notif.WinId, notif.Op.String(), notif.Offset, notif.Len, notif.Cmd})
+}
+
+func (n notificationWriter) Flush() {
+	if n.csv != nil {
+		n.csv.Flush()
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	api "anvil-go-api"
+)
+
+func TestParseOps(t *testing.T) {
+	type test struct {
+		input     string
+		output    []api.NotificationOp
+		expectErr bool
+	}
+
+	tests := []test{
+		{input: "", output: nil},
+		{input: "save", output: []api.NotificationOp{api.NotificationOpSave}},
+		{input: "Insert, delete", output: []api.NotificationOp{api.NotificationOpInsert, api.NotificationOpDelete}},
+		{input: "completeword,plumb", output: []api.NotificationOp{api.NotificationOpCompleteWord, api.NotificationOpPlumb}},
+		{input: "save,bogus", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			output, err := parseOps(tc.input)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("For '%s', expected an error", tc.input)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(output, tc.output) {
+				t.Fatalf("For '%s', expected %v does not match actual %v (err %v)", tc.input, tc.output, output, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	api "anvil-go-api"
+
+	"github.com/ddkwork/golibrary/mylog"
+	"github.com/ogier/pflag"
+)
+
+var (
+	optFormat = pflag.StringP("format", "f", "json", "Output format: json or csv")
+	optSess   = pflag.StringP("sess", "S", "", "API session id. Defaults to ANVIL_API_SESS, or the user token if that is not set")
+	optPort   = pflag.StringP("port", "p", "", "API TCP port. Defaults to ANVIL_API_PORT")
+	optSocket = pflag.StringP("socket", "s", "", "API Unix socket. Defaults to ANVIL_API_SOCK, or the socket in the Anvil config directory")
+)
+
+type subcommand struct {
+	run   func(args []string)
+	usage string
+	help  string
+}
+
+var subcommands map[string]subcommand
+
+func init() {
+	// Initialized here rather than statically since the subcommands refer to the map for their usage.
+	subcommands = map[string]subcommand{
+		"wins":  {cmdWins, "wins", "List the open windows"},
+		"cat":   {cmdCat, "cat WINID", "Write the body of a window to stdout"},
+		"write": {cmdWrite, "write [-a] WINID", "Replace (or with -a append to) the body of a window with stdin"},
+		"tag":   {cmdTag, "tag WINID [TEXT...]", "Print the tag of a window, or set it to TEXT. If TEXT is - it is read from stdin"},
+		"exec":  {cmdExec, "exec [-w WINID] CMD [ARG...]", "Execute a command as if it was run from the editor tag, or from a window tag"},
+		"expr":  {cmdExpr, "expr -w WINID EXPR...", "Run an Edit expression on the body of a window"},
+		"watch": {cmdWatch, "watch [-o OPS] [-w WINID] [-i MILLIS]", "Print notifications as they occur"},
+		"sel":   {cmdSel, "sel [-t] WINID", "Print the selections in a window, or with -t the selected text"},
+	}
+}
+
+// usingUserToken is true if we are authenticated with the user token rather than a session
+// Anvil created for us.
+var usingUserToken bool
+
+func main() {
+	pflag.Usage = usage
+	pflag.SetInterspersed(false)
+	pflag.Parse()
+
+	if *optFormat != "json" && *optFormat != "csv" {
+		die("anvilctl: format must be json or csv\n")
+	}
+
+	if pflag.NArg() < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	sub, ok := subcommands[pflag.Arg(0)]
+	if !ok {
+		die("anvilctl: unknown subcommand %s\n", pflag.Arg(0))
+	}
+
+	sub.run(pflag.Args()[1:])
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <subcommand> [argument...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Script a running Anvil editor using its API.\n\n")
+	fmt.Fprintf(os.Stderr, "Options:\n")
+	pflag.PrintDefaults()
+
+	fmt.Fprintf(os.Stderr, "\nSubcommands:\n")
+	names := make([]string, 0, len(subcommands))
+	for n := range subcommands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", subcommands[n].usage, subcommands[n].help)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nWhen not run from within Anvil, anvilctl connects to the socket in the Anvil config directory\n")
+	fmt.Fprintf(os.Stderr, "using the user token.\n")
+}
+
+// connect builds an Anvil client from the options, the environment and the Anvil config directory.
+// Options take precedence over the environment.
+func connect() (anvil api.Anvil) {
+	sess := firstNonEmpty(*optSess, os.Getenv("ANVIL_API_SESS"))
+	port := firstNonEmpty(*optPort, os.Getenv("ANVIL_API_PORT"))
+	sock := firstNonEmpty(*optSocket, os.Getenv("ANVIL_API_SOCK"))
+
+	if sess == "" {
+		sess = mylog.Check2(api.UserToken())
+		usingUserToken = true
+		if sock == "" {
+			sock = api.SocketPath()
+		}
+	}
+
+	switch {
+	case *optPort != "":
+		anvil = api.New(sess, port)
+	case sock != "":
+		anvil = api.NewUnix(sess, sock)
+	case port != "":
+		anvil = api.New(sess, port)
+	default:
+		die("anvilctl: can't determine how to connect to Anvil. Set ANVIL_API_PORT or ANVIL_API_SOCK\n")
+	}
+
+	return anvil.WithEncoding(encoding())
+}
+
+func encoding() string {
+	if *optFormat == "csv" {
+		return api.EncodingCsv
+	}
+	return api.EncodingJson
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func parseWinId(s string) int {
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 {
+		die("anvilctl: invalid window id '%s'\n", s)
+	}
+	return id
+}
+
+func die(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+	os.Exit(1)
+}
@@ -3,14 +3,28 @@ module github.com/jeffwilliams/anvil-extras
 go 1.22.4
 
 require (
-	anvil-go-api v0.0.0-00010101000000-000000000000 // indirect
+	anvil-go-api v0.0.0-00010101000000-000000000000
+	github.com/acarl005/stripansi v0.0.0-20180116102854-5a71ef0e047d
+	github.com/creack/pty v1.1.21
+	github.com/ddkwork/golibrary v0.0.83
+	github.com/ogier/pflag v0.0.1
+	github.com/speedata/hyphenation v1.0.2
+	golang.org/x/sys v0.21.0
+)
+
+require (
 	github.com/UserExistsError/conpty v0.1.2 // indirect
-	github.com/acarl005/stripansi v0.0.0-20180116102854-5a71ef0e047d // indirect
-	github.com/creack/pty v1.1.21 // indirect
-	github.com/ddkwork/golibrary v0.0.83 // indirect
-	github.com/ogier/pflag v0.0.1 // indirect
-	github.com/speedata/hyphenation v1.0.2 // indirect
-	golang.org/x/sys v0.21.0 // indirect
+	github.com/dc0d/caseconv v0.5.0 // indirect
+	github.com/fatih/color v1.17.0 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	golang.org/x/exp v0.0.0-20240613232115-7f521ea00fb8 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+	mvdan.cc/gofumpt v0.6.0 // indirect
 )
 
 replace anvil-go-api => ../anvil-go-api
@@ -1,12 +1,18 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 
 	"github.com/ddkwork/golibrary/mylog"
 )
@@ -37,14 +43,35 @@ func NewURLs(port string) URLs {
 	}
 }
 
+// NewUnixURLs returns URLs for use with a client that dials a Unix socket. The host part
+// of the URL is ignored by the transport.
+func NewUnixURLs() URLs {
+	return URLs{
+		base: "http://anvil",
+	}
+}
+
 func (u URLs) Build(path string) string {
 	return fmt.Sprintf("%s%s", u.base, path)
 }
 
 type Anvil struct {
-	sessId string
-	urls   URLs
-	client http.Client
+	sessId   string
+	urls     URLs
+	client   http.Client
+	encoding string
+}
+
+const (
+	EncodingJson = "application/json"
+	EncodingCsv  = "text/csv"
+)
+
+// WithEncoding returns a copy of the Anvil that sends and requests bodies in the
+// specified encoding, which is one of EncodingJson or EncodingCsv.
+func (a Anvil) WithEncoding(encoding string) Anvil {
+	a.encoding = encoding
+	return a
 }
 
 func New(sessId, port string) Anvil {
@@ -54,14 +81,39 @@ func New(sessId, port string) Anvil {
 	}
 }
 
+// NewUnix returns an Anvil that connects to the API over the Unix domain socket at sockPath.
+func NewUnix(sessId, sockPath string) Anvil {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", sockPath)
+	}
+
+	return Anvil{
+		sessId: sessId,
+		urls:   NewUnixURLs(),
+		client: http.Client{
+			Transport: &http.Transport{DialContext: dial},
+		},
+	}
+}
+
+// NewFromEnv returns an Anvil using the environment variables Anvil sets for commands it executes.
+// The Unix socket in ANVIL_API_SOCK is preferred over the TCP port in ANVIL_API_PORT.
 func NewFromEnv() (anvil Anvil, err error) {
 	sessId := os.Getenv("ANVIL_API_SESS")
 	port := os.Getenv("ANVIL_API_PORT")
+	sock := os.Getenv("ANVIL_API_SOCK")
 
 	if sessId == "" {
 		mylog.Check(fmt.Errorf("environment variable ANVIL_API_SESS is not set"))
 		return
 	}
+
+	if sock != "" {
+		anvil = NewUnix(sessId, sock)
+		return
+	}
+
 	if port == "" {
 		mylog.Check(fmt.Errorf("environment variable ANVIL_API_PORT is not set"))
 		return
@@ -74,6 +126,70 @@ func NewFromEnv() (anvil Anvil, err error) {
 	return
 }
 
+// ConfDir returns the Anvil configuration directory of the current user.
+func ConfDir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("USERPROFILE"), ".anvil")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".anvil")
+}
+
+// NewFromUserToken returns an Anvil that authenticates using the user token stored in the
+// Anvil configuration directory. It is meant for programs that are not started by Anvil.
+// The API socket in the configuration directory is used, unless ANVIL_API_PORT is set.
+func NewFromUserToken() (anvil Anvil, err error) {
+	tok := mylog.Check2(UserToken())
+
+	if port := os.Getenv("ANVIL_API_PORT"); port != "" {
+		anvil = New(tok, port)
+		return
+	}
+
+	anvil = NewUnix(tok, SocketPath())
+	return
+}
+
+// UserToken reads the user token from the Anvil configuration directory.
+func UserToken() (tok string, err error) {
+	raw := mylog.Check2(os.ReadFile(filepath.Join(ConfDir(), "api.token")))
+	tok = strings.TrimSpace(string(raw))
+	if tok == "" {
+		mylog.Check(fmt.Errorf("the user token file in %s is empty", ConfDir()))
+	}
+	return
+}
+
+// SocketPath returns the path of the Unix socket Anvil serves the API on for the current user.
+func SocketPath() string {
+	return filepath.Join(ConfDir(), "api.sock")
+}
+
+// NewSession creates a new API session, which has its own notifications and user-defined
+// commands, and returns an Anvil that uses it. The receiver must be authenticated using the user token.
+func (a Anvil) NewSession(cmd string) (anvil Anvil, err error) {
+	body := mylog.Check2(json.Marshal(SessionReq{Cmd: cmd, Pid: os.Getpid()}))
+
+	rsp := mylog.Check2(a.WithEncoding(EncodingJson).Post("/sessions", bytes.NewReader(body)))
+	defer rsp.Body.Close()
+
+	var sess Session
+	mylog.Check(json.NewDecoder(rsp.Body).Decode(&sess))
+
+	anvil = a
+	anvil.sessId = sess.Id
+	return
+}
+
+// CloseSession deletes the API session used by the receiver.
+func (a Anvil) CloseSession() (err error) {
+	req, url := mylog.Check3(a.buildReq(http.MethodDelete, "/sessions", nil))
+
+	rsp := mylog.Check2(a.client.Do(req))
+	defer rsp.Body.Close()
+	mylog.Check(checkHttpError(rsp, fmt.Sprintf("DELETE to %s failed", url)))
+	return
+}
+
 func (a Anvil) Get(path string) (rsp *http.Response, err error) {
 	req, url := mylog.Check3(a.buildReq(http.MethodGet, path, nil))
 
@@ -84,7 +200,7 @@ func (a Anvil) Get(path string) (rsp *http.Response, err error) {
 }
 
 func (a Anvil) GetInto(path string, resp interface{}) (err error) {
-	rsp := mylog.Check2(a.Get(path))
+	rsp := mylog.Check2(a.WithEncoding(EncodingJson).Get(path))
 	raw := mylog.Check2(ioutil.ReadAll(rsp.Body))
 	mylog.Check(prefixError(err, "Error reading body info"))
 	mylog.Check(json.Unmarshal(raw, resp))
@@ -115,8 +231,73 @@ func (a Anvil) buildReq(method, path string, body io.Reader) (req *http.Request,
 	req = mylog.Check2(http.NewRequest(method, url, body))
 	mylog.Check(prefixError(err, fmt.Sprintf("Error building %s request for %s", method, url)))
 
+	enc := a.encoding
+	if enc == "" {
+		enc = EncodingJson
+	}
+
 	req.Header.Add("Anvil-Sess", a.sessId)
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", enc)
+	req.Header.Add("Accept", enc)
+	return
+}
+
+// RegisterCommands registers user-defined commands for the session. When one is executed in Anvil the
+// session receives an Exec notification.
+func (a Anvil) RegisterCommands(cmds ...UserDefinedCommand) (err error) {
+	body := mylog.Check2(json.Marshal(cmds))
+	rsp := mylog.Check2(a.WithEncoding(EncodingJson).Post("/cmds", bytes.NewReader(body)))
+	rsp.Body.Close()
+	return
+}
+
+// AnswerCompletion sends the completions for the Complete or CompleteWord notification with the request id.
+func (a Anvil) AnswerCompletion(reqId int, completions []string) (err error) {
+	body := mylog.Check2(json.Marshal(CompletionRsp{ReqId: reqId, Completions: completions}))
+	rsp := mylog.Check2(a.WithEncoding(EncodingJson).Post("/cmds/completions", bytes.NewReader(body)))
+	rsp.Body.Close()
+	return
+}
+
+// RegisterCompletionProviders registers the session to provide completions of words in window bodies,
+// replacing any earlier registration. The session then receives CompleteWord notifications, which it
+// answers using AnswerCompletion. Calling it with no providers stops them.
+func (a Anvil) RegisterCompletionProviders(providers ...CompletionProvider) (err error) {
+	if providers == nil {
+		providers = []CompletionProvider{}
+	}
+	body := mylog.Check2(json.Marshal(providers))
+	rsp := mylog.Check2(a.WithEncoding(EncodingJson).Post("/completers", bytes.NewReader(body)))
+	rsp.Body.Close()
+	return
+}
+
+// RegisterPlumbingPorts makes the session listen on the plumbing ports, replacing any earlier
+// registration. The session then receives a Plumb notification when a plumbing rule sends a message
+// to one of the ports. Calling it with no ports stops them.
+func (a Anvil) RegisterPlumbingPorts(ports ...string) (err error) {
+	if ports == nil {
+		ports = []string{}
+	}
+	body := mylog.Check2(json.Marshal(ports))
+	rsp := mylog.Check2(a.WithEncoding(EncodingJson).Put("/plumb/ports", bytes.NewReader(body)))
+	rsp.Body.Close()
+	return
+}
+
+// SetNotificationFilter limits the notifications delivered to the session to those with the
+// specified ops. Calling it with no ops delivers the insert and delete notifications, as for a
+// session that never set a filter. Exec and complete notifications for the session's own commands
+// are always delivered. The open, close, save, focus and select notifications are only delivered
+// when they are in the filter.
+func (a Anvil) SetNotificationFilter(ops ...NotificationOp) (err error) {
+	names := make([]string, len(ops))
+	for i, op := range ops {
+		names[i] = op.String()
+	}
+
+	body := mylog.Check2(json.Marshal(names))
+	rsp := mylog.Check2(a.WithEncoding(EncodingJson).Put("/notifs/filter", bytes.NewReader(body)))
+	rsp.Body.Close()
 	return
 }
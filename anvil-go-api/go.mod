@@ -2,4 +2,19 @@ module anvil-go-api
 
 go 1.22.4
 
-require github.com/ddkwork/golibrary v0.0.83 // indirect
+require github.com/ddkwork/golibrary v0.0.83
+
+require (
+	github.com/dc0d/caseconv v0.5.0 // indirect
+	github.com/fatih/color v1.17.0 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	golang.org/x/exp v0.0.0-20240613232115-7f521ea00fb8 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+	mvdan.cc/gofumpt v0.6.0 // indirect
+)
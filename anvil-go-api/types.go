@@ -6,6 +6,10 @@ type Window struct {
 	Path       string
 }
 
+type Selection struct {
+	Start, End, Len int
+}
+
 type WindowBody struct {
 	Len int
 }
@@ -16,17 +20,79 @@ type Notification struct {
 	Offset int
 	Len    int
 	Cmd    []string
+	// ReqId identifies the request of a Complete notification. Answer it using Anvil.AnswerCompletion.
+	ReqId int
 }
 
 type NotificationOp int
 
 const (
-	NotificationOpInsert = iota
+	NotificationOpInsert NotificationOp = iota
 	NotificationOpDelete
 	NotificationOpExec
+	NotificationOpOpen
+	NotificationOpClose
+	NotificationOpSave
+	NotificationOpFocus
+	NotificationOpSelect
+	// NotificationOpComplete asks for completions of the last element of Cmd. It is only sent
+	// for commands registered with Completes set.
+	NotificationOpComplete
+	// NotificationOpCompleteWord asks for completions of the partial word in Cmd at the cursor position
+	// Offset. It is only sent to sessions that registered a completion provider.
+	NotificationOpCompleteWord
+	// NotificationOpPlumb is sent when a plumbing rule sends a message to a port the session listens on.
+	// Cmd holds the port, the plumbed text, and then the message's attributes in the form name=value.
+	NotificationOpPlumb
 )
 
+var notificationOpNames = []string{"insert", "delete", "exec", "open", "close", "save", "focus", "select", "complete", "completeword", "plumb"}
+
+func (o NotificationOp) String() string {
+	if int(o) < 0 || int(o) >= len(notificationOpNames) {
+		return "unknown"
+	}
+	return notificationOpNames[o]
+}
+
 type ExecuteReq struct {
-	Cmd  string
-	Args []string
+	Cmd   string
+	Args  []string
+	WinId int `json:",omitempty"`
+}
+
+type SessionReq struct {
+	Cmd string
+	Pid int `json:",omitempty"`
+}
+
+type Session struct {
+	Id string
+}
+
+// UserDefinedCommand describes a command registered with Anvil. Only Name is required.
+type UserDefinedCommand struct {
+	Name      string
+	ShortHelp string `json:",omitempty"`
+	LongHelp  string `json:",omitempty"`
+	// WinIds, if not empty, limits the command to the windows with these ids.
+	WinIds []int `json:",omitempty"`
+	// FilePatterns, if not empty, limits the command to windows whose file matches one of these glob patterns.
+	FilePatterns []string `json:",omitempty"`
+	// Completes is true if the session answers Complete notifications for the command's arguments.
+	Completes bool `json:",omitempty"`
+}
+
+type CompletionRsp struct {
+	ReqId       int
+	Completions []string
+}
+
+// CompletionProvider registers a session to provide completions of words in window bodies. An empty
+// CompletionProvider provides completions for all windows.
+type CompletionProvider struct {
+	// WinIds, if not empty, limits the provider to the windows with these ids.
+	WinIds []int `json:",omitempty"`
+	// FilePatterns, if not empty, limits the provider to windows whose file matches one of these glob patterns.
+	FilePatterns []string `json:",omitempty"`
 }
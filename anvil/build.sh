@@ -8,19 +8,22 @@ ldflags="-X main.buildVersion=$vers -X main.buildTime=$now"
 go_build_flags=""
 
 function usage() {
-  echo "Usage: $0 [-a ARCH] [-o OS] [-t]"
+  echo "Usage: $0 [-a ARCH] [-o OS] [-t] [-r]"
   echo "The supported values fo ARCH are '386' (for 32-bit x86) or 'amd64' (for 64-bit x86_64)"
   echo "The supported values fo OS are 'linux' or 'windows'"
   echo "Each of the -o and -a flags may be specified multiple times to produce builds for multiple architectures"
   echo "The -t option trims the paths in the binaries"
+  echo "The -r option also builds the anvil-agent remote helper for the common Unix platforms into the agents directory."
+  echo "Copy them to the agents directory in the Anvil config directory to use them."
   exit 1
 }
 
 GOARCHS=""
 GOOSS=""
+AGENTS=""
 
 function parse_opts() {
-  while getopts "a:o:t" o
+  while getopts "a:o:tr" o
   do
     case "$o" in
       a)
@@ -32,6 +35,9 @@ function parse_opts() {
       t)
         go_build_flags="-trimpath"
         ;;
+      r)
+        AGENTS=1
+        ;;
       *)
         usage
         ;;
@@ -72,6 +78,19 @@ function build_anvil() {
   move_if_exists src/anvil/anvil .
 }
 
+function build_agents() {
+  mkdir -p agents
+
+  for os in linux darwin freebsd
+  do
+    for arch in amd64 arm64
+    do
+      echo "Building anvil-agent for $os/$arch"
+      (cd src/anvil && CGO_ENABLED=0 GOOS=$os GOARCH=$arch go build -ldflags "-s -w" $go_build_flags -o ../../agents/anvil-agent-$os-$arch ./cmd/anvil-agent)
+    done
+  done
+}
+
 function build_all() {
   local msg=$1
 
@@ -128,3 +147,8 @@ clean
 
 echo "building version $vers"
 build_all_os_and_arch
+
+if [ "$AGENTS" != "" ]
+then
+  build_agents
+fi
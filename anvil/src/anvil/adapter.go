@@ -11,6 +11,8 @@ import (
 // embedded in (the editor)
 type adapter interface {
 	completeFilename(word string, callback CompletionsCallback)
+	completeCommandArgument(e *editable, callback CompletionsCallback) (requested bool)
+	completeWord(e *editable, prefix string, callback CompletionsCallback) (requested bool)
 	appendError(dir, msg string)
 	copyAllSelectionsFromLastSelectedEditable(gtx layout.Context)
 	cutAllSelectionsFromLastSelectedEditable(gtx layout.Context)
@@ -23,7 +25,7 @@ type adapter interface {
 	loadFileInPlaceAndGoto(gtx layout.Context, path string, opts LoadFileOpts)
 	loadFileInPlace(gtx layout.Context, path string)
 	textOfLastSelectionInEditor() string
-	shiftEditorItemsDueToTextModification(startOfChange, lengthOfChange int)
+	shiftEditorItemsDueToTextModification(m *editableModel, startOfChange, lengthOfChange int)
 	setFocusedEditable(e *editable)
 	focusedEditable() *editable
 	findFile(file string) (path *GlobalPath, err error)
@@ -33,9 +35,18 @@ type adapter interface {
 	file() string
 	mark(markName, file string, cursorIndex int)
 	gotoMark(markName string)
+	// lineMarks returns the rune indices of the marked lines to show beside the text of the editable.
+	lineMarks(e *editable) []int
+	// breakpoints returns the rune indices of the lines with breakpoints to show beside the text of the editable.
+	breakpoints(e *editable) []int
+	// debugLine returns the rune index of the line the debugger is stopped at, if it is in the editable.
+	debugLine(e *editable) (index int, ok bool)
+	// recordJump adds the cursor position of the window to the jump list before the cursor jumps away.
+	recordJump()
 	doWork(w Work)
 	replaceCrWithTofu() bool
 	setShellString(s string)
+	selectionsChanged(e *editable)
 }
 
 // editableAdapter connects an editable with the rest of the editor (it's owning window, etc)
@@ -57,6 +68,29 @@ func (a editableAdapter) completeFilename(word string, callback CompletionsCallb
 		Check(FilenameCompletionsAsync(word, dir, base, callback))
 }
 
+// completeCommandArgument requests completions from the API session that owns the user-defined
+// command on the line before the cursor, if there is one.
+func (a editableAdapter) completeCommandArgument(e *editable, callback CompletionsCallback) (requested bool) {
+	winId := -1
+	if w, ok := a.owner.(*Window); ok {
+		winId = w.Id
+	}
+
+	line := e.lineBeforeCursor(e.firstCursorIndex())
+	return requestApiCommandArgCompletion(winId, a.file(), line, callback)
+}
+
+// completeWord requests completions of the word at the cursor from the API sessions that provide
+// completions for the window.
+func (a editableAdapter) completeWord(e *editable, prefix string, callback CompletionsCallback) (requested bool) {
+	winId := -1
+	if w, ok := a.owner.(*Window); ok {
+		winId = w.Id
+	}
+
+	return requestApiWordCompletions(winId, a.file(), e.firstCursorIndex(), prefix, callback) > 0
+}
+
 func (a editableAdapter) appendError(dir, msg string) {
 	editor.AppendError(dir, msg)
 }
@@ -144,6 +178,7 @@ func (a editableAdapter) column() *Col {
 }
 
 func (a editableAdapter) loadFileAndGoto(gtx layout.Context, path string, opts LoadFileOpts) {
+	a.recordJump()
 	opts.InCol = a.column()
 	w := editor.LoadFileOpts(path, opts)
 	if w != nil {
@@ -152,6 +187,7 @@ func (a editableAdapter) loadFileAndGoto(gtx layout.Context, path string, opts L
 }
 
 func (a editableAdapter) loadFile(gtx layout.Context, path string) {
+	a.recordJump()
 	var opts LoadFileOpts
 	opts.InCol = a.column()
 	w := editor.LoadFileOpts(path, opts)
@@ -166,6 +202,7 @@ func (a editableAdapter) loadFileInPlaceAndGoto(gtx layout.Context, path string,
 		return
 	}
 
+	editor.recordJump(win)
 	win.LoadFileAndGoto(path, opts.GoTo, opts.SelectBehaviour, opts.GrowBodyBehaviour)
 }
 
@@ -175,6 +212,7 @@ func (a editableAdapter) loadFileInPlace(gtx layout.Context, path string) {
 		return
 	}
 
+	editor.recordJump(win)
 	win.LoadFile(path)
 }
 
@@ -200,9 +238,15 @@ func (a editableAdapter) textOfAllSelectionsInLastSelectedEditable() []string {
 	return res
 }
 
-func (a editableAdapter) shiftEditorItemsDueToTextModification(startOfChange, lengthOfChange int) {
-	file := mylog.Check2(a.fileFinder.WindowFile())
-	editor.Marks.ShiftDueToTextModification(file, startOfChange, lengthOfChange)
+func (a editableAdapter) shiftEditorItemsDueToTextModification(m *editableModel, startOfChange, lengthOfChange int) {
+	// Only changes to the body of a window move the marks in its file.
+	w, ok := a.owner.(*Window)
+	if !ok || m != &w.Body.editableModel {
+		return
+	}
+	editor.Marks.ShiftDueToTextModification(w.file, startOfChange, lengthOfChange)
+	editor.Jumps.ShiftDueToTextModification(w.file, startOfChange, lengthOfChange)
+	editor.Debugger.ShiftDueToTextModification(w.file, startOfChange, lengthOfChange)
 }
 
 func (a editableAdapter) setFocusedEditable(e *editable) {
@@ -248,14 +292,51 @@ func (a editableAdapter) mark(markName, file string, cursorIndex int) {
 func (a editableAdapter) gotoMark(markName string) {
 	file, seek, ok := editor.Marks.Seek(markName)
 	if ok {
+		a.recordJump()
 		editor.LoadFileOpts(file, LoadFileOpts{GoTo: seek, SelectBehaviour: dontSelectText})
 	}
 }
 
+func (a editableAdapter) lineMarks(e *editable) []int {
+	w, ok := a.owner.(*Window)
+	if !ok || e != &w.Body.editable {
+		return nil
+	}
+	return editor.Marks.Lines(w.file)
+}
+
+func (a editableAdapter) breakpoints(e *editable) []int {
+	w, ok := a.owner.(*Window)
+	if !ok || e != &w.Body.editable {
+		return nil
+	}
+	return editor.Debugger.Breakpoints.Lines(w.file)
+}
+
+func (a editableAdapter) debugLine(e *editable) (index int, ok bool) {
+	w, ok := a.owner.(*Window)
+	if !ok || e != &w.Body.editable {
+		return 0, false
+	}
+	return editor.Debugger.stoppedLineIn(w)
+}
+
+func (a editableAdapter) recordJump() {
+	w, _ := a.owner.(*Window)
+	editor.recordJump(w)
+}
+
 func (a editableAdapter) doWork(w Work) {
 	editor.WorkChan() <- w
 }
 
+func (a editableAdapter) selectionsChanged(e *editable) {
+	w, ok := a.owner.(*Window)
+	if ok && e == &w.Body.editable {
+		w.notifyApiSelectionChanged()
+	}
+}
+
 func (a editableAdapter) replaceCrWithTofu() bool {
 	return settings.Typesetting.ReplaceCRWithTofu
 }
@@ -272,11 +353,12 @@ func (a nilAdapter) execute(e *editable, gtx layout.Context, cmd string, args []
 func (a nilAdapter) plumb(e *editable, gtx layout.Context, obj string) (plumbed bool)   { return false }
 func (a nilAdapter) loadFileAndGoto(gtx layout.Context, path string, opts LoadFileOpts) {
 }
-func (a nilAdapter) loadFile(gtx layout.Context, path string)                                {}
-func (a nilAdapter) textOfLastSelectionInEditor() string                                     { return "" }
-func (a nilAdapter) shiftEditorItemsDueToTextModification(startOfChange, lengthOfChange int) {}
-func (a nilAdapter) setFocusedEditable(e *editable)                                          {}
-func (a nilAdapter) focusedEditable() *editable                                              { return nil }
+func (a nilAdapter) loadFile(gtx layout.Context, path string) {}
+func (a nilAdapter) textOfLastSelectionInEditor() string      { return "" }
+func (a nilAdapter) shiftEditorItemsDueToTextModification(m *editableModel, startOfChange, lengthOfChange int) {
+}
+func (a nilAdapter) setFocusedEditable(e *editable) {}
+func (a nilAdapter) focusedEditable() *editable     { return nil }
 func (a nilAdapter) findFile(file string) (path *GlobalPath, err error) {
 	return nil, fmt.Errorf("not implemented")
 }
@@ -286,8 +368,19 @@ func (a nilAdapter) get()
 func (a nilAdapter) file() string                                                              { return "" }
 func (a nilAdapter) mark(markName, file string, cursorIndex int)                               {}
 func (a nilAdapter) gotoMark(markName string)                                                  {}
+func (a nilAdapter) lineMarks(e *editable) []int                                               { return nil }
+func (a nilAdapter) breakpoints(e *editable) []int                                             { return nil }
+func (a nilAdapter) debugLine(e *editable) (index int, ok bool)                                { return 0, false }
+func (a nilAdapter) recordJump()                                                               {}
 func (a nilAdapter) doWork(w Work)                                                             {}
 func (a nilAdapter) loadFileInPlaceAndGoto(gtx layout.Context, path string, opts LoadFileOpts) {}
 func (a nilAdapter) loadFileInPlace(gtx layout.Context, path string)                           {}
 func (a nilAdapter) replaceCrWithTofu() bool                                                   { return false }
 func (a nilAdapter) setShellString(s string)                                                   {}
+func (a nilAdapter) selectionsChanged(e *editable)                                             {}
+func (a nilAdapter) completeCommandArgument(e *editable, callback CompletionsCallback) (requested bool) {
+	return false
+}
+func (a nilAdapter) completeWord(e *editable, prefix string, callback CompletionsCallback) (requested bool) {
+	return false
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/csv"
@@ -10,8 +9,11 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"gioui.org/layout"
@@ -39,17 +41,44 @@ Summary of operations:
     GET /wins/1/tag: Get tag
     PUT /wins/1/tag: Set tag
     GET /jobs: list jobs
+   POST /sessions: Create a new API session and return its id. Only allowed when authenticated with the user token.
+ DELETE /sessions: Delete the current API session.
     GET /notifs: Get any pending notifications for the current API session. The notifications are then cleared.
-	 POST /cmds: Create a new client-defined command. If it already exists, register interest in it.
-
-	 POST /execute: Execute a command as if it was clicked. The command is executed as if it was run from the editor tag
+    PUT /notifs/filter: Set the notification ops (i.e. "insert", "save") the current API session receives. An empty list,
+                        like not setting a filter, means insert and delete. Notifications meant for the session, such
+                        as exec and complete for its commands, are always sent.
+	 POST /cmds: Create new client-defined commands. If one already exists, register interest in it. Each element of the
+	             list is either the name of the command or, for JSON only, an object with the fields Name, ShortHelp,
+	             LongHelp, WinIds, FilePatterns and Completes.
+	 POST /cmds/completions: Answer a Complete or CompleteWord notification with the completions.
+	 POST /completers: Register the current API session to provide completions of words in window bodies. The body
+	                   is a list of objects with the optional fields WinIds and FilePatterns that limit the windows
+	                   the session provides completions for, and replaces the session's earlier registrations.
+	                   The session is then sent CompleteWord notifications.
+
+	 POST /execute: Execute a command as if it was clicked. The command is executed as if it was run from the editor tag,
+	               or from the tag of the window with id WinId if it is set.
 
 		Supports JSON and CSV encodings. CSV is better for bash.
+
+The API is served on a TCP port on localhost and on a Unix domain socket in the config directory that
+is only accessible to the current user. Requests are authenticated with the Anvil-Sess header, which must
+contain either the id of an API session (created for each command Anvil executes) or the user token.
+The user token is stored in the config directory, is readable only by the current user, and persists
+across restarts so that tools started outside of Anvil can use the API.
 */
 
-var localApiPort int
+var (
+	localApiPort   int
+	localApiSocket string
+	userApiToken   ApiSessionId
+)
 
 func ServeLocalAPI() {
+	loadOrCreateUserApiToken()
+	go ServeLocalAPIOnUnixSocket()
+	go reapApiSessions()
+
 	l := mylog.Check2(net.Listen("tcp", "127.0.0.1:0"))
 	tl, ok := l.Addr().(*net.TCPAddr)
 	if !ok {
@@ -59,16 +88,92 @@ func ServeLocalAPI() {
 	mylog.Check(ServeAPIOnListener(l))
 }
 
+// ServeAPIOnListener serves the API until the listener is closed.
 func ServeAPIOnListener(l net.Listener) error {
 	handler := &ApiHandler{}
-	mylog.Check(http.Serve(l, handler))
-	return nil
+	return http.Serve(l, handler)
 }
 
 func LocalAPIPort() int {
 	return localApiPort
 }
 
+// ServeLocalAPIOnUnixSocket serves the API on the Unix domain socket ApiSocketFile(). Any stale
+// socket left by a previous run is replaced.
+func ServeLocalAPIOnUnixSocket() {
+	path := ApiSocketFile()
+
+	l, err := listenOnPrivateUnixSocket(path)
+	if err != nil {
+		log(LogCatgAPI, "ServeLocalAPIOnUnixSocket: can't listen on %s: %v\n", path, err)
+		return
+	}
+
+	localApiSocket = path
+	mylog.Check(ServeAPIOnListener(l))
+}
+
+// listenOnPrivateUnixSocket listens on a Unix domain socket at path that only the current user can
+// connect to. The socket is created in a new directory that only the user can access, and is moved to
+// path once its permissions are restricted, so that others can't connect to it in between.
+func listenOnPrivateUnixSocket(path string) (l net.Listener, err error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(path))
+	l, err = net.Listen("unix", tmp)
+	if err != nil {
+		return
+	}
+	// The socket is moved, so don't try to remove it from the temporary path when the listener is closed
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err = os.Chmod(tmp, 0o600); err == nil {
+		os.Remove(path)
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return
+}
+
+// LocalAPISocket returns the path of the Unix domain socket the API is served on, or the empty
+// string if the API is not served on a socket.
+func LocalAPISocket() string {
+	return localApiSocket
+}
+
+// loadOrCreateUserApiToken reads the user token from ApiTokenFile(), creating it if it doesn't exist,
+// and registers a long-lived API session for it.
+func loadOrCreateUserApiToken() {
+	path := ApiTokenFile()
+
+	var tok string
+	b, err := os.ReadFile(path)
+	if err == nil {
+		tok = strings.TrimSpace(string(b))
+	}
+
+	if tok == "" {
+		tok = string(newApiSessionId())
+		mylog.Check(os.WriteFile(path, []byte(tok+"\n"), 0o600))
+	}
+	mylog.CheckIgnore(os.Chmod(path, 0o600))
+
+	userApiToken = ApiSessionId(tok)
+	sess := &ApiSession{
+		id:         userApiToken,
+		cmd:        "user token",
+		persistent: true,
+	}
+	mylog.Check(apiSessions.Add(sess))
+}
+
 type ApiHandler struct{}
 
 func (a ApiHandler) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
@@ -110,12 +215,33 @@ func (a ApiHandler) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
 	} else if req.URL.Path == "/notifs" {
 		a.serveNotifs(&sess, rsp, req)
 		return
+	} else if req.URL.Path == "/notifs/filter" {
+		a.serveNotifsFilter(&sess, rsp, req)
+		return
 	} else if req.URL.Path == "/cmds" {
 		a.serveCmds(&sess, rsp, req)
 		return
+	} else if req.URL.Path == "/cmds/history" {
+		a.serveCmdsHistory(&sess, rsp, req)
+		return
+	} else if req.URL.Path == "/cmds/completions" {
+		a.serveCmdsCompletions(&sess, rsp, req)
+		return
+	} else if req.URL.Path == "/completers" {
+		a.serveCompleters(&sess, rsp, req)
+		return
 	} else if req.URL.Path == "/execute" {
 		a.serveExecute(&sess, rsp, req)
 		return
+	} else if req.URL.Path == "/sessions" {
+		a.serveSessions(&sess, rsp, req)
+		return
+	} else if req.URL.Path == "/plumb" {
+		a.servePlumb(&sess, rsp, req)
+		return
+	} else if req.URL.Path == "/plumb/ports" {
+		a.servePlumbPorts(&sess, rsp, req)
+		return
 	}
 
 	// if strings.HasPrefix(req.URL.Path, "/wins"
@@ -139,7 +265,7 @@ func (a ApiHandler) findSession(req *http.Request) (sess ApiSession, ok bool) {
 		return
 	}
 
-	return findApiSession(ApiSessionId(hdrs[0]))
+	return useApiSession(ApiSessionId(hdrs[0]))
 }
 
 func (a ApiHandler) parseInitialNumber(s string) (num int, rest string) {
@@ -399,6 +525,7 @@ func (a ApiHandler) putWindowBodyCursors(winId int, rsp http.ResponseWriter, req
 	ch := make(chan []int)
 	fn := func() {
 		cursors := <-ch
+		editor.recordJump(win)
 		win.Body.SetCursorIndices(cursors)
 		return
 	}
@@ -694,15 +821,21 @@ func (a ApiHandler) buildJobs() apiJobs {
 }
 
 func (a ApiHandler) buildJob(j Job) apiJob {
-	return apiJob{
+	job := apiJob{
 		Name: j.Name(),
 	}
+	if n, ok := j.(numberedJob); ok {
+		job.Id = n.HistoryId()
+	}
+	return job
 }
 
 type apiJobs []apiJob
 
 type apiJob struct {
 	Name string
+	// Id is the number of the external command in the command history, or 0 if the job is not a command
+	Id int
 }
 
 func (a ApiHandler) serveNotifs(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
@@ -725,6 +858,37 @@ func (a ApiHandler) getNotifs(sess *ApiSession, rsp http.ResponseWriter, req *ht
 	flush()
 }
 
+func (a ApiHandler) serveNotifsFilter(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPut {
+		a.putNotifsFilter(sess, rsp, req)
+		return
+	}
+
+	msg := fmt.Sprintf("Method %s is not supported for %s", req.Method, req.URL.Path)
+	http.Error(rsp, msg, http.StatusBadRequest)
+}
+
+func (a ApiHandler) putNotifsFilter(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	var names []string
+
+	_, dec := mylog.Check3(a.getDecoder(rsp, req, "op"))
+	mylog.Check(dec.Decode(&names))
+
+	ops := make([]ApiNotificationOp, 0, len(names))
+	for _, n := range names {
+		op, ok := ParseApiNotificationOp(n)
+		if !ok {
+			msg := fmt.Sprintf("Unknown notification op '%s'", n)
+			http.Error(rsp, msg, http.StatusBadRequest)
+			return
+		}
+		ops = append(ops, op)
+	}
+
+	log(LogCatgAPI, "ApiHandler.putNotifsFilter: session will receive ops %v\n", ops)
+	apiSessions.SetNotificationFilter(sess.Id(), ops)
+}
+
 func (a ApiHandler) serveCmds(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodPost {
 		log(LogCatgAPI, "ApiHandler.serveCmds: request to post content\n")
@@ -737,16 +901,127 @@ func (a ApiHandler) serveCmds(sess *ApiSession, rsp http.ResponseWriter, req *ht
 }
 
 func (a ApiHandler) registerUserDefinedCommands(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
-	var cmds []string
-
-	_, dec := mylog.Check3(a.getDecoder(rsp, req, "cmd"))
-	mylog.Check(dec.Decode(&cmds))
+	var cmds []apiUserDefinedCommand
+
+	contentType, dec := mylog.Check3(a.getDecoder(rsp, req, "cmd"))
+	if contentType == encodingTextCsv {
+		var names []string
+		mylog.Check(dec.Decode(&names))
+		for _, n := range names {
+			if n = textBeforeFirstSpace(n); n != "" {
+				cmds = append(cmds, apiUserDefinedCommand{Name: n})
+			}
+		}
+	} else {
+		var raw []json.RawMessage
+		mylog.Check(dec.Decode(&raw))
+
+		var err error
+		cmds, err = parseApiUserDefinedCommands(raw)
+		if err != nil {
+			http.Error(rsp, fmt.Sprintf("Invalid command: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
 
 	for _, c := range cmds {
-		log(LogCatgAPI, "ApiHandler.registerUserDefinedCommands: registering command %s\n", c)
-		sess.addUserDefinedCommand(c)
+		log(LogCatgAPI, "ApiHandler.registerUserDefinedCommands: registering command %s\n", c.Name)
+	}
+	apiSessions.AddUserDefinedCommands(sess.Id(), cmds)
+	addApiUserDefinedCommandHelp(cmds)
+}
+
+func (a ApiHandler) serveCmdsCompletions(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		msg := fmt.Sprintf("Method %s is not supported for %s", req.Method, req.URL.Path)
+		http.Error(rsp, msg, http.StatusBadRequest)
+		return
+	}
+
+	var comps apiCompletionRsp
+	_, dec := mylog.Check3(a.getDecoder(rsp, req, "reqid", "completions"))
+	mylog.Check(dec.Decode(&comps))
+
+	if err := answerApiCommandArgCompletion(comps.ReqId, comps.Completions); err != nil {
+		http.Error(rsp, err.Error(), http.StatusNotFound)
+	}
+}
+
+func (a ApiHandler) serveCmdsHistory(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		a.getCmdsHistory(rsp, req)
+		return
+	}
+
+	msg := fmt.Sprintf("Method %s is not supported for %s", req.Method, req.URL.Path)
+	http.Error(rsp, msg, http.StatusBadRequest)
+}
+
+// getCmdsHistory returns the external command history. The optional query parameter 'filter' is a regular
+// expression that must match the command or directory, and 'pinned=true' returns only the pinned commands.
+func (a ApiHandler) getCmdsHistory(rsp http.ResponseWriter, req *http.Request) {
+	var args []string
+	q := req.URL.Query()
+	if q.Get("pinned") == "true" {
+		args = append(args, "-p")
+	}
+	if f := q.Get("filter"); f != "" {
+		args = append(args, f)
+	}
+
+	filter, err := parseCommandHistoryFilter(args)
+	if err != nil {
+		http.Error(rsp, fmt.Sprintf("Invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	hist := []apiCmdHistoryEntry{}
+	for _, e := range cmdHistory.Entries(filter) {
+		hist = append(hist, apiCmdHistoryEntry{
+			Id:          e.id,
+			Cmd:         strings.TrimSpace(e.cmd),
+			Dir:         e.dir,
+			State:       e.state.String(),
+			Started:     e.started,
+			Ended:       e.ended,
+			ExitCode:    e.exitCode,
+			ExitCodeSet: e.exitCodeSet,
+			Pinned:      e.pinned,
+		})
+	}
+
+	contentType, enc, flush := a.getEncoder(rsp, req)
+
+	rsp.Header().Add("Content-Type", string(contentType))
+	enc.Encode(hist)
+	flush()
+}
+
+type apiCmdHistoryEntry struct {
+	Id          int
+	Cmd         string
+	Dir         string
+	State       string
+	Started     time.Time
+	Ended       time.Time
+	ExitCode    int
+	ExitCodeSet bool
+	Pinned      bool
+}
+
+func (a ApiHandler) serveCompleters(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		msg := fmt.Sprintf("Method %s is not supported for %s", req.Method, req.URL.Path)
+		http.Error(rsp, msg, http.StatusBadRequest)
+		return
 	}
-	updateApiSession(sess)
+
+	var providers []apiCompletionProvider
+	_, dec := mylog.Check3(a.getDecoder(rsp, req, "winids", "filepatterns"))
+	mylog.Check(dec.Decode(&providers))
+
+	log(LogCatgAPI, "ApiHandler.serveCompleters: session registered %d completion providers\n", len(providers))
+	apiSessions.SetCompletionProviders(sess.Id(), providers)
 }
 
 func (a ApiHandler) serveExecute(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
@@ -763,15 +1038,192 @@ func (a ApiHandler) serveExecute(sess *ApiSession, rsp http.ResponseWriter, req
 func (a ApiHandler) executeOnEditor(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
 	var cmd apiExecuteReq
 
-	_, dec := mylog.Check3(a.getDecoder(rsp, req, "cmd", "args"))
+	_, dec := mylog.Check3(a.getDecoder(rsp, req, "cmd", "args", "winid"))
 	mylog.Check(dec.Decode(&cmd))
 
-	editor.Execute(cmd.Cmd, cmd.Args)
+	if cmd.WinId == 0 {
+		editor.Execute(cmd.Cmd, cmd.Args)
+		return
+	}
+
+	win := a.FindWindowForId(cmd.WinId)
+	if win == nil {
+		msg := fmt.Sprintf("No window with id %d", cmd.WinId)
+		http.Error(rsp, msg, http.StatusNotFound)
+		return
+	}
+
+	editor.WorkChan() <- basicWork{func() {
+		win.Execute(cmd.Cmd, cmd.Args)
+	}}
+}
+
+func (a ApiHandler) servePlumb(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		msg := fmt.Sprintf("Method %s is not supported for %s", req.Method, req.URL.Path)
+		http.Error(rsp, msg, http.StatusBadRequest)
+		return
+	}
+
+	var preq apiPlumbReq
+	_, dec := mylog.Check3(a.getDecoder(rsp, req, "data", "winid", "test"))
+	mylog.Check(dec.Decode(&preq))
+
+	var win *Window
+	if preq.WinId != 0 {
+		win = a.FindWindowForId(preq.WinId)
+		if win == nil {
+			msg := fmt.Sprintf("No window with id %d", preq.WinId)
+			http.Error(rsp, msg, http.StatusNotFound)
+			return
+		}
+	}
+
+	if !preq.Test {
+		if win == nil {
+			editor.Execute("Plumb", []string{preq.Data})
+			return
+		}
+		editor.WorkChan() <- basicWork{func() {
+			win.Execute("Plumb", []string{preq.Data})
+		}}
+		return
+	}
+
+	ch := make(chan []PlumbMatch)
+	fn := func() {
+		if plumber == nil {
+			ch <- nil
+			return
+		}
+		msg := PlumbMsg{Data: preq.Data}
+		if win != nil {
+			finder := NewFileFinder(win)
+			msg.WinId = win.Id
+			msg.File, _ = finder.WindowFile()
+			msg.Dir, _ = finder.WindowDir()
+		}
+		ch <- plumber.Match(msg, windowPlumbFileFinder(win))
+	}
+
+	editor.WorkChan() <- basicWork{fn}
+	matches := <-ch
+
+	r := []apiPlumbMatch{}
+	for _, m := range matches {
+		for _, act := range m.Actions {
+			r = append(r, apiPlumbMatch{Line: m.Line, Action: act.String()})
+		}
+	}
+
+	contentType, enc, flush := a.getEncoder(rsp, req)
+	rsp.Header().Add("Content-Type", string(contentType))
+	enc.Encode(r)
+	flush()
+}
+
+func (a ApiHandler) servePlumbPorts(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		msg := fmt.Sprintf("Method %s is not supported for %s", req.Method, req.URL.Path)
+		http.Error(rsp, msg, http.StatusBadRequest)
+		return
+	}
+
+	var ports []string
+	_, dec := mylog.Check3(a.getDecoder(rsp, req, "port"))
+	mylog.Check(dec.Decode(&ports))
+
+	log(LogCatgAPI, "ApiHandler.servePlumbPorts: session listens on plumbing ports %v\n", ports)
+	apiSessions.SetPlumbingPorts(sess.Id(), ports)
+}
+
+func (a ApiHandler) serveSessions(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		a.postSessions(sess, rsp, req)
+		return
+	} else if req.Method == http.MethodDelete {
+		a.deleteSessions(sess, rsp, req)
+		return
+	}
+
+	msg := fmt.Sprintf("Method %s is not supported for %s", req.Method, req.URL.Path)
+	http.Error(rsp, msg, http.StatusBadRequest)
+}
+
+func (a ApiHandler) postSessions(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	if sess.Id() != userApiToken {
+		http.Error(rsp, "Sessions may only be created using the user token", http.StatusForbidden)
+		return
+	}
+
+	var sreq apiSessionReq
+	_, dec := mylog.Check3(a.getDecoder(rsp, req, "cmd"))
+	dec.Decode(&sreq)
+
+	if sreq.Cmd == "" {
+		sreq.Cmd = "external"
+	}
+
+	nsess := &ApiSession{
+		id:       newApiSessionId(),
+		cmd:      sreq.Cmd,
+		pid:      sreq.Pid,
+		lastUsed: time.Now(),
+		// Without an owning process there is no way to tell that the session was forgotten, other than
+		// that it's no longer used
+		expiresWhenIdle: sreq.Pid == 0,
+	}
+	if err := apiSessions.Add(nsess); err != nil {
+		http.Error(rsp, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log(LogCatgAPI, "ApiHandler.postSessions: created session for '%s'\n", sreq.Cmd)
+
+	contentType, enc, flush := a.getEncoder(rsp, req)
+	rsp.Header().Add("Content-Type", string(contentType))
+	enc.Encode(apiSessionRsp{Id: string(nsess.Id())})
+	flush()
+}
+
+func (a ApiHandler) deleteSessions(sess *ApiSession, rsp http.ResponseWriter, req *http.Request) {
+	if sess.persistent {
+		http.Error(rsp, "The user token session can't be deleted", http.StatusForbidden)
+		return
+	}
+	deleteApiSession(sess.Id())
+}
+
+type apiSessionReq struct {
+	Cmd string
+	// Pid is the process id of the program that owns the session. If set, the session is deleted
+	// when the process exits. Otherwise it is deleted once it has not been used for apiSessionIdleTimeout.
+	Pid int
+}
+
+type apiSessionRsp struct {
+	Id string
 }
 
 type apiExecuteReq struct {
 	Cmd  string
 	Args []string
+	// WinId, if set, is the id of the window in whose tag the command is executed.
+	WinId int
+}
+
+// apiPlumbReq is a request to plumb text. If Test is set, the matching rules are returned instead of being performed.
+type apiPlumbReq struct {
+	Data string
+	// WinId, if set, is the id of the window the text is plumbed from.
+	WinId int
+	Test  bool
+}
+
+// apiPlumbMatch is an action of a rule that matched a plumbed message, with variables expanded.
+type apiPlumbMatch struct {
+	// Line is the line in the plumbing file where the rule begins.
+	Line   int
+	Action string
 }
 
 type notifs []ApiNotification
@@ -811,6 +1263,20 @@ func (s *ApiSessionStore) Update(sess *ApiSession) {
 	s.sessions[sess.id] = sess
 }
 
+// Use finds the session like Find, and records that it was used at the time now.
+func (s *ApiSessionStore) Use(id ApiSessionId, now time.Time) (sess ApiSession, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ptr, ok := s.sessions[id]
+	if ok {
+		ptr.lastUsed = now
+		sess = *ptr
+	}
+
+	return
+}
+
 func (s *ApiSessionStore) Find(id ApiSessionId) (sess ApiSession, ok bool) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -823,10 +1289,98 @@ func (s *ApiSessionStore) Find(id ApiSessionId) (sess ApiSession, ok bool) {
 	return
 }
 
-func (s *ApiSessionStore) Del(id ApiSessionId) {
+// Del deletes the session and returns the commands it had registered.
+func (s *ApiSessionStore) Del(id ApiSessionId) (cmds []apiUserDefinedCommand) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		cmds = sess.userDefinedCommands
+	}
 	delete(s.sessions, id)
+	return
+}
+
+func (s *ApiSessionStore) AddUserDefinedCommands(id ApiSessionId, cmds []apiUserDefinedCommand) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+
+	for _, c := range cmds {
+		sess.addUserDefinedCommand(c)
+	}
+}
+
+func (s *ApiSessionStore) AddNotification(id ApiSessionId, n ApiNotification) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if sess, ok := s.sessions[id]; ok {
+		sess.AddNotification(n)
+	}
+}
+
+// FindCompletingSession returns the session that answers argument completion requests for the command
+// when executed in the window with the specified id and file.
+func (s *ApiSessionStore) FindCompletingSession(cmd string, winId int, file string) (id ApiSessionId, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, sess := range s.sessions {
+		for _, c := range sess.userDefinedCommands {
+			if c.Name == cmd && c.Completes && c.appliesTo(winId, file) {
+				return sess.id, true
+			}
+		}
+	}
+	return
+}
+
+// SetCompletionProviders replaces the completion providers of the session.
+func (s *ApiSessionStore) SetCompletionProviders(id ApiSessionId, providers []apiCompletionProvider) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if sess, ok := s.sessions[id]; ok {
+		sess.completionProviders = providers
+	}
+}
+
+// FindCompletionProviders returns the sessions that provide completions of words in the window with the
+// specified id and file.
+func (s *ApiSessionStore) FindCompletionProviders(winId int, file string) (ids []ApiSessionId) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, sess := range s.sessions {
+		for _, p := range sess.completionProviders {
+			if p.appliesTo(winId, file) {
+				ids = append(ids, sess.id)
+				break
+			}
+		}
+	}
+	return
+}
+
+// ExpiredSessions returns the ids of the sessions whose owning process has exited, and of the sessions
+// that expire when idle and have not been used for apiSessionIdleTimeout before the time now.
+func (s *ApiSessionStore) ExpiredSessions(now time.Time) (ids []ApiSessionId) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, sess := range s.sessions {
+		switch {
+		case sess.pid != 0 && !processExists(sess.pid):
+			ids = append(ids, id)
+		case sess.expiresWhenIdle && now.Sub(sess.lastUsed) > apiSessionIdleTimeout:
+			ids = append(ids, id)
+		}
+	}
+	return
 }
 
 func (s *ApiSessionStore) Len() int {
@@ -855,6 +1409,53 @@ func (s *ApiSessionStore) AddNotificationToAll(n ApiNotification) {
 	}
 }
 
+func (s *ApiSessionStore) SetNotificationFilter(id ApiSessionId, ops []ApiNotificationOp) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+
+	if len(ops) == 0 {
+		sess.notificationFilter = nil
+		return
+	}
+
+	sess.notificationFilter = map[ApiNotificationOp]struct{}{}
+	for _, op := range ops {
+		sess.notificationFilter[op] = struct{}{}
+	}
+}
+
+func (s *ApiSessionStore) SetPlumbingPorts(id ApiSessionId, ports []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if sess, ok := s.sessions[id]; ok {
+		sess.plumbingPorts = ports
+	}
+}
+
+// SendToPlumbingPort adds the notification to the sessions listening on the plumbing port, and
+// returns false if there are none.
+func (s *ApiSessionStore) SendToPlumbingPort(port string, n ApiNotification) (sent bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, sess := range s.sessions {
+		for _, p := range sess.plumbingPorts {
+			if p == port {
+				sess.AddNotification(n)
+				sent = true
+				break
+			}
+		}
+	}
+	return
+}
+
 func (s *ApiSessionStore) GetAndClearNotifications(id ApiSessionId) []ApiNotification {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -869,7 +1470,7 @@ func (s *ApiSessionStore) GetAndClearNotifications(id ApiSessionId) []ApiNotific
 	return r
 }
 
-func (s *ApiSessionStore) HandleCommand(winId int, cmd string, args []string) (handled bool) {
+func (s *ApiSessionStore) HandleCommand(winId int, file, cmd string, args []string) (handled bool) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -877,8 +1478,8 @@ func (s *ApiSessionStore) HandleCommand(winId int, cmd string, args []string) (h
 	for _, sess := range s.sessions {
 		log(LogCatgAPI, "ApiSessionStore.HandleCommand: checking session. Has %d commands\n", len(sess.userDefinedCommands))
 		for _, scmd := range sess.userDefinedCommands {
-			log(LogCatgAPI, "ApiSessionStore.HandleCommand: checking command %s vs %s\n", cmd, scmd)
-			if scmd == cmd {
+			log(LogCatgAPI, "ApiSessionStore.HandleCommand: checking command %s vs %s\n", cmd, scmd.Name)
+			if scmd.Name == cmd && scmd.appliesTo(winId, file) {
 				n := newCommandApiNotification(winId, cmd, args)
 				sess.AddNotification(n)
 
@@ -914,17 +1515,39 @@ type ApiSession struct {
 	id                   ApiSessionId
 	pendingNotifications []ApiNotification
 	cmd                  string
-	userDefinedCommands  []string
+	userDefinedCommands  []apiUserDefinedCommand
+	completionProviders  []apiCompletionProvider
+	// notificationFilter is the set of notification ops the session receives. If nil, it receives the
+	// ops in defaultApiNotificationOps. Exec and Complete notifications for the session's own commands,
+	// CompleteWord notifications for its completion providers, and Plumb notifications for its plumbing
+	// ports are always delivered.
+	notificationFilter map[ApiNotificationOp]struct{}
+	// plumbingPorts are the names of the plumbing ports the session listens on.
+	plumbingPorts []string
+	// persistent is true for the session of the user token, which is never deleted.
+	persistent bool
+	// pid is the process id of the program that owns the session, or 0 if it is unknown.
+	pid int
+	// lastUsed is when a request was last made using the session.
+	lastUsed time.Time
+	// expiresWhenIdle is true if the session is deleted once it is not used for apiSessionIdleTimeout.
+	expiresWhenIdle bool
+}
+
+func newApiSessionId() ApiSessionId {
+	buf := make([]byte, 200)
+	mylog.Check2(rand.Read(buf))
+	return ApiSessionId(base64.StdEncoding.EncodeToString(buf))
 }
 
 func createApiSession(cmd string) (sess *ApiSession, err error) {
-	buf := make([]byte, 200)
-	mylog.Check2(rand.Read(buf))
 	sess = &ApiSession{
-		id:  ApiSessionId(base64.StdEncoding.EncodeToString(buf)),
+		id:  newApiSessionId(),
 		cmd: cmd,
 	}
-	apiSessions.Add(sess)
+	if err = apiSessions.Add(sess); err != nil {
+		return nil, err
+	}
 	return
 }
 
@@ -932,12 +1555,32 @@ func updateApiSession(sess *ApiSession) {
 	apiSessions.Update(sess)
 }
 
-func findApiSession(id ApiSessionId) (sess ApiSession, ok bool) {
-	return apiSessions.Find(id)
+// useApiSession finds the session and records that it was just used.
+func useApiSession(id ApiSessionId) (sess ApiSession, ok bool) {
+	return apiSessions.Use(id, time.Now())
 }
 
 func deleteApiSession(id ApiSessionId) {
-	apiSessions.Del(id)
+	cmds := apiSessions.Del(id)
+	removeApiUserDefinedCommandHelp(cmds)
+}
+
+const apiSessionReapInterval = 5 * time.Second
+
+// apiSessionIdleTimeout is how long a session created with the user token and no owning process may go
+// unused before it is deleted.
+const apiSessionIdleTimeout = 30 * time.Minute
+
+// reapApiSessions periodically deletes the API sessions whose owning processes have exited or that
+// were left unused.
+func reapApiSessions() {
+	for {
+		time.Sleep(apiSessionReapInterval)
+		for _, id := range apiSessions.ExpiredSessions(time.Now()) {
+			log(LogCatgAPI, "reapApiSessions: session has expired; deleting session\n")
+			deleteApiSession(id)
+		}
+	}
 }
 
 func getApiSessions() []*ApiSession {
@@ -952,8 +1595,8 @@ func apiGetAndClearNotifications(id ApiSessionId) []ApiNotification {
 	return apiSessions.GetAndClearNotifications(id)
 }
 
-func apiHandleCommand(winId int, cmd string, args []string) (handled bool) {
-	return apiSessions.HandleCommand(winId, cmd, args)
+func apiHandleCommand(winId int, file, cmd string, args []string) (handled bool) {
+	return apiSessions.HandleCommand(winId, file, cmd, args)
 }
 
 func (s *ApiSession) Id() ApiSessionId {
@@ -965,31 +1608,52 @@ func (s *ApiSession) Cmd() string {
 }
 
 func (s *ApiSession) AddNotification(n ApiNotification) {
+	if !s.wantsNotification(n) {
+		return
+	}
 	if len(s.pendingNotifications) >= maxApiNotificationsPerSession {
 		return
 	}
 	s.pendingNotifications = append(s.pendingNotifications, n)
 }
 
-func (a *ApiSession) addUserDefinedCommand(s string) {
-	t := a.textBeforeFirstSpace(s)
-	log(LogCatgAPI, "ApiSession.addUserDefinedCommand: cmd: '%s' cleaned: '%s'\n", s, t)
-	if t == "" {
-		return
+// defaultApiNotificationOps are the ops delivered to sessions that have not set a notification filter.
+// They are the ops that existed before filters did, so that the newer and more frequent ops such as
+// Select don't crowd out the notifications older clients rely on.
+var defaultApiNotificationOps = map[ApiNotificationOp]struct{}{
+	ApiNotificationOpInsert: {},
+	ApiNotificationOpDelete: {},
+}
+
+func (s *ApiSession) wantsNotification(n ApiNotification) bool {
+	switch n.Op {
+	case ApiNotificationOpExec, ApiNotificationOpComplete, ApiNotificationOpCompleteWord, ApiNotificationOpPlumb:
+		// These are only sent to the sessions they are meant for
+		return true
+	}
+
+	filter := s.notificationFilter
+	if filter == nil {
+		filter = defaultApiNotificationOps
 	}
-	a.userDefinedCommands = append(a.userDefinedCommands, t)
+	_, ok := filter[n.Op]
+	return ok
 }
 
-func (a *ApiSession) textBeforeFirstSpace(s string) string {
-	rns := []rune(s)
-	var buf bytes.Buffer
-	for _, r := range rns {
-		if unicode.IsSpace(r) {
-			break
+func (a *ApiSession) addUserDefinedCommand(c apiUserDefinedCommand) {
+	for i, o := range a.userDefinedCommands {
+		if o.Name == c.Name {
+			a.userDefinedCommands[i] = c
+			return
 		}
-		buf.WriteRune(r)
 	}
-	return buf.String()
+	a.userDefinedCommands = append(a.userDefinedCommands, c)
+}
+
+func (s *ApiSession) UserDefinedCommands() []apiUserDefinedCommand {
+	r := make([]apiUserDefinedCommand, len(s.userDefinedCommands))
+	copy(r, s.userDefinedCommands)
+	return r
 }
 
 type ApiNotification struct {
@@ -998,12 +1662,55 @@ type ApiNotification struct {
 	Offset int
 	Len    int
 	Cmd    []string
+	// ReqId identifies the request of a Complete notification.
+	ReqId int
 }
 
 type ApiNotificationOp int
 
 const (
-	ApiNotificationOpInsert = iota
+	ApiNotificationOpInsert ApiNotificationOp = iota
 	ApiNotificationOpDelete
 	ApiNotificationOpExec
+	// ApiNotificationOpOpen is sent when a window is created.
+	ApiNotificationOpOpen
+	// ApiNotificationOpClose is sent when a window is deleted.
+	ApiNotificationOpClose
+	// ApiNotificationOpSave is sent when a window's body has been saved to its file.
+	ApiNotificationOpSave
+	// ApiNotificationOpFocus is sent when a different window gains the keyboard focus.
+	ApiNotificationOpFocus
+	// ApiNotificationOpSelect is sent when the selection in a window body changes. Offset and Len
+	// describe the primary selection, or the first cursor if there is no selection.
+	ApiNotificationOpSelect
+	// ApiNotificationOpComplete requests completions for the last argument of a user-defined command.
+	// The completions are sent back with a POST to /cmds/completions.
+	ApiNotificationOpComplete
+	// ApiNotificationOpCompleteWord requests completions for the partial word in Cmd at the cursor
+	// position Offset. It is sent to sessions that registered a completion provider. The completions
+	// are sent back with a POST to /cmds/completions.
+	ApiNotificationOpCompleteWord
+	// ApiNotificationOpPlumb is sent to the sessions listening on a plumbing port when a plumbing rule
+	// sends a message to the port. Cmd holds the port, the plumbed text, and then the message's
+	// attributes in the form name=value.
+	ApiNotificationOpPlumb
 )
+
+var apiNotificationOpNames = []string{"insert", "delete", "exec", "open", "close", "save", "focus", "select", "complete", "completeword", "plumb"}
+
+func (o ApiNotificationOp) String() string {
+	if int(o) < 0 || int(o) >= len(apiNotificationOpNames) {
+		return "unknown"
+	}
+	return apiNotificationOpNames[o]
+}
+
+func ParseApiNotificationOp(s string) (op ApiNotificationOp, ok bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, n := range apiNotificationOpNames {
+		if n == s {
+			return ApiNotificationOp(i), true
+		}
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestApiSessionNotificationFilter(t *testing.T) {
+	sent := []ApiNotification{
+		{WinId: 1, Op: ApiNotificationOpSelect},
+		{WinId: 1, Op: ApiNotificationOpFocus},
+		{WinId: 1, Op: ApiNotificationOpInsert},
+		{WinId: 1, Op: ApiNotificationOpSave},
+		{WinId: 1, Op: ApiNotificationOpDelete},
+		{WinId: 1, Op: ApiNotificationOpExec},
+	}
+
+	ops := func(notifs []ApiNotification) (r []ApiNotificationOp) {
+		for _, n := range notifs {
+			r = append(r, n.Op)
+		}
+		return
+	}
+
+	tests := []struct {
+		name     string
+		filter   []ApiNotificationOp
+		expected []ApiNotificationOp
+	}{
+		{
+			name:     "no filter",
+			expected: []ApiNotificationOp{ApiNotificationOpInsert, ApiNotificationOpDelete, ApiNotificationOpExec},
+		},
+		{
+			name:     "filter",
+			filter:   []ApiNotificationOp{ApiNotificationOpSelect, ApiNotificationOpSave},
+			expected: []ApiNotificationOp{ApiNotificationOpSelect, ApiNotificationOpSave, ApiNotificationOpExec},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewApiSessionStore(10)
+			sess := &ApiSession{id: "sess"}
+			store.Add(sess)
+			store.SetNotificationFilter(sess.id, tc.filter)
+
+			for _, n := range sent {
+				store.AddNotificationToAll(n)
+			}
+
+			if got := ops(store.GetAndClearNotifications(sess.id)); !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected ops %v but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestApiSessionNotificationsNotCrowdedOut(t *testing.T) {
+	store := NewApiSessionStore(10)
+	sess := &ApiSession{id: "sess"}
+	store.Add(sess)
+
+	for i := 0; i < 2*maxApiNotificationsPerSession; i++ {
+		store.AddNotificationToAll(ApiNotification{WinId: 1, Op: ApiNotificationOpSelect})
+	}
+	store.AddNotificationToAll(ApiNotification{WinId: 1, Op: ApiNotificationOpInsert, Offset: 3, Len: 1})
+
+	notifs := store.GetAndClearNotifications(sess.id)
+	if len(notifs) != 1 || notifs[0].Op != ApiNotificationOpInsert {
+		t.Fatalf("expected only the insert notification but got %v", notifs)
+	}
+}
+
+func TestApiSessionsExpireWhenIdle(t *testing.T) {
+	now := time.Now()
+	store := NewApiSessionStore(10)
+	store.Add(&ApiSession{id: "idle", lastUsed: now, expiresWhenIdle: true})
+	store.Add(&ApiSession{id: "used", lastUsed: now, expiresWhenIdle: true})
+	store.Add(&ApiSession{id: "kept", lastUsed: now})
+
+	later := now.Add(apiSessionIdleTimeout / 2)
+	if _, ok := store.Use("used", later); !ok {
+		t.Fatalf("session not found")
+	}
+
+	if ids := store.ExpiredSessions(later); len(ids) != 0 {
+		t.Fatalf("expected no expired sessions but got %v", ids)
+	}
+
+	ids := store.ExpiredSessions(now.Add(apiSessionIdleTimeout + time.Second))
+	if !slices.Equal(ids, []ApiSessionId{"idle"}) {
+		t.Fatalf("expected only the idle session to expire but got %v", ids)
+	}
+}
+
+func TestListenOnPrivateUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix file permissions are not supported")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "api.sock")
+	// A socket left behind by an earlier run is replaced
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := listenOnPrivateUnixSocket(path)
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected a socket with permissions 0600 but got %v", info.Mode())
+	}
+
+	// Only the socket is left in the directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the socket in the directory but got %d entries", len(entries))
+	}
+
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("connecting failed: %v", err)
+	}
+	c.Close()
+}
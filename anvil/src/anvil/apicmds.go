@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// apiUserDefinedCommand is a command that a program using the API registered with the editor. When it is
+// executed the owning API session is sent an Exec notification.
+type apiUserDefinedCommand struct {
+	Name      string
+	ShortHelp string
+	LongHelp  string
+	// WinIds, if not empty, limits the command to the windows with these ids.
+	WinIds []int
+	// FilePatterns, if not empty, limits the command to windows whose file matches one of these
+	// glob patterns. Patterns without a slash are matched against the basename of the file.
+	FilePatterns []string
+	// Completes is true if the owning session answers argument completion requests for the command.
+	Completes bool
+}
+
+// parseApiUserDefinedCommands parses the body of a POST to /cmds. Each element of the JSON list is either
+// a string naming the command, or an object describing the command.
+func parseApiUserDefinedCommands(raw []json.RawMessage) (cmds []apiUserDefinedCommand, err error) {
+	for _, r := range raw {
+		r = bytes.TrimSpace(r)
+
+		var c apiUserDefinedCommand
+		if len(r) > 0 && r[0] == '"' {
+			err = json.Unmarshal(r, &c.Name)
+		} else {
+			err = json.Unmarshal(r, &c)
+		}
+		if err != nil {
+			return
+		}
+
+		c.Name = textBeforeFirstSpace(c.Name)
+		if c.Name == "" {
+			continue
+		}
+		cmds = append(cmds, c)
+	}
+	return
+}
+
+// appliesTo returns true if the command may be executed in the window with the specified id and file.
+// A winId of -1 means the command was not executed in a window.
+func (c apiUserDefinedCommand) appliesTo(winId int, file string) bool {
+	return appliesToWindow(c.WinIds, c.FilePatterns, winId, file)
+}
+
+// appliesToWindow returns true if the window with the specified id and file is one of winIds, or its
+// file matches one of the patterns. If both are empty it applies to all windows.
+func appliesToWindow(winIds []int, filePatterns []string, winId int, file string) bool {
+	if len(winIds) == 0 && len(filePatterns) == 0 {
+		return true
+	}
+
+	for _, id := range winIds {
+		if id == winId {
+			return true
+		}
+	}
+
+	if file == "" {
+		return false
+	}
+
+	for _, p := range filePatterns {
+		name := file
+		if !strings.ContainsRune(p, '/') {
+			name = filepath.Base(file)
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c apiUserDefinedCommand) help() string {
+	if c.LongHelp != "" {
+		return c.LongHelp
+	}
+	return c.ShortHelp
+}
+
+func textBeforeFirstSpace(s string) string {
+	for i, r := range s {
+		if unicode.IsSpace(r) {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// apiHelpTopics is the set of help topics that were added for user-defined commands. It is only
+// accessed on the main goroutine.
+var apiHelpTopics = map[string]struct{}{}
+
+// addApiUserDefinedCommandHelp registers help for the commands on the main goroutine. Help for
+// built-in topics is not replaced.
+func addApiUserDefinedCommandHelp(cmds []apiUserDefinedCommand) {
+	editor.WorkChan() <- basicWork{func() {
+		for _, c := range cmds {
+			h := c.help()
+			if h == "" {
+				continue
+			}
+			if _, ok := apiHelpTopics[c.Name]; !ok && Help(c.Name) != "" {
+				continue
+			}
+			AddHelp(c.Name, h)
+			apiHelpTopics[c.Name] = struct{}{}
+		}
+	}}
+}
+
+// removeApiUserDefinedCommandHelp removes the help for the commands that are no longer provided
+// by any API session.
+func removeApiUserDefinedCommandHelp(cmds []apiUserDefinedCommand) {
+	if len(cmds) == 0 {
+		return
+	}
+
+	editor.WorkChan() <- basicWork{func() {
+		provided := map[string]struct{}{}
+		for _, c := range apiUserDefinedCommands() {
+			provided[c.Name] = struct{}{}
+		}
+
+		for _, c := range cmds {
+			if _, ok := provided[c.Name]; ok {
+				continue
+			}
+			if _, ok := apiHelpTopics[c.Name]; !ok {
+				continue
+			}
+			RemoveHelp(c.Name)
+			delete(apiHelpTopics, c.Name)
+		}
+	}}
+}
+
+// apiUserDefinedCommands returns the commands registered by all API sessions, sorted by name.
+func apiUserDefinedCommands() []apiUserDefinedCommand {
+	var cmds []apiUserDefinedCommand
+	for _, s := range getApiSessions() {
+		cmds = append(cmds, s.UserDefinedCommands()...)
+	}
+
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].Name < cmds[j].Name
+	})
+	return cmds
+}
+
+// apiCompletionRequests tracks the completion requests sent to API sessions that
+// have not yet been answered.
+type apiCompletionRequests struct {
+	lock    sync.Mutex
+	nextId  int
+	pending map[int]CompletionsCallback
+}
+
+const apiCompletionTimeout = 10 * time.Second
+
+var apiCompletions = apiCompletionRequests{pending: map[int]CompletionsCallback{}}
+
+// Add stores the callback and returns the id of the request. If the request is not answered
+// within apiCompletionTimeout it is discarded.
+func (r *apiCompletionRequests) Add(cb CompletionsCallback) (id int) {
+	r.lock.Lock()
+	r.nextId++
+	id = r.nextId
+	r.pending[id] = cb
+	r.lock.Unlock()
+
+	time.AfterFunc(apiCompletionTimeout, func() {
+		r.Take(id)
+	})
+	return
+}
+
+// Take removes and returns the callback for the request.
+func (r *apiCompletionRequests) Take(id int) (cb CompletionsCallback, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cb, ok = r.pending[id]
+	delete(r.pending, id)
+	return
+}
+
+// requestApiCommandArgCompletion checks if the text before the cursor on the current line contains a
+// user-defined command whose owner answers completion requests and, if so, sends the owner a Complete
+// notification. The Cmd of the notification contains the command, the preceding arguments and the
+// partial argument to complete. The callback is invoked when the session answers the request.
+func requestApiCommandArgCompletion(winId int, file, lineBeforeCursor string, cb CompletionsCallback) (requested bool) {
+	fields := strings.Fields(lineBeforeCursor)
+	partial := ""
+	if len(fields) > 0 && !strings.HasSuffix(lineBeforeCursor, " ") && !strings.HasSuffix(lineBeforeCursor, "\t") {
+		partial = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+
+	for i := len(fields) - 1; i >= 0; i-- {
+		sess, ok := apiSessions.FindCompletingSession(fields[i], winId, file)
+		if !ok {
+			continue
+		}
+
+		cmd := make([]string, 0, len(fields)-i+1)
+		cmd = append(cmd, fields[i:]...)
+		cmd = append(cmd, partial)
+
+		id := apiCompletions.Add(cb)
+		log(LogCatgAPI, "requestApiCommandArgCompletion: sending completion request %d for %v\n", id, cmd)
+		apiSessions.AddNotification(sess, ApiNotification{
+			WinId: winId,
+			Op:    ApiNotificationOpComplete,
+			ReqId: id,
+			Cmd:   cmd,
+		})
+		return true
+	}
+	return false
+}
+
+// answerApiCommandArgCompletion delivers the completions an API session sent for the request with the id.
+func answerApiCommandArgCompletion(id int, completions []string) error {
+	cb, ok := apiCompletions.Take(id)
+	if !ok {
+		return fmt.Errorf("No pending completion request with id %d", id)
+	}
+
+	editor.WorkChan() <- basicWork{func() {
+		cb(completions)
+	}}
+	return nil
+}
+
+type apiCompletionRsp struct {
+	ReqId       int
+	Completions []string
+}
+
+// apiCompletionProvider registers an API session to be asked for completions of the word at the cursor
+// in window bodies. The session is sent a CompleteWord notification whose Cmd contains the partial word
+// and whose Offset is the cursor position, and answers it with a POST to /cmds/completions.
+type apiCompletionProvider struct {
+	// WinIds, if not empty, limits the provider to the windows with these ids.
+	WinIds []int
+	// FilePatterns, if not empty, limits the provider to windows whose file matches one of these
+	// glob patterns. Patterns without a slash are matched against the basename of the file.
+	FilePatterns []string
+}
+
+func (p apiCompletionProvider) appliesTo(winId int, file string) bool {
+	return appliesToWindow(p.WinIds, p.FilePatterns, winId, file)
+}
+
+// requestApiWordCompletions sends a CompleteWord notification to each API session with a completion provider
+// that applies to the window. The callback is invoked on the main goroutine as each session answers. It
+// returns the number of sessions that were asked.
+func requestApiWordCompletions(winId int, file string, offset int, prefix string, cb CompletionsCallback) (requested int) {
+	for _, sess := range apiSessions.FindCompletionProviders(winId, file) {
+		id := apiCompletions.Add(cb)
+		log(LogCatgAPI, "requestApiWordCompletions: sending completion request %d for '%s'\n", id, prefix)
+		apiSessions.AddNotification(sess, ApiNotification{
+			WinId:  winId,
+			Op:     ApiNotificationOpCompleteWord,
+			Offset: offset,
+			ReqId:  id,
+			Cmd:    []string{prefix},
+		})
+		requested++
+	}
+	return
+}
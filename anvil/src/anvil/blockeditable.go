@@ -50,13 +50,18 @@ func (t *blockEditable) HandleEvents(gtx layout.Context, queue event.Queue) {
 	t.prepareForLayout()
 
 	for _, ev := range queue.Events(t) {
+		if t.inputHook != nil && t.inputHook(ev) {
+			continue
+		}
+
 		switch e := ev.(type) {
 		case pointer.Event:
 			t.Pointer(gtx, &e)
 		case key.Event:
 			t.Key(gtx, &e)
 		case key.EditEvent:
-			t.InsertText(e.Text)
+			t.InsertTypedText(e.Text)
+			t.refineWordCompletion()
 		case key.FocusEvent:
 			/*action := "set to"
 			  if !e.Focus {
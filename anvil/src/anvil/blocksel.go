@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jeffwilliams/anvil/internal/runes"
+	"github.com/jeffwilliams/anvil/internal/typeset"
+)
+
+// blockSelection is the state of a rectangular (block) selection that is being built by dragging
+// with the primary button while Alt and Shift are held. The rectangle spans the lines from the
+// anchor to the line under the pointer, and the visual columns between the anchor and the pointer.
+//
+// Columns are measured in pixels from the start of each line as it is laid out without wrapping, so
+// tabs are expanded using the TabStopInterval and the columns match what is drawn even when the
+// font is not monospaced.
+type blockSelection struct {
+	// anchor is the rune index at which the drag started
+	anchor int
+	// anchorX is the horizontal offset in pixels of the anchor from the start of its line
+	anchorX int
+}
+
+// blockClipboardText is the text most recently cut or copied from a block selection. When it is
+// pasted it is inserted column-wise rather than as ordinary text.
+var blockClipboardText string
+
+func (e *editable) startBuildingBlockSelection(ps *PointerState) {
+	ri := ps.currentPointerEvent.runeIndex
+	e.clearSelections()
+	e.setToOneCursorIndex(ri)
+	e.blockSelectionBeingBuilt = &blockSelection{
+		anchor:  ri,
+		anchorX: e.blockColumnOfPointer(ps),
+	}
+}
+
+func (e *editable) extendBlockSelection(ps *PointerState) {
+	b := e.blockSelectionBeingBuilt
+
+	x0, x1 := b.anchorX, e.blockColumnOfPointer(ps)
+	if x1 < x0 {
+		x0, x1 = x1, x0
+	}
+
+	start, end := b.anchor, ps.currentPointerEvent.runeIndex
+	if end < start {
+		start, end = end, start
+	}
+
+	lines, lineStarts := e.blockLines(start, end)
+	sels, cursors := blockRanges(lines, lineStarts, x0, x1)
+
+	e.clearSelections()
+	if len(sels) > 0 {
+		cursors = cursors[:0]
+		for _, s := range sels {
+			e.addSecondarySelection(s.start, s.end)
+			cursors = append(cursors, s.start)
+		}
+	}
+	if len(cursors) > 0 {
+		e.CursorIndices = cursors
+	}
+	e.blockSelected = true
+	e.adapter.selectionsChanged(e)
+}
+
+func (e *editable) stopBuildingBlockSelection() {
+	e.blockSelectionBeingBuilt = nil
+}
+
+// blockColumnOfPointer returns the horizontal offset in pixels of the pointer from the start of the
+// line under it, as if the line was not wrapped.
+func (e *editable) blockColumnOfPointer(ps *PointerState) int {
+	ri := ps.currentPointerEvent.runeIndex
+	px := int(ps.currentPointerEvent.Position.X) - e.style.TextLeftPadding + e.xScroll
+	if px < 0 {
+		px = 0
+	}
+
+	lines, lineStarts := e.blockLines(ri, ri)
+	if len(lines) == 0 {
+		return px
+	}
+
+	l := lines[0]
+	col := ri - lineStarts[0]
+	x := l.XOfRuneIndex(col)
+	if col >= lineRuneCount(l) && px > x {
+		// The pointer is past the end of the line. Let the block extend past it as well.
+		x = px
+	}
+	return x
+}
+
+// blockLines lays out, without wrapping, the lines from the one containing the rune index start to the
+// one containing the rune index end. It returns the lines and the rune index at which each begins.
+func (e *editable) blockLines(start, end int) (lines []typeset.Line, lineStarts []int) {
+	w := runes.NewWalker(e.Bytes())
+	w.SetRunePos(start)
+	first, _ := w.CurrentLineBounds()
+	w.SetRunePos(end)
+	_, last := w.CurrentLineBoundsIncludingNl()
+
+	t, errs := typeset.Layout(w.TextBetweenRuneIndices(first, last), e.unwrappedTextLayoutConstraints())
+	for _, err := range errs {
+		log(LogCatgEd, "typeset.Layout error: %v\n", err)
+	}
+
+	lines = t.Lines()
+	lineStarts = make([]int, len(lines))
+	i := first
+	for j, l := range lines {
+		lineStarts[j] = i
+		i += l.RuneCount()
+	}
+	return
+}
+
+func (e *editable) unwrappedTextLayoutConstraints() typeset.Constraints {
+	c := e.fontLayoutConstraints()
+	c.TabStopInterval = e.tabStopInterval()
+	return c
+}
+
+// fontLayoutConstraints are the constraints for laying out text in the font of the editable without
+// wrapping, using the tab stop interval of the style.
+func (e *editable) fontLayoutConstraints() typeset.Constraints {
+	return typeset.Constraints{
+		FontFaceId:        e.curFontName(),
+		FontSize:          e.curFontSize(),
+		FontFace:          e.curFont(),
+		TabStopInterval:   e.style.TabStopInterval,
+		ExtraLineGap:      e.style.LineSpacing,
+		ReplaceCRWithTofu: e.adapter.replaceCrWithTofu(),
+	}
+}
+
+// blockRanges computes the part of each of the unwrapped lines that lies between the horizontal pixel
+// offsets x0 and x1. If the block has a width, one selection is returned for each line that reaches
+// into the block. Otherwise a cursor is returned for each line at x0, or at the end of the line if it
+// is shorter.
+func blockRanges(lines []typeset.Line, lineStarts []int, x0, x1 int) (sels []selection, cursors []int) {
+	for i, l := range lines {
+		left, right := l.RuneIndexAtX(x0), l.RuneIndexAtX(x1)
+		cursors = append(cursors, lineStarts[i]+left)
+		if right > left {
+			sels = append(sels, selection{lineStarts[i] + left, lineStarts[i] + right})
+		}
+	}
+	return
+}
+
+// lineRuneCount returns the number of runes in the line not counting a trailing newline.
+func lineRuneCount(l typeset.Line) int {
+	n := l.RuneCount()
+	if l.EndsWith('\n') {
+		n--
+	}
+	return n
+}
+
+// textOfSelectionsForClipboard returns the text of the selections in display order. The text of
+// a block selection has one line per selection.
+func (e *editable) textOfSelectionsForClipboard(sels []*selection) string {
+	var buf bytes.Buffer
+	for i, s := range sels {
+		if e.blockSelected && i > 0 {
+			buf.WriteRune('\n')
+		}
+		buf.WriteString(e.textOfSelection(s))
+	}
+
+	if e.blockSelected {
+		blockClipboardText = buf.String()
+	}
+	return buf.String()
+}
+
+// insertBlockText inserts text that was cut or copied from a block selection, or that is pasted
+// over a block selection, column-wise: each line of the text goes to a different line of the
+// document. If there is one cursor or selection for each line of the text, each line replaces the
+// corresponding selection or is inserted at the corresponding cursor. If there is a single cursor the
+// lines are inserted at the cursor's column on it and the following lines. It returns false if
+// the text should be inserted normally instead.
+func (e *editable) insertBlockText(text string) (inserted bool) {
+	if !e.blockSelected && text != blockClipboardText {
+		return false
+	}
+
+	rows := strings.Split(text, "\n")
+	if len(rows) < 2 {
+		return false
+	}
+
+	switch {
+	case !e.SelectionsPresent() && (len(e.CursorIndices) == len(rows) || len(e.CursorIndices) == 1) && strings.Trim(text, "\n") == "":
+		// The block is empty, so there is nothing to insert at the cursors
+		return true
+	case e.SelectionsPresent() && e.numberOfSelections() == len(rows):
+		e.StartTransaction()
+		sels := e.selectionsInDisplayOrder()
+		for i := len(sels) - 1; i >= 0; i-- {
+			e.replaceSelectionWith(sels[i], rows[i])
+		}
+		e.EndTransaction()
+		e.invalidateLayedoutText()
+		e.textChanged(fireListeners, TextChange{})
+	case !e.SelectionsPresent() && len(e.CursorIndices) == len(rows):
+		e.StartTransaction()
+		e.insertRowsAtCursors(rows)
+		e.EndTransaction()
+	case !e.SelectionsPresent() && len(e.CursorIndices) == 1:
+		e.StartTransaction()
+		e.insertRowsAsBlockAtCursor(rows)
+		e.EndTransaction()
+	default:
+		return false
+	}
+
+	e.typingInSelectedTextAction = appendTextToSelections
+	return true
+}
+
+func (e *editable) insertRowsAtCursors(rows []string) {
+	cursors := make([]int, len(e.CursorIndices))
+	copy(cursors, e.CursorIndices)
+	sort.Ints(cursors)
+
+	// Insert from the last cursor backwards so that the earlier cursor indices remain valid
+	for i := len(cursors) - 1; i >= 0; i-- {
+		if rows[i] != "" {
+			e.insertToPieceTable(cursors[i], rows[i])
+		}
+	}
+
+	delta := 0
+	for i := range cursors {
+		delta += utf8.RuneCountInString(rows[i])
+		cursors[i] += delta
+	}
+	e.CursorIndices = cursors
+}
+
+func (e *editable) insertRowsAsBlockAtCursor(rows []string) {
+	ci := e.firstCursorIndex()
+
+	x := 0
+	lineStart := ci
+	lines, lineStarts := e.blockLines(ci, ci)
+	if len(lines) > 0 {
+		lineStart = lineStarts[0]
+		x = lines[0].XOfRuneIndex(ci - lineStart)
+	}
+
+	spaceWidth := e.widthOfSpace()
+
+	for i, row := range rows {
+		if i > 0 {
+			w := runes.NewWalker(e.Bytes())
+			w.SetRunePos(lineStart)
+			_, end := w.CurrentLineBounds()
+			if end >= e.Len() {
+				e.insertToPieceTable(e.Len(), "\n")
+			}
+			lineStart = end + 1
+		}
+
+		col := 0
+		pad := ""
+		lines, _ := e.blockLines(lineStart, lineStart)
+		if len(lines) > 0 {
+			l := lines[0]
+			col = l.RuneIndexAtX(x)
+			if w := l.XOfRuneIndex(col); col == lineRuneCount(l) && x > w {
+				pad = strings.Repeat(" ", (x-w+spaceWidth/2)/spaceWidth)
+			}
+		} else if x > 0 {
+			pad = strings.Repeat(" ", (x+spaceWidth/2)/spaceWidth)
+		}
+
+		if row != "" {
+			e.insertToPieceTable(lineStart+col, pad+row)
+		}
+	}
+
+	e.setToOneCursorIndex(ci + utf8.RuneCountInString(rows[0]))
+}
+
+func (e *editable) widthOfSpace() int {
+	t, _ := typeset.Layout([]byte(" "), e.fontLayoutConstraints())
+	if t.LineCount() == 0 {
+		return 1
+	}
+
+	w := t.Lines()[0].XOfRuneIndex(1)
+	if w <= 0 {
+		w = 1
+	}
+	return w
+}
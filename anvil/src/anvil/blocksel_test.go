@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jeffwilliams/anvil/internal/typeset"
+)
+
+func TestBlockRanges(t *testing.T) {
+	constraints := typeset.Constraints{
+		FontFace:   MonoFont,
+		FontFaceId: "mono",
+		FontSize:   14,
+	}
+
+	one, _ := typeset.Layout([]byte("a"), constraints)
+	cw := one.Lines()[0].XOfRuneIndex(1)
+	constraints.TabStopInterval = 4 * cw
+
+	text := "a\tbc\nabcdefghij\nxy\n"
+	layedout, _ := typeset.Layout([]byte(text), constraints)
+	lines := layedout.Lines()
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines but got %d", len(lines))
+	}
+	lineStarts := []int{0, 5, 16}
+
+	tests := []struct {
+		name    string
+		x0, x1  int
+		sels    []selection
+		cursors []int
+	}{
+		{
+			name:    "columns after tab",
+			x0:      4 * cw,
+			x1:      6 * cw,
+			sels:    []selection{{2, 4}, {9, 11}},
+			cursors: []int{2, 9, 18},
+		},
+		{
+			name:    "columns within tab",
+			x0:      1 * cw,
+			x1:      2 * cw,
+			sels:    []selection{{6, 7}, {17, 18}},
+			cursors: []int{1, 6, 17},
+		},
+		{
+			name:    "zero width",
+			x0:      3 * cw,
+			x1:      3 * cw,
+			cursors: []int{2, 8, 18},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sels, cursors := blockRanges(lines, lineStarts, tc.x0, tc.x1)
+
+			if len(sels) != len(tc.sels) {
+				t.Fatalf("expected selections %v but got %v", tc.sels, sels)
+			}
+			for i := range sels {
+				if sels[i] != tc.sels[i] {
+					t.Fatalf("expected selections %v but got %v", tc.sels, sels)
+				}
+			}
+
+			if len(cursors) != len(tc.cursors) {
+				t.Fatalf("expected cursors %v but got %v", tc.cursors, cursors)
+			}
+			for i := range cursors {
+				if cursors[i] != tc.cursors[i] {
+					t.Fatalf("expected cursors %v but got %v", tc.cursors, cursors)
+				}
+			}
+		})
+	}
+}
+
+func TestInsertBlockText(t *testing.T) {
+	oldClipboard := blockClipboardText
+	defer func() { blockClipboardText = oldClipboard }()
+
+	tests := []struct {
+		name            string
+		text            string
+		cursors         []int
+		paste           string
+		expectedText    string
+		expectedCursors []int
+	}{
+		{
+			name:            "cursor on each line",
+			text:            "abc\ndef\nghi\n",
+			cursors:         []int{1, 5, 9},
+			paste:           "X\nY\nZ",
+			expectedText:    "aXbc\ndYef\ngZhi\n",
+			expectedCursors: []int{2, 7, 12},
+		},
+		{
+			name:            "single cursor",
+			text:            "abc\ndef\nghi\n",
+			cursors:         []int{1},
+			paste:           "XY\nZ",
+			expectedText:    "aXYbc\ndZef\nghi\n",
+			expectedCursors: []int{3},
+		},
+		{
+			name:            "single cursor past the ends of lines",
+			text:            "ab\nc",
+			cursors:         []int{2},
+			paste:           "X\nY\nZ",
+			expectedText:    "abX\nc Y\n  Z",
+			expectedCursors: []int{3},
+		},
+		{
+			name:            "empty rows",
+			text:            "abc\ndef\nghi\n",
+			cursors:         []int{1, 5, 9},
+			paste:           "X\n\nZ",
+			expectedText:    "aXbc\ndef\ngZhi\n",
+			expectedCursors: []int{2, 6, 11},
+		},
+		{
+			name:            "empty block",
+			text:            "abc\ndef\nghi\n",
+			cursors:         []int{1, 5, 9},
+			paste:           "\n\n",
+			expectedText:    "abc\ndef\nghi\n",
+			expectedCursors: []int{1, 5, 9},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var e editable
+			e.Init(editableStyle{Fonts: []FontStyle{{FontName: "mono", FontSize: 14, FontFace: MonoFont}}})
+			e.Scheduler = NewScheduler(make(chan Work, 10))
+			e.SetTextString(tc.text)
+			e.CursorIndices = tc.cursors
+
+			changes := 0
+			e.AddTextChangeListener(func(*TextChange) { changes++ })
+
+			blockClipboardText = tc.paste
+			if !e.insertBlockText(tc.paste) {
+				t.Fatalf("the text was not inserted as a block")
+			}
+
+			if got := string(e.Bytes()); got != tc.expectedText {
+				t.Fatalf("expected text %q but got %q", tc.expectedText, got)
+			}
+			if !reflect.DeepEqual(e.CursorIndices, tc.expectedCursors) {
+				t.Fatalf("expected cursors %v but got %v", tc.expectedCursors, e.CursorIndices)
+			}
+			if tc.text == tc.expectedText && changes != 0 {
+				t.Fatalf("expected no text changes but got %d", changes)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+// Command anvil-agent is the helper that Anvil uploads to remote hosts and runs over ssh when the
+// remote-agent ssh setting is enabled. It serves the protocol of the agent package on its standard input
+// and output. It is built for Unix hosts only. It is not meant to be run by hand.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jeffwilliams/anvil/internal/agent"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "-version" {
+		fmt.Println(agent.Version)
+		return
+	}
+
+	if err := agent.Serve(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "anvil-agent: %v\n", err)
+		os.Exit(1)
+	}
+}
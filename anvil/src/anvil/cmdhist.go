@@ -3,6 +3,10 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,10 +15,16 @@ import (
 
 type CommandHistory struct {
 	cmds circ.Circ[*CommandHistoryEntry]
-	lock sync.Mutex
+	// pinned are the pinned entries, ordered by id. They are kept when newer commands evict them
+	// from cmds.
+	pinned []*CommandHistoryEntry
+	nextId int
+	lock   sync.Mutex
 }
 
 type CommandHistoryEntry struct {
+	// id is the number of the entry shown by Cmds and used by Rerun and Pin. It is not reused.
+	id          int
 	cmd         string
 	started     time.Time
 	ended       time.Time
@@ -22,6 +32,67 @@ type CommandHistoryEntry struct {
 	dir         string
 	exitCode    int
 	exitCodeSet bool
+	pinned      bool
+	// pid is the process id of a command run locally, or 0.
+	pid int
+}
+
+// cmdAndArg splits the entry's command line into the command and its arguments.
+func (e CommandHistoryEntry) cmdAndArg() (cmd, arg string) {
+	cmd, arg, _ = strings.Cut(e.cmd, " ")
+	return
+}
+
+// duration is how long the command ran, or has been running so far.
+func (e CommandHistoryEntry) duration(now time.Time) time.Duration {
+	switch e.state {
+	case Running:
+		return now.Sub(e.started).Round(time.Second)
+	case Completed:
+		return e.ended.Sub(e.started).Round(time.Second)
+	}
+	return 0
+}
+
+// exitStatus describes how the command ended, or is empty if that is not known.
+func (e CommandHistoryEntry) exitStatus() string {
+	switch {
+	case !e.exitCodeSet:
+		return ""
+	case e.exitCode < 0:
+		return "killed"
+	}
+	return fmt.Sprintf("exit %d", e.exitCode)
+}
+
+// CommandHistoryFilter selects the entries of the history that are listed.
+type CommandHistoryFilter struct {
+	// Re, if set, must match the command or the directory of the entry.
+	Re         *regexp.Regexp
+	PinnedOnly bool
+}
+
+func (f CommandHistoryFilter) matches(e *CommandHistoryEntry) bool {
+	if f.PinnedOnly && !e.pinned {
+		return false
+	}
+	return f.Re == nil || f.Re.MatchString(e.cmd) || f.Re.MatchString(e.dir)
+}
+
+// parseCommandHistoryFilter builds a filter from the arguments of Cmds: an optional -p to list only
+// pinned entries followed by a regular expression.
+func parseCommandHistoryFilter(args []string) (f CommandHistoryFilter, err error) {
+	if len(args) > 0 && args[0] == "-p" {
+		f.PinnedOnly = true
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return
+	}
+
+	f.Re, err = regexp.Compile(strings.Join(args, " "))
+	return
 }
 
 type RunState int
@@ -59,7 +130,9 @@ func NewCommandHistory(max int) *CommandHistory {
 func (ch *CommandHistory) Started(dir, cmd string) *CommandHistoryEntry {
 	ch.lock.Lock()
 	defer ch.lock.Unlock()
+	ch.nextId++
 	e := &CommandHistoryEntry{
+		id:      ch.nextId,
 		cmd:     cmd,
 		started: time.Now(),
 		state:   Running,
@@ -76,6 +149,12 @@ func (ch *CommandHistory) Completed(e *CommandHistoryEntry) {
 	e.state = Completed
 }
 
+func (ch *CommandHistory) SetPid(e *CommandHistoryEntry, pid int) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	e.pid = pid
+}
+
 func (ch *CommandHistory) SetExitCode(e *CommandHistoryEntry, c int) {
 	ch.lock.Lock()
 	defer ch.lock.Unlock()
@@ -83,12 +162,100 @@ func (ch *CommandHistory) SetExitCode(e *CommandHistoryEntry, c int) {
 	e.exitCodeSet = true
 }
 
-func (ch *CommandHistory) String(verbosity Verbosity) string {
-	var buf bytes.Buffer
+// Find returns a copy of the entry with the given id.
+func (ch *CommandHistory) Find(id int) (entry CommandHistoryEntry, ok bool) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.each(func(e *CommandHistoryEntry) {
+		if e.id == id {
+			entry, ok = *e, true
+		}
+	})
+	return
+}
 
+// Last returns a copy of the most recent entry.
+func (ch *CommandHistory) Last() (entry CommandHistoryEntry, ok bool) {
 	ch.lock.Lock()
 	defer ch.lock.Unlock()
+	ch.each(func(e *CommandHistoryEntry) {
+		entry, ok = *e, true
+	})
+	return
+}
+
+// SetPinned marks the entry with the given id as a favourite or not.
+func (ch *CommandHistory) SetPinned(id int, pinned bool) (ok bool) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.each(func(e *CommandHistoryEntry) {
+		if e.id != id {
+			return
+		}
+		if pinned && !e.pinned {
+			ch.addPinned(e)
+		} else if !pinned && e.pinned {
+			ch.removePinned(e)
+		}
+		e.pinned = pinned
+		ok = true
+	})
+	return
+}
+
+func (ch *CommandHistory) addPinned(e *CommandHistoryEntry) {
+	i := sort.Search(len(ch.pinned), func(i int) bool { return ch.pinned[i].id >= e.id })
+	ch.pinned = slices.Insert(ch.pinned, i, e)
+}
+
+func (ch *CommandHistory) removePinned(e *CommandHistoryEntry) {
+	ch.pinned = slices.DeleteFunc(ch.pinned, func(p *CommandHistoryEntry) bool { return p == e })
+}
+
+// each calls f for each entry, oldest first: the pinned entries that newer commands evicted from
+// cmds, and then the entries in cmds.
+func (ch *CommandHistory) each(f func(e *CommandHistoryEntry)) {
+	recent := map[*CommandHistoryEntry]bool{}
 	ch.cmds.Each(func(e *CommandHistoryEntry) {
+		recent[e] = true
+	})
+
+	for _, e := range ch.pinned {
+		if !recent[e] {
+			f(e)
+		}
+	}
+	ch.cmds.Each(f)
+}
+
+// Entries returns copies of the entries that match the filter, oldest first.
+func (ch *CommandHistory) Entries(filter CommandHistoryFilter) (entries []CommandHistoryEntry) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.each(func(e *CommandHistoryEntry) {
+		if filter.matches(e) {
+			entries = append(entries, *e)
+		}
+	})
+	return
+}
+
+func (ch *CommandHistory) String(verbosity Verbosity, filter CommandHistoryFilter) string {
+	var buf bytes.Buffer
+
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.each(func(e *CommandHistoryEntry) {
+		if !filter.matches(e) {
+			return
+		}
+
+		pin := ""
+		if e.pinned {
+			pin = "*"
+		}
+		fmt.Fprintf(&buf, "%d%s ", e.id, pin)
+
 		ss, es := ch.formatTimes(e.started, e.ended)
 		dirString := ""
 		if verbosity == Verbose && e.dir != "" {
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandHistory(t *testing.T) {
+	ch := NewCommandHistory(3)
+
+	e := ch.Started("/src", "make ")
+	ch.SetExitCode(e, 2)
+	ch.Completed(e)
+	ch.Started("host:/src", "go test ./...")
+	ch.Started("/src", "ls -l")
+	ch.Started("/doc", "ls")
+
+	if _, ok := ch.Find(1); ok {
+		t.Fatalf("found the evicted entry")
+	}
+
+	last, ok := ch.Last()
+	if !ok || last.id != 4 || last.cmd != "ls" {
+		t.Fatalf("unexpected last entry %+v", last)
+	}
+
+	e2, ok := ch.Find(2)
+	if !ok {
+		t.Fatalf("entry 2 not found")
+	}
+	if cmd, arg := e2.cmdAndArg(); cmd != "go" || arg != "test ./..." {
+		t.Fatalf("unexpected command %q and arg %q", cmd, arg)
+	}
+
+	ch.SetPinned(3, true)
+
+	ids := func(f CommandHistoryFilter) (r []int) {
+		for _, e := range ch.Entries(f) {
+			r = append(r, e.id)
+		}
+		return
+	}
+
+	tests := []struct {
+		args     []string
+		expected []int
+	}{
+		{nil, []int{2, 3, 4}},
+		{[]string{"^ls"}, []int{3, 4}},
+		{[]string{"host:"}, []int{2}},
+		{[]string{"-p"}, []int{3}},
+		{[]string{"-p", "doc"}, nil},
+	}
+
+	for _, tc := range tests {
+		f, err := parseCommandHistoryFilter(tc.args)
+		if err != nil {
+			t.Fatalf("parsing filter %v failed: %v", tc.args, err)
+		}
+		if r := ids(f); !reflect.DeepEqual(r, tc.expected) {
+			t.Errorf("filter %v: expected %v but got %v", tc.args, tc.expected, r)
+		}
+	}
+
+	if _, err := parseCommandHistoryFilter([]string{"("}); err == nil {
+		t.Fatalf("invalid regular expression was accepted")
+	}
+}
+
+func TestCommandHistoryState(t *testing.T) {
+	ch := NewCommandHistory(10)
+	e := ch.Started("/src", "make ")
+	ch.SetExitCode(e, 1)
+	ch.Completed(e)
+	ch.SetPinned(e.id, true)
+	ch.Started("/src", "sleep 100")
+
+	restored := NewCommandHistory(10)
+	restored.SetState(ch.State())
+
+	r, ok := restored.Find(1)
+	if !ok || !r.pinned || !r.exitCodeSet || r.exitCode != 1 || r.state != Completed {
+		t.Fatalf("unexpected restored entry %+v", r)
+	}
+	if r, _ := restored.Find(2); r.state != Orphaned {
+		t.Fatalf("running command was not orphaned: %v", r.state)
+	}
+	if n := restored.Started("/src", "ls"); n.id != 3 {
+		t.Fatalf("new entry reused an id: %d", n.id)
+	}
+
+	// Entries saved without ids are numbered in order
+	old := NewCommandHistory(10)
+	old.SetState(&CommandHistoryState{Cmds: []CommandHistoryEntryState{{Cmd: "a"}, {Cmd: "b"}}})
+	if r, ok := old.Find(2); !ok || r.cmd != "b" {
+		t.Fatalf("unexpected entry %+v", r)
+	}
+}
+
+func TestCmdHistoryEntryText(t *testing.T) {
+	e := CommandHistoryEntry{cmd: "make ", dir: "host:/src"}
+	if s := cmdHistoryEntryText("host:/src", e); s != "make" {
+		t.Fatalf("unexpected text %q", s)
+	}
+	if s := cmdHistoryEntryText("/doc", e); s != "On host:/src make" {
+		t.Fatalf("unexpected text %q", s)
+	}
+}
+
+func TestCommandHistoryKeepsPinnedEntries(t *testing.T) {
+	ch := NewCommandHistory(3)
+
+	ch.Started("/src", "make")
+	ch.Started("/src", "go vet")
+	ch.SetPinned(1, true)
+	for i := 0; i < 5; i++ {
+		ch.Started("/src", "ls")
+	}
+
+	if e, ok := ch.Find(1); !ok || !e.pinned || e.cmd != "make" {
+		t.Fatalf("the pinned entry was evicted: %+v", e)
+	}
+	if _, ok := ch.Find(2); ok {
+		t.Fatalf("found the evicted entry that was not pinned")
+	}
+
+	ids := func(f CommandHistoryFilter) (r []int) {
+		for _, e := range ch.Entries(f) {
+			r = append(r, e.id)
+		}
+		return
+	}
+	if r := ids(CommandHistoryFilter{}); !reflect.DeepEqual(r, []int{1, 5, 6, 7}) {
+		t.Fatalf("unexpected entries %v", r)
+	}
+	if r := ids(CommandHistoryFilter{PinnedOnly: true}); !reflect.DeepEqual(r, []int{1}) {
+		t.Fatalf("unexpected pinned entries %v", r)
+	}
+
+	restored := NewCommandHistory(3)
+	restored.SetState(ch.State())
+	restored.Started("/src", "ls")
+	if e, ok := restored.Find(1); !ok || !e.pinned {
+		t.Fatalf("the pinned entry was not restored: %+v", e)
+	}
+
+	// Once unpinned the evicted entry is dropped
+	ch.SetPinned(1, false)
+	if _, ok := ch.Find(1); ok {
+		t.Fatalf("found the unpinned entry")
+	}
+}
@@ -13,12 +13,11 @@ import (
 	"strings"
 	"unicode/utf8"
 
-	"golang.org/x/crypto/ssh"
 	"golang.org/x/image/colornames"
 
 	"gioui.org/layout"
-	"github.com/alecthomas/chroma/v2/lexers"
 	"github.com/ddkwork/golibrary/mylog"
+	"github.com/jeffwilliams/anvil/internal/runes"
 )
 
 var cmdHistory = NewCommandHistory(100)
@@ -100,14 +99,25 @@ func (c *CommandExecutor) initToplevelCommands() {
 	addCommand("Paste", c.CmdPaste, "Paste text", "Paste writes the text from the clipboard to the window.")
 	addCommand("Put", c.CmdPut, "Save the window body", "Put writes the contents of the window body to the path that is the leftmost text in the window tag.")
 	addCommand("Get", c.CmdGet, "Load the window body", "Get reads the contents of the path that is the leftmost text in the window tag and replaces the window body contents with it.")
-	addCommand("Kill", c.CmdKill, "Kill a running job", "Kill kills all the jobs that are currently running that have names matching the arguments to the Kill command. If no argument is provided the first job is killed")
+	addCommand("Kill", c.CmdKill, "Kill a running job", "Kill kills all the jobs that are currently running that have names matching the arguments to the Kill command. An argument that is a number kills the external command with that number in the Jobs window. If no argument is provided the first job is killed. With the option -INT the external commands are sent an interrupt (SIGINT) instead of being killed, which lets them clean up.")
+	addCommand("Make", c.CmdMake, "Build the project and collect the errors", "Make runs the build command of the project the window belongs to, in the project's directory. Projects are configured in the settings, or with a .anvil-make.toml file in the project's directory. If arguments are given they are run as the command instead. The output is shown in the +Errors window and the locations of errors in the output, in the formats used by Go, go test -json, gcc and Python tracebacks, are collected so that Next and Prev can visit them. A project with on-save set is built whenever one of its files is saved.")
+	addCommand("Next", c.CmdNext, "Go to the next error from Make", "Next opens the file of the next error collected by the last Make and moves the cursor to it.")
+	addCommand("Prev", c.CmdPrev, "Go to the previous error from Make", "Prev opens the file of the previous error collected by the last Make and moves the cursor to it.")
+	addCommand("Debug", c.CmdDebug, "Debug a program using a debug adapter", "Debug starts debugging the Go package in the window's directory using Delve's debug adapter (dlv dap), or the program configured for the language of the window's file in the debug adapters settings. Arguments after 'start' are passed to the program, and 'Debug test' debugs the package's tests. The output of the program and the commands that control it are in the +Debug window: 'continue', 'next', 'step', 'out', 'pause' and 'stop'. 'Debug break' adds or removes a breakpoint on the line the cursor is on, which is shown beside the line, and 'Debug clear' removes the breakpoints of the file. When the program stops the line it stopped at is highlighted. 'Debug stack' shows the stack in the +Stack window and 'Debug vars' shows the variables of the innermost frame, or the frame with the number given, in the +Variables window. Both are updated when the program stops.")
+	addCommand("Tests", c.CmdTests, "List and run the tests of a Go package", "Tests lists the tests of the Go package in the window's directory in its +Tests window. With the argument 'all' all the tests are run, with 'failed' the tests that failed in the last run are run again, and with 'run' followed by test names those tests are run. With 'here' the test that the cursor is in is run, either in a _test.go file or on a line of the +Tests window. The tests are run using go test -json and each shows whether it passed or failed and how long it took. The locations in the output of failed tests can be visited using Next and Prev.")
+	addCommand("Jobs", c.CmdJobs, "List running and finished jobs", "Jobs lists the running and recently finished external commands in the +Jobs window, with their number, process id, host, running time and exit status. Running the command again refreshes the list. Running commands can be interrupted or killed using the Kill commands after them.")
 	addCommand("Look", c.CmdLook, "Look for a string in the window body", "Look searches for the next string in the window body that exactly matches the argument to Look.")
 	addCommand("Keypass", c.CmdKeyPassword, "Specify the password used to decrypt an ssh private key file or log into a host", "Keypass is used to specify the password used to decrypt an ssh private key file. It takes two arguments: the first is the ssh filename and the second is the password. This is needed when an ssh private key file is encrypted and ssh-agent is not being used.")
+	addCommand("Ssh", c.CmdSsh, "List and manage ssh connections and port forwards", "Ssh lists the open ssh connections in the +Ssh window with their number, endpoint, how long ago they were opened and how long they have been idle, followed by their port forwards. With the argument 'close' or 'reconnect' followed by a connection it closes or re-opens that connection. A connection is given by its number, its endpoint as listed, or its host. With the argument 'forward' followed by a connection, a local address and a remote address it forwards connections made to the local address through the ssh connection to the remote address, for example to reach a development server on the remote host. 'rforward' is the reverse: it forwards connections made to the remote address to the local address. An address that is just a port is on the loopback interface. With the argument 'unforward' followed by the number of a port forward it stops that forward. Connections are checked every ssh.keepalive-interval seconds and lost connections are re-opened along with their port forwards.")
+	addCommand("Acceptkey", c.CmdAcceptKey, "Trust the key of an unknown ssh server", "Acceptkey trusts the host key presented by an ssh server that was rejected because the server was not known. It takes the host printed in +Errors when the connection was rejected as its argument, and records the key in the known_hosts file in the Anvil config directory. With no arguments it lists the keys that may be accepted. Keys that differ from the known key for a host can't be accepted this way; remove the old key from the known_hosts file first if the change is expected.")
 	addCommand("Hostpass", c.CmdHostPassword, "Specify the password used to log into an ssh server", "Hostpass is used to specify the password used to log into an ssh server. It takes between two and four arguments. The first argument is the password. The second argument is the hostname or IP address of the server. The third argument is the username for the server; if not specified the current user's name is used. The fourth argument is the TCP port number for the server; if not specified 22 is used.")
 	addCommand("Zerox", c.CmdZerox, "Clone a window", "Zerox opens a second window which is a copy of the current window")
 	addCommand("Title", c.CmdTitle, "Set the editor title", "Title sets the title of the editor to it's combined arguments. The title is usually displayed by the OS window manager in the title bar.")
 	addCommand("Syn", c.CmdSyntax, "Enable or disable syntax highlighting, or list supported formats", "Syntax is used to control syntax highlighting for the current window. With the argument 'off' it disables syntax highlighting, and with the argument 'list' it lists the valid supported languages. With any other argument it enables syntax highlighting and highlights the body using the language named by the argument. With no argument it attempts to analyze the text to autodetect the language.")
 	addCommand("Ansi", c.CmdAnsi, "Enable or disable Ansi colors", "Ansi is used to control whether Ansi terminal color escape sequences cause coloring or not. With no argument or the 'on' it enables coloring. With the argument 'off' it disables coloring.")
+	addCommand("Wrap", c.CmdWrap, "Set how long lines are wrapped", "Wrap controls how lines that are wider than the window body are displayed. With no argument it toggles between not wrapping and the last wrapping mode. With the argument 'none' lines are not wrapped and the body scrolls horizontally to follow the cursor; it can also be scrolled using Alt-Left and Alt-Right or a horizontal mouse wheel or Shift with the mouse wheel. With 'char' lines are wrapped at any character, and with 'word' lines are wrapped between words and the wrapped part is indented to match the start of the line. With a number lines are wrapped at that column, or at the right edge of the window if it is narrower; 0 wraps at the edge of the window. A mode and a column may be given together.")
+	addCommand("Snip", c.CmdSnip, "Expand a snippet", "Snip expands the snippet named by the argument at the cursor in the window body. With no argument it lists the snippets that can be used in the window. Snippets are read from the files in the snippets directory in the Anvil config directory. Each file is named after a language, like go.toml, or is all.toml for snippets that apply to every file, and contains a TOML table for each snippet named by the word that triggers it, with a body and a description. A snippet is also expanded by typing its trigger and pressing Tab. In the body $1, $2 and so on are tab stops that Tab and Shift-Tab move between, ${1:text} is a tab stop with placeholder text, and $0 is where the cursor ends up. A tab stop that appears more than once is edited in all places at once. The variables $FILENAME, $FILENAME_BASE, $FILEPATH, $DIRECTORY, $DATE, $TIME, $YEAR and $USER are replaced by their values.")
+	addCommand("Term", c.CmdTerm, "Open a terminal window", "Term opens a new window running a shell in a terminal, in the directory of the window or on the remote host if the directory is remote. While the cursor is on the terminal screen at the end of the body, keys and typed or pasted text are sent to the shell, and programs can move the cursor, use colors and take over the whole window. Lines that scroll off the top of the screen are kept above it as ordinary text; moving the cursor into them edits the body as usual. The terminal is resized to fit the window, and the shell is killed when the window is deleted. Terminals are only supported on Linux and over ssh.")
 	addCommand("Dump", c.CmdDump, "Save the editor's state to disk", fmt.Sprintf("Dump saves the editor's state to disk: the size of the open windows and the current value of their tags. With an argument the state is written to the file named by the argument. With no argument state is written to the file %s.dump. The state can be loaded using Load", editorName))
 	addCommand("Load", c.CmdLoad, "Load the editor's state from disk", fmt.Sprintf("Load loads the editor's state from disk as written by the Dump command. With an argument the state is read from the file named by the argument. With no argument state is read from the file %s.dump", editorName))
 	addCommand("Putall", c.CmdPutall, "Save all windows", "Putall executes a Put on all open windows, saving all windows.")
@@ -116,9 +126,13 @@ func (c *CommandExecutor) initToplevelCommands() {
 	addCommand("Goto", c.CmdGoto, "Jump to a bookmark", "Goto sets the current cursor position in the window body to the named bookmark, created by Mark. If no argument is given it jumps to the bookmark 'def'.")
 	addCommand("Marks", c.CmdMarks, "Display bookmarks", "Marks displays the currently set bookmarks to the Errors window.")
 	addCommand("Marks-", c.CmdClearMarks, "Clear bookmarks", "Marks- clears all the currently set bookmarks.")
+	addCommand("Lmark", c.CmdLmark, "Toggle a line mark", "Lmark adds an unnamed mark to the line of the cursor in the window body, or removes it if the line is already marked. Marked lines are shown with a bar to the left of the text, and the marks move with the text as it is edited. With the argument 'next' or 'prev' the cursor moves to the next or previous marked line in the window, and with 'clear' all the line marks of the window are removed. Ctrl-B toggles a line mark, and Ctrl-J and Ctrl-Shift-J move to the next and previous marked lines.")
+	addCommand("Back", c.CmdBack, "Jump back to the previous position", "Back moves the cursor back to where it was before the last jump, opening the file if needed. Jumps are made by Goto, acquiring a file, searching, moving to line marks, and setting the cursor using the API. Repeating Back walks further back through the jumps, and Fwd walks forward again. Ctrl-O performs Back and Ctrl-I performs Fwd.")
+	addCommand("Fwd", c.CmdFwd, "Jump forward to the next position", "Fwd moves the cursor forward through the jumps after Back has been used to walk back through them. See Back.")
 	addCommand("SaveStyle", c.CmdSaveStyle, "Save current editor style", fmt.Sprintf("SaveStyle saves the editor style information to a file: the current font and size, colors, etc. With one argument the style is saved to the file named by the argument. With no argument it is saved to %s. When the editor is started the style file %s is loaded", StyleConfigFile(), StyleConfigFile()))
 	addCommand("LoadStyle", c.CmdLoadStyle, "Load editor style from file", fmt.Sprintf("LoadStyle loads the editor style information from a file: the current font and size, colors, etc. With one argument the style is loaded from the file named by the argument. With no argument it is loaded from %s. When the editor is started the style file %s is loaded", StyleConfigFile(), StyleConfigFile()))
 	addCommand("LoadPlumbing", c.CmdLoadPlumbing, "Load plumbing rules from file", fmt.Sprintf("LoadPlumbing loads the plumbing rules from a file. With one argument the plumbing is loaded from the file named by the argument. With no argument it is loaded from %s. When the editor is started the plumbing file %s is loaded", PlumbingConfigFile(), PlumbingConfigFile()))
+	addCommand("Plumb", c.CmdPlumb, "Plumb text using the plumbing rules", "Plumb passes its argument, or the primary selection if there is no argument, to the plumbing rules as if it was acquired with ALT+Right Click, and reports if no rule matched. With the option -n the matching rules and their expanded actions are listed in the Errors window instead of being performed, which is useful for testing rules.")
 	addCommand("Help", c.CmdHelp, "Show help", "Help shows a bit of help for the editor. With no argument it lists the main commands and a brief description. With an argument displays information about that topic. The argument may be a command, which displays more detail about the command, or it may be another selected topic.")
 	addCommand("◊", c.CmdInsertLozenge, "Insert a ◊ rune, or surround selection with it", "If there are no selections, insert a ◊ rune at the cursor. If there are selections, insert a ◊ before and after each selection.")
 	addCommand("Rot", c.CmdRot, "Rotate selections", "Rot rotates the selections when there are multiple selections. The primary selection moves to the next selection, that one to the next and so on, with the last moving to the primary.")
@@ -126,8 +140,11 @@ func (c *CommandExecutor) initToplevelCommands() {
 	addCommand("About", c.CmdAbout, "About the editor", "Print information about the editor, including where some files are expected to be located")
 	addCommand("Font", c.CmdFont, "Change to next font", "Change to the next font defined in the styles")
 	addCommand("On", c.CmdOn, "Run command on remote host", "Run takes two or more arguments. The first is a host and directory (in the format host:directory) and the remaining arguments are the command and arguments to run.")
-	addCommand("Cmds", c.CmdCmds, "List the recent external commands", "List the most recent external commands executed")
-	addCommand("Cmds*", c.CmdCmdsVerbose, "List the recent external commands verbosely", "List the most recent external commands executed along with the directory they were executed in")
+	addCommand("Cmds", c.CmdCmds, "List the recent external commands", "List the most recent external commands executed, each preceded by its number. Pinned commands are marked with a *. If arguments are given they are a regular expression and only the commands where it matches the command or directory are listed. With the option -p only pinned commands are listed.")
+	addCommand("Cmds*", c.CmdCmdsVerbose, "List the recent external commands verbosely", "List the most recent external commands executed along with the directory they were executed in. It accepts the same arguments as Cmds.")
+	addCommand("Rerun", c.CmdRerun, "Re-run a command from the command history", "Rerun runs the external command with the number listed by Cmds again, in the same directory and on the same host it was originally run. With no number the most recent command is run. With the option -e the command is instead appended to the tag of the window so that it can be edited and then executed.")
+	addCommand("Pin", c.CmdPin, "Pin a command from the command history", "Pin marks the external command with the number listed by Cmds as a favourite, and appends it to the tag of the window. Pinned commands are saved with the editor state and can be listed with Cmds -p. If the command was run in a different directory than the window's the command is prefixed with On and the directory.")
+	addCommand("Unpin", c.CmdUnpin, "Unpin a command from the command history", "Unpin removes the favourite mark from the external command with the number listed by Cmds.")
 	addCommand("Wins", c.CmdWins, "List the open windows", "List the filenames of the open windows")
 	addCommand("Undo", c.CmdUndo, "Undo the last change", "Undo the last change")
 	addCommand("Redo", c.CmdRedo, "Redo the last change", "Redo the last change")
@@ -291,6 +308,8 @@ func (c CommandExecutor) delWindow(w *Window) (didNotDelete bool) {
 		didNotDelete = true
 		return
 	}
+	w.notifyApi(ApiNotificationOpClose)
+	w.stopTerminal()
 	application.winIdGenerator.Free(w.Id)
 	w.col.markForRemoval(w)
 	return
@@ -300,6 +319,8 @@ func (c CommandExecutor) CmdDelForce(ctx *CmdContext) {
 	switch w := c.source.(type) {
 	case Window:
 	case *Window:
+		w.notifyApi(ApiNotificationOpClose)
+		w.stopTerminal()
 		application.winIdGenerator.Free(w.Id)
 		w.col.markForRemoval(w)
 	}
@@ -404,9 +425,15 @@ func (c CommandExecutor) CmdAcq(ctx *CmdContext) {
 		}
 	}
 
+	c.acquireFile(path, ctx)
+}
+
+// acquireFile loads the file, which may end in a seek, relative to the source window and focuses its window.
+func (c CommandExecutor) acquireFile(path string, ctx *CmdContext) {
 	path, seek := mylog.Check3(parseSeekFromFilename(path))
 
 	w, _ := c.source.(*Window)
+	editor.recordJump(w)
 	finder := NewFileFinder(w)
 
 	realpath, _ := mylog.Check3(finder.Find(path))
@@ -464,13 +491,15 @@ func setExitCodeInHistory(e *CommandHistoryEntry, c int) {
 
 func (c CommandExecutor) tryApiUserDefinedCommand(ctx *CmdContext, command string) (handled bool) {
 	winId := -1
+	file := ""
 	switch v := c.source.(type) {
 	case Window:
 	case *Window:
 		winId = v.Id
+		file = v.file
 	}
 
-	return apiHandleCommand(winId, command, ctx.Args)
+	return apiHandleCommand(winId, file, command, ctx.Args)
 }
 
 func printErrs(c chan error) (d chan error) {
@@ -493,11 +522,8 @@ func snoopAndSaveFirstError(c chan error, entry *CommandHistoryEntry) (d chan er
 	go func() {
 		for e := range d {
 			log(LogCatgCmd, "Snooped an error and it is a %T\n", e)
-			switch t := e.(type) {
-			case *exec.ExitError:
-				setExitCodeInHistory(entry, t.ExitCode())
-			case *ssh.ExitError:
-				setExitCodeInHistory(entry, t.ExitStatus())
+			if code, ok := exitCodeOfError(e); ok {
+				setExitCodeInHistory(entry, code)
 			}
 			c <- e
 		}
@@ -529,19 +555,32 @@ func (c CommandExecutor) tryOsCmd(ctx *CmdContext, command string) {
 
 	hist := addCommandToHistory(dir, ec.cmd, ec.arg)
 	ec.errs = snoopAndSaveFirstError(ec.errs, hist)
+	ec.interrupt = load.Interrupt
+	ec.started = func(pid int) {
+		cmdHistory.SetPid(hist, pid)
+	}
 	mylog.Check(sfs.execAsync(ec))
 
+	winName := editor.ErrorsFileNameOf(dir)
+	if settings.Jobs.OutputWindows {
+		winName = jobOutputFileName(dir, hist.id)
+	}
+
 	go func() {
 		<-done
 		markCommandCompletedInHistory(hist)
+		editor.WorkChan() <- basicWork{func() {
+			editor.notifyJobEnded(hist.id, winName)
+		}}
 	}()
 
 	wl := &WindowDataLoad{
 		DataLoad:          *load,
-		Win:               NewWindowHolderForName(editor.ErrorsFileNameOf(dir)),
+		Win:               NewWindowHolderForName(winName),
 		Jobname:           command,
 		Tail:              true,
 		GrowBodyBehaviour: growBodyIfTooSmall,
+		CmdHistoryId:      hist.id,
 	}
 
 	wl.Start(editor.WorkChan())
@@ -648,16 +687,170 @@ func (c CommandExecutor) CmdGet(ctx *CmdContext) {
 }
 
 func (c CommandExecutor) CmdKill(ctx *CmdContext) {
+	args := ctx.Args
+	signal := editor.KillJob
+	if len(args) > 0 && args[0] == "-INT" {
+		signal = editor.InterruptJob
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		signal("")
+		return
+	}
+
+	for _, s := range args {
+		signal(s)
+	}
+}
+
+func (c CommandExecutor) CmdMake(ctx *CmdContext) {
+	maker.Make(ctx.Dir, ctx.CombinedArgs())
+}
+
+func (c CommandExecutor) CmdNext(ctx *CmdContext) {
+	c.visitQuickfixItem(ctx, Forward)
+}
+
+func (c CommandExecutor) CmdPrev(ctx *CmdContext) {
+	c.visitQuickfixItem(ctx, Reverse)
+}
+
+func (c CommandExecutor) visitQuickfixItem(ctx *CmdContext, dir direction) {
+	q := &editor.Quickfix
+	if q.Len() == 0 {
+		editor.AppendError("", "There are no errors from Make")
+		return
+	}
+
+	var item QuickfixItem
+	var ok bool
+	if dir == Forward {
+		item, ok = q.Next()
+	} else {
+		item, ok = q.Prev()
+	}
+	if !ok {
+		editor.AppendError("", "No more errors")
+		return
+	}
+
+	path, seek, err := parseSeekFromFilename(item.Location())
+	if err != nil {
+		editor.AppendError("", err.Error())
+		return
+	}
+
+	editor.recordJump(nil)
+	w := editor.LoadFileOpts(path, LoadFileOpts{GoTo: seek, SelectBehaviour: selectText, GrowBodyBehaviour: dontGrowBodyIfTooSmall})
+	if w != nil {
+		w.SetFocus(ctx.Gtx)
+	}
+	log(LogCatgCmd, "visitQuickfixItem: error %d of %d: %s\n", q.Pos()+1, q.Len(), item.Msg)
+}
+
+func (c CommandExecutor) CmdTests(ctx *CmdContext) {
+	dir := ctx.Dir
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
 	if len(ctx.Args) == 0 {
-		editor.KillJob("")
+		editor.listTests(dir)
 		return
 	}
 
-	for _, s := range ctx.Args {
-		editor.KillJob(s)
+	switch ctx.Args[0] {
+	case "all":
+		editor.runTests(dir, nil)
+	case "failed":
+		failed := editor.testSuite(dir).failed()
+		if len(failed) == 0 {
+			editor.AppendError(dir, "No tests failed in the last run")
+			return
+		}
+		editor.runTests(dir, failed)
+	case "run":
+		if len(ctx.Args) < 2 {
+			editor.AppendError(dir, "Tests run needs the names of the tests to run")
+			return
+		}
+		editor.runTests(dir, ctx.Args[1:])
+	case "here":
+		w, ok := c.source.(*Window)
+		if !ok {
+			return
+		}
+		test := testAtCursor(w.Body.String(), w.Body.firstCursorIndex(), strings.HasSuffix(w.file, testsWindowName))
+		if test == "" {
+			editor.AppendError(dir, "The cursor is not in a test")
+			return
+		}
+		editor.runTests(dir, []string{test})
+	default:
+		editor.AppendError(dir, fmt.Sprintf("Unknown argument to Tests: %s", ctx.Args[0]))
 	}
 }
 
+func (c CommandExecutor) CmdDebug(ctx *CmdContext) {
+	dir := ctx.Dir
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
+	d := &editor.Debugger
+	w, _ := c.source.(*Window)
+	file := ""
+	if w != nil {
+		file = w.file
+	}
+
+	arg, args := "start", []string(nil)
+	if len(ctx.Args) > 0 {
+		arg, args = ctx.Args[0], ctx.Args[1:]
+	}
+
+	switch arg {
+	case "start":
+		d.Start(dir, file, "debug", args)
+	case "test":
+		d.Start(dir, file, "test", args)
+	case "continue", "next", "step", "out", "pause":
+		d.Step(dir, arg)
+	case "stop":
+		d.Stop(dir)
+	case "break", "clear":
+		if w == nil || w.file == "" {
+			editor.AppendError(dir, fmt.Sprintf("Debug %s must be run from the window of a file", arg))
+			return
+		}
+		if arg == "break" {
+			d.ToggleBreakpoint(w)
+		} else {
+			d.ClearBreakpoints(w)
+		}
+	case "stack":
+		d.ShowStack(dir)
+	case "vars":
+		frame := 0
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				editor.AppendError(dir, fmt.Sprintf("Debug vars: invalid frame number %s", args[0]))
+				return
+			}
+			frame = n
+		}
+		d.ShowVariables(dir, frame)
+	default:
+		editor.AppendError(dir, fmt.Sprintf("Unknown argument to Debug: %s", arg))
+	}
+}
+
+func (c CommandExecutor) CmdJobs(ctx *CmdContext) {
+	editor.ShowJobs()
+}
+
 func (c CommandExecutor) CmdLook(ctx *CmdContext) {
 	needle := ctx.CombinedArgs()
 	ctx.Editable.SearchAndUpdateEditable(ctx.Gtx, needle, ctx.Editable.firstCursorIndex(), Forward)
@@ -674,6 +867,117 @@ func (c CommandExecutor) CmdKeyPassword(ctx *CmdContext) {
 	sshClientCache.SetKeyfilePassword(file, pass)
 }
 
+func (c CommandExecutor) CmdSsh(ctx *CmdContext) {
+	arg, args := "list", []string(nil)
+	if len(ctx.Args) > 0 {
+		arg, args = ctx.Args[0], ctx.Args[1:]
+	}
+
+	// done reports the error of an operation, if any, and refreshes the list of connections
+	done := func(err error) {
+		editor.WorkChan() <- basicWork{func() {
+			if err != nil {
+				editor.AppendError("", fmt.Sprintf("Ssh %s: %v", arg, err))
+			}
+			editor.ShowSshConnections()
+		}}
+	}
+
+	findClient := func() *SshClient {
+		if len(args) == 0 {
+			editor.AppendError("", fmt.Sprintf("Ssh %s needs a connection as an argument", arg))
+			return nil
+		}
+		client, ok := sshClientCache.Find(args[0])
+		if !ok {
+			editor.AppendError("", fmt.Sprintf("Ssh %s: there is no ssh connection %s", arg, args[0]))
+		}
+		return client
+	}
+
+	switch arg {
+	case "list":
+		editor.ShowSshConnections()
+	case "close":
+		if client := findClient(); client != nil {
+			go func() {
+				done(sshClientCache.Close(client))
+			}()
+		}
+	case "reconnect":
+		if client := findClient(); client != nil {
+			go func() {
+				_, err := sshClientCache.Reconnect(client)
+				done(err)
+			}()
+		}
+	case "forward", "rforward":
+		client := findClient()
+		if client == nil {
+			return
+		}
+		if len(args) != 3 {
+			editor.AppendError("", fmt.Sprintf("Ssh %s needs a connection, an address to listen on and an address to connect to", arg))
+			return
+		}
+		listen, target, err := sshForwardAddrs(args[1], args[2])
+		if err != nil {
+			editor.AppendError("", fmt.Sprintf("Ssh %s: %v", arg, err))
+			return
+		}
+		go func() {
+			_, err := client.Forward(arg == "rforward", listen, target)
+			done(err)
+		}()
+	case "unforward":
+		if len(args) == 0 {
+			editor.AppendError("", "Ssh unforward needs the number of a port forward as an argument")
+			return
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			editor.AppendError("", fmt.Sprintf("Ssh unforward: invalid port forward number %s", args[0]))
+			return
+		}
+		if err := sshClientCache.Unforward(id); err != nil {
+			editor.AppendError("", fmt.Sprintf("Ssh unforward: %v", err))
+			return
+		}
+		editor.ShowSshConnections()
+	default:
+		editor.AppendError("", fmt.Sprintf("Unknown argument to Ssh: %s", arg))
+	}
+}
+
+func (c CommandExecutor) CmdAcceptKey(ctx *CmdContext) {
+	v := sshHostKeyVerifier()
+
+	if len(ctx.Args) == 0 {
+		pending := v.Pending()
+		if len(pending) == 0 {
+			editor.AppendError("", "No unknown ssh host keys are waiting to be accepted")
+			return
+		}
+
+		var text bytes.Buffer
+		fmt.Fprintf(&text, "Unknown ssh host keys:\n")
+		for _, k := range pending {
+			fmt.Fprintf(&text, "  %s %s %s  (◊Acceptkey %s◊)\n", k.Host, k.Key.Type(), k.Fingerprint(), k.Host)
+		}
+		editor.AppendError("", text.String())
+		return
+	}
+
+	for _, host := range ctx.Args {
+		err := v.Accept(host)
+		if err != nil {
+			editor.AppendError("", fmt.Sprintf("Acceptkey: %v", err))
+			continue
+		}
+		editor.AppendError("", fmt.Sprintf("Trusting the host key of %s. It was added to %s", host, SshKnownHostsFile()))
+	}
+}
+
 func (c CommandExecutor) CmdHostPassword(ctx *CmdContext) {
 	if len(ctx.Args) < 2 {
 		editor.AppendError("", "Not enough arguments to Hostpass")
@@ -1093,7 +1397,7 @@ func (l edInsertText) Job() Job {
 
 func (c CommandExecutor) CmdSyntax(ctx *CmdContext) {
 	if len(ctx.Args) > 0 && ctx.Args[0] == "list" {
-		names := lexers.Names(true)
+		names := syntaxLanguageNames()
 		msg := fmt.Sprintf("syntax highlighting languages:\n%s\n", strings.Join(names, "\n"))
 		editor.AppendError("", msg)
 		return
@@ -1136,6 +1440,58 @@ func (c CommandExecutor) CmdAnsi(ctx *CmdContext) {
 	}
 }
 
+func (c CommandExecutor) CmdWrap(ctx *CmdContext) {
+	switch v := c.source.(type) {
+	case Window:
+	case *Window:
+		if len(ctx.Args) == 0 {
+			v.Body.ToggleWrap()
+			return
+		}
+
+		mode, column, err := parseWrapArgs(ctx.Args, v.Body.wrap)
+		if err != nil {
+			editor.AppendError("", err.Error())
+			return
+		}
+		v.Body.SetWrap(mode, column)
+	}
+}
+
+func (c CommandExecutor) CmdSnip(ctx *CmdContext) {
+	switch v := c.source.(type) {
+	case *Window:
+		if len(ctx.Args) == 0 {
+			editor.AppendError("", fmt.Sprintf("Snippets for %s:\n%s", v.file, snippetNames(snippets.ForFile(v.file))))
+			return
+		}
+
+		err := v.Body.ExpandSnippet(ctx.Args[0])
+		if err != nil {
+			editor.AppendError("", fmt.Sprintf("Snip: %v", err))
+		}
+	}
+}
+
+func (c CommandExecutor) CmdTerm(ctx *CmdContext) {
+	w := editor.NewWindow(c.column())
+	if w == nil {
+		return
+	}
+	name := ctx.Dir
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	w.SetFilenameAndTag(name+terminalName, typeFile)
+
+	err := w.StartTerminal(ctx.Dir)
+	if err != nil {
+		editor.AppendError(ctx.Dir, fmt.Sprintf("Term: %v", err))
+		return
+	}
+	w.SetFocus(ctx.Gtx)
+}
+
 func (c CommandExecutor) determineDumpFilename(ctx *CmdContext) string {
 	filename := fmt.Sprintf("%s.dump", editorName)
 
@@ -1231,6 +1587,8 @@ func (c CommandExecutor) CmdGoto(ctx *CmdContext) {
 
 	file, seek, ok := editor.Marks.Seek(markName)
 	if ok {
+		w, _ := c.source.(*Window)
+		editor.recordJump(w)
 		editor.LoadFileOpts(file, LoadFileOpts{GoTo: seek, SelectBehaviour: dontSelectText})
 	}
 }
@@ -1245,6 +1603,65 @@ func (c CommandExecutor) CmdClearMarks(ctx *CmdContext) {
 	editor.Marks.Clear()
 }
 
+func (c CommandExecutor) CmdLmark(ctx *CmdContext) {
+	w, ok := c.source.(*Window)
+	if !ok || w.file == "" {
+		return
+	}
+
+	arg := ""
+	if len(ctx.Args) > 0 {
+		arg = ctx.Args[0]
+	}
+
+	body := &w.Body.editable
+	walker := runes.NewWalker(body.Bytes())
+	walker.SetRunePosCache(body.firstCursorIndex(), &body.runeOffsetCache)
+	lineStart, lineEnd := walker.CurrentLineBounds()
+
+	switch arg {
+	case "":
+		editor.Marks.ToggleLine(w.file, lineStart, lineEnd)
+	case "next", "prev":
+		dir := Forward
+		if arg == "prev" {
+			dir = Reverse
+		}
+		i, ok := editor.Marks.NextLine(w.file, lineStart, lineEnd, dir)
+		if !ok {
+			return
+		}
+		// Edits may have moved the mark away from the start of its line
+		walker.SetRunePosCache(i, &body.runeOffsetCache)
+		i, _ = walker.CurrentLineBounds()
+		editor.recordJump(w)
+		body.setToOneCursorIndex(i)
+		body.AddOpForNextLayout(func(gtx layout.Context) {
+			body.makeCursorVisibleByScrolling(gtx)
+		})
+	case "clear":
+		editor.Marks.ClearLines(w.file)
+	default:
+		editor.AppendError(ctx.Dir, fmt.Sprintf("Lmark: unknown argument '%s'", arg))
+	}
+}
+
+func (c CommandExecutor) CmdBack(ctx *CmdContext) {
+	c.walkJumpList(ctx, Reverse)
+}
+
+func (c CommandExecutor) CmdFwd(ctx *CmdContext) {
+	c.walkJumpList(ctx, Forward)
+}
+
+func (c CommandExecutor) walkJumpList(ctx *CmdContext, dir direction) {
+	w, _ := c.source.(*Window)
+	w = editor.walkJumpList(w, dir)
+	if w != nil {
+		w.SetFocus(ctx.Gtx)
+	}
+}
+
 func (c CommandExecutor) CmdSaveStyle(ctx *CmdContext) {
 	file := StyleConfigFile()
 	if len(ctx.Args) > 0 {
@@ -1272,7 +1689,45 @@ func (c CommandExecutor) CmdLoadPlumbing(ctx *CmdContext) {
 	}
 
 	log(LogCatgCmd, "Loading plumbing rules from file %s\n", file)
-	HirePlumberUsingFile(file)
+	if err := HirePlumberUsingFile(file); err != nil {
+		editor.AppendError(ctx.Dir, fmt.Sprintf("Loading plumbing rules failed: %v", err))
+	}
+}
+
+func (c CommandExecutor) CmdPlumb(ctx *CmdContext) {
+	args := ctx.Args
+	test := len(args) > 0 && args[0] == "-n"
+	if test {
+		args = args[1:]
+	}
+
+	text := strings.Join(args, " ")
+	if text == "" && ctx.Editable != nil {
+		text, _ = ctx.Editable.textOfPrimarySelection()
+	}
+	if text == "" {
+		editor.AppendError(ctx.Dir, "Plumb: there is nothing to plumb")
+		return
+	}
+
+	if plumber == nil {
+		editor.AppendError(ctx.Dir, "Plumb: no plumbing rules are loaded")
+		return
+	}
+
+	if test {
+		w, _ := c.source.(*Window)
+		msg := PlumbMsg{Data: text, Dir: ctx.Dir, File: ctx.Path}
+		if w != nil {
+			msg.WinId = w.Id
+		}
+		editor.AppendError(ctx.Dir, formatPlumbMatches(text, plumber.Match(msg, windowPlumbFileFinder(w))))
+		return
+	}
+
+	if ok, _ := plumber.Plumb(text, &c, ctx); !ok {
+		editor.AppendError(ctx.Dir, fmt.Sprintf("Plumb: no rule matched '%s'", text))
+	}
 }
 
 func (c CommandExecutor) CmdInsertLozenge(ctx *CmdContext) {
@@ -1308,6 +1763,19 @@ func (c CommandExecutor) CmdHelp(ctx *CmdContext) {
 	}
 	text.WriteRune('\n')
 
+	apiCmds := apiUserDefinedCommands()
+	if len(apiCmds) > 0 {
+		fmt.Fprintf(&text, "=== Commands Defined Through the API ===\n\n")
+		for _, v := range apiCmds {
+			if Help(v.Name) != "" {
+				fmt.Fprintf(&text, "%s  (◊Help %s◊)\n\t%s\n", v.Name, v.Name, v.ShortHelp)
+			} else {
+				fmt.Fprintf(&text, "%s\n\t%s\n", v.Name, v.ShortHelp)
+			}
+		}
+		text.WriteRune('\n')
+	}
+
 	editor.AppendError("", text.String())
 }
 
@@ -1347,7 +1815,10 @@ func (c CommandExecutor) CmdAbout(ctx *CmdContext) {
 	fmt.Fprintf(&text, "Style config file: %s (%s)\n", StyleConfigFile(), loadedStr(styleLoadedFromFile))
 	fmt.Fprintf(&text, "SSH key directory: %s\n", SshKeyDir())
 	fmt.Fprintf(&text, "Plumbing config file: %s (%s)\n", PlumbingConfigFile(), loadedStr(plumbingLoadedFromFile))
+	fmt.Fprintf(&text, "Snippet directory: %s\n", SnippetDir())
 	fmt.Fprintf(&text, "API listener port: %d\n", LocalAPIPort())
+	fmt.Fprintf(&text, "API socket: %s\n", LocalAPISocket())
+	fmt.Fprintf(&text, "API user token file: %s\n", ApiTokenFile())
 
 	sshKeys := sshClientCache.Keys()
 	sshEntries := sshClientCache.Entries()
@@ -1367,11 +1838,20 @@ func (c CommandExecutor) CmdAbout(ctx *CmdContext) {
 	if len(apiSessions) > 0 {
 		fmt.Fprintf(&text, "API sessions:\n")
 		for _, e := range apiSessions {
-			s := strings.Join(e.userDefinedCommands, ", ")
+			var names []string
+			for _, c := range e.UserDefinedCommands() {
+				names = append(names, c.Name)
+			}
+			s := strings.Join(names, ", ")
 			if len(s) > 0 {
 				s = fmt.Sprintf(" user-defined commands: [%s]", s)
 			}
-			fmt.Fprintf(&text, "  %s %s%s\n", e.Cmd(), e.Id(), s)
+			id := e.Id()
+			if e.persistent {
+				// Don't reveal the user token
+				id = "(user token)"
+			}
+			fmt.Fprintf(&text, "  %s %s%s\n", e.Cmd(), id, s)
 		}
 	} else {
 		fmt.Fprintf(&text, "No API sessions\n")
@@ -1403,11 +1883,121 @@ func (c CommandExecutor) CmdOn(ctx *CmdContext) {
 }
 
 func (c CommandExecutor) CmdCmds(ctx *CmdContext) {
-	editor.AppendError("", cmdHistory.String(NotVerbose))
+	c.listCmdHistory(ctx, NotVerbose)
 }
 
 func (c CommandExecutor) CmdCmdsVerbose(ctx *CmdContext) {
-	editor.AppendError("", cmdHistory.String(Verbose))
+	c.listCmdHistory(ctx, Verbose)
+}
+
+func (c CommandExecutor) listCmdHistory(ctx *CmdContext, verbosity Verbosity) {
+	filter, err := parseCommandHistoryFilter(ctx.Args)
+	if err != nil {
+		editor.AppendError("", fmt.Sprintf("Invalid filter: %v", err))
+		return
+	}
+
+	editor.AppendError("", cmdHistory.String(verbosity, filter))
+}
+
+func (c CommandExecutor) CmdRerun(ctx *CmdContext) {
+	args := ctx.Args
+	edit := false
+	if len(args) > 0 && args[0] == "-e" {
+		edit = true
+		args = args[1:]
+	}
+
+	e, ok := c.cmdHistoryEntry("Rerun", args)
+	if !ok {
+		return
+	}
+
+	if edit {
+		w, ok := c.source.(*Window)
+		if !ok {
+			editor.AppendError("", "Rerun -e must be executed from a window")
+			return
+		}
+		appendToWindowTag(w, cmdHistoryEntryText(ctx.Dir, e))
+		w.Tag.SetCursorIndices([]int{w.Tag.Len()})
+		return
+	}
+
+	cmd, arg := e.cmdAndArg()
+	ctx.Dir = e.dir
+	ctx.Args = nil
+	if arg != "" {
+		ctx.Args = []string{arg}
+	}
+
+	c.tryOsCmd(ctx, cmd)
+}
+
+func (c CommandExecutor) CmdPin(ctx *CmdContext) {
+	w, ok := c.source.(*Window)
+	if !ok {
+		editor.AppendError("", "Pin must be executed from a window")
+		return
+	}
+
+	e, ok := c.cmdHistoryEntry("Pin", ctx.Args)
+	if !ok {
+		return
+	}
+
+	cmdHistory.SetPinned(e.id, true)
+	appendToWindowTag(w, cmdHistoryEntryText(ctx.Dir, e))
+}
+
+func (c CommandExecutor) CmdUnpin(ctx *CmdContext) {
+	e, ok := c.cmdHistoryEntry("Unpin", ctx.Args)
+	if !ok {
+		return
+	}
+
+	cmdHistory.SetPinned(e.id, false)
+}
+
+// cmdHistoryEntry finds the command history entry numbered by the argument, or the most recent if there
+// is no argument. If there is no such entry an error is reported.
+func (c CommandExecutor) cmdHistoryEntry(cmdName string, args []string) (e CommandHistoryEntry, ok bool) {
+	if len(args) == 0 {
+		e, ok = cmdHistory.Last()
+		if !ok {
+			editor.AppendError("", "The command history is empty")
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		editor.AppendError("", fmt.Sprintf("The %s command takes the number of a command listed by Cmds", cmdName))
+		return
+	}
+
+	e, ok = cmdHistory.Find(id)
+	if !ok {
+		editor.AppendError("", fmt.Sprintf("There is no command numbered %d in the command history", id))
+	}
+	return
+}
+
+// cmdHistoryEntryText returns the text that runs the history entry when executed in the directory dir.
+func cmdHistoryEntryText(dir string, e CommandHistoryEntry) string {
+	cmd := strings.TrimSpace(e.cmd)
+	if e.dir == "" || e.dir == dir {
+		return cmd
+	}
+	return fmt.Sprintf("On %s %s", e.dir, cmd)
+}
+
+func appendToWindowTag(w *Window, text string) {
+	tag := w.Tag.String()
+	if tag != "" && !strings.HasSuffix(tag, " ") {
+		text = " " + text
+	}
+	w.Tag.insertToPieceTable(w.Tag.Len(), text)
 }
 
 func (c CommandExecutor) CmdUndo(ctx *CmdContext) {
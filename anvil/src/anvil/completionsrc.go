@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Besides the words in the open windows, word completions come from the tags files in the
+// directories containing the window's directory (the ctags files the Rt command searches), and
+// from the files in the window's project that have the same extension as the window's file. The
+// project is the nearest directory containing the window that contains a .git directory.
+//
+// These sources are added to the editor's completer in the background, and are named with a prefix
+// so that completions in a window only come from the sources that apply to it.
+
+const (
+	tagsCompletionSourcePrefix    = "tags:"
+	projectCompletionSourcePrefix = "project:"
+
+	// projectCompletionRefreshInterval is how often the words of a project are read again.
+	projectCompletionRefreshInterval = time.Minute
+	// projectCompletionMaxFiles is the most files read for the words of a project.
+	projectCompletionMaxFiles = 500
+	// projectCompletionMaxFileSize is the size of the largest file read for the words of a project.
+	projectCompletionMaxFileSize = 512 * 1024
+)
+
+var completionSources = completionSourceLoader{
+	loaded:  map[string]time.Time{},
+	loading: map[string]struct{}{},
+}
+
+// completionSourceLoader loads the tags and project completion sources.
+type completionSourceLoader struct {
+	lock sync.Mutex
+	// loaded is the modification time of each loaded tags file, and the time each project was read.
+	loaded map[string]time.Time
+	// loading is the set of directories whose sources are being loaded.
+	loading map[string]struct{}
+}
+
+// Refresh loads the completion sources that apply to a window with the directory and file in
+// the background, if they were not loaded yet or are out of date.
+func (l *completionSourceLoader) Refresh(dir, file string) {
+	if dir == "" || isRemoteCompletionDir(dir) {
+		return
+	}
+
+	key := dir + "\x00" + filepath.Ext(file)
+	l.lock.Lock()
+	if _, ok := l.loading[key]; ok {
+		l.lock.Unlock()
+		return
+	}
+	l.loading[key] = struct{}{}
+	l.lock.Unlock()
+
+	go func() {
+		l.refreshTags(dir)
+		l.refreshProject(dir, filepath.Ext(file))
+
+		l.lock.Lock()
+		delete(l.loading, key)
+		l.lock.Unlock()
+	}()
+}
+
+func isRemoteCompletionDir(dir string) bool {
+	p, err := NewGlobalPath(dir, GlobalPathIsDir)
+	return err != nil || p.IsRemote()
+}
+
+func (l *completionSourceLoader) refreshTags(dir string) {
+	for _, path := range tagsFilesFor(dir) {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		src := tagsCompletionSourcePrefix + path
+		l.lock.Lock()
+		t, ok := l.loaded[src]
+		l.lock.Unlock()
+		if ok && t.Equal(info.ModTime()) {
+			continue
+		}
+
+		names, err := readTagNames(path)
+		if err != nil {
+			log(LogCatgCompletion, "Error reading tags file %s: %v\n", path, err)
+			continue
+		}
+		log(LogCatgCompletion, "Loaded %d completions from tags file %s\n", len(names), path)
+		editor.Completer().BuildFromWords(src, names)
+
+		l.lock.Lock()
+		l.loaded[src] = info.ModTime()
+		l.lock.Unlock()
+	}
+}
+
+// tagsFilesFor returns the tags files in dir and the directories containing it.
+func tagsFilesFor(dir string) (paths []string) {
+	dir = filepath.Clean(dir)
+	for {
+		f := filepath.Join(dir, "tags")
+		if info, err := os.Stat(f); err == nil && !info.IsDir() {
+			paths = append(paths, f)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return
+		}
+		dir = parent
+	}
+}
+
+// readTagNames returns the names of the tags in a ctags file.
+func readTagNames(path string) (names []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	seen := map[string]struct{}{}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		l := s.Text()
+		if strings.HasPrefix(l, "!_") {
+			// Pseudo-tag
+			continue
+		}
+		name, _, ok := strings.Cut(l, "\t")
+		if !ok || name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	err = s.Err()
+	return
+}
+
+func (l *completionSourceLoader) refreshProject(dir, ext string) {
+	if ext == "" {
+		return
+	}
+
+	root, ok := projectRootFor(dir)
+	if !ok {
+		return
+	}
+
+	src := projectCompletionSource(root, ext)
+	l.lock.Lock()
+	t, ok := l.loaded[src]
+	l.lock.Unlock()
+	if ok && time.Since(t) < projectCompletionRefreshInterval {
+		return
+	}
+
+	text := readProjectFiles(root, ext)
+	log(LogCatgCompletion, "Loaded completions from the %s files in project %s\n", ext, root)
+	editor.Completer().Build(src, text)
+
+	l.lock.Lock()
+	l.loaded[src] = time.Now()
+	l.lock.Unlock()
+}
+
+func projectCompletionSource(root, ext string) string {
+	return projectCompletionSourcePrefix + filepath.Join(root, "*"+ext)
+}
+
+// projectRootFor returns the nearest directory containing dir that contains a .git directory.
+func projectRootFor(dir string) (root string, ok bool) {
+	dir = filepath.Clean(dir)
+	for {
+		if info, err := os.Stat(filepath.Join(dir, ".git")); err == nil && info.IsDir() {
+			return dir, true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return
+		}
+		dir = parent
+	}
+}
+
+// readProjectFiles returns the contents of the files under root with the extension, skipping
+// hidden and dependency directories.
+func readProjectFiles(root, ext string) []byte {
+	var buf bytes.Buffer
+	count := 0
+
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if d.IsDir() {
+			name := d.Name()
+			if path != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if filepath.Ext(path) != ext {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > projectCompletionMaxFileSize {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+
+		count++
+		if count >= projectCompletionMaxFiles {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+
+	return buf.Bytes()
+}
+
+// completionSourceFilter returns a function that reports whether completions from a source apply
+// to a window with the directory and file. The words of open windows always apply.
+func completionSourceFilter(dir, file string) func(source string) bool {
+	ext := filepath.Ext(file)
+
+	return func(source string) bool {
+		if path, ok := strings.CutPrefix(source, tagsCompletionSourcePrefix); ok {
+			return dir != "" && isInDir(dir, filepath.Dir(path))
+		}
+
+		if pattern, ok := strings.CutPrefix(source, projectCompletionSourcePrefix); ok {
+			return dir != "" && ext != "" && filepath.Ext(pattern) == ext && isInDir(dir, filepath.Dir(pattern))
+		}
+
+		return true
+	}
+}
+
+// isInDir returns true if path is the directory dir or is within it.
+func isInDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -34,6 +34,54 @@ func SshKeyDir() string {
 	return fmt.Sprintf("%s/%s", ConfDir, "sshkeys")
 }
 
+// SshAgentDir is the directory holding the builds of the anvil-agent helper that are
+// uploaded to remote hosts.
+func SshAgentDir() string {
+	return fmt.Sprintf("%s/%s", ConfDir, "agents")
+}
+
+// SshKnownHostsFile is the file that holds the ssh host keys accepted in Anvil. It's in the
+// same format as the OpenSSH known_hosts file.
+func SshKnownHostsFile() string {
+	return fmt.Sprintf("%s/%s", ConfDir, "known_hosts")
+}
+
+// UserSshConfigFile is the OpenSSH client config file of the user.
+func UserSshConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// UserSshKnownHostsFile is the OpenSSH known_hosts file of the user.
+func UserSshKnownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+func ApiSocketFile() string {
+	return fmt.Sprintf("%s/%s", ConfDir, "api.sock")
+}
+
+func ApiTokenFile() string {
+	return fmt.Sprintf("%s/%s", ConfDir, "api.token")
+}
+
+// SyntaxGrammarDir is the directory containing user syntax grammars.
+func SyntaxGrammarDir() string {
+	return fmt.Sprintf("%s/%s", ConfDir, "syntax")
+}
+
+// SnippetDir is the directory containing the snippet files.
+func SnippetDir() string {
+	return fmt.Sprintf("%s/%s", ConfDir, "snippets")
+}
+
 func LoadSshKeys() {
 	d := SshKeyDir()
 	entries := mylog.Check2(os.ReadDir(d))
@@ -127,13 +175,17 @@ func PlumbingConfigFile() string {
 	return fmt.Sprintf("%s/%s", ConfDir, "plumbing")
 }
 
-func LoadPlumbingRulesFromFile(path string) (rules []PlumbingRule) {
-	stream.WriteTruncate(path, "") // todo
+func LoadPlumbingRulesFromFile(path string) (rules []PlumbingRule, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
 
-	f := mylog.Check2(os.Open(path))
-	rules = ParsePlumbingRules(f)
-	defer func() { mylog.Check(f.Close()) }()
-	mylog.CheckNil(rules)
+	rules, err = ParsePlumbingRules(f)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", path, err)
+	}
 	return
 }
 
@@ -150,13 +202,103 @@ type Settings struct {
 	Ssh         SshSettings
 	Typesetting TypesettingSettings
 	Layout      LayoutSettings
+	Syntax      SyntaxSettings
+	Indent      IndentSettings
+	Hooks       HookSettings
+	Jobs        JobSettings
+	Make        MakeSettings
+	Debug       DebugSettings
 }
 
 type SshSettings struct {
-	Shell      string
-	CloseStdin bool `toml:"close-stdin"`
-	CacheSize  int
-	Env        map[string]string
+	Shell             string
+	CloseStdin        bool `toml:"close-stdin"`
+	CacheSize         int
+	Env               map[string]string
+	HostKeyPolicy     string `toml:"host-key-policy"`
+	ConfigFile        string `toml:"config-file"`
+	RemoteAgent       bool   `toml:"remote-agent"`
+	KeepaliveInterval int    `toml:"keepalive-interval"`
+}
+
+type SyntaxSettings struct {
+	Filetypes map[string]string
+}
+
+// IndentSettings are how files are indented and formatted when they're saved. The settings for the
+// language of a file override the defaults, and are in turn overridden by .editorconfig files.
+type IndentSettings struct {
+	Default   IndentOptions
+	Languages map[string]IndentOptions
+}
+
+// IndentOptions are indentation settings. Options that are not set don't override others.
+type IndentOptions struct {
+	Style                  string `toml:"style"`
+	Size                   int    `toml:"size"`
+	TabWidth               int    `toml:"tab-width"`
+	EndOfLine              string `toml:"end-of-line"`
+	TrimTrailingWhitespace *bool  `toml:"trim-trailing-whitespace"`
+	InsertFinalNewline     *bool  `toml:"insert-final-newline"`
+}
+
+// HookSettings are commands that are run when certain things happen in the editor.
+type HookSettings struct {
+	Save []SaveHook `toml:"save"`
+}
+
+// SaveHook is commands that are run when a file that matches Pattern is saved. The commands are
+// run by the shell in the directory of the file.
+type SaveHook struct {
+	Pattern string `toml:"pattern"`
+	// Pre are commands that are given the text of the file on standard input before it is saved.
+	// The text is replaced with what they write to standard output.
+	Pre []string `toml:"pre"`
+	// Post are commands that are run after the file is saved.
+	Post []string `toml:"post"`
+}
+
+// MakeSettings configure the projects that Make builds.
+type MakeSettings struct {
+	Projects []MakeProject `toml:"projects"`
+}
+
+// MakeProject is how a project is built by Make. Projects can also be described by a .anvil-make.toml
+// file in the project's directory, in which case Dir is not given.
+type MakeProject struct {
+	// Dir is the directory the build is run in. It applies to the directories below it as well.
+	Dir string `toml:"dir"`
+	// Cmd is the shell command that builds or tests the project.
+	Cmd string `toml:"cmd"`
+	// OnSave builds the project when a file in it that matches Patterns is saved.
+	OnSave   bool     `toml:"on-save"`
+	Patterns []string `toml:"patterns"`
+}
+
+// DebugSettings configure the debug adapters that Debug starts, by language. The language of a file is its
+// extension. Directories are debugged using the adapter for go, which is Delve by default.
+type DebugSettings struct {
+	Adapters map[string]DebugAdapter `toml:"adapters"`
+}
+
+// DebugAdapter is how the debug adapter for a language is started and how it launches programs.
+type DebugAdapter struct {
+	// Cmd is the command that starts the adapter. If it contains {addr} the adapter is connected to over
+	// TCP at that address, which is a free local port. Otherwise it is spoken to on its standard input and output.
+	Cmd string `toml:"cmd"`
+	// Program is what is debugged: "dir" for the directory of the window, which is the default, or "file"
+	// for the window's file.
+	Program string `toml:"program"`
+	// Launch are arguments added to the launch request. They override the mode, program and cwd that are
+	// otherwise sent.
+	Launch map[string]interface{} `toml:"launch"`
+}
+
+// JobSettings control how external commands are run.
+type JobSettings struct {
+	// OutputWindows makes each command write its output to its own window named +Job<n>, where n is
+	// the number of the command in the command history, instead of the +Errors window of the directory.
+	OutputWindows bool `toml:"output-windows"`
 }
 
 type TypesettingSettings struct {
@@ -194,6 +336,73 @@ func GenerateSampleSettings() string {
 # The default is false
 #replace-cr-with-tofu=false
 
+[syntax]
+# Grammars for syntax highlighting languages that are not built in may be added by placing
+# them in the syntax directory in the Anvil config directory. They are chroma XML lexer
+# definitions, and are used instead of a built in language with the same name.
+#
+# The syntax.filetypes table maps file name patterns to the language used to highlight
+# the files that match. The patterns are matched against the file name without the
+# directory, and are checked before the patterns from the grammars.
+#[syntax.filetypes]
+#"*.tmpl"="html"
+#"Jenkinsfile"="groovy"
+
+[indent.default]
+# These settings control how text is indented and how files are changed when they are saved.
+# The settings in an indent.languages table apply to files of that language, using the language
+# names used for syntax highlighting, and override these defaults. Both are overridden by the
+# settings from .editorconfig files in the directory of a file or the directories above it.
+#
+# style is "tab" to indent using tabs or "space" to indent using spaces. The default is "tab"
+#style="tab"
+
+# size is the number of spaces in one level of indentation when indenting using spaces.
+# The default is 4
+#size=4
+
+# tab-width is the number of columns between tab stops. The default is to use the
+# TabStopInterval from the style
+#tab-width=8
+
+# end-of-line is "lf", "crlf" or "cr" to convert the line endings to that when a file is saved.
+# The default is to leave them unchanged
+#end-of-line="lf"
+
+# trim-trailing-whitespace removes spaces and tabs from the ends of lines when a file is saved.
+# The default is false
+#trim-trailing-whitespace=false
+
+# insert-final-newline adds a newline to the end of a file that doesn't end in one when it is saved.
+# The default is false
+#insert-final-newline=false
+
+#[indent.languages.python]
+#style="space"
+#size=4
+
+#[indent.languages.yaml]
+#style="space"
+#size=2
+
+# Save hooks are commands that are run when a file is saved using Put. Each [[hooks.save]]
+# table applies to the files whose name matches its pattern. The pattern is matched
+# against the file name without the directory, unless it contains a slash, in which case
+# it is matched against the whole path. The commands are run by the shell in the
+# directory of the file, on the remote host for remote files.
+#
+# pre commands are run before the file is saved, one after the other. Each is given the
+# text of the file on standard input, and the text is replaced with what it writes to
+# standard output, or left unchanged if it writes nothing. If a pre command fails the file
+# is not saved and its error output is shown in +Errors. The replacement can be undone as
+# a single change.
+#
+# post commands are run after the file is saved. Their output is shown in +Errors.
+#[[hooks.save]]
+#pattern="*.go"
+#pre=["goimports"]
+#post=["go vet ."]
+
 [ssh]
 # shell specifies the shell to use when commands are executed on a remote system.
 # The default is "sh"
@@ -209,6 +418,39 @@ func GenerateSampleSettings() string {
 # combination requires a different connection
 #cachesize=5
 
+# host-key-policy controls how the keys presented by ssh servers are verified. Keys are
+# looked up in ~/.ssh/known_hosts and in the known_hosts file in the Anvil config directory.
+# A key that differs from the known key for a host is always rejected. The policy decides
+# what happens when a host has no known key:
+#   ask         reject the connection and print the key to +Errors so that it can be
+#               trusted using the Acceptkey command
+#   accept-new  trust the key and record it in the Anvil known_hosts file
+#   strict      reject the connection
+#   insecure    don't verify host keys at all
+# The default is "ask"
+#host-key-policy="ask"
+
+# config-file is the OpenSSH client config file used to resolve host aliases in remote paths.
+# HostName, User, Port, IdentityFile and ProxyJump are used from it, so a host behind a chain
+# of bastions may be opened using just its alias. Set it to "none" to not read a config file.
+# The default is "~/.ssh/config"
+#config-file="~/.ssh/config"
+
+# remote-agent makes Anvil upload a small helper program to remote hosts and use it to read,
+# write and list files and to run commands, instead of building shell command lines. This
+# avoids depending on the quoting rules of the remote shell. The helper is taken from the
+# agents directory in the Anvil config directory, where it must be named
+# anvil-agent-<os>-<arch>, for example anvil-agent-linux-amd64. The helper is only used on
+# Unix hosts: it's installed using a POSIX shell, and builds are only made for Unix platforms.
+# If no helper is available for the remote host, such as for Windows hosts, the shell is used.
+# The default is false
+#remote-agent=false
+
+# keepalive-interval is how often, in seconds, the cached ssh connections are checked. Lost
+# connections are re-opened along with their port forwards. 0 disables the checks.
+# The default is 30
+#keepalive-interval=30
+
 # The ssh.env table lists environment variables to be exported when running remote
 # commands.
 #[ssh.env]
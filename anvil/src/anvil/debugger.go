@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jeffwilliams/anvil/internal/dap"
+	"github.com/jeffwilliams/anvil/internal/runes"
+)
+
+const (
+	// debugWindowName is the name of the window that shows the output of the program being debugged in a
+	// directory, and has the commands that control it in its tag.
+	debugWindowName     = "+Debug"
+	stackWindowName     = "+Stack"
+	variablesWindowName = "+Variables"
+
+	debugWindowTag = "◊Debug continue◊ ◊Debug next◊ ◊Debug step◊ ◊Debug out◊ ◊Debug pause◊ ◊Debug stop◊ ◊Debug stack◊ ◊Debug vars◊"
+)
+
+// defaultDebugAdapters are used for the languages that have no adapter in the settings.
+var defaultDebugAdapters = map[string]DebugAdapter{
+	"go": {Cmd: "dlv dap --listen={addr}"},
+}
+
+// debugStepCommands are the requests sent for the Debug commands that control a stopped program.
+var debugStepCommands = map[string]string{
+	"continue": "continue",
+	"next":     "next",
+	"step":     "stepIn",
+	"out":      "stepOut",
+	"pause":    "pause",
+}
+
+// Breakpoints are the lines of files that the debugger stops at. Like line marks they are kept as
+// sorted rune indices in the lines, so that they move with the text as it is edited.
+type Breakpoints struct {
+	lines Marks
+}
+
+func (b *Breakpoints) Toggle(file string, lineStart, lineEnd int) {
+	b.lines.ToggleLine(file, lineStart, lineEnd)
+}
+
+// Lines returns rune indices in the lines of the file with breakpoints.
+func (b *Breakpoints) Lines(file string) []int {
+	return b.lines.Lines(file)
+}
+
+func (b *Breakpoints) Clear(file string) {
+	b.lines.ClearLines(file)
+}
+
+// Files returns the files that have breakpoints, sorted.
+func (b *Breakpoints) Files() (files []string) {
+	for f := range b.lines.lines {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return
+}
+
+func (b *Breakpoints) ShiftDueToTextModification(file string, startOfChange, lengthOfChange int) {
+	b.lines.ShiftDueToTextModification(file, startOfChange, lengthOfChange)
+}
+
+func (b *Breakpoints) State() map[string][]int {
+	return b.lines.State().Lines
+}
+
+func (b *Breakpoints) SetState(state map[string][]int) {
+	b.lines.SetState(MarkState{Lines: state})
+}
+
+// Debugger debugs programs using a debug adapter. There is at most one debug session at a time. It is
+// only accessed from the main goroutine.
+type Debugger struct {
+	Breakpoints Breakpoints
+	session     *debugSession
+}
+
+type debugSession struct {
+	dir     string
+	client  *dap.Client
+	adapter *exec.Cmd
+	// started is true once the program has been launched and the breakpoints set
+	started  bool
+	ended    bool
+	threadId int
+	// frames are the stack frames of the thread when it last stopped, innermost first
+	frames []dap.StackFrame
+	// stop is where the program is stopped, or nil while it runs
+	stop *debugLocation
+}
+
+type debugLocation struct {
+	file string
+	line int
+	// pos is the rune index of the start of the line in the text of the file's window, or -1 if it is not
+	// known yet
+	pos int
+}
+
+// debugScope is the variables of a scope of a stack frame.
+type debugScope struct {
+	name string
+	vars []dap.Variable
+}
+
+// Start starts debugging the program in dir, or the file if the adapter for its language debugs files,
+// using the debug adapter for the language. The mode is the Delve mode: debug or test. args are passed
+// to the program.
+func (d *Debugger) Start(dir, file, mode string, args []string) {
+	if d.session != nil {
+		editor.AppendError(dir, fmt.Sprintf("Already debugging in %s. Use Debug stop to end it.", d.session.dir))
+		return
+	}
+
+	gdir, err := NewGlobalPath(dir, GlobalPathIsDir)
+	if err != nil {
+		editor.AppendError(dir, err.Error())
+		return
+	}
+	if gdir.IsRemote() {
+		editor.AppendError(dir, "Debug only works on local directories")
+		return
+	}
+
+	lang := debugLanguage(file)
+	adapter, ok := debugAdapterFor(lang)
+	if !ok {
+		editor.AppendError(dir, fmt.Sprintf("No debug adapter is configured for %s files", lang))
+		return
+	}
+
+	s := &debugSession{dir: dir, threadId: 1}
+	d.session = s
+	bps := d.breakpointLines()
+	launchArgs := debugLaunchArguments(adapter, mode, gdir.Path(), file, args)
+	d.appendOutput(s, fmt.Sprintf("Starting %s\n", adapter.Cmd))
+
+	go func() {
+		conn, cmd, err := startDebugAdapter(adapter.Cmd, gdir.Path(), debugOutputWriter{s})
+		if err != nil {
+			d.reportAndEnd(s, fmt.Sprintf("Starting the debug adapter failed: %v", err))
+			return
+		}
+
+		client := dap.NewClient(conn, func(ev *dap.Message) {
+			editor.WorkChan() <- basicWork{func() {
+				d.handleEvent(s, ev)
+			}}
+		})
+
+		editor.WorkChan() <- basicWork{func() {
+			s.client, s.adapter = client, cmd
+			if s.ended {
+				d.closeSession(s)
+			}
+		}}
+
+		go func() {
+			<-client.Done()
+			editor.WorkChan() <- basicWork{func() {
+				d.end(s)
+			}}
+		}()
+
+		set, err := client.Start(lang, launchArgs, bps)
+		if err != nil {
+			d.reportAndEnd(s, fmt.Sprintf("Launching the program failed: %v", err))
+			return
+		}
+
+		editor.WorkChan() <- basicWork{func() {
+			s.started = true
+			d.reportUnverifiedBreakpoints(s, set)
+		}}
+	}()
+}
+
+// handleEvent handles an event sent by the adapter of the session.
+func (d *Debugger) handleEvent(s *debugSession, ev *dap.Message) {
+	if s.ended {
+		return
+	}
+
+	switch ev.Event {
+	case "output":
+		var body dap.OutputEventBody
+		if ev.DecodeBody(&body) == nil && body.Category != "telemetry" {
+			d.appendOutput(s, body.Output)
+		}
+	case "stopped":
+		var body dap.StoppedEventBody
+		ev.DecodeBody(&body)
+		if body.ThreadId != 0 {
+			s.threadId = body.ThreadId
+		}
+		d.loadStack(s, body.Reason)
+	case "continued":
+		d.setRunning(s)
+	case "exited":
+		var body dap.ExitedEventBody
+		ev.DecodeBody(&body)
+		d.appendOutput(s, fmt.Sprintf("Program exited with code %d\n", body.ExitCode))
+	case "terminated":
+		d.end(s)
+	}
+}
+
+// loadStack gets the stack of the stopped thread, moves to where it stopped and refreshes the Stack and
+// Variables windows.
+func (d *Debugger) loadStack(s *debugSession, reason string) {
+	client, threadId := s.client, s.threadId
+	go func() {
+		frames, err := client.StackTrace(threadId)
+		editor.WorkChan() <- basicWork{func() {
+			if s.ended {
+				return
+			}
+			if err != nil {
+				d.appendOutput(s, fmt.Sprintf("Getting the stack failed: %v\n", err))
+				return
+			}
+			s.frames = frames
+			d.setStopped(s, reason)
+		}}
+	}()
+}
+
+func (d *Debugger) setStopped(s *debugSession, reason string) {
+	s.stop = nil
+	for _, f := range s.frames {
+		if f.Source != nil && f.Source.Path != "" {
+			s.stop = &debugLocation{file: f.Source.Path, line: f.Line, pos: -1}
+			d.appendOutput(s, fmt.Sprintf("Stopped (%s) in %s at %s:%d\n", reason, f.Name, f.Source.Path, f.Line))
+			break
+		}
+	}
+
+	if s.stop != nil {
+		w := editor.LoadFileOpts(s.stop.file, LoadFileOpts{
+			GoTo:              seek{seekType: seekToLineAndCol, line: s.stop.line},
+			SelectBehaviour:   dontSelectText,
+			GrowBodyBehaviour: dontGrowBodyIfTooSmall,
+		})
+		if w != nil {
+			w.Body.invalidateLayedoutText()
+		}
+	}
+
+	if editor.FindWindowForFile(s.dir+stackWindowName) != nil {
+		d.showStack(s)
+	}
+	if editor.FindWindowForFile(s.dir+variablesWindowName) != nil {
+		d.loadVariables(s, 0, false)
+	}
+}
+
+func (d *Debugger) setRunning(s *debugSession) {
+	if s.stop != nil {
+		if w := editor.FindWindowForFile(s.stop.file); w != nil {
+			w.Body.invalidateLayedoutText()
+		}
+	}
+	s.stop = nil
+	s.frames = nil
+}
+
+// Step sends the request for one of the debugStepCommands.
+func (d *Debugger) Step(dir, cmd string) {
+	s, ok := d.activeSession(dir)
+	if !ok {
+		return
+	}
+
+	req := debugStepCommands[cmd]
+	if req != "pause" {
+		// Not all adapters send a continued event when the program continues because of a request
+		d.setRunning(s)
+	}
+
+	client, threadId := s.client, s.threadId
+	go func() {
+		err := client.Request(req, dap.ThreadArguments{ThreadId: threadId}, nil)
+		if err != nil {
+			editor.WorkChan() <- basicWork{func() {
+				d.appendOutput(s, fmt.Sprintf("Debug %s: %v\n", cmd, err))
+			}}
+		}
+	}()
+}
+
+// Stop ends the debug session and the program being debugged.
+func (d *Debugger) Stop(dir string) {
+	s := d.session
+	if s == nil {
+		editor.AppendError(dir, "Not debugging")
+		return
+	}
+
+	if s.client == nil {
+		d.end(s)
+		return
+	}
+
+	client := s.client
+	go func() {
+		done := make(chan struct{})
+		go func() {
+			client.Disconnect(true)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		editor.WorkChan() <- basicWork{func() {
+			d.end(s)
+		}}
+	}()
+}
+
+func (d *Debugger) reportAndEnd(s *debugSession, msg string) {
+	editor.WorkChan() <- basicWork{func() {
+		d.appendOutput(s, msg+"\n")
+		d.end(s)
+	}}
+}
+
+// end ends the session if it hasn't already ended.
+func (d *Debugger) end(s *debugSession) {
+	if s.ended {
+		return
+	}
+	d.setRunning(s)
+	s.ended = true
+	if d.session == s {
+		d.session = nil
+	}
+	d.closeSession(s)
+	d.appendOutput(s, "Debugging ended\n")
+}
+
+func (d *Debugger) closeSession(s *debugSession) {
+	if s.client != nil {
+		s.client.Close()
+	}
+	if s.adapter != nil && s.adapter.Process != nil {
+		s.adapter.Process.Kill()
+	}
+}
+
+func (d *Debugger) activeSession(dir string) (s *debugSession, ok bool) {
+	s = d.session
+	switch {
+	case s == nil:
+		editor.AppendError(dir, "Not debugging. Use Debug or Debug test to start.")
+		return nil, false
+	case !s.started:
+		editor.AppendError(dir, "The program is still starting")
+		return nil, false
+	}
+	return s, true
+}
+
+// ToggleBreakpoint adds or removes a breakpoint on the line of the window that the cursor is on.
+func (d *Debugger) ToggleBreakpoint(w *Window) {
+	if w.file == "" {
+		return
+	}
+
+	body := &w.Body.editable
+	walker := runes.NewWalker(body.Bytes())
+	walker.SetRunePosCache(body.firstCursorIndex(), &body.runeOffsetCache)
+	lineStart, lineEnd := walker.CurrentLineBounds()
+	d.Breakpoints.Toggle(w.file, lineStart, lineEnd)
+	w.Body.invalidateLayedoutText()
+	d.updateBreakpoints(w.file)
+}
+
+// ClearBreakpoints removes the breakpoints of the file.
+func (d *Debugger) ClearBreakpoints(w *Window) {
+	d.Breakpoints.Clear(w.file)
+	w.Body.invalidateLayedoutText()
+	d.updateBreakpoints(w.file)
+}
+
+// updateBreakpoints sets the breakpoints of the file in the running session, if there is one.
+func (d *Debugger) updateBreakpoints(file string) {
+	s := d.session
+	if s == nil || !s.started {
+		return
+	}
+
+	lines := d.breakpointLinesOf(file)
+	client := s.client
+	go func() {
+		set, err := client.SetBreakpoints(file, lines)
+		editor.WorkChan() <- basicWork{func() {
+			if err != nil {
+				d.appendOutput(s, fmt.Sprintf("Setting breakpoints failed: %v\n", err))
+				return
+			}
+			d.reportUnverifiedBreakpoints(s, map[string][]dap.Breakpoint{file: set})
+		}}
+	}()
+}
+
+func (d *Debugger) reportUnverifiedBreakpoints(s *debugSession, set map[string][]dap.Breakpoint) {
+	for file, bps := range set {
+		for _, b := range bps {
+			if !b.Verified {
+				d.appendOutput(s, fmt.Sprintf("Breakpoint at %s:%d was not set: %s\n", file, b.Line, b.Message))
+			}
+		}
+	}
+}
+
+// breakpointLines returns the numbers of the lines with breakpoints by file, for the local files that have any.
+func (d *Debugger) breakpointLines() map[string][]int {
+	m := map[string][]int{}
+	for _, f := range d.Breakpoints.Files() {
+		if lines := d.breakpointLinesOf(f); len(lines) > 0 {
+			m[f] = lines
+		}
+	}
+	return m
+}
+
+// breakpointLinesOf returns the numbers of the lines with breakpoints in the file, using the text in its
+// window if it has one.
+func (d *Debugger) breakpointLinesOf(file string) []int {
+	indices := d.Breakpoints.Lines(file)
+	if len(indices) == 0 {
+		return nil
+	}
+
+	if w := editor.FindWindowForFile(file); w != nil {
+		return lineNumbersOfIndices(w.Body.Bytes(), indices)
+	}
+
+	if gpath, err := NewGlobalPath(file, GlobalPathIsFile); err != nil || gpath.IsRemote() {
+		return nil
+	}
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	return lineNumbersOfIndices(text, indices)
+}
+
+// stoppedLineIn returns the rune index of the start of the line the program is stopped at, if it is
+// stopped in the window's file.
+func (d *Debugger) stoppedLineIn(w *Window) (index int, ok bool) {
+	s := d.session
+	if s == nil || s.stop == nil || s.stop.file != w.file {
+		return
+	}
+
+	if s.stop.pos < 0 {
+		if w.Body.Len() == 0 {
+			// The file is still loading
+			return
+		}
+		s.stop.pos, ok = lineStartIndex(w.Body.Bytes(), s.stop.line)
+		if !ok {
+			return
+		}
+	}
+	return s.stop.pos, true
+}
+
+func (d *Debugger) ShiftDueToTextModification(file string, startOfChange, lengthOfChange int) {
+	d.Breakpoints.ShiftDueToTextModification(file, startOfChange, lengthOfChange)
+
+	if s := d.session; s != nil && s.stop != nil && s.stop.file == file && s.stop.pos >= 0 {
+		s.stop.pos = shiftIndexDueToTextModification(s.stop.pos, startOfChange, lengthOfChange)
+	}
+}
+
+// ShowStack shows the stack of the stopped thread in the Stack window.
+func (d *Debugger) ShowStack(dir string) {
+	s, ok := d.activeSession(dir)
+	if !ok {
+		return
+	}
+	d.showStack(s)
+}
+
+func (d *Debugger) showStack(s *debugSession) {
+	text := "Running\n"
+	if s.stop != nil {
+		text = formatStack(s.frames)
+	}
+	d.showInWindow(s.dir+stackWindowName, text)
+}
+
+// ShowVariables shows the variables of a frame of the stack of the stopped thread in the Variables window.
+// Frame 0 is the innermost.
+func (d *Debugger) ShowVariables(dir string, frame int) {
+	s, ok := d.activeSession(dir)
+	if !ok {
+		return
+	}
+	d.loadVariables(s, frame, true)
+}
+
+func (d *Debugger) loadVariables(s *debugSession, frame int, report bool) {
+	if s.stop == nil {
+		if report {
+			d.showInWindow(s.dir+variablesWindowName, "Running\n")
+		}
+		return
+	}
+	if frame < 0 || frame >= len(s.frames) {
+		if report {
+			editor.AppendError(s.dir, fmt.Sprintf("There is no frame %d in the stack", frame))
+		}
+		return
+	}
+
+	client, f := s.client, s.frames[frame]
+	go func() {
+		scopes, err := loadDebugScopes(client, f.Id)
+		editor.WorkChan() <- basicWork{func() {
+			if s.ended {
+				return
+			}
+			if err != nil {
+				d.appendOutput(s, fmt.Sprintf("Getting the variables failed: %v\n", err))
+				return
+			}
+			d.showInWindow(s.dir+variablesWindowName, fmt.Sprintf("%s\n%s", f.Name, formatVariables(scopes)))
+		}}
+	}()
+}
+
+func loadDebugScopes(client *dap.Client, frameId int) (scopes []debugScope, err error) {
+	sc, err := client.Scopes(frameId)
+	if err != nil {
+		return
+	}
+	for _, s := range sc {
+		if s.Expensive {
+			continue
+		}
+		var vars []dap.Variable
+		vars, err = client.Variables(s.VariablesReference)
+		if err != nil {
+			return
+		}
+		scopes = append(scopes, debugScope{name: s.Name, vars: vars})
+	}
+	return
+}
+
+// showInWindow replaces the text of the window named name, creating it if needed.
+func (d *Debugger) showInWindow(name, text string) {
+	w := editor.FindOrCreateWindow(name)
+	if w == nil {
+		return
+	}
+	w.SetFilenameAndTag(name, typeFile)
+	w.Body.SetTextString(text)
+	w.markTextAsUnchanged()
+	w.GrowIfBodyTooSmall()
+}
+
+// appendOutput appends the text to the Debug window of the session, creating it if needed.
+func (d *Debugger) appendOutput(s *debugSession, text string) {
+	if text == "" {
+		return
+	}
+
+	name := s.dir + debugWindowName
+	w := editor.FindWindowForFile(name)
+	if w == nil {
+		w = editor.FindOrCreateWindow(name)
+		if w == nil {
+			return
+		}
+		w.SetFilenameAndTag(name, typeFile)
+		appendToWindowTag(w, debugWindowTag)
+	}
+	w.Append([]byte(text))
+	w.markTextAsUnchanged()
+	w.GrowIfBodyTooSmall()
+}
+
+// debugOutputWriter writes the output of a debug adapter to the Debug window of its session.
+type debugOutputWriter struct {
+	s *debugSession
+}
+
+func (o debugOutputWriter) Write(b []byte) (int, error) {
+	text := string(b)
+	editor.WorkChan() <- basicWork{func() {
+		editor.Debugger.appendOutput(o.s, text)
+	}}
+	return len(b), nil
+}
+
+// debugLanguage returns the language of the file, which is its extension, for choosing a debug adapter.
+// Directories are debugged as Go packages.
+func debugLanguage(file string) string {
+	ext := strings.TrimPrefix(filepath.Ext(file), ".")
+	if ext == "" || strings.HasPrefix(filepath.Base(file), "+") {
+		return "go"
+	}
+	return ext
+}
+
+func debugAdapterFor(lang string) (a DebugAdapter, ok bool) {
+	if a, ok = settings.Debug.Adapters[lang]; ok {
+		return
+	}
+	a, ok = defaultDebugAdapters[lang]
+	return
+}
+
+// debugLaunchArguments returns the arguments of the launch request. The arguments in the adapter's
+// settings override the others.
+func debugLaunchArguments(a DebugAdapter, mode, dir, file string, args []string) map[string]interface{} {
+	program := dir
+	if a.Program == "file" {
+		program = file
+	}
+
+	m := map[string]interface{}{
+		"mode":    mode,
+		"program": program,
+		"cwd":     dir,
+	}
+	if len(args) > 0 {
+		m["args"] = args
+	}
+	for k, v := range a.Launch {
+		m[k] = v
+	}
+	return m
+}
+
+// startDebugAdapter runs the debug adapter command in dir and connects to it. If the command contains
+// {addr} it is replaced with a free local address that the adapter is connected to over TCP, and the
+// output of the adapter is written to output. Otherwise the adapter is spoken to over its standard input
+// and output, and only its standard error is written to output.
+func startDebugAdapter(cmdline, dir string, output io.Writer) (conn io.ReadWriteCloser, cmd *exec.Cmd, err error) {
+	addr := ""
+	if strings.Contains(cmdline, "{addr}") {
+		addr, err = freeLocalAddr()
+		if err != nil {
+			return
+		}
+		cmdline = strings.ReplaceAll(cmdline, "{addr}", addr)
+	}
+
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		err = fmt.Errorf("the debug adapter command is empty")
+		return
+	}
+
+	cmd = exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stderr = output
+
+	if addr != "" {
+		cmd.Stdout = output
+		if err = cmd.Start(); err != nil {
+			return
+		}
+		conn, err = dialDebugAdapter(addr, 10*time.Second)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return
+		}
+	} else {
+		var stdin io.WriteCloser
+		var stdout io.ReadCloser
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return
+		}
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return
+		}
+		if err = cmd.Start(); err != nil {
+			return
+		}
+		conn = stdioConn{stdout, stdin}
+	}
+
+	go func() {
+		cmd.Wait()
+		conn.Close()
+	}()
+	return
+}
+
+func freeLocalAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// dialDebugAdapter connects to the adapter at addr, waiting for it to start listening.
+func dialDebugAdapter(addr string, timeout time.Duration) (conn net.Conn, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err = net.DialTimeout("tcp", addr, time.Second)
+		if err == nil || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stdioConn is a connection to a process over its standard output and input.
+type stdioConn struct {
+	io.ReadCloser
+	w io.WriteCloser
+}
+
+func (c stdioConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c stdioConn) Close() error {
+	c.w.Close()
+	return c.ReadCloser.Close()
+}
+
+// lineNumbersOfIndices returns the numbers, starting at 1, of the lines of the text that the sorted rune
+// indices are on. Indices past the end are on the last line. Each line is returned once.
+func lineNumbersOfIndices(text []byte, indices []int) (lines []int) {
+	add := func(line int) {
+		if len(lines) == 0 || lines[len(lines)-1] != line {
+			lines = append(lines, line)
+		}
+	}
+
+	line, pos, j := 1, 0, 0
+	for _, r := range string(text) {
+		for ; j < len(indices) && indices[j] <= pos; j++ {
+			add(line)
+		}
+		if r == '\n' {
+			line++
+		}
+		pos++
+	}
+	for ; j < len(indices); j++ {
+		add(line)
+	}
+	return
+}
+
+// lineStartIndex returns the rune index of the start of the line of the text, numbered from 1.
+func lineStartIndex(text []byte, line int) (index int, ok bool) {
+	if line < 1 {
+		return
+	}
+	if line == 1 {
+		return 0, true
+	}
+
+	n := 1
+	for _, r := range string(text) {
+		index++
+		if r == '\n' {
+			n++
+			if n == line {
+				return index, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// formatStack formats the frames as a table, innermost first, with the location of each frame in a form
+// that can be opened.
+func formatStack(frames []dap.StackFrame) string {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for i, f := range frames {
+		loc := ""
+		if f.Source != nil && f.Source.Path != "" {
+			loc = f.Source.Path + ":" + strconv.Itoa(f.Line)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", i, f.Name, loc)
+	}
+	tw.Flush()
+	return buf.String()
+}
+
+// formatVariables formats the variables of each scope, one per line.
+func formatVariables(scopes []debugScope) string {
+	var buf bytes.Buffer
+	for _, s := range scopes {
+		fmt.Fprintf(&buf, "%s:\n", s.name)
+		tw := tabwriter.NewWriter(&buf, 0, 8, 1, ' ', 0)
+		for _, v := range s.vars {
+			fmt.Fprintf(tw, "  %s\t%s\t= %s\n", v.Name, v.Type, v.Value)
+		}
+		tw.Flush()
+	}
+	return buf.String()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jeffwilliams/anvil/internal/dap"
+)
+
+func TestLineNumbersOfIndices(t *testing.T) {
+	text := []byte("package main\n\nfunc main() {\n\tprintln(\"é\")\n}\n")
+
+	tests := []struct {
+		name     string
+		indices  []int
+		expected []int
+	}{
+		{name: "none", indices: nil, expected: nil},
+		{name: "first line", indices: []int{0}, expected: []int{1}},
+		{name: "line starts", indices: []int{13, 14, 28}, expected: []int{2, 3, 4}},
+		{name: "middle of a line", indices: []int{20}, expected: []int{3}},
+		{name: "after a multibyte rune", indices: []int{43}, expected: []int{5}},
+		{name: "same line once", indices: []int{14, 15}, expected: []int{3}},
+		{name: "past the end", indices: []int{1000}, expected: []int{6}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := lineNumbersOfIndices(text, tc.indices)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected %v but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLineStartIndex(t *testing.T) {
+	text := []byte("ab\né\n\nx")
+
+	tests := []struct {
+		line     int
+		expected int
+		ok       bool
+	}{
+		{line: 0, ok: false},
+		{line: 1, expected: 0, ok: true},
+		{line: 2, expected: 3, ok: true},
+		{line: 3, expected: 5, ok: true},
+		{line: 4, expected: 6, ok: true},
+		{line: 5, ok: false},
+	}
+
+	for _, tc := range tests {
+		got, ok := lineStartIndex(text, tc.line)
+		if ok != tc.ok || got != tc.expected {
+			t.Fatalf("line %d: expected %d, %v but got %d, %v", tc.line, tc.expected, tc.ok, got, ok)
+		}
+	}
+
+	// lineNumbersOfIndices is the inverse
+	for line := 1; line <= 4; line++ {
+		i, _ := lineStartIndex(text, line)
+		if got := lineNumbersOfIndices(text, []int{i}); !reflect.DeepEqual(got, []int{line}) {
+			t.Fatalf("line %d starts at %d, which is on lines %v", line, i, got)
+		}
+	}
+}
+
+func TestBreakpointsShiftDueToTextModification(t *testing.T) {
+	var b Breakpoints
+	b.Toggle("a.go", 20, 29)
+	b.Toggle("a.go", 5, 9)
+	b.Toggle("b.go", 5, 9)
+
+	b.ShiftDueToTextModification("a.go", 10, 3)
+	if got := b.Lines("a.go"); !reflect.DeepEqual(got, []int{5, 23}) {
+		t.Fatalf("unexpected breakpoints after insert: %v", got)
+	}
+	if got := b.Lines("b.go"); !reflect.DeepEqual(got, []int{5}) {
+		t.Fatalf("breakpoints in another file moved: %v", got)
+	}
+
+	b.Toggle("a.go", 5, 9)
+	if got := b.Lines("a.go"); !reflect.DeepEqual(got, []int{23}) {
+		t.Fatalf("unexpected breakpoints after toggle: %v", got)
+	}
+
+	b.Clear("b.go")
+	if got := b.Files(); !reflect.DeepEqual(got, []string{"a.go"}) {
+		t.Fatalf("unexpected files: %v", got)
+	}
+}
+
+func TestDebugLaunchArguments(t *testing.T) {
+	a := DebugAdapter{Cmd: "dlv dap --listen={addr}"}
+	got := debugLaunchArguments(a, "test", "/src/x", "/src/x/x_test.go", []string{"-test.run", "TestA"})
+	expected := map[string]interface{}{
+		"mode":    "test",
+		"program": "/src/x",
+		"cwd":     "/src/x",
+		"args":    []string{"-test.run", "TestA"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v but got %v", expected, got)
+	}
+
+	a = DebugAdapter{Cmd: "python3 -m debugpy.adapter", Program: "file", Launch: map[string]interface{}{"type": "python", "mode": nil}}
+	got = debugLaunchArguments(a, "debug", "/src/y", "/src/y/main.py", nil)
+	expected = map[string]interface{}{
+		"mode":    nil,
+		"program": "/src/y/main.py",
+		"cwd":     "/src/y",
+		"type":    "python",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v but got %v", expected, got)
+	}
+}
+
+func TestDebugLanguage(t *testing.T) {
+	tests := map[string]string{
+		"/src/x/main.go":  "go",
+		"/src/y/main.py":  "py",
+		"/src/x/":         "go",
+		"/src/x/+Debug":   "go",
+		"/src/x/Makefile": "go",
+		"":                "go",
+	}
+	for file, expected := range tests {
+		if got := debugLanguage(file); got != expected {
+			t.Fatalf("%s: expected %s but got %s", file, expected, got)
+		}
+	}
+}
+
+func TestFormatStack(t *testing.T) {
+	frames := []dap.StackFrame{
+		{Id: 1, Name: "main.f", Source: &dap.Source{Path: "/src/x/main.go"}, Line: 12},
+		{Id: 2, Name: "main.main", Source: &dap.Source{Path: "/src/x/main.go"}, Line: 4},
+		{Id: 3, Name: "runtime.goexit"},
+	}
+	expected := "" +
+		"0  main.f          /src/x/main.go:12\n" +
+		"1  main.main       /src/x/main.go:4\n" +
+		"2  runtime.goexit  \n"
+	if got := formatStack(frames); got != expected {
+		t.Fatalf("expected\n%q\nbut got\n%q", expected, got)
+	}
+}
+
+func TestFormatVariables(t *testing.T) {
+	scopes := []debugScope{
+		{name: "Arguments", vars: []dap.Variable{{Name: "n", Type: "int", Value: "3"}}},
+		{name: "Locals", vars: []dap.Variable{
+			{Name: "s", Type: "string", Value: `"hi"`},
+			{Name: "total", Type: "float64", Value: "1.5"},
+		}},
+	}
+	expected := "" +
+		"Arguments:\n" +
+		"  n int = 3\n" +
+		"Locals:\n" +
+		"  s     string  = \"hi\"\n" +
+		"  total float64 = 1.5\n"
+	if got := formatVariables(scopes); got != expected {
+		t.Fatalf("expected\n%q\nbut got\n%q", expected, got)
+	}
+}
@@ -6,13 +6,12 @@ import (
 	"image"
 	"image/color"
 	"math"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 	"unicode/utf8"
 
-	"golang.org/x/image/math/fixed"
-
 	"gioui.org/f32"
 	"gioui.org/io/clipboard"
 	"gioui.org/io/event"
@@ -74,6 +73,17 @@ type editable struct {
 	adapter                adapter
 	syntaxHighlightDelay   time.Duration
 	draggingTertiaryButton bool
+	// blockSelectionBeingBuilt is set while a block selection is being built by dragging
+	blockSelectionBeingBuilt *blockSelection
+	wrap                     wrapSettings
+	indent                   indentation
+	// xScroll is how far in pixels the text is scrolled to the left when lines are not wrapped
+	xScroll int
+	// snippetsEnabled is true if snippets may be expanded using Tab
+	snippetsEnabled bool
+	// inputHook, if set, is given the key, text and clipboard events before they are handled. Events
+	// that it returns true for are not handled by the editable.
+	inputHook func(ev event.Event) bool
 }
 
 type editableStyle struct {
@@ -88,6 +98,9 @@ type editableStyle struct {
 
 	TabStopInterval int
 	TextLeftPadding int
+	MarkColor       Color
+	BreakpointColor Color
+	DebugLineColor  Color
 }
 
 type deferredPointerEvent struct {
@@ -109,6 +122,11 @@ func (e *editable) Init(style editableStyle) {
 	e.syntaxHighlightDelay = 1 * time.Millisecond
 	e.CursorIndices = []int{0}
 	e.wordCompletion = NewCompletion(e)
+	e.wordCompletion.onAccept = func(word string) {
+		if e.completer != nil {
+			e.completer.Accepted(word)
+		}
+	}
 	e.fileCompletion = NewCompletion(e)
 }
 
@@ -186,6 +204,10 @@ func (e *editable) KeyRelease(gtx layout.Context, ev *key.Event) {
 func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 	log(LogCatgEd, "%s: keypress: %#v\n", e.label, ev)
 
+	if e.completionPopupKey(ev) {
+		return
+	}
+
 	resetWordCompletions := true
 	resetFileCompletions := true
 
@@ -211,14 +233,7 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 		if len(e.CursorIndices) == 1 && !ev.Modifiers.Contain(key.ModShift) {
 			// Autoindenting with multiple cursors is tricky since InsertText applies the change
 			// for multiple cursors
-			w := runes.NewWalker(e.Bytes())
-			w.SetRunePosCache(e.firstCursorIndex(), &e.runeOffsetCache)
-			w.BackwardToStartOfLine()
-			space := w.CurrentRunOfSpaces()
-			e.InsertText("\n")
-			if space != "" {
-				e.InsertText(space)
-			}
+			e.insertNewlineAndIndent()
 		} else {
 			e.InsertText("\n")
 		}
@@ -240,14 +255,27 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 		if len(e.CursorIndices) > 1 {
 			e.SetSaveDeletes(false)
 		}
+		// Find what to delete before deleting anything, so the text only needs to be fetched once.
+		// Deleting at one cursor shifts the later cursors but doesn't change the graphemes before them.
+		text := e.Bytes()
+		lens := make([]int, len(e.CursorIndices))
 		for i, ndx := range e.CursorIndices {
 			if ndx > 0 {
-				e.CursorIndices[i]--
-				e.deleteFromPieceTable(e.CursorIndices[i], 1)
-				log(LogCatgEd, "Delete at %d of length %d\n", e.CursorIndices[i], 1)
+				lens[i] = ndx - e.graphemeBefore(text, ndx)
+			}
+		}
+		for i, n := range lens {
+			if n > 0 {
+				e.CursorIndices[i] -= n
+				e.deleteFromPieceTable(e.CursorIndices[i], n)
+				log(LogCatgEd, "Delete at %d of length %d\n", e.CursorIndices[i], n)
 			}
 		}
 		e.SetSaveDeletes(true)
+		if e.wordCompletion.isCompletionInProgress() {
+			resetWordCompletions = false
+			e.refineWordCompletion()
+		}
 	case "⌦":
 		// Delete
 		if e.SelectionsPresent() {
@@ -256,16 +284,35 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 			break
 		}
 
-		for _, ndx := range e.CursorIndices {
+		text := e.Bytes()
+		lens := make([]int, len(e.CursorIndices))
+		for i, ndx := range e.CursorIndices {
 			if ndx < e.text.Len() {
-				e.deleteFromPieceTable(ndx, 1)
+				lens[i] = e.graphemeAfter(text, ndx) - ndx
+			}
+		}
+		for i, n := range lens {
+			if n > 0 {
+				e.deleteFromPieceTable(e.CursorIndices[i], n)
 			}
 		}
 	case "Tab":
 		// Tab
-		e.InsertText("\t")
+		if ev.Modifiers.Contain(key.ModShift) {
+			e.moveToSnippetStop(Reverse)
+			break
+		}
+		if e.expandSnippetBeforeCursor() || e.moveToSnippetStop(Forward) {
+			break
+		}
+		e.insertTab()
 	case "←":
 		// Left
+		if ev.Modifiers.Contain(key.ModAlt) && e.wrap.mode == noWrap {
+			e.scrollHorizontally(Left)
+			break
+		}
+
 		if e.SelectionsPresent() {
 			e.changeSelectionsToCursors(Left)
 			return
@@ -283,14 +330,20 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 			break
 		}
 
+		text := e.Bytes()
 		for i, ndx := range e.CursorIndices {
 			if ndx > 0 {
-				e.CursorIndices[i]--
+				e.CursorIndices[i] = e.graphemeBefore(text, ndx)
 			}
 		}
 		e.removeDuplicateCursors()
 		e.makeCursorVisibleByScrolling(gtx)
 	case "→":
+		if ev.Modifiers.Contain(key.ModAlt) && e.wrap.mode == noWrap {
+			e.scrollHorizontally(Right)
+			break
+		}
+
 		if e.SelectionsPresent() {
 			e.changeSelectionsToCursors(Right)
 			return
@@ -307,9 +360,10 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 			e.makeCursorVisibleByScrolling(gtx)
 			break
 		}
+		text := e.Bytes()
 		for i, ndx := range e.CursorIndices {
 			if ndx < e.text.Len() {
-				e.CursorIndices[i]++
+				e.CursorIndices[i] = e.graphemeAfter(text, ndx)
 			}
 		}
 		e.removeDuplicateCursors()
@@ -328,6 +382,7 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 				li = w.LineLen() - 1
 			}
 			w.Forward(li)
+			w.AlignToGraphemeStart()
 			e.CursorIndices[i] = w.RunePos()
 		}
 		e.removeDuplicateCursors()
@@ -345,6 +400,7 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 				li = w.LineLen() - 1
 			}
 			w.Forward(li)
+			w.AlignToGraphemeStart()
 			e.CursorIndices[i] = w.RunePos()
 		}
 		e.removeDuplicateCursors()
@@ -475,6 +531,28 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 		if ev.Modifiers.Contain(key.ModCtrl) {
 			e.selectAll()
 		}
+	case "O":
+		if ev.Modifiers.Contain(key.ModCtrl) {
+			e.adapter.execute(e, gtx, "Back", nil)
+		}
+	case "I":
+		if ev.Modifiers.Contain(key.ModCtrl) {
+			e.adapter.execute(e, gtx, "Fwd", nil)
+		}
+	case "B":
+		if ev.Modifiers.Contain(key.ModCtrl) {
+			tgt := e.executeOn
+			tgt.adapter.execute(tgt, gtx, "Lmark", nil)
+		}
+	case "J":
+		if ev.Modifiers.Contain(key.ModCtrl) {
+			tgt := e.executeOn
+			arg := "next"
+			if ev.Modifiers.Contain(key.ModShift) {
+				arg = "prev"
+			}
+			tgt.adapter.execute(tgt, gtx, "Lmark", []string{arg})
+		}
 	case "D":
 		if ev.Modifiers.Contain(key.ModCtrl) {
 			e.DelimitSelectionsWithCursors()
@@ -542,6 +620,7 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 
 	case "⎋":
 		// Escape
+		e.snippet.end()
 		e.makeCursorAtEachLineInSelections()
 
 	default:
@@ -556,6 +635,38 @@ func (e *editable) KeyPress(gtx layout.Context, ev *key.Event) {
 	}
 }
 
+// completionPopupKey handles the keys that choose a completion from the popup, if it is shown.
+func (e *editable) completionPopupKey(ev *key.Event) (handled bool) {
+	c := e.completionWithVisiblePopup()
+	if c == nil || ev.Modifiers.Contain(key.ModCtrl) {
+		return false
+	}
+
+	switch ev.Name {
+	case "↓":
+		c.Move(Forward)
+	case "↑":
+		c.Move(Reverse)
+	case "⏎", "Tab":
+		c.Accept()
+	case "⎋":
+		c.Reset()
+	default:
+		return false
+	}
+	return true
+}
+
+func (e *editable) completionWithVisiblePopup() *completion {
+	if e.wordCompletion.popupVisible() {
+		return &e.wordCompletion
+	}
+	if e.fileCompletion.popupVisible() {
+		return &e.fileCompletion
+	}
+	return nil
+}
+
 func (e *editable) KeySet() key.Set {
 	// The Ctrl-Ctrl and Ctrl, and Shift-Shift and Shift are used to workaround a bit if an odd handling of
 	// keys in GIO. When Ctrl is pressed alone, the event ends up being the key Ctrl with the modifier Ctrl. When Ctrl
@@ -565,7 +676,11 @@ func (e *editable) KeySet() key.Set {
 	//
 	// See the GIO file app/internal/xkb/xkb_unix.go function (x *Context) Modifiers() and (x *Context) DispatchKey, and the
 	// similar Windows function windowProc.
-	return "(Ctrl)-[←,→]|↑|↓|(Shift)-⏎|(Ctrl)-⏎|⌫|⌦|Tab|(Ctrl)-[⇱,⇲]|⇟|⇞|Ctrl-[A,Z,R,E,Y,N,S,F,X,C,V,L,T,G,D,U,K,P]|Ctrl|Ctrl-Ctrl|Shift|Shift-Shift|F1|F2|F3|F4|F5|F6|F7|F8|F9|F10|F11|F12|⎋"
+	keys := key.Set("(Ctrl)-[←,→]|Alt-[←,→]|↑|↓|(Shift)-⏎|(Ctrl)-⏎|⌫|⌦|(Shift)-Tab|(Ctrl)-[⇱,⇲]|⇟|⇞|Ctrl-[A,Z,R,E,Y,N,S,F,X,C,V,L,T,G,D,U,K,P,O,I,B]|Ctrl-(Shift)-J|Ctrl|Ctrl-Ctrl|Shift|Shift-Shift|F1|F2|F3|F4|F5|F6|F7|F8|F9|F10|F11|F12|⎋")
+	if e.inputHook != nil {
+		keys += "|" + terminalKeySet
+	}
+	return keys
 }
 
 func (e *editable) Undo(gtx layout.Context) {
@@ -611,6 +726,7 @@ func (e *editable) undoOrRedo(gtx layout.Context, undoOrRedo func() []interface{
 	if e.SelectionsPresent() {
 		e.clearSelections()
 	}
+	e.snippet.end()
 
 	e.invalidateLayedoutText()
 	e.textChanged(fireListeners, TextChange{})
@@ -657,6 +773,8 @@ func (e *editable) makeCursorVisibleByScrolling(gtx layout.Context) {
 		return
 	}
 
+	e.makeCursorVisibleByScrollingHorizontally(gtx)
+
 	cursorIndex := e.firstCursorIndex()
 
 	w := runes.NewWalker(e.Bytes())
@@ -832,9 +950,39 @@ func (e *editable) Pointer(gtx layout.Context, ev *pointer.Event) {
 }
 
 func (e *editable) runeIndexOfPointerEvent(ev *pointer.Event, text typeset.Text) int {
-	runeIndex := text.IndexOfPixelCoord(ev.Position)
+	pos := ev.Position
+	pos.X += float32(e.xScroll)
+	runeIndex := text.IndexOfPixelCoord(pos)
 	runeIndex += e.TopLeftIndex
-	return runeIndex
+	return e.graphemeStart(runeIndex)
+}
+
+// graphemeStart returns the index of the start of the grapheme cluster containing the rune at index.
+// The cursor is only placed at the start of grapheme clusters so that a character made of several
+// runes, like a letter with combining marks or an emoji ZWJ sequence, is not split.
+func (e *editable) graphemeStart(index int) int {
+	w := runes.NewWalker(e.Bytes())
+	w.SetRunePosCache(index, &e.runeOffsetCache)
+	w.AlignToGraphemeStart()
+	return w.RunePos()
+}
+
+// graphemeBefore returns the index of the start of the grapheme cluster before the rune at index.
+// text is the editable's text, which callers fetch once for all their cursors.
+func (e *editable) graphemeBefore(text []byte, index int) int {
+	w := runes.NewWalker(text)
+	w.SetRunePosCache(index, &e.runeOffsetCache)
+	w.BackwardGrapheme()
+	return w.RunePos()
+}
+
+// graphemeAfter returns the index of the start of the grapheme cluster after the one at index.
+// text is the editable's text, which callers fetch once for all their cursors.
+func (e *editable) graphemeAfter(text []byte, index int) int {
+	w := runes.NewWalker(text)
+	w.SetRunePosCache(index, &e.runeOffsetCache)
+	w.ForwardGrapheme()
+	return w.RunePos()
 }
 
 type verticalDirection int
@@ -973,15 +1121,60 @@ func (e *editable) draw(gtx layout.Context) layout.Dimensions {
 
 	mylog.Check2(e.getOrBuildLayedoutText(gtx, e.visibleText(gtx)))
 
-	height := e.renderTextWithStyles(gtx, *e.layedoutText)
-
-	e.drawCursorIn(gtx, *e.layedoutText)
+	e.drawDebugLine(gtx, *e.layedoutText)
+	e.drawLineMarks(gtx, *e.layedoutText)
+	height := e.drawScrolledHorizontally(gtx)
+	e.drawCompletionPopup(gtx, *e.layedoutText)
 
 	// e.postDraw(gtx)
 
 	return layout.Dimensions{Size: image.Point{X: gtx.Constraints.Max.X, Y: int(height)}}
 }
 
+// drawScrolledHorizontally draws the text and cursors shifted left by the horizontal scroll, clipped to
+// the area to the right of the left padding.
+func (e *editable) drawScrolledHorizontally(gtx layout.Context) int {
+	if e.xScroll != 0 {
+		r := image.Rect(0, 0, gtx.Constraints.Max.X-e.style.TextLeftPadding, gtx.Constraints.Max.Y)
+		defer clip.Rect(r).Push(gtx.Ops).Pop()
+		defer op.Offset(image.Point{-e.xScroll, 0}).Push(gtx.Ops).Pop()
+	}
+
+	height := e.renderTextWithStyles(gtx, *e.layedoutText)
+	e.drawCursorIn(gtx, *e.layedoutText)
+	return height
+}
+
+// drawLineMarks draws a bar in the left padding beside each marked line and each line with a breakpoint.
+func (e *editable) drawLineMarks(gtx layout.Context, ltext typeset.Text) {
+	e.drawBarsBesideLines(gtx, ltext, e.adapter.lineMarks(e), e.style.MarkColor)
+	e.drawBarsBesideLines(gtx, ltext, e.adapter.breakpoints(e), e.style.BreakpointColor)
+}
+
+func (e *editable) drawBarsBesideLines(gtx layout.Context, ltext typeset.Text, lines []int, c Color) {
+	if len(lines) == 0 {
+		return
+	}
+
+	for _, pt := range e.findCursorsInSlice(gtx, &ltext, lines, -1, -1) {
+		r := image.Rect(-e.style.TextLeftPadding, pt.Y, 0, pt.Y+ltext.LineHeight())
+		paint.FillShape(gtx.Ops, color.NRGBA(c), clip.Rect(r).Op())
+	}
+}
+
+// drawDebugLine highlights the whole of the line that the debugger is stopped at.
+func (e *editable) drawDebugLine(gtx layout.Context, ltext typeset.Text) {
+	i, ok := e.adapter.debugLine(e)
+	if !ok {
+		return
+	}
+
+	for _, pt := range e.findCursorsInSlice(gtx, &ltext, []int{i}, -1, -1) {
+		r := image.Rect(-e.style.TextLeftPadding, pt.Y, gtx.Constraints.Max.X, pt.Y+ltext.LineHeight())
+		paint.FillShape(gtx.Ops, color.NRGBA(e.style.DebugLineColor), clip.Rect(r).Op())
+	}
+}
+
 func (e *editable) indentOnLeft(gtx *layout.Context) op.TransformStack {
 	return op.Offset(image.Point{e.style.TextLeftPadding, 0}).Push(gtx.Ops)
 }
@@ -1015,6 +1208,10 @@ func (e *editable) SetPreDrawHook(preDrawHook func(e *editable, gtx layout.Conte
 	e.preDrawHook = preDrawHook
 }
 
+func (e *editable) SetInputHook(inputHook func(ev event.Event) bool) {
+	e.inputHook = inputHook
+}
+
 func (e *editable) heightInLines(gtx layout.Context) int {
 	pixelHeight := gtx.Constraints.Max.Y
 	lineHeight := e.textRender.lineHeight
@@ -1042,8 +1239,9 @@ func (e *editable) textLayoutConstraints(gtx layout.Context) typeset.Constraints
 		FontFaceId:        e.curFontName(),
 		FontSize:          e.curFontSize(),
 		FontFace:          e.curFont(),
-		WrapWidth:         gtx.Constraints.Max.X - e.style.TextLeftPadding,
-		TabStopInterval:   e.style.TabStopInterval,
+		WrapWidth:         e.wrapWidth(gtx),
+		WrapMode:          e.typesetWrapMode(),
+		TabStopInterval:   e.tabStopInterval(),
 		MaxHeight:         gtx.Constraints.Max.Y,
 		ExtraLineGap:      e.style.LineSpacing,
 		ReplaceCRWithTofu: e.adapter.replaceCrWithTofu(),
@@ -1080,6 +1278,7 @@ func (e *editable) textChanged(b fireListenersBehaviour, textChange TextChange)
 func (e *editable) textChangedButDontClearRuneOffsetCache(b fireListenersBehaviour, textChange TextChange) {
 	if e.asyncHighlighter != nil {
 		e.asyncHighlighter.Cancel()
+		e.asyncHighlighter.TextChanged(textChange)
 	}
 	e.schedule("highlight-syntax", e.syntaxHighlightDelay, func() { e.HighlightSyntax() })
 
@@ -1154,6 +1353,11 @@ func (e *editable) onPointerPrimaryButtonPress(ps *PointerState) {
 	if ps.consecutiveClicks == 1 {
 		// Single click
 		e.lastSearchResult = nil
+		if ev.Modifiers.Contain(key.ModAlt | key.ModShift) {
+			e.startBuildingBlockSelection(ps)
+			return
+		}
+
 		if ev.Modifiers&key.ModAlt == 0 {
 			e.setToOneCursorIndex(runeIndex)
 			e.clearSelections()
@@ -1475,6 +1679,7 @@ func (e *editable) searchAndUpdateEditable(gtx layout.Context, searchAt int, nee
 		return
 	}
 
+	e.executeOn.adapter.recordJump()
 	e.executeOn.setToOneCursorIndex(pos)
 	e.executeOn.addPrimarySelection(pos, end)
 	e.executeOn.lastSearchResult = e.executeOn.primarySel
@@ -1502,6 +1707,13 @@ func (e *editable) searchAndUpdateEditable(gtx layout.Context, searchAt int, nee
 }
 
 func (e *editable) onPointerPrimaryButtonDrag(ps *PointerState) {
+	if e.blockSelectionBeingBuilt != nil {
+		e.scrollIfPointerEventNearEdge(ps)
+		e.extendBlockSelection(ps)
+		e.lastSearchResult = nil
+		return
+	}
+
 	// Extend the selection from the start to here
 	rank := PrimarySelection
 	if ps.currentPointerEvent.Modifiers&key.ModAlt > 0 && e.SelectionsPresent() {
@@ -1541,10 +1753,25 @@ func (e *editable) scrollIfPointerEventNearEdge(ps *PointerState) {
 }
 
 func (e *editable) onPointerRelease(ps *PointerState) {
+	e.stopBuildingBlockSelection()
 	e.stopBuildingSelection()
 }
 
 func (e *editable) onPointerScroll(ps *PointerState) {
+	ev := ps.currentPointerEvent
+	if e.wrap.mode == noWrap && (ev.Scroll.X != 0 || ev.Modifiers.Contain(key.ModShift)) {
+		amount := ev.Scroll.X
+		if amount == 0 {
+			amount = ev.Scroll.Y
+		}
+		direction := Right
+		if amount < 0 {
+			direction = Left
+		}
+		e.scrollHorizontally(direction)
+		return
+	}
+
 	direction := Down
 	if ps.currentPointerEvent.Scroll.Y > 0 {
 		direction = Down
@@ -1596,13 +1823,10 @@ func (e *editable) renderTextWithStyles(gtx layout.Context, ltext typeset.Text)
 }
 
 func (e *editable) renderLineWithStyles(gtx layout.Context, ltext *typeset.Text, line *typeset.Line, lineStartIndex *int, isLastLine bool) {
-	xoffset := 0
-
-	moveRightBy := func(line *typeset.Line) {
-		d := line.Width().Round()
-		op.Offset(image.Point{d, 0}).Add(gtx.Ops)
-		xoffset += d
-	}
+	// The parts of the line split at each style change keep the horizontal positions their runes have
+	// in the whole line, which for right-to-left text aren't in the same order as the runes, and so
+	// all parts are drawn at the start of the line.
+	width := line.Width().Round()
 
 	stack := op.Offset(image.Point{}).Push(gtx.Ops)
 	e.applyStyleFor(e.styleChanges.Active())
@@ -1623,13 +1847,14 @@ func (e *editable) renderLineWithStyles(gtx layout.Context, ltext *typeset.Text,
 		e.textRender.DrawTextline(gtx, first)
 		e.styleChanges.ForwardTo(nxt)
 		e.applyStyleFor(e.styleChanges.Active())
-		moveRightBy(first)
 		line = rest
 	}
 
 	// In case we are in a selection, draw the text background all the way to the right margin
 	if !isLastLine {
-		e.textRender.DrawTextBgRect(gtx, gtx.Constraints.Max.X-xoffset)
+		bgStack := op.Offset(image.Point{width, 0}).Push(gtx.Ops)
+		e.textRender.DrawTextBgRect(gtx, gtx.Constraints.Max.X+e.xScroll-width)
+		bgStack.Pop()
 	}
 
 	*lineStartIndex += lineLen
@@ -1713,20 +1938,7 @@ func (e *editable) findCursorsInSlice(gtx layout.Context, ltext *typeset.Text, c
 	lastLineIndex := len(lines) - 1
 
 	determineXWithinLine := func(line *typeset.Line, cursorIndexWithinLine int) (x int) {
-		runeIndex := 0
-		var xp fixed.Int26_6
-		glyphs := line.Glyphs()
-		for i := range line.Runes() {
-			if cursorIndexWithinLine <= runeIndex {
-				break
-			}
-			runeIndex++
-			if i < len(glyphs) {
-				xp += glyphs[i].Advance
-			}
-		}
-		x = xp.Round()
-		return
+		return line.XOfRuneIndex(cursorIndexWithinLine)
 	}
 
 	if minCursor == -1 {
@@ -1848,9 +2060,15 @@ func (e *editable) HighlightSyntax() {
 	// it is cancelled and run in the background asynchronously. This is so that typing in a large
 	// document doesn't seem to lag since the highlighting doesn't appear to take so long when it
 	// does run.
+	//
+	// Fourth, the highlighter remembers the state of the lexer at points in the text and is told
+	// about each change, so it only highlights the text again from a bit before the change until
+	// the result is the same as before the change. The visible text is highlighted first and the
+	// rest continues in the background.
 
 	if e.syntaxHighlighter != nil && e.text.Len() < e.syntaxMaxDocSize {
-		tokens, er := e.asyncHighlighter.Highlight(string(e.Bytes()))
+		doc := e.Bytes()
+		tokens, er := e.asyncHighlighter.Highlight(string(doc), e.lastVisibleRuneIndex(doc))
 		mylog.CheckIgnore(er)
 		if er == nil {
 			// e.syntaxHighlightDelay = 1 * time.Millisecond
@@ -1864,14 +2082,35 @@ func (e *editable) HighlightSyntax() {
 	}
 }
 
+// lastVisibleRuneIndex returns the index of the rune after the text that fits in the editable when
+// it was last laid out. Since lines may wrap, it may be past the end of the visible text.
+func (e *editable) lastVisibleRuneIndex(doc []byte) int {
+	lineHeight := e.textRender.lineHeight
+	if lineHeight <= 0 || e.maxSizeLastLayout.Y <= 0 {
+		return -1
+	}
+
+	w := runes.NewWalker(doc)
+	err := w.SetRunePosCache(e.TopLeftIndex, &e.runeOffsetCache)
+	if err != nil {
+		return -1
+	}
+	w.ForwardLines(e.maxSizeLastLayout.Y/lineHeight + 1)
+	return w.RunePos()
+}
+
 func (e *editable) BuildCompletions() {
 	if e.completer != nil && e.text.Len() < e.completionMaxDocSize {
 		e.completer.Build(e.completionSource, e.Bytes())
 	}
+	if e.completer != nil && e.completionSource != "" {
+		completionSources.Refresh(e.adapter.dir(), e.adapter.file())
+	}
 }
 
 func (e *editable) applyStyleFor(c []intvl.Interval) {
 	e.textRender.SetDrawBg(false)
+	e.textRender.SetDecoration(TextDecoration{})
 
 	if c == nil || len(c) == 0 {
 		// Use the default style.
@@ -1908,7 +2147,12 @@ func (e *editable) applyStyleFor(c []intvl.Interval) {
 		for _, intvl := range c {
 			syn, ok := intvl.(*SyntaxInterval)
 			if ok {
-				e.textRender.SetFgColor(syn.Color())
+				if syn.Plain() {
+					e.textRender.SetFgColor(e.style.FgColor)
+				} else {
+					e.textRender.SetFgColor(syn.Color())
+				}
+				e.textRender.SetDecoration(syn.Decoration())
 			}
 		}
 	}
@@ -1970,6 +2214,99 @@ func (e *editable) drawCursor(gtx layout.Context) {
 	stack.Pop()
 }
 
+// drawCompletionPopup draws the popup of completions below the word being completed, or above
+// it if there is not enough room below.
+func (e *editable) drawCompletionPopup(gtx layout.Context, ltext typeset.Text) {
+	c := e.completionWithVisiblePopup()
+	if c == nil || e.adapter.focusedEditable() != e {
+		return
+	}
+
+	pos := e.findCursorsInSlice(gtx, &ltext, []int{c.context.wordStartIndex}, -1, -1)
+	if len(pos) == 0 {
+		return
+	}
+
+	items := c.visibleCompletions()
+	var buf bytes.Buffer
+	for i, w := range items {
+		if i > 0 {
+			buf.WriteRune('\n')
+		}
+		buf.WriteString(completionPopupLabel(w))
+	}
+
+	constraints := e.textLayoutConstraints(gtx)
+	constraints.WrapWidth = 0
+	constraints.MaxHeight = 0
+	popup, errs := typeset.Layout(buf.Bytes(), constraints)
+	for _, err := range errs {
+		log(LogCatgEd, "typeset.Layout error: %v\n", err)
+	}
+
+	const pad = 4
+	width := 0
+	for _, l := range popup.Lines() {
+		width = max(width, l.Width().Round())
+	}
+	width += 2 * pad
+	height := len(items)*popup.LineHeight() + 2*pad
+
+	pt := pos[0]
+	pt.Y += e.textRender.lineHeight
+	if pt.Y+height > gtx.Constraints.Max.Y && pos[0].Y-height >= 0 {
+		pt.Y = pos[0].Y - height
+	}
+	pt.X -= e.xScroll
+	pt.X = max(min(pt.X, gtx.Constraints.Max.X-e.style.TextLeftPadding-width), 0)
+
+	defer op.Offset(pt).Push(gtx.Ops).Pop()
+
+	// Border and background
+	fillRect(gtx, image.Rect(-1, -1, width+1, height+1), e.style.FgColor)
+	fillRect(gtx, image.Rect(0, 0, width, height), e.style.BgColor)
+
+	defer op.Offset(image.Pt(pad, pad)).Push(gtx.Ops).Pop()
+	e.textRender.SetDecoration(TextDecoration{})
+	for i, line := range popup.Lines() {
+		style := textStyle{FgColor: e.style.FgColor, BgColor: e.style.BgColor}
+		if c.top+i == c.selected {
+			style = e.style.PrimarySelection
+		}
+		e.textRender.SetFgColor(style.FgColor)
+		e.textRender.SetBgColor(style.BgColor)
+
+		stack := op.Offset(image.Pt(0, i*popup.LineHeight())).Push(gtx.Ops)
+		e.textRender.DrawTextBgRect(gtx, width-2*pad)
+		e.textRender.DrawTextline(gtx, &line)
+		stack.Pop()
+	}
+}
+
+// completionPopupLabel returns the text shown for a completion in the popup: the completion, and
+// the name of the source it came from if there is only one.
+func completionPopupLabel(w Worder) string {
+	sourcer, ok := w.(Sourcer)
+	if !ok || len(sourcer.Sources()) != 1 {
+		return w.Word()
+	}
+
+	src := sourcer.Sources()[0]
+	if p, ok := strings.CutPrefix(src, tagsCompletionSourcePrefix); ok {
+		src = "tags " + filepath.Dir(p)
+	} else if p, ok := strings.CutPrefix(src, projectCompletionSourcePrefix); ok {
+		src = "project " + filepath.Dir(p)
+	}
+	return fmt.Sprintf("%s  (%s)", w.Word(), filepath.Base(src))
+}
+
+func fillRect(gtx layout.Context, r image.Rectangle, c Color) {
+	stack := clip.Rect(r).Push(gtx.Ops)
+	paint.ColorOp{Color: color.NRGBA(c)}.Add(gtx.Ops)
+	paint.PaintOp{}.Add(gtx.Ops)
+	stack.Pop()
+}
+
 func (e *editable) InsertText(text string) {
 	e.invalidateLayedoutText()
 
@@ -2037,6 +2374,10 @@ func (e *editable) DelimitSelectionsWithCursors() {
 }
 
 func (e *editable) InsertTextAndSelect(text string) {
+	if e.insertBlockText(text) {
+		return
+	}
+
 	if e.SelectionsPresent() {
 		e.InsertText(text)
 		return
@@ -2156,7 +2497,6 @@ func (e *editable) copyText(gtx layout.Context, sel *selection) {
 }
 
 func (e *editable) cutAllSelectedText(gtx layout.Context) {
-	var buf bytes.Buffer
 	sels := e.selectionsInDisplayOrder()
 
 	ci := 0
@@ -2166,9 +2506,7 @@ func (e *editable) cutAllSelectedText(gtx layout.Context) {
 		ci = sels[0].Start()
 	}
 
-	for _, s := range sels {
-		buf.WriteString(e.textOfSelection(s))
-	}
+	text := e.textOfSelectionsForClipboard(sels)
 
 	e.StartTransaction()
 	for _, s := range sels {
@@ -2176,25 +2514,32 @@ func (e *editable) cutAllSelectedText(gtx layout.Context) {
 	}
 	e.EndTransaction()
 
-	e.clearSelections()
-	e.setToOneCursorIndex(ci)
+	if e.blockSelected {
+		// Leave a cursor where each line of the block was so that typing or pasting continues column-wise
+		cursors := make([]int, len(sels))
+		for i, s := range sels {
+			cursors[i] = s.Start()
+		}
+		e.clearSelections()
+		e.SetCursorIndices(cursors)
+		e.blockSelected = true
+	} else {
+		e.clearSelections()
+		e.setToOneCursorIndex(ci)
+	}
 	e.makeCursorVisibleByScrolling(gtx)
 
-	op := clipboard.WriteOp{Text: buf.String()}
+	op := clipboard.WriteOp{Text: text}
 	op.Add(gtx.Ops)
 }
 
 func (e *editable) copyAllSelectedText(gtx layout.Context) {
-	var buf bytes.Buffer
 	sels := e.selectionsInDisplayOrder()
+	text := e.textOfSelectionsForClipboard(sels)
 
-	for _, s := range sels {
-		buf.WriteString(e.textOfSelection(s))
-	}
-
-	log(LogCatgEd, "%s: copying this text to clipboard: '%s'\n", e.label, buf.String())
+	log(LogCatgEd, "%s: copying this text to clipboard: '%s'\n", e.label, text)
 
-	op := clipboard.WriteOp{Text: buf.String()}
+	op := clipboard.WriteOp{Text: text}
 	op.Add(gtx.Ops)
 }
 
@@ -2274,18 +2619,69 @@ func (e *editable) schedule(id string, d time.Duration, f func()) {
 }
 
 func (e *editable) doWordCompletion(ctx completionContext, direction direction) {
-	moveCurrentWordToEndOfCompletions := func(comps []words.Completion) {
-		slice.FindAndMoveToEnd(comps, func(i int) bool { return comps[i].Word() == ctx.word })
+	if e.completer == nil {
+		return
 	}
 
-	if e.completer != nil {
-		if e.wordCompletion.NeedCompletions() {
-			comps, _ := e.completer.Completions(ctx.prefix)
-			moveCurrentWordToEndOfCompletions(comps)
-			e.wordCompletion.SetCompletions(e.convertCompletionsToWorders(comps))
-		}
-		e.wordCompletion.ApplyCompletion(ctx, direction)
+	if e.wordCompletion.NeedCompletions() {
+		e.beginWordCompletion(ctx, true)
+		return
+	}
+	e.wordCompletion.ApplyCompletion(ctx, direction)
+}
+
+// beginWordCompletion finds the completions for the word and shows them in the popup. If applySingle is
+// true and there is only one completion it is applied immediately instead. API sessions that provide
+// completions are asked as well, and their completions are added to the popup when they answer.
+func (e *editable) beginWordCompletion(ctx completionContext, applySingle bool) {
+	comps := e.completer.Completions(words.Query{
+		Pattern: ctx.prefix,
+		Nearby:  e.wordDistancesFromCursor(),
+		Sources: completionSourceFilter(e.adapter.dir(), e.adapter.file()),
+	})
+	slice.FindAndMoveToEnd(comps, func(i int) bool { return comps[i].Word() == ctx.word })
+
+	e.wordCompletion.SetCompletions(e.convertCompletionsToWorders(comps))
+	gen, open := e.wordCompletion.Begin(ctx, applySingle)
+	if !open {
+		return
+	}
+
+	cb := func(completions []string) {
+		e.wordCompletion.AddCompletions(gen, e.convertStringsToWorders(completions))
+	}
+	if !e.adapter.completeWord(e, ctx.prefix, cb) && len(comps) == 0 {
+		e.wordCompletion.Reset()
+	}
+}
+
+// refineWordCompletion updates the completions in the popup after the word being completed
+// was changed by typing.
+func (e *editable) refineWordCompletion() {
+	e.fileCompletion.Reset()
+
+	if !e.wordCompletion.isCompletionInProgress() {
+		return
+	}
+	e.wordCompletion.Reset()
+
+	if e.completer == nil || len(e.CursorIndices) != 1 {
+		return
 	}
+
+	ctx := e.wordObjectToComplete(e.firstCursorIndex())
+	if ctx.prefix == "" {
+		return
+	}
+	e.beginWordCompletion(ctx, false)
+}
+
+// wordDistancesFromCursor returns the words near the first cursor mapped to their distance from it.
+func (e *editable) wordDistancesFromCursor() map[string]int {
+	doc := e.Bytes()
+	w := runes.NewWalker(doc)
+	w.SetRunePosCache(e.firstCursorIndex(), &e.runeOffsetCache)
+	return words.WordDistances(doc, w.BytePos())
 }
 
 func (e *editable) convertCompletionsToWorders(comps []words.Completion) []Worder {
@@ -2310,28 +2706,17 @@ func (e *editable) convertStringsToWorders(comps []string) []Worder {
 	return converted
 }
 
-func (e *editable) showCompletions(dir string, comps []Worder) {
-	var text bytes.Buffer
-
-	fmt.Fprintf(&text, "Completions:\n")
-	for _, c := range comps {
-		sourcer, ok := c.(Sourcer)
-		if ok {
-			fmt.Fprintf(&text, "%s  %s\n", c.Word(), sourcer.Sources())
-		} else {
-			fmt.Fprintf(&text, "%s\n", c.Word())
-		}
-
-	}
-	e.adapter.appendError(dir, text.String())
-}
-
 func (e *editable) doFilenameCompletion(ctx completionContext, direction direction) {
 	cb := func(completions []string) {
 		ndx := e.firstCursorIndex()
 		ctx := e.filenameObjectToComplete(ndx)
 		e.applyFilenameCompletions(completions, ctx, direction)
 	}
+
+	// Arguments of commands defined through the API are completed by the program that defined them
+	if e.fileCompletion.NeedCompletions() && e.adapter.completeCommandArgument(e, cb) {
+		return
+	}
 	e.adapter.completeFilename(ctx.prefix, cb)
 }
 
@@ -2343,6 +2728,8 @@ func (e *editable) applyFilenameCompletions(comps []string, ctx completionContex
 	if e.fileCompletion.NeedCompletions() {
 		moveCurrentWordToEndOfCompletions(comps)
 		e.fileCompletion.SetCompletions(e.convertStringsToWorders(comps))
+		e.fileCompletion.Begin(ctx, true)
+		return
 	}
 	e.fileCompletion.ApplyCompletion(ctx, direction)
 }
@@ -2531,15 +2918,27 @@ type Sourcer interface {
 	Sources() []string
 }
 
+// completion is the state of a word or filename completion. When there is more than one completion
+// they are shown in a popup below the word, from which one is chosen.
 type completion struct {
 	context              completionContext
 	completions          []Worder
 	editable             *editable
-	dir                  string
 	completionInProgress bool
-	completionToShow     int
+	// selected is the index of the completion selected in the popup, and top is the index of the
+	// first completion shown in it.
+	selected int
+	top      int
+	// generation identifies the current completion, so that completions that arrive from API sessions
+	// after it ended are ignored.
+	generation int
+	// onAccept, if set, is called with the completion that was accepted.
+	onAccept func(word string)
 }
 
+// completionPopupMaxItems is the most completions shown in the popup at once.
+const completionPopupMaxItems = 10
+
 func NewCompletion(e *editable) completion {
 	return completion{editable: e}
 }
@@ -2556,65 +2955,114 @@ func (c *completion) SetCompletions(completions []Worder) {
 	c.completions = completions
 }
 
+// ApplyCompletion moves the selection in the popup in the direction.
 func (c *completion) ApplyCompletion(ctx completionContext, direction direction) {
-	if c.isCompletionInProgress() {
-		delta := 1
-		if direction == Reverse {
-			delta = len(c.completions) - 1
-		}
-		c.completionToShow = (c.completionToShow + delta) % len(c.completions)
-		c.applyNextCompletion()
+	if !c.isCompletionInProgress() {
+		c.Begin(ctx, true)
 		return
 	}
-
-	c.beginNewCompletion(ctx)
+	c.Move(direction)
 }
 
 func (c *completion) isCompletionInProgress() bool {
 	return c.completionInProgress
 }
 
-func (c *completion) beginNewCompletion(ctx completionContext) {
+// popupVisible returns true if the popup of completions is shown.
+func (c *completion) popupVisible() bool {
+	return c.completionInProgress && len(c.completions) > 0
+}
+
+// Begin starts a new completion of the word described by ctx. If applySingle is true and there is
+// only one completion it replaces the word immediately. Otherwise the completions are shown in the
+// popup. It returns the generation of the completion and whether the popup was opened.
+func (c *completion) Begin(ctx completionContext, applySingle bool) (generation int, open bool) {
+	c.generation++
+	c.context = ctx
+	c.selected = 0
+	c.top = 0
+
+	if applySingle && len(c.completions) == 1 {
+		c.replaceWordWithCurrentCompletion()
+		c.accepted()
+		c.completionInProgress = false
+		return c.generation, false
+	}
+
+	c.completionInProgress = true
+	return c.generation, true
+}
+
+// AddCompletions adds completions that arrived after the completion of the specified generation began.
+// They are ignored if that completion has ended.
+func (c *completion) AddCompletions(generation int, completions []Worder) {
+	if !c.completionInProgress || generation != c.generation {
+		return
+	}
+
+	present := map[string]struct{}{}
+	for _, w := range c.completions {
+		present[w.Word()] = struct{}{}
+	}
+
+	for _, w := range completions {
+		if _, ok := present[w.Word()]; ok || w.Word() == c.context.word {
+			continue
+		}
+		present[w.Word()] = struct{}{}
+		c.completions = append(c.completions, w)
+	}
+}
+
+// Move moves the selection in the popup by one completion in the direction, wrapping around at the ends.
+func (c *completion) Move(direction direction) {
 	if len(c.completions) == 0 {
 		return
 	}
 
-	c.completionInProgress = true
-	c.completionToShow = 0
-	c.context = ctx
+	delta := 1
+	if direction == Reverse {
+		delta = len(c.completions) - 1
+	}
+	c.selected = (c.selected + delta) % len(c.completions)
 
-	if len(c.completions) > 1 {
-		c.editable.showCompletions(c.dir, c.completions)
+	if c.selected < c.top {
+		c.top = c.selected
+	} else if c.selected >= c.top+completionPopupMaxItems {
+		c.top = c.selected - completionPopupMaxItems + 1
+	}
+}
+
+// Accept replaces the word with the selected completion and closes the popup.
+func (c *completion) Accept() {
+	if !c.popupVisible() {
+		return
 	}
 	c.replaceWordWithCurrentCompletion()
+	c.accepted()
+	c.Reset()
 }
 
-func (c *completion) replaceWordWithCurrentCompletion() {
-	c.editable.deleteFromPieceTableUndoIndex(c.context.wordStartIndex, c.context.wordEndIndex-c.context.wordStartIndex, c.context.prefixEndIndex)
-	s := c.completions[c.completionToShow].Word()
-	l := utf8.RuneCountInString(s)
-	c.editable.insertToPieceTable(c.context.wordStartIndex, s)
-	c.context.wordEndIndex = c.context.wordStartIndex + l
-	c.editable.clearSelections()
-	// c.editable.SetCursorIndex(0, c.context.prefixEndIndex/)
-	c.editable.SetCursorIndex(0, c.context.wordEndIndex)
+func (c *completion) accepted() {
+	if c.onAccept != nil {
+		c.onAccept(c.completions[c.selected].Word())
+	}
+}
+
+// visibleCompletions returns the completions shown in the popup.
+func (c *completion) visibleCompletions() []Worder {
+	end := min(c.top+completionPopupMaxItems, len(c.completions))
+	return c.completions[c.top:end]
 }
 
-/*
 func (c *completion) replaceWordWithCurrentCompletion() {
-	// The cursor is at the end of the prefix to be completed.
 	c.editable.deleteFromPieceTableUndoIndex(c.context.wordStartIndex, c.context.wordEndIndex-c.context.wordStartIndex, c.context.prefixEndIndex)
-	s := c.completions[c.completionToShow].Word()
+	s := c.completions[c.selected].Word()
 	l := utf8.RuneCountInString(s)
 	c.editable.insertToPieceTable(c.context.wordStartIndex, s)
 	c.context.wordEndIndex = c.context.wordStartIndex + l
 	c.editable.clearSelections()
-	c.editable.SetCursorIndex(0, c.context.prefixEndIndex)
-}
-*/
-
-func (c *completion) applyNextCompletion() {
-	c.replaceWordWithCurrentCompletion()
+	c.editable.SetCursorIndex(0, c.context.wordEndIndex)
 }
 
 func (c *completion) shiftDueToTextModification(startOfChange, lenOfChange int) {
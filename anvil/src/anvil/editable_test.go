@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gioui.org/io/key"
+	"gioui.org/layout"
+	"github.com/jeffwilliams/anvil/internal/words"
+)
+
+func TestKeyDeletesGraphemes(t *testing.T) {
+	tests := []struct {
+		name            string
+		text            string
+		key             string
+		cursors         []int
+		expectedText    string
+		expectedCursors []int
+	}{
+		{
+			name:            "backspace combining marks",
+			text:            "ae\u0301b\nxe\u0301y",
+			key:             "⌫",
+			cursors:         []int{3, 8},
+			expectedText:    "ab\nxy",
+			expectedCursors: []int{1, 4},
+		},
+		{
+			name:            "delete combining marks",
+			text:            "ae\u0301b\nxe\u0301y",
+			key:             "⌦",
+			cursors:         []int{1, 6},
+			expectedText:    "ab\nxy",
+			expectedCursors: []int{1, 4},
+		},
+		{
+			name:            "backspace emoji sequence",
+			text:            "a👩\u200d💻b",
+			key:             "⌫",
+			cursors:         []int{4},
+			expectedText:    "ab",
+			expectedCursors: []int{1},
+		},
+		{
+			name:            "backspace at start",
+			text:            "ab",
+			key:             "⌫",
+			cursors:         []int{0, 2},
+			expectedText:    "a",
+			expectedCursors: []int{0, 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var e editable
+			e.Init(editableStyle{Fonts: []FontStyle{{FontName: "mono", FontSize: 14, FontFace: MonoFont}}})
+			e.Scheduler = NewScheduler(make(chan Work, 10))
+			e.SetTextString(tc.text)
+			e.CursorIndices = tc.cursors
+
+			e.KeyPress(layout.Context{}, &key.Event{Name: tc.key})
+
+			if got := string(e.Bytes()); got != tc.expectedText {
+				t.Fatalf("expected text %q but got %q", tc.expectedText, got)
+			}
+			if !reflect.DeepEqual(e.CursorIndices, tc.expectedCursors) {
+				t.Fatalf("expected cursors %v but got %v", tc.expectedCursors, e.CursorIndices)
+			}
+		})
+	}
+}
+
+func TestAltArrowScrollsOnlyWhenNotWrapping(t *testing.T) {
+	tests := []struct {
+		name            string
+		mode            wrapMode
+		key             string
+		expectedCursors []int
+		expectedXScroll bool
+	}{
+		{name: "wrapped left", mode: wrapAtChars, key: "←", expectedCursors: []int{1}},
+		{name: "wrapped right", mode: wrapAtWords, key: "→", expectedCursors: []int{3}},
+		{name: "not wrapped", mode: noWrap, key: "→", expectedCursors: []int{2}, expectedXScroll: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var e editable
+			e.Init(editableStyle{Fonts: []FontStyle{{FontName: "mono", FontSize: 14, FontFace: MonoFont}}})
+			e.Scheduler = NewScheduler(make(chan Work, 10))
+			e.SetTextString("abcd")
+			e.wrap.mode = tc.mode
+			e.CursorIndices = []int{2}
+
+			e.KeyPress(layout.Context{}, &key.Event{Name: tc.key, Modifiers: key.ModAlt})
+
+			if !reflect.DeepEqual(e.CursorIndices, tc.expectedCursors) {
+				t.Fatalf("expected cursors %v but got %v", tc.expectedCursors, e.CursorIndices)
+			}
+			if scrolled := e.xScroll > 0; scrolled != tc.expectedXScroll {
+				t.Fatalf("expected scrolled to be %v but xScroll is %d", tc.expectedXScroll, e.xScroll)
+			}
+		})
+	}
+}
+
+func TestCompletionPopup(t *testing.T) {
+	// apricot is nearer to the word being completed than apple, so it is ranked first
+	text := "apple " + strings.Repeat("x ", words.ProximityRange) + "apricot "
+
+	// Accepting a completion clears the editor's last selection
+	oldEditor := editor
+	editor = &Editor{work: make(chan Work, 10)}
+	defer func() { editor = oldEditor }()
+
+	tests := []struct {
+		name         string
+		keys         []string
+		expectedText string
+	}{
+		{name: "accept first", keys: []string{"⏎"}, expectedText: text + "apricot"},
+		{name: "accept second", keys: []string{"↓", "Tab"}, expectedText: text + "apple"},
+		{name: "wrap around", keys: []string{"↑", "⏎"}, expectedText: text + "apple"},
+		{name: "dismiss", keys: []string{"↓", "⎋"}, expectedText: text + "ap"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var e editable
+			e.Init(editableStyle{Fonts: []FontStyle{{FontName: "mono", FontSize: 14, FontFace: MonoFont}}})
+			e.Scheduler = NewScheduler(make(chan Work, 10))
+			e.completer = words.NewCompleter()
+			e.completer.Build("", []byte(text))
+			e.SetTextString(text + "ap")
+			e.CursorIndices = []int{len(text) + 2}
+
+			e.KeyPress(layout.Context{}, &key.Event{Name: "N", Modifiers: key.ModCtrl})
+
+			var shown []string
+			for _, w := range e.wordCompletion.visibleCompletions() {
+				shown = append(shown, w.Word())
+			}
+			if !e.wordCompletion.popupVisible() || !reflect.DeepEqual(shown, []string{"apricot", "apple"}) {
+				t.Fatalf("expected the popup to show [apricot apple] but it shows %v", shown)
+			}
+
+			for _, k := range tc.keys {
+				e.KeyPress(layout.Context{}, &key.Event{Name: k})
+			}
+
+			if e.wordCompletion.popupVisible() {
+				t.Fatalf("expected the popup to be closed")
+			}
+			if got := string(e.Bytes()); got != tc.expectedText {
+				t.Fatalf("expected text ending in %q but got text ending in %q", tc.expectedText[len(tc.expectedText)-10:], got[max(len(got)-10, 0):])
+			}
+		})
+	}
+}
@@ -40,6 +40,9 @@ type Editor struct {
 	recentFiles          *LRUCache
 	completer            *words.Completer
 	Marks                Marks
+	Jumps                JumpList
+	Quickfix             QuickfixList
+	Debugger             Debugger
 }
 
 type Job interface {
@@ -137,7 +140,9 @@ func (e *Editor) NewWindow(col *Col) *Window {
 
 	log(LogCatgEditor, "Editor.NewWindow: col is %p\n", col)
 	if col != nil {
-		return col.NewWindow()
+		w := col.NewWindow()
+		w.notifyApi(ApiNotificationOpOpen)
+		return w
 	}
 
 	cols := e.VisibleCols()
@@ -151,6 +156,7 @@ func (e *Editor) NewWindow(col *Col) *Window {
 	}
 
 	w := leastPopulated.NewWindow()
+	w.notifyApi(ApiNotificationOpOpen)
 	return w
 }
 
@@ -657,6 +663,10 @@ func (e *Editor) copyAllSelectionsFromLastSelectedEditable(gtx layout.Context) {
 }
 
 func (e *Editor) setFocusedEditable(ed *editable, owningWindow *Window) {
+	if owningWindow != nil && owningWindow != e.focusedWindow {
+		owningWindow.notifyApi(ApiNotificationOpFocus)
+	}
+
 	e.focusedEditable = ed
 	e.focusedWindow = owningWindow
 	// Clear any windows that are flashed
@@ -774,23 +784,10 @@ func (e *Editor) prependJobToTag(job Job) {
 	e.Tag.insertToPieceTable(0, s)
 }
 
+// KillJob kills the job found like findJob.
 func (e *Editor) KillJob(name string) {
-	if name == "" {
-		e.killFirstJob()
-		return
-	}
-
-	for _, j := range e.jobs {
-		if j.Name() == name {
-			j.Kill()
-			break
-		}
-	}
-}
-
-func (e *Editor) killFirstJob() {
-	if len(e.jobs) > 0 {
-		e.jobs[0].Kill()
+	if j := e.findJob(name); j != nil {
+		j.Kill()
 	}
 }
 
@@ -37,6 +37,11 @@ type editableModel struct {
 	runeOffsetCache          runes.OffsetCache
 	matchingBracketInsertion matchingBracketInsertion
 	writeLock                editableWriteLock
+	// blockSelected is true when the selections, or the cursors if there are no selections, were made
+	// by a block selection. Their text is then cut, copied and pasted column-wise.
+	blockSelected bool
+	// snippet is the snippet whose tab stops are being visited, if any.
+	snippet snippetSession
 }
 
 func (e *editableModel) SetTextString(s string) {
@@ -178,6 +183,14 @@ func (e *editableModel) filenameObjectToComplete(runeIndex int) completionContex
 	return e.itemToComplete(w, runeIndex, w.CurrentWordBounds)
 }
 
+// lineBeforeCursor returns the text on the line containing the rune index up to the index.
+func (e *editableModel) lineBeforeCursor(runeIndex int) string {
+	w := runes.NewWalker(e.Bytes())
+	w.SetRunePosCache(runeIndex, &e.runeOffsetCache)
+	start, _ := w.CurrentLineBounds()
+	return string(w.TextBetweenRuneIndices(start, runeIndex))
+}
+
 func (e *editableModel) itemToComplete(w runes.Walker, runeIndex int, getBounds func() (leftRuneIndex, rightRuneIndex int)) completionContext {
 	sel := e.selectionContaining(runeIndex)
 	if sel != nil {
@@ -206,15 +219,25 @@ func (e *editableModel) itemToComplete(w runes.Walker, runeIndex int, getBounds
 }
 
 func (e *editableModel) shiftItemsDueToTextModification(startOfChange, lengthOfChange int) {
+	if e.writeLock.isLocked() {
+		return
+	}
+	e.adapter.shiftEditorItemsDueToTextModification(e, startOfChange, lengthOfChange)
+	e.shiftOwnItemsDueToTextModification(startOfChange, lengthOfChange)
+}
+
+// shiftOwnItemsDueToTextModification shifts the items that belong to the editable, but not those
+// kept by the editor for the file such as marks. It is used when the text is changed through a clone.
+func (e *editableModel) shiftOwnItemsDueToTextModification(startOfChange, lengthOfChange int) {
 	if e.writeLock.isLocked() {
 		return
 	}
 	e.shiftSelectionsDueToTextModification(startOfChange, lengthOfChange)
 	e.shiftSyntaxTokensDueToTextModification(startOfChange, lengthOfChange)
 	e.shiftManualHighlightsDueToTextModification(startOfChange, lengthOfChange)
-	e.adapter.shiftEditorItemsDueToTextModification(startOfChange, lengthOfChange)
 	e.shiftCursorsDueToTextModification(startOfChange, lengthOfChange)
 	e.shiftCompletersDueToTextModification(startOfChange, lengthOfChange)
+	e.snippet.shiftDueToTextModification(startOfChange, lengthOfChange)
 }
 
 func (e *editableModel) shiftCursorsDueToTextModification(startOfChange, lengthOfChange int) {
@@ -732,19 +755,24 @@ func (e *editableModel) ClearSelectedManualHighlights() {
 		}
 	}
 
+	e.removeManualHighlights(toRemove)
+}
+
+func (e *editableModel) removeManualHighlights(toRemove []*SyntaxInterval) {
 	if len(toRemove) == 0 {
 		return
 	}
 
+	remove := make(map[*SyntaxInterval]struct{}, len(toRemove))
+	for _, r := range toRemove {
+		remove[r] = struct{}{}
+	}
+
 	var toKeep []*SyntaxInterval
-manual:
 	for _, m := range e.manualHighlighting {
-		for _, r := range toRemove {
-			if m == r {
-				continue manual
-			}
+		if _, ok := remove[m]; !ok {
+			toKeep = append(toKeep, m)
 		}
-		toKeep = append(toKeep, m)
 	}
 	e.manualHighlighting = toKeep
 }
@@ -183,12 +183,14 @@ type DataLoad struct {
 	Filenames chan []string
 	Errs      chan error // Will only contain one error
 	Kill      chan struct{}
+	Interrupt chan struct{}
 }
 
 func NewDataLoad() *DataLoad {
 	return &DataLoad{
 		Errs:      make(chan error),
 		Kill:      make(chan struct{}, 1),
+		Interrupt: make(chan struct{}, 1),
 		Contents:  make(chan []byte),
 		Filenames: make(chan []string),
 	}
@@ -241,8 +243,9 @@ func GetFs(path string) (sfs simpleFs, err error) {
 
 func sshOptsFromSettings() sshFsOpts {
 	return sshFsOpts{
-		shell:      settings.Ssh.Shell,
-		closeStdin: settings.Ssh.CloseStdin,
+		shell:       settings.Ssh.Shell,
+		closeStdin:  settings.Ssh.CloseStdin,
+		remoteAgent: settings.Ssh.RemoteAgent,
 	}
 }
 
@@ -257,8 +260,12 @@ type simpleFs interface {
 	filenamesInDir(path string) (names []string, err error)
 	filenamesInDirAsync(path string, names chan []string, errs chan error, kill chan struct{}) (err error)
 	exec(dir, cmd, arg string) (output []byte, err error)
+	// filter runs the shell command in dir with input as its standard input.
+	filter(dir, command string, input []byte) (stdout, stderr []byte, err error)
 	// execAsync(dir, cmd, arg string, stdin []byte, contents chan []byte, errs chan error, kill chan struct{}) (err error)
 	execAsync(execCtx) (err error)
+	// startTerm starts an interactive shell in dir in a pseudo-terminal of the given size.
+	startTerm(dir string, rows, cols int) (p termProcess, err error)
 	contentsAsync(path string, names chan []string, contents chan []byte, errs chan error, kill chan struct{}) (err error)
 }
 
@@ -273,6 +280,11 @@ type execCtx struct {
 	extraEnv    []string
 	done        chan struct{}
 	shellString string
+	// interrupt, if set, is used to send an interrupt to the running command instead of killing it.
+	interrupt chan struct{}
+	// started, if set, is called with the process id of the command once it has been started locally,
+	// or remotely by the anvil-agent helper.
+	started func(pid int)
 }
 
 func (c execCtx) fullEnv() []string {
@@ -420,14 +432,44 @@ func (f localFs) exec(dir, command, arg string) (output []byte, err error) {
 	return
 }
 
+func (f localFs) filter(dir, command string, input []byte) (stdout, stderr []byte, err error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = WindowsCmd(command)
+	} else {
+		cmd = exec.Command("bash", "-c", command)
+	}
+
+	var out, errOut bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	cmd.Dir = dir
+	err = cmd.Run()
+	stdout, stderr = out.Bytes(), errOut.Bytes()
+	return
+}
+
 func (f localFs) execAsync(c execCtx) (err error) {
 	cmd, _, _, closed, apiSess := mylog.Check6(f.setupForAsyncExec(c))
 	mylog.Check(cmd.Start())
+	if c.started != nil {
+		c.started(cmd.Process.Pid)
+	}
 
 	go func() {
-		_, ok := <-c.kill
-		if ok {
-			mylog.Check(KillProcess(cmd.Process))
+		for {
+			select {
+			case _, ok := <-c.kill:
+				if ok {
+					mylog.Check(KillProcess(cmd.Process))
+				}
+				return
+			case <-c.interrupt:
+				if err := InterruptProcess(cmd.Process); err != nil {
+					log(LogCatgFS, "localFs.execAsync: interrupting process failed: %v\n", err)
+				}
+			}
 		}
 	}()
 
@@ -476,10 +518,18 @@ func (f localFs) setupForAsyncExec(c execCtx) (cmd *exec.Cmd, stdout, stderr io.
 		cmd.Env = c.fullEnv()
 	}
 	cmd.Env = append(cmd.Env, fmt.Sprintf("ANVIL_API_PORT=%d", LocalAPIPort()))
+	if LocalAPISocket() != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("ANVIL_API_SOCK=%s", LocalAPISocket()))
+	}
 
-	apiSess = mylog.Check2(createApiSession(args))
-
-	cmd.Env = append(cmd.Env, fmt.Sprintf("ANVIL_API_SESS=%s", apiSess.Id()))
+	// The command can still run without a session, it just can't use the API
+	apiSess, err = createApiSession(args)
+	if err != nil {
+		log(LogCatgFS, "localFs.exec: not creating API session: %v\n", err)
+		err = nil
+	} else {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("ANVIL_API_SESS=%s", apiSess.Id()))
+	}
 
 	c3, closed := signalWhenComplete(c.contents)
 	c1, c2 := mergeContentsInto(c3)
@@ -566,18 +616,22 @@ func isRemoteFilenameOrDir(path string) (b bool, err error) {
 type sshFs struct {
 	shell      string
 	closeStdin bool
+	// remoteAgent is set if the anvil-agent helper should be used on the remote host when possible
+	remoteAgent bool
 }
 
 func NewSshFs(opts sshFsOpts) *sshFs {
 	return &sshFs{
-		shell:      opts.shell,
-		closeStdin: opts.closeStdin,
+		shell:       opts.shell,
+		closeStdin:  opts.closeStdin,
+		remoteAgent: opts.remoteAgent,
 	}
 }
 
 type sshFsOpts struct {
-	shell      string
-	closeStdin bool
+	shell       string
+	closeStdin  bool
+	remoteAgent bool
 }
 
 func (f *sshFs) getShell() string {
@@ -587,7 +641,21 @@ func (f *sshFs) getShell() string {
 	return f.shell
 }
 
+// fileExists, isDirAsync, loadFile and filenamesInDir only read, so they are retried on a new connection
+// if the connection to the host was lost.
 func (f *sshFs) fileExists(path string) (ok bool, err error) {
+	err = f.retryIfDisconnected(path, func() (err error) {
+		ok, err = f.fileExistsOnce(path)
+		return
+	})
+	return
+}
+
+func (f *sshFs) fileExistsOnce(path string) (ok bool, err error) {
+	if r, file, ok := f.agentFor(path, nil); ok {
+		return r.fileExists(file)
+	}
+
 	file, session, _ := mylog.Check4(f.splitFilenameAndMakeSession(path, nil))
 
 	defer session.Close()
@@ -610,6 +678,18 @@ func (f *sshFs) fileExists(path string) (ok bool, err error) {
 }
 
 func (f *sshFs) isDirAsync(path string, kill chan struct{}) (ok bool, err error) {
+	err = f.retryIfDisconnected(path, func() (err error) {
+		ok, err = f.isDirAsyncOnce(path, kill)
+		return
+	})
+	return
+}
+
+func (f *sshFs) isDirAsyncOnce(path string, kill chan struct{}) (ok bool, err error) {
+	if r, file, ok := f.agentFor(path, kill); ok {
+		return r.isDir(file)
+	}
+
 	file, session, _ := mylog.Check4(f.splitFilenameAndMakeSession(path, kill))
 
 	defer session.Close()
@@ -637,24 +717,25 @@ func (f *sshFs) splitFilenameAndMakeSession(path string, kill chan struct{}) (fi
 }
 
 func (f *sshFs) splitFilenameAndDial(path string, kill chan struct{}) (client *SshClient, file string, err error) {
+	endpt, file := mylog.Check3(f.splitFilenameAndEndpt(path))
+	client = mylog.Check2(f.dial(endpt, kill))
+	return
+}
+
+func (f *sshFs) splitFilenameAndEndpt(path string) (endpt SshEndpt, file string, err error) {
 	gpath := mylog.Check2(NewGlobalPath(path, GlobalPathUnknown))
 
 	log(LogCatgFS, "sshFs: split path %s into %#v\n", path, gpath)
 	file = gpath.Path()
 
-	endpt := SshEndpt{
+	endpt = SshEndpt{
 		Dest: SshHop{
 			User: gpath.User(),
 			Host: gpath.Host(),
 			Port: gpath.Port(),
 		},
-		Proxy: SshHop{
-			User: gpath.ProxyUser(),
-			Host: gpath.ProxyHost(),
-			Port: gpath.ProxyPort(),
-		},
+		Proxies: gpath.Proxies(),
 	}
-	client = mylog.Check2(f.dial(endpt, kill))
 	return
 }
 
@@ -665,6 +746,18 @@ func (f *sshFs) dial(endpt SshEndpt, kill chan struct{}) (client *SshClient, err
 }
 
 func (f *sshFs) loadFile(path string) (contents []byte, err error) {
+	err = f.retryIfDisconnected(path, func() (err error) {
+		contents, err = f.loadFileOnce(path)
+		return
+	})
+	return
+}
+
+func (f *sshFs) loadFileOnce(path string) (contents []byte, err error) {
+	if r, file, ok := f.agentFor(path, nil); ok {
+		return r.loadFile(file)
+	}
+
 	file, session, _ := mylog.Check4(f.splitFilenameAndMakeSession(path, nil))
 
 	defer session.Close()
@@ -678,6 +771,11 @@ func (f *sshFs) loadFile(path string) (contents []byte, err error) {
 
 func (f *sshFs) loadFileAsync(path string, contents chan []byte, errs chan error, kill chan struct{}) (err error) {
 	go func() {
+		if r, file, ok := f.agentFor(path, kill); ok {
+			r.loadFileAsync(file, contents, errs, kill)
+			return
+		}
+
 		file, session, _ := mylog.Check4(f.splitFilenameAndMakeSession(path, kill))
 
 		cmd := fmt.Sprintf("%s -c 'cat \"%s\"'", f.getShell(), file)
@@ -696,6 +794,10 @@ func (f *sshFs) loadFileAsync(path string, contents chan []byte, errs chan error
 }
 
 func (f *sshFs) saveFile(path string, contents []byte) (err error) {
+	if r, file, ok := f.agentFor(path, nil); ok {
+		return r.saveFile(file, contents)
+	}
+
 	file, session, _ := mylog.Check4(f.splitFilenameAndMakeSession(path, nil))
 
 	defer session.Close()
@@ -716,6 +818,14 @@ func (f *sshFs) saveFile(path string, contents []byte) (err error) {
 func (f sshFs) saveFileAsync(path string, contents []byte, errs chan error, kill chan struct{}) (err error) {
 	// return fmt.Errorf("Not implemented yet")
 	go func() {
+		if r, file, ok := f.agentFor(path, kill); ok {
+			if err := r.saveFile(file, contents); err != nil {
+				errs <- err
+			}
+			close(errs)
+			return
+		}
+
 		file, session, _ := mylog.Check4(f.splitFilenameAndMakeSession(path, kill))
 
 		cmd := fmt.Sprintf("%s -c 'cat > \"%s\"'", f.getShell(), file)
@@ -747,6 +857,18 @@ func (f sshFs) saveFileAsync(path string, contents []byte, errs chan error, kill
 }
 
 func (f *sshFs) filenamesInDir(path string) (names []string, err error) {
+	err = f.retryIfDisconnected(path, func() (err error) {
+		names, err = f.filenamesInDirOnce(path)
+		return
+	})
+	return
+}
+
+func (f *sshFs) filenamesInDirOnce(path string) (names []string, err error) {
+	if r, file, ok := f.agentFor(path, nil); ok {
+		return r.filenamesInDir(file)
+	}
+
 	file, session, _ := mylog.Check4(f.splitFilenameAndMakeSession(path, nil))
 
 	defer session.Close()
@@ -760,6 +882,20 @@ func (f *sshFs) filenamesInDir(path string) (names []string, err error) {
 }
 
 func (f *sshFs) filenamesInDirAsync(path string, names chan []string, errs chan error, kill chan struct{}) (err error) {
+	if r, file, ok := f.agentFor(path, kill); ok {
+		go func() {
+			lnames, err := r.filenamesInDir(file)
+			if err != nil {
+				errs <- err
+			} else {
+				names <- lnames
+			}
+			close(names)
+			close(errs)
+		}()
+		return
+	}
+
 	file, session, _ := mylog.Check4(f.splitFilenameAndMakeSession(path, kill))
 
 	// TODO: make this more asynchronous for huge directories
@@ -792,6 +928,10 @@ func (f *sshFs) contentsAsync(path string, names chan []string, contents chan []
 }
 
 func (f sshFs) exec(path, command, arg string) (output []byte, err error) {
+	if r, dir, ok := f.agentFor(path, nil); ok {
+		return r.exec(dir, command, arg)
+	}
+
 	dir, session, _ := mylog.Check4(f.splitFilenameAndMakeSession(path, nil))
 
 	defer session.Close()
@@ -802,8 +942,39 @@ func (f sshFs) exec(path, command, arg string) (output []byte, err error) {
 	return
 }
 
+func (f sshFs) filter(path, command string, input []byte) (stdout, stderr []byte, err error) {
+	if r, dir, ok := f.agentFor(path, nil); ok {
+		return r.filter(dir, command, input)
+	}
+
+	dir, session, _, err := f.splitFilenameAndMakeSession(path, nil)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var out, errOut bytes.Buffer
+	session.Stdin = bytes.NewReader(input)
+	session.Stdout = &out
+	session.Stderr = &errOut
+
+	cmd := fmt.Sprintf(`%s -c $'cd "%s" && %s'`, f.getShell(), dir, escapeSingleTicks(command))
+	log(LogCatgFS, "sshFs.filter: running command: %s\n", cmd)
+	err = session.Run(cmd)
+	stdout, stderr = out.Bytes(), errOut.Bytes()
+	return
+}
+
 func (f sshFs) execAsync(c execCtx) (err error) {
 	go func() {
+		// A shell string is a template for a remote shell command line, so it needs the shell
+		if c.shellString == "" {
+			if r, dir, ok := f.agentFor(c.dir, c.kill); ok {
+				r.execAsync(dir, c)
+				return
+			}
+		}
+
 		session, cmd, apiSess, ok := f.setupForAsyncExec(c)
 		if !ok {
 			return
@@ -811,7 +982,16 @@ func (f sshFs) execAsync(c execCtx) (err error) {
 		mylog.Check(session.Start(cmd))
 
 		go func() {
-			<-c.kill
+		WAIT:
+			for {
+				select {
+				case <-c.interrupt:
+					log(LogCatgFS, "sshFs.exec: interrupt received\n")
+					session.Signal(ssh.SIGINT)
+				case <-c.kill:
+					break WAIT
+				}
+			}
 			log(LogCatgFS, "sshFs.exec: kill received. Closing session\n")
 			// See https://github.com/golang/go/issues/16597
 			session.Signal(ssh.SIGKILL)
@@ -865,10 +1045,17 @@ func (f sshFs) setupForAsyncExec(c execCtx) (session *ssh.Session, cmd string, a
 		// But each execution of a command gets a new session id
 		f.maybeServeAPIOverSshClient(client))
 
-	apiSess = mylog.Check2(createApiSession(fmt.Sprintf("%s %s", c.cmd, c.arg)))
-
-	session.Setenv("ANVIL_API_PORT", strconv.Itoa(client.ListenerPort()))
-	session.Setenv("ANVIL_API_SESS", string(apiSess.Id()))
+	// The command can still run without a session, it just can't use the API
+	apiSess, err := createApiSession(fmt.Sprintf("%s %s", c.cmd, c.arg))
+	if err != nil {
+		log(LogCatgFS, "sshFs.exec: not creating API session: %v\n", err)
+	} else {
+		session.Setenv("ANVIL_API_PORT", strconv.Itoa(client.ListenerPort()))
+		session.Setenv("ANVIL_API_SESS", string(apiSess.Id()))
+	}
+	if client.UnixListenerPath() != "" {
+		session.Setenv("ANVIL_API_SOCK", client.UnixListenerPath())
+	}
 
 	if c.extraEnv != nil {
 		names, values := mylog.Check3(c.extraEnvNamesAndValues())
@@ -913,10 +1100,25 @@ func (f sshFs) maybeServeAPIOverSshClient(client *SshClient) (err error) {
 	listener := mylog.Check2(client.Listener())
 
 	log(LogCatgFS, "sshFs.maybeServeAPIOverSshClient: Serving API\n")
+	// The listeners are closed along with the connection, which ends the servers
 	go func() {
-		mylog.Check(ServeAPIOnListener(listener))
+		err := ServeAPIOnListener(listener)
+		log(LogCatgFS, "sshFs.maybeServeAPIOverSshClient: API server for %s ended: %v\n", client.endpt, err)
 	}()
 
+	// The Unix socket is optional since the remote sshd may not permit streamlocal forwarding.
+	unixListener, err := client.UnixListener()
+	if err != nil {
+		log(LogCatgFS, "sshFs.maybeServeAPIOverSshClient: not serving API on a remote Unix socket: %v\n", err)
+		err = nil
+	} else {
+		log(LogCatgFS, "sshFs.maybeServeAPIOverSshClient: Serving API on remote socket %s\n", client.UnixListenerPath())
+		go func() {
+			err := ServeAPIOnListener(unixListener)
+			log(LogCatgFS, "sshFs.maybeServeAPIOverSshClient: API server on remote socket for %s ended: %v\n", client.endpt, err)
+		}()
+	}
+
 	client.userData = true
 
 	return nil
@@ -925,7 +1127,7 @@ func (f sshFs) maybeServeAPIOverSshClient(client *SshClient) (err error) {
 var winInvalidPathSyntaxErr = syscall.Errno(123)
 
 func fileExists(path string) (ok bool, err error) {
-	if _ = mylog.Check2(os.Stat(path)); err == nil {
+	if _, err = os.Stat(path); err == nil {
 		ok = true
 	} else if errors.Is(err, fs.ErrNotExist) {
 		ok = false
@@ -942,7 +1144,7 @@ func fileExists(path string) (ok bool, err error) {
 }
 
 func isDir(path string) (ok bool, err error) {
-	if s := mylog.Check2(os.Stat(path)); err == nil && s.IsDir() {
+	if s, err := os.Stat(path); err == nil && s.IsDir() {
 		ok = true
 	}
 	return
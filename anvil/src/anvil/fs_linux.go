@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"os/exec"
+	"syscall"
 )
 
 func WindowsCmd(arg string) *exec.Cmd {
@@ -12,3 +13,14 @@ func WindowsCmd(arg string) *exec.Cmd {
 func KillProcess(p *os.Process) error {
 	return p.Kill()
 }
+
+// InterruptProcess sends SIGINT to the process, which gives it a chance to clean up unlike KillProcess.
+func InterruptProcess(p *os.Process) error {
+	return p.Signal(os.Interrupt)
+}
+
+// processExists returns true if a process with the pid is running.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -163,6 +163,41 @@ func TestGlobalPath(t *testing.T) {
 			},
 			output: "host:22%user@proxy:path/file_wth_@.c",
 		},
+		{
+			name:  "host%jump1%user@jump2:2222:path/file.c",
+			input: "host%jump1%user@jump2:2222:path/file.c",
+			global: GlobalPath{
+				host:         "host",
+				path:         "path/file.c",
+				proxyHost:    "jump1",
+				outerProxies: "user@jump2:2222",
+			},
+			output: "host%jump1%user@jump2:2222:path/file.c",
+		},
+		{
+			name:  "user@host:22%jump1:23%jump2%jump3:/file.c",
+			input: "user@host:22%jump1:23%jump2%jump3:/file.c",
+			global: GlobalPath{
+				user:         "user",
+				host:         "host",
+				port:         "22",
+				path:         "/file.c",
+				proxyHost:    "jump1",
+				proxyPort:    "23",
+				outerProxies: "jump2%jump3",
+			},
+			output: "user@host:22%jump1:23%jump2%jump3:/file.c",
+		},
+		{
+			name:  "host%proxy:path/50%off.txt",
+			input: "host%proxy:path/50%off.txt",
+			global: GlobalPath{
+				host:      "host",
+				path:      "path/50%off.txt",
+				proxyHost: "proxy",
+			},
+			output: "host%proxy:path/50%off.txt",
+		},
 	}
 
 	for _, tc := range tests {
@@ -27,3 +27,27 @@ func KillProcess(p *os.Process) error {
 
 	return p.Kill()
 }
+
+// InterruptProcess kills the process. Windows can't send a Ctrl-C to a process that is not attached to
+// our console, so an interrupt is the same as KillProcess.
+func InterruptProcess(p *os.Process) error {
+	return KillProcess(p)
+}
+
+// stillActive is the exit code GetExitCodeProcess reports for a running process.
+const stillActive = 259
+
+// processExists returns true if a process with the pid is running.
+func processExists(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
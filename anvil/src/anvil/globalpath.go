@@ -14,7 +14,9 @@ import (
 type GlobalPath struct {
 	user, host, path, port          string
 	proxyUser, proxyHost, proxyPort string
-	dirState                        GlobalPathDirState
+	// outerProxies are the proxies beyond the first one when the path has more than one
+	outerProxies SshHopChain
+	dirState     GlobalPathDirState
 }
 
 type GlobalPathDirState int
@@ -39,42 +41,12 @@ func (g *GlobalPath) splitFilename(path string) (err error) {
 	}
 
 	// Grammar:
-	// GlobalPath -> Dest? Path | Dest Proxy Path
-	// Dest -> (User '@')? Host ':'
-	// Proxy -> '%' (User '@')? Host ':'
-
-	parseHop := func(s string) (user, host, port, rest string) {
-		i := 0
-
-		consumePrefix := func() (r string) {
-			r = s[0:i]
-			s = s[i+1:]
-			i = 0
-			return
-		}
-
-		sawColon := false
-
-		for i < len(s) {
-			r := s[i]
-			if r == '@' && !sawColon {
-				user = consumePrefix()
-				continue
-			} else if r == ':' {
-				sawColon = true
-				if host == "" {
-					host = consumePrefix()
-					continue
-				} else if port == "" {
-					port = consumePrefix()
-					continue
-				}
-			}
-			i++
-		}
-		rest = s
-		return
-	}
+	// GlobalPath -> Dest? Path | Dest Proxy+ Path
+	// Dest -> (User '@')? Host (':' Port)? ':'
+	// Proxy -> '%' (User '@')? Host (':' Port)? ':'
+	//
+	// Only the last Proxy is terminated by ':'. Each hop is reached through the hop after it,
+	// so the last Proxy is the one dialed first.
 
 	pctIndex := strings.Index(path, "%")
 	if pctIndex >= 0 {
@@ -84,7 +56,34 @@ func (g *GlobalPath) splitFilename(path string) (err error) {
 			return
 		}
 		g.user, g.host, g.port, _ = parseHop(path[:pctIndex] + ":")
-		g.proxyUser, g.proxyHost, g.proxyPort, g.path = parseHop(path[pctIndex+1:])
+
+		rest := path[pctIndex+1:]
+		var outer []string
+		for {
+			i := strings.Index(rest, "%")
+			if i < 0 || !isHopText(rest[:i]) || !strings.Contains(rest[i+1:], ":") {
+				break
+			}
+			outer = append(outer, rest[:i])
+			rest = rest[i+1:]
+		}
+
+		if len(outer) == 0 {
+			g.proxyUser, g.proxyHost, g.proxyPort, g.path = parseHop(rest)
+			return
+		}
+
+		g.proxyUser, g.proxyHost, g.proxyPort, _ = parseHop(outer[0] + ":")
+		var last SshHop
+		last.User, last.Host, last.Port, g.path = parseHop(rest)
+		hops := make([]SshHop, 0, len(outer))
+		for _, o := range outer[1:] {
+			var h SshHop
+			h.User, h.Host, h.Port, _ = parseHop(o + ":")
+			hops = append(hops, h)
+		}
+		hops = append(hops, last)
+		g.outerProxies = NewSshHopChain(hops...)
 		return
 	}
 
@@ -92,6 +91,60 @@ func (g *GlobalPath) splitFilename(path string) (err error) {
 	return
 }
 
+// parseHop parses a hop of the form (User '@')? Host ':' (Port ':')? from the start of s and
+// returns the remainder.
+func parseHop(s string) (user, host, port, rest string) {
+	i := 0
+
+	consumePrefix := func() (r string) {
+		r = s[0:i]
+		s = s[i+1:]
+		i = 0
+		return
+	}
+
+	sawColon := false
+
+	for i < len(s) {
+		r := s[i]
+		if r == '@' && !sawColon {
+			user = consumePrefix()
+			continue
+		} else if r == ':' {
+			sawColon = true
+			if host == "" {
+				host = consumePrefix()
+				continue
+			} else if port == "" {
+				port = consumePrefix()
+				continue
+			}
+		}
+		i++
+	}
+	rest = s
+	return
+}
+
+// isHopText returns true if s is a complete hop of the form (User '@')? Host (':' Port)?
+// without the terminating ':'. It is used to tell a '%' that separates proxies from
+// a '%' that is part of the path.
+func isHopText(s string) bool {
+	if s == "" || strings.ContainsAny(s, "/\\") {
+		return false
+	}
+	_, host, port, rest := parseHop(s + ":")
+	if host == "" || rest != "" {
+		return false
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 func (g *GlobalPath) SetDirState(s GlobalPathDirState) {
 	g.dirState = s
 }
@@ -140,6 +193,28 @@ func (g GlobalPath) ProxyPort() string {
 	return g.proxyPort
 }
 
+// Proxies returns all the proxies through which the host is reached. The first is the one
+// that connects to the host, and the last is the one dialed first.
+func (g GlobalPath) Proxies() SshHopChain {
+	if g.proxyHost == "" {
+		return ""
+	}
+	first := NewSshHopChain(SshHop{User: g.proxyUser, Host: g.proxyHost, Port: g.proxyPort})
+	if g.outerProxies == "" {
+		return first
+	}
+	return first + "%" + g.outerProxies
+}
+
+// hostOfGlobalPath returns the host that the path is on, or "local".
+func hostOfGlobalPath(path string) string {
+	g, err := NewGlobalPath(path, GlobalPathUnknown)
+	if err != nil || !g.IsRemote() {
+		return "local"
+	}
+	return g.Host()
+}
+
 func (g GlobalPath) IsRemote() bool {
 	return g.host != ""
 }
@@ -151,18 +226,7 @@ func (g GlobalPath) HasProxy() bool {
 func (g GlobalPath) String() string {
 	proxyStr := ""
 	if g.proxyHost != "" {
-		var buf bytes.Buffer
-		if g.proxyUser != "" {
-			fmt.Fprintf(&buf, "%s@", g.proxyUser)
-		}
-
-		fmt.Fprintf(&buf, "%s:", g.proxyHost)
-
-		if g.proxyPort != "" {
-			fmt.Fprintf(&buf, "%s:", g.proxyPort)
-		}
-
-		proxyStr = buf.String()
+		proxyStr = string(g.Proxies()) + ":"
 	}
 
 	if g.host != "" {
@@ -216,14 +280,15 @@ func (g GlobalPath) MakeAbsoluteRelativeTo(p *GlobalPath) *GlobalPath {
 	}
 
 	return &GlobalPath{
-		user:      p.user,
-		host:      p.host,
-		path:      path,
-		port:      p.port,
-		dirState:  g.dirState,
-		proxyUser: p.proxyUser,
-		proxyHost: p.proxyHost,
-		proxyPort: p.proxyPort,
+		user:         p.user,
+		host:         p.host,
+		path:         path,
+		port:         p.port,
+		dirState:     g.dirState,
+		proxyUser:    p.proxyUser,
+		proxyHost:    p.proxyHost,
+		proxyPort:    p.proxyPort,
+		outerProxies: p.outerProxies,
 	}
 }
 
@@ -243,14 +308,15 @@ func (g GlobalPath) Dir() GlobalPath {
 	}
 
 	return GlobalPath{
-		user:      g.user,
-		host:      g.host,
-		port:      g.port,
-		path:      path,
-		dirState:  GlobalPathIsDir,
-		proxyUser: g.proxyUser,
-		proxyHost: g.proxyHost,
-		proxyPort: g.proxyPort,
+		user:         g.user,
+		host:         g.host,
+		port:         g.port,
+		path:         path,
+		dirState:     GlobalPathIsDir,
+		proxyUser:    g.proxyUser,
+		proxyHost:    g.proxyHost,
+		proxyPort:    g.proxyPort,
+		outerProxies: g.outerProxies,
 	}
 }
 
@@ -284,13 +350,14 @@ func (g GlobalPath) GlobalizeRelativeTo(p *GlobalPath) *GlobalPath {
 	}
 
 	return &GlobalPath{
-		user:      p.user,
-		host:      p.host,
-		path:      g.path,
-		port:      p.port,
-		dirState:  g.dirState,
-		proxyUser: p.proxyUser,
-		proxyHost: p.proxyHost,
-		proxyPort: p.proxyPort,
+		user:         p.user,
+		host:         p.host,
+		path:         g.path,
+		port:         p.port,
+		dirState:     g.dirState,
+		proxyUser:    p.proxyUser,
+		proxyHost:    p.proxyHost,
+		proxyPort:    p.proxyPort,
+		outerProxies: p.outerProxies,
 	}
 }
@@ -23,10 +23,12 @@ require (
 	github.com/ogier/pflag v0.0.1
 	github.com/pelletier/go-toml v1.9.5
 	github.com/pkg/profile v1.6.0
+	github.com/rivo/uniseg v0.4.7
 	github.com/sarpdag/boyermoore v0.0.0-20210425165139-a89ed1b5913b
 	github.com/stretchr/testify v1.9.0
 	golang.org/x/crypto v0.24.0
 	golang.org/x/image v0.17.0
+	golang.org/x/text v0.16.0
 )
 
 require (
@@ -48,13 +50,11 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-sqlite3 v1.14.22 // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
-	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/exp v0.0.0-20240613232115-7f521ea00fb8 // indirect
 	golang.org/x/exp/shiny v0.0.0-20220827204233-334a2380cb91 // indirect
 	golang.org/x/mod v0.18.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/sys v0.21.0 // indirect
-	golang.org/x/text v0.16.0 // indirect
 	golang.org/x/tools v0.22.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	mvdan.cc/gofumpt v0.6.0 // indirect
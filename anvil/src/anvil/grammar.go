@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffwilliams/syn"
+	synlexers "github.com/jeffwilliams/syn/lexers"
+)
+
+// userGrammars are the syntax grammars loaded from the files in SyntaxGrammarDir. The files are
+// chroma XML lexer definitions. They are loaded again when the files change.
+var userGrammars grammarRegistry
+
+// grammarCheckInterval is how often the grammar directory is checked for changes.
+const grammarCheckInterval = 2 * time.Second
+
+type grammarRegistry struct {
+	lock        sync.Mutex
+	registry    *syn.LexerRegistry
+	files       map[string]time.Time
+	lastChecked time.Time
+}
+
+// Registry returns the registry of user grammars, loading them again first if the files changed.
+func (g *grammarRegistry) Registry() *syn.LexerRegistry {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.registry != nil && time.Since(g.lastChecked) < grammarCheckInterval {
+		return g.registry
+	}
+	g.lastChecked = time.Now()
+
+	files := g.grammarFiles()
+	if g.registry != nil && sameModTimes(files, g.files) {
+		return g.registry
+	}
+
+	g.files = files
+	g.registry = g.load(files)
+	return g.registry
+}
+
+func (g *grammarRegistry) grammarFiles() map[string]time.Time {
+	files := map[string]time.Time{}
+
+	entries, err := os.ReadDir(SyntaxGrammarDir())
+	if err != nil {
+		return files
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".xml") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files[filepath.Join(SyntaxGrammarDir(), e.Name())] = info.ModTime()
+	}
+	return files
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !w.Equal(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *grammarRegistry) load(files map[string]time.Time) *syn.LexerRegistry {
+	reg := syn.NewLexerRegistry()
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		lexer, err := loadGrammar(path)
+		if err != nil {
+			log(LogCatgConf, "Error loading syntax grammar %s: %v\n", path, err)
+			if editor != nil {
+				editor.AppendError("", fmt.Sprintf("Error loading syntax grammar %s: %v", path, err))
+			}
+			continue
+		}
+		log(LogCatgConf, "Loaded syntax grammar %s\n", path)
+		reg.Register(lexer)
+	}
+	return reg
+}
+
+// grammarConfig is the part of a chroma XML lexer definition that is checked before the lexer is built.
+type grammarConfig struct {
+	Name      string   `xml:"config>name"`
+	Filenames []string `xml:"config>filename"`
+}
+
+func loadGrammar(path string) (*syn.Lexer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg grammarConfig
+	err = xml.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("the grammar has no name")
+	}
+	// The registry panics when matching a file name against an invalid pattern.
+	for _, f := range cfg.Filenames {
+		_, err = filepath.Match(f, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid filename pattern %s: %w", f, err)
+		}
+	}
+
+	return syn.NewLexerFromXML(bytes.NewReader(b))
+}
+
+// syntaxLexer returns the lexer to highlight a file with. If language is set it's the lexer
+// for that language, and otherwise the one for filename. User grammars are preferred to the
+// builtin lexers. It returns nil if there is no such lexer.
+func syntaxLexer(language, filename string) *syn.Lexer {
+	if language == "" && filename != "" {
+		language = syntaxLanguageForFiletype(filename)
+	}
+
+	user := userGrammars.Registry()
+	if language != "" {
+		if l := user.Get(language); l != nil {
+			return l
+		}
+		if l := synlexers.Get(language); l != nil {
+			return l
+		}
+	}
+
+	if filename != "" {
+		if l := user.Match(filename); l != nil {
+			return l
+		}
+		return synlexers.Match(filename)
+	}
+	return nil
+}
+
+// syntaxLanguageForFiletype returns the language the syntax.filetypes setting maps the filename
+// to, or the empty string if it's not mapped.
+func syntaxLanguageForFiletype(filename string) string {
+	base := filepath.Base(filename)
+
+	patterns := make([]string, 0, len(settings.Syntax.Filetypes))
+	for p := range settings.Syntax.Filetypes {
+		patterns = append(patterns, p)
+	}
+	// Check the patterns in a fixed order so that the result doesn't change when several match
+	sort.Strings(patterns)
+
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, base); ok {
+			return settings.Syntax.Filetypes[p]
+		}
+	}
+	return ""
+}
+
+// syntaxLanguageNames returns the names of the languages that can be highlighted, with their aliases.
+func syntaxLanguageNames() []string {
+	names := userGrammars.Registry().Names(true)
+	names = append(names, synlexers.Names(true)...)
+	sort.Strings(names)
+
+	var uniq []string
+	for i, n := range names {
+		if i == 0 || n != names[i-1] {
+			uniq = append(uniq, n)
+		}
+	}
+	return uniq
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jeffwilliams/syn"
+)
+
+const testGrammar = `<lexer>
+  <config>
+    <name>Keyval</name>
+    <alias>kv</alias>
+    <filename>*.kv</filename>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="#.*">
+        <token type="CommentSingle"/>
+      </rule>
+      <rule pattern="(\w+)(\s*)(=)(\s*)(.*)">
+        <bygroups>
+          <token type="NameAttribute"/>
+          <token type="Text"/>
+          <token type="Operator"/>
+          <token type="Text"/>
+          <token type="LiteralString"/>
+        </bygroups>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>
+`
+
+func TestSyntaxLanguageForFiletype(t *testing.T) {
+	old := settings.Syntax.Filetypes
+	defer func() { settings.Syntax.Filetypes = old }()
+
+	settings.Syntax.Filetypes = map[string]string{
+		"*.tmpl":      "html",
+		"Jenkinsfile": "groovy",
+		"*.conf":      "ini",
+		"nginx*.conf": "nginx",
+	}
+
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		{"page.tmpl", "html"},
+		{"/src/site/page.tmpl", "html"},
+		{"Jenkinsfile", "groovy"},
+		{"/src/Jenkinsfile", "groovy"},
+		{"Jenkinsfile.old", ""},
+		{"app.conf", "ini"},
+		// Several patterns match, and the first in sorted order is used
+		{"nginx-site.conf", "ini"},
+		{"main.go", ""},
+		{"/src/tmpl/main.go", ""},
+	}
+
+	for _, tc := range tests {
+		if got := syntaxLanguageForFiletype(tc.filename); got != tc.expected {
+			t.Errorf("%s: expected language %q but got %q", tc.filename, tc.expected, got)
+		}
+	}
+}
+
+func TestLoadGrammar(t *testing.T) {
+	tests := []struct {
+		name      string
+		grammar   string
+		expectErr bool
+	}{
+		{name: "valid", grammar: testGrammar},
+		{name: "no name", grammar: `<lexer><config><filename>*.kv</filename></config><rules><state name="root"/></rules></lexer>`, expectErr: true},
+		{name: "bad filename pattern", grammar: `<lexer><config><name>Bad</name><filename>[*.kv</filename></config><rules><state name="root"/></rules></lexer>`, expectErr: true},
+		{name: "not xml", grammar: "name = Keyval", expectErr: true},
+	}
+
+	dir := t.TempDir()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "grammar.xml")
+			if err := os.WriteFile(path, []byte(tc.grammar), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			lexer, err := loadGrammar(path)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil || lexer == nil {
+				t.Fatalf("loading failed: %v", err)
+			}
+		})
+	}
+}
+
+// resetUserGrammars makes the next lookup of user grammars read the grammar directory again.
+func resetUserGrammars() {
+	userGrammars.lock.Lock()
+	defer userGrammars.lock.Unlock()
+	userGrammars.registry = nil
+	userGrammars.files = nil
+}
+
+func TestUserGrammars(t *testing.T) {
+	oldConfDir, oldFiletypes := ConfDir, settings.Syntax.Filetypes
+	defer func() {
+		ConfDir, settings.Syntax.Filetypes = oldConfDir, oldFiletypes
+		resetUserGrammars()
+	}()
+
+	ConfDir = t.TempDir()
+	settings.Syntax.Filetypes = map[string]string{"*.conf": "kv"}
+	resetUserGrammars()
+
+	if err := os.MkdirAll(SyntaxGrammarDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(SyntaxGrammarDir(), "keyval.xml"), []byte(testGrammar), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Files other than grammars are ignored
+	if err := os.WriteFile(filepath.Join(SyntaxGrammarDir(), "README"), []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	user := userGrammars.Registry().Get("Keyval")
+	if user == nil {
+		t.Fatalf("the grammar was not loaded")
+	}
+
+	tests := []struct {
+		language, filename string
+		expected           *syn.Lexer
+	}{
+		{language: "kv", expected: user},
+		{language: "Keyval", filename: "a.go", expected: user},
+		{filename: "/src/settings.kv", expected: user},
+		{filename: "/src/app.conf", expected: user},
+		{language: "nosuchlanguage"},
+	}
+
+	for _, tc := range tests {
+		if got := syntaxLexer(tc.language, tc.filename); got != tc.expected {
+			t.Errorf("language %q file %q: got a different lexer than expected", tc.language, tc.filename)
+		}
+	}
+
+	if l := syntaxLexer("", "main.go"); l == nil || l == user {
+		t.Fatalf("expected the builtin lexer for Go")
+	}
+
+	type token struct {
+		typ  syn.TokenType
+		text string
+	}
+	var got []token
+	iter := user.Tokenise([]rune("# settings\nkey = value\n"))
+	for {
+		tok, err := iter.Next()
+		if err != nil {
+			t.Fatalf("tokenising failed: %v", err)
+		}
+		if tok.Type == syn.EOFType {
+			break
+		}
+		if tok.Type != syn.Text {
+			got = append(got, token{tok.Type, string(tok.Value)})
+		}
+	}
+
+	expected := []token{
+		{syn.CommentSingle, "# settings"},
+		{syn.NameAttribute, "key"},
+		{syn.Operator, "="},
+		{syn.LiteralString, "value"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected tokens %v but got %v", expected, got)
+	}
+}
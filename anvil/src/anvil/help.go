@@ -39,6 +39,15 @@ func AddHelp(topic string, text string) {
 	help.addHelp(topic, text)
 }
 
+func (h *helper) removeHelp(topic string) {
+	delete(h.data, topic)
+	delete(h.data, strings.ToLower(topic))
+}
+
+func RemoveHelp(topic string) {
+	help.removeHelp(topic)
+}
+
 func Help(topic string) string {
 	return help.help(topic)
 }
@@ -64,7 +73,9 @@ ANVIL_WIN_ID	The internal numeric ID of the window. This may be used in the API.
 
 ANVIL_API_PORT	The TCP port number on which the Anvil REST API is running. Connections to the API should be performed to the local host; if a remote command is executed an SSH tunnel is created so that commands may connect locally.
 
-ANVIL_API_SESS	Session id used to authenticate the client program against the API.
+ANVIL_API_SOCK	The path of a Unix domain socket on which the Anvil REST API is also served. The socket is only accessible to the current user. If a remote command is executed and the SSH server permits it, the socket is created on the remote host and tunnelled back to Anvil.
+
+ANVIL_API_SESS	Session id used to authenticate the client program against the API. Programs started outside of Anvil may instead use the user token stored in the file api.token in the config directory.
 `
 	h.addHelp("Environment", s)
 
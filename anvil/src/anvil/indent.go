@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/jeffwilliams/anvil/internal/editorconfig"
+	"github.com/jeffwilliams/anvil/internal/runes"
+)
+
+// indentation is how the text of a window body is indented, and how it's formatted when it's saved.
+// The zero value indents using tabs and doesn't change the text when it's saved.
+type indentation struct {
+	useSpaces bool
+	// size is the number of columns in one level of indentation when indenting using spaces.
+	size int
+	// tabWidth is the number of columns between tab stops, or 0 to use the TabStopInterval of the style.
+	tabWidth               int
+	endOfLine              string
+	trimTrailingWhitespace bool
+	insertFinalNewline     bool
+}
+
+// defaultIndentSize is the indent size used when indenting with spaces and no size is configured.
+const defaultIndentSize = 4
+
+// maxBracketScan is the most runes searched backwards for the opening bracket that matches a closing
+// bracket being typed.
+const maxBracketScan = 100000
+
+// unit returns the text inserted for one level of indentation.
+func (ind indentation) unit() string {
+	if !ind.useSpaces {
+		return "\t"
+	}
+	size := ind.size
+	if size <= 0 {
+		size = defaultIndentSize
+	}
+	return strings.Repeat(" ", size)
+}
+
+// applyOptions overrides the indentation with the options that are set.
+func (ind *indentation) applyOptions(o IndentOptions) {
+	switch o.Style {
+	case "tab":
+		ind.useSpaces = false
+	case "space":
+		ind.useSpaces = true
+	}
+	if o.Size > 0 {
+		ind.size = o.Size
+	}
+	if o.TabWidth > 0 {
+		ind.tabWidth = o.TabWidth
+	}
+	if o.EndOfLine != "" {
+		ind.endOfLine = o.EndOfLine
+	}
+	if o.TrimTrailingWhitespace != nil {
+		ind.trimTrailingWhitespace = *o.TrimTrailingWhitespace
+	}
+	if o.InsertFinalNewline != nil {
+		ind.insertFinalNewline = *o.InsertFinalNewline
+	}
+}
+
+// applyEditorConfig overrides the indentation with the EditorConfig properties that are set.
+func (ind *indentation) applyEditorConfig(props editorconfig.Properties) {
+	o := IndentOptions{
+		Style:     props["indent_style"],
+		Size:      props.Int("indent_size"),
+		TabWidth:  props.Int("tab_width"),
+		EndOfLine: props["end_of_line"],
+	}
+	if v, ok := props.Bool("trim_trailing_whitespace"); ok {
+		o.TrimTrailingWhitespace = &v
+	}
+	if v, ok := props.Bool("insert_final_newline"); ok {
+		o.InsertFinalNewline = &v
+	}
+	ind.applyOptions(o)
+}
+
+// indentationFromSettings returns the indentation the settings file gives the file: the defaults,
+// overridden by the settings for the language of the file.
+func indentationFromSettings(filename string) indentation {
+	var ind indentation
+	ind.applyOptions(settings.Indent.Default)
+
+	names := languageNamesForFile(filename)
+	for lang, o := range settings.Indent.Languages {
+		for _, n := range names {
+			if strings.EqualFold(lang, n) {
+				ind.applyOptions(o)
+				return ind
+			}
+		}
+	}
+	return ind
+}
+
+// languageNamesForFile returns the name and aliases of the language of the file, as used for syntax
+// highlighting.
+func languageNamesForFile(filename string) []string {
+	if filename == "" {
+		return nil
+	}
+
+	lang := syntaxLanguageForFiletype(filename)
+	lexer := lexers.Match(filepath.Base(filename))
+	if lang != "" {
+		lexer = lexers.Get(lang)
+	}
+	if lexer == nil {
+		if lang != "" {
+			return []string{lang}
+		}
+		return nil
+	}
+
+	cfg := lexer.Config()
+	return append([]string{cfg.Name}, cfg.Aliases...)
+}
+
+// loadIndentation sets the indentation of the window body from the settings and then looks up the
+// .editorconfig files that apply to the window's file in the background, applying them once found.
+func (w *Window) loadIndentation() {
+	if w.fileType != typeFile || w.file == "" || w.IsErrorsWindow() {
+		return
+	}
+
+	file := w.file
+	ind := indentationFromSettings(file)
+	w.Body.SetIndentation(ind)
+
+	gpath, err := NewGlobalPath(file, GlobalPathIsFile)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		props, err := editorconfig.Resolve(filepath.ToSlash(gpath.Path()), editorConfigReader(*gpath))
+		if err != nil {
+			log(LogCatgWin, "loading .editorconfig for %s failed: %v\n", file, err)
+			editor.WorkChan() <- basicWork{func() {
+				editor.AppendError("", fmt.Sprintf("Error reading .editorconfig for %s: %v", file, err))
+			}}
+			return
+		}
+		if len(props) == 0 {
+			return
+		}
+
+		editor.WorkChan() <- basicWork{func() {
+			// The window may have been closed or changed to another file while the files were read.
+			if editor.FindWindowForId(w.Id) != w || w.file != file {
+				return
+			}
+			ind.applyEditorConfig(props)
+			w.Body.SetIndentation(ind)
+		}}
+	}()
+}
+
+// editorConfigReader returns a function that reads files on the host of the path p, which may be remote.
+func editorConfigReader(p GlobalPath) editorconfig.ReadFunc {
+	return func(path string) ([]byte, error) {
+		fp := p
+		if fp.IsRemote() {
+			fp.SetPath(path)
+		} else {
+			fp.SetPath(filepath.FromSlash(path))
+		}
+		full := fp.String()
+
+		sfs, err := GetFs(full)
+		if err != nil {
+			return nil, err
+		}
+		if fp.IsRemote() {
+			// A failed remote read doesn't say why, so check that the file is there first.
+			ok, err := sfs.fileExists(full)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fs.ErrNotExist
+			}
+		}
+		// A missing local file is reported as an error that matches fs.ErrNotExist
+		return sfs.loadFile(full)
+	}
+}
+
+func (e *editable) SetIndentation(ind indentation) {
+	e.indent = ind
+	e.invalidateLayedoutText()
+}
+
+func (e *editable) Indentation() indentation {
+	return e.indent
+}
+
+// tabStopInterval returns the distance in pixels between tab stops.
+func (e *editable) tabStopInterval() int {
+	if e.indent.tabWidth <= 0 {
+		return e.style.TabStopInterval
+	}
+	return e.indent.tabWidth * e.widthOfSpace()
+}
+
+// columnOf returns the column of the rune index within its line, with tabs advancing to the next
+// tab stop.
+func (e *editable) columnOf(index int) int {
+	tabWidth := e.indent.tabWidth
+	if tabWidth <= 0 {
+		tabWidth = max(e.style.TabStopInterval/e.widthOfSpace(), 1)
+	}
+
+	w := runes.NewWalker(e.Bytes())
+	w.SetRunePosCache(index, &e.runeOffsetCache)
+	w.BackwardToStartOfLine()
+
+	col := 0
+	for w.RunePos() < index && !w.AtEnd() {
+		if w.Rune() == '\t' {
+			col = (col/tabWidth + 1) * tabWidth
+		} else {
+			col++
+		}
+		w.Forward(1)
+	}
+	return col
+}
+
+// insertTab inserts a tab at the cursors, or when indenting with spaces the spaces that reach the
+// next indent stop after the first cursor.
+func (e *editable) insertTab() {
+	if !e.indent.useSpaces {
+		e.InsertText("\t")
+		return
+	}
+
+	size := utf8.RuneCountInString(e.indent.unit())
+	col := e.columnOf(e.firstCursorIndex())
+	e.InsertText(strings.Repeat(" ", size-col%size))
+}
+
+// insertNewlineAndIndent inserts a newline at the cursor and indents the new line like the line the
+// cursor was on. If the cursor follows an opening bracket the new line is indented one more level,
+// and if it's also before the matching closing bracket, the closing bracket is moved to a line
+// of its own indented like the opening one.
+func (e *editable) insertNewlineAndIndent() {
+	ndx := e.firstCursorIndex()
+	lineStart, space := e.leadingSpaceOfLine(ndx)
+	w := runes.NewWalker(e.Bytes())
+	w.SetRunePosCache(ndx, &e.runeOffsetCache)
+	before := strings.TrimRight(string(w.TextBetweenRuneIndices(lineStart, ndx)), " \t")
+	if utf8.RuneCountInString(space) > ndx-lineStart {
+		// Don't indent further than where the line is split.
+		space = string(w.TextBetweenRuneIndices(lineStart, ndx))
+	}
+
+	if e.SelectionsPresent() {
+		e.InsertText("\n" + space)
+		return
+	}
+
+	var opener rune
+	if before != "" {
+		opener, _ = utf8.DecodeLastRuneInString(before)
+	}
+	if opener != '{' && opener != '(' && opener != '[' {
+		e.InsertText("\n" + space)
+		return
+	}
+
+	inner := space + e.indent.unit()
+	_, closer := runes.MatchingBracket(opener)
+	w.SetRunePos(ndx)
+	if w.Rune() != closer {
+		e.InsertText("\n" + inner)
+		return
+	}
+
+	after := "\n" + space
+	e.InsertText("\n" + inner + after)
+	e.CursorIndices[0] -= utf8.RuneCountInString(after)
+}
+
+// InsertTypedText inserts text typed by the user. When a closing bracket is typed at the start of a
+// line, the line is first dedented to the indentation of the line with the matching opening bracket.
+func (e *editable) InsertTypedText(text string) {
+	if !e.typedClosingBracketNeedsDedent(text) {
+		e.InsertText(text)
+		return
+	}
+
+	e.text.StartTransaction()
+	e.dedentLineForClosingBracket(text)
+	e.InsertText(text)
+	e.text.EndTransaction()
+}
+
+func (e *editable) typedClosingBracketNeedsDedent(text string) bool {
+	if len(e.CursorIndices) != 1 || e.SelectionsPresent() || e.blockSelectionBeingBuilt != nil {
+		return false
+	}
+	if text != "}" && text != ")" && text != "]" {
+		return false
+	}
+
+	lineStart, space := e.leadingSpaceOfLine(e.firstCursorIndex())
+	return space != "" && lineStart+utf8.RuneCountInString(space) == e.firstCursorIndex()
+}
+
+func (e *editable) leadingSpaceOfLine(index int) (lineStart int, space string) {
+	w := runes.NewWalker(e.Bytes())
+	w.SetRunePosCache(index, &e.runeOffsetCache)
+	w.BackwardToStartOfLine()
+	lineStart = w.RunePos()
+	if w.AtEnd() || w.Rune() == '\n' {
+		return
+	}
+	space = strings.TrimRight(w.CurrentRunOfSpaces(), "\r")
+	return
+}
+
+func (e *editable) dedentLineForClosingBracket(closer string) {
+	lineStart, space := e.leadingSpaceOfLine(e.firstCursorIndex())
+
+	r, _ := utf8.DecodeRuneInString(closer)
+	target, ok := e.indentOfMatchingOpener(lineStart, r)
+	if !ok {
+		target = strings.TrimSuffix(space, e.indent.unit())
+		if target == space {
+			target = space[:len(space)-1]
+		}
+	}
+	if target == space {
+		return
+	}
+
+	e.deleteFromPieceTable(lineStart, utf8.RuneCountInString(space))
+	e.insertToPieceTable(lineStart, target)
+	e.CursorIndices[0] = lineStart + utf8.RuneCountInString(target)
+}
+
+// indentOfMatchingOpener returns the leading whitespace of the line containing the opening bracket
+// that a closing bracket inserted at index would match.
+func (e *editable) indentOfMatchingOpener(index int, closer rune) (space string, ok bool) {
+	_, opener := runes.MatchingBracket(closer)
+
+	w := runes.NewWalker(e.Bytes())
+	w.SetRunePosCache(index, &e.runeOffsetCache)
+	depth := 0
+	for i := 0; i < maxBracketScan && !w.AtStart(); i++ {
+		w.Backward(1)
+		switch w.Rune() {
+		case closer:
+			depth++
+		case opener:
+			if depth == 0 {
+				_, space = e.leadingSpaceOfLine(w.RunePos())
+				return space, true
+			}
+			depth--
+		}
+	}
+	return
+}
+
+// formatForSave changes the text as the indentation settings say it should be when it's saved:
+// trailing whitespace is removed from the lines and a final newline is added if they are enabled.
+// The changes are made as one undoable change.
+func (e *editable) formatForSave() {
+	if !e.indent.trimTrailingWhitespace && !e.indent.insertFinalNewline {
+		return
+	}
+
+	text := e.Bytes()
+	var deletes []selection
+	if e.indent.trimTrailingWhitespace {
+		deletes = trailingWhitespace(text)
+	}
+	addNewline := e.indent.insertFinalNewline && len(text) > 0 && text[len(text)-1] != '\n' && text[len(text)-1] != '\r'
+	if len(deletes) == 0 && !addNewline {
+		return
+	}
+
+	e.text.StartTransaction()
+	e.SetSaveDeletes(false)
+	if addNewline {
+		e.insertToPieceTable(utf8.RuneCount(text), e.newlineForSave())
+	}
+	for i := len(deletes) - 1; i >= 0; i-- {
+		e.deleteFromPieceTable(deletes[i].start, deletes[i].Len())
+	}
+	e.SetSaveDeletes(true)
+	e.text.EndTransaction()
+}
+
+func (e *editable) newlineForSave() string {
+	switch e.indent.endOfLine {
+	case "crlf":
+		return "\r\n"
+	case "cr":
+		return "\r"
+	}
+	return "\n"
+}
+
+// trailingWhitespace returns the rune ranges of the spaces and tabs at the ends of the lines of text.
+func trailingWhitespace(text []byte) (ranges []selection) {
+	runeIndex := 0
+	wsStart := -1
+	for _, r := range string(text) {
+		switch r {
+		case ' ', '\t':
+			if wsStart < 0 {
+				wsStart = runeIndex
+			}
+		case '\r', '\n':
+			if wsStart >= 0 {
+				ranges = append(ranges, selection{wsStart, runeIndex})
+			}
+			wsStart = -1
+		default:
+			wsStart = -1
+		}
+		runeIndex++
+	}
+	if wsStart >= 0 {
+		ranges = append(ranges, selection{wsStart, runeIndex})
+	}
+	return
+}
+
+// convertLineEndings converts the line endings of text to those named by eol, which is one of lf,
+// crlf or cr. If eol is empty the text is not changed.
+func convertLineEndings(text []byte, eol string) []byte {
+	var nl []byte
+	switch eol {
+	case "lf":
+		nl = []byte("\n")
+	case "crlf":
+		nl = []byte("\r\n")
+	case "cr":
+		nl = []byte("\r")
+	default:
+		return text
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(text))
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\r':
+			if i+1 < len(text) && text[i+1] == '\n' {
+				i++
+			}
+			buf.Write(nl)
+		case '\n':
+			buf.Write(nl)
+		default:
+			buf.WriteByte(text[i])
+		}
+	}
+	return buf.Bytes()
+}
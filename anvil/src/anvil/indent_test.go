@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jeffwilliams/anvil/internal/editorconfig"
+)
+
+func TestTrailingWhitespace(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []selection
+	}{
+		{
+			name:  "none",
+			input: "a\nb\n",
+		},
+		{
+			name:     "spaces and tabs",
+			input:    "a \t\nb\nc  ",
+			expected: []selection{{1, 3}, {7, 9}},
+		},
+		{
+			name:     "before carriage return",
+			input:    "ab \r\n",
+			expected: []selection{{2, 3}},
+		},
+		{
+			name:     "whitespace only line",
+			input:    "a\n  \nβ \n",
+			expected: []selection{{2, 4}, {6, 7}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := trailingWhitespace([]byte(tc.input))
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected %v but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestConvertLineEndings(t *testing.T) {
+	tests := []struct {
+		input, eol, expected string
+	}{
+		{"a\nb\r\nc\rd", "lf", "a\nb\nc\nd"},
+		{"a\nb\r\nc\n", "crlf", "a\r\nb\r\nc\r\n"},
+		{"a\nb\r\n", "cr", "a\rb\r"},
+		{"a\nb\r\n", "", "a\nb\r\n"},
+	}
+
+	for _, tc := range tests {
+		got := string(convertLineEndings([]byte(tc.input), tc.eol))
+		if got != tc.expected {
+			t.Errorf("converting %q to %s: expected %q but got %q", tc.input, tc.eol, tc.expected, got)
+		}
+	}
+}
+
+func TestEditorConfigReader(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "src", "main.py")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func() editorconfig.Properties {
+		gpath, err := NewGlobalPath(file, GlobalPathIsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		props, err := editorconfig.Resolve(filepath.ToSlash(gpath.Path()), editorConfigReader(*gpath))
+		if err != nil {
+			t.Fatalf("resolving failed: %v", err)
+		}
+		return props
+	}
+
+	if props := resolve(); len(props) != 0 {
+		t.Fatalf("expected no properties without a .editorconfig but got %v", props)
+	}
+
+	contents := "root = true\n[*.py]\nindent_style = space\nindent_size = 4\n"
+	if err := os.WriteFile(filepath.Join(root, ".editorconfig"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	props := resolve()
+	if props["indent_style"] != "space" || props["indent_size"] != "4" {
+		t.Fatalf("unexpected properties %v", props)
+	}
+}
@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAgent serves the protocol over an in-memory connection and returns a client for it.
+func startAgent(t *testing.T) *Client {
+	t.Helper()
+	client, server := net.Pipe()
+	go Serve(server, server)
+	c := NewClient(client)
+	t.Cleanup(func() {
+		c.Close()
+		server.Close()
+	})
+	return c
+}
+
+func skipOnWindows(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test runs sh")
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	f := &Frame{Id: 7, Type: TypeExec, Argv: []string{"sh", "-c", "echo 'it''s'"}, Env: []string{"A=b c"}, Dir: "/tmp", Data: []byte{0, 1, 2}}
+	if err := WriteFrame(&buf, f); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	got, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, f) {
+		t.Fatalf("expected %#v but got %#v", f, got)
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	_, err := ReadFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestHello(t *testing.T) {
+	c := startAgent(t)
+	v, err := c.Hello()
+	if err != nil || v != Version {
+		t.Fatalf("expected version %d but got %d (err %v)", Version, v, err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	c := startAgent(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "it's a \"file\".txt")
+
+	info, err := c.Stat(file)
+	if err != nil || info.Exists {
+		t.Fatalf("expected the file not to exist but got %#v (err %v)", info, err)
+	}
+
+	contents := bytes.Repeat([]byte("line\n"), 30000)
+	if err := c.WriteFile(file, contents); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	info, err = c.Stat(file)
+	if err != nil || !info.Exists || info.IsDir || info.Size != int64(len(contents)) {
+		t.Fatalf("unexpected info %#v (err %v)", info, err)
+	}
+
+	got, err := c.ReadFile(file)
+	if err != nil || !bytes.Equal(got, contents) {
+		t.Fatalf("read %d bytes but expected %d (err %v)", len(got), len(contents), err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := c.List(dir)
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir {
+			names = append(names, e.Name+"/")
+		} else {
+			names = append(names, e.Name)
+		}
+	}
+	sort.Strings(names)
+	if expected := []string{"it's a \"file\".txt", "sub/"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v but got %v", expected, names)
+	}
+
+	if _, err := c.ReadFile(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("expected reading a missing file to fail")
+	}
+}
+
+func TestExec(t *testing.T) {
+	skipOnWindows(t)
+	c := startAgent(t)
+	dir := t.TempDir()
+
+	var stdout, stderr bytes.Buffer
+	err := c.Run(ExecOptions{
+		Argv:   []string{"sh", "-c", `pwd; echo "$GREETING"; cat; echo oops >&2; exit 3`},
+		Env:    []string{"GREETING=it's \"quoted\""},
+		Dir:    dir,
+		Stdin:  strings.NewReader("from stdin\n"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 {
+		t.Fatalf("expected exit status 3 but got %v", err)
+	}
+
+	wd, _ := filepath.EvalSymlinks(dir)
+	lines := strings.Split(stdout.String(), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("unexpected output %q", stdout.String())
+	}
+	if got, _ := filepath.EvalSymlinks(lines[0]); got != wd {
+		t.Fatalf("expected to run in %s but ran in %s", wd, lines[0])
+	}
+	if lines[1] != `it's "quoted"` || lines[2] != "from stdin" {
+		t.Fatalf("unexpected output %q", stdout.String())
+	}
+	if stderr.String() != "oops\n" {
+		t.Fatalf("unexpected error output %q", stderr.String())
+	}
+}
+
+func TestExecNotFound(t *testing.T) {
+	c := startAgent(t)
+	_, err := c.Start(ExecOptions{Argv: []string{"/no/such/command"}})
+	if err == nil {
+		t.Fatalf("expected starting a missing command to fail")
+	}
+}
+
+func TestSignal(t *testing.T) {
+	skipOnWindows(t)
+	c := startAgent(t)
+
+	p, err := c.Start(ExecOptions{Argv: []string{"sh", "-c", "sleep 10"}, CloseStdin: true})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if p.Pid == 0 {
+		t.Fatalf("expected the pid of the command")
+	}
+
+	if err := p.Signal(SigInt); err != nil {
+		t.Fatalf("signal failed: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- p.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the command was not interrupted")
+	}
+
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != -1 {
+		t.Fatalf("expected the command to be killed but got %v", err)
+	}
+}
+
+// blockingWriter blocks writes until release is closed. written has a value once the first write was made.
+type blockingWriter struct {
+	written chan struct{}
+	release chan struct{}
+}
+
+func (w blockingWriter) Write(b []byte) (int, error) {
+	select {
+	case w.written <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(b), nil
+}
+
+func TestSlowOutputDoesNotBlockOtherRequests(t *testing.T) {
+	skipOnWindows(t)
+	c := startAgent(t)
+
+	written, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+
+	// Far more output than fits in any buffer, none of which is taken until the end of the test
+	p, err := c.Start(ExecOptions{
+		Argv:       []string{"sh", "-c", "head -c 4000000 /dev/zero"},
+		CloseStdin: true,
+		Stdout:     blockingWriter{written, release},
+	})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer p.Signal(SigKill)
+
+	<-written
+	// Let the rest of the output arrive
+	time.Sleep(200 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if _, err := c.Stat("/"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("stat failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("requests were held up by the output of the command")
+	}
+}
+
+func TestClosed(t *testing.T) {
+	client, server := net.Pipe()
+	c := NewClient(client)
+	server.Close()
+
+	<-c.Done()
+	if _, err := c.Stat("/"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed but got %v", err)
+	}
+}
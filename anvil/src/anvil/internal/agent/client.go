@@ -0,0 +1,389 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrClosed is returned for requests made after the connection to the agent was closed or lost.
+var ErrClosed = errors.New("connection to the agent is closed")
+
+// ExitError is returned by Process.Wait when a command exits with a non-zero status, or is killed by a
+// signal, in which case Code is -1.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	if e.Code < 0 {
+		return "killed"
+	}
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Client is a connection to an agent. Its methods may be called from multiple goroutines.
+type Client struct {
+	conn io.ReadWriteCloser
+
+	writeLock sync.Mutex
+
+	lock   sync.Mutex
+	nextId uint64
+	// calls are the queues that the replies to each request are put on
+	calls map[uint64]*replyQueue
+	err   error
+	done  chan struct{}
+}
+
+// NewClient starts a client that speaks to the agent over conn.
+func NewClient(conn io.ReadWriteCloser) *Client {
+	c := &Client{
+		conn:  conn,
+		calls: map[uint64]*replyQueue{},
+		done:  make(chan struct{}),
+	}
+	go c.read()
+	return c
+}
+
+// Done is closed when the connection to the agent ends.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, once Done is closed.
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) read() {
+	var err error
+	for {
+		var f *Frame
+		f, err = ReadFrame(c.conn)
+		if err != nil {
+			break
+		}
+
+		c.lock.Lock()
+		q, ok := c.calls[f.Id]
+		c.lock.Unlock()
+		if ok {
+			q.put(f)
+		}
+	}
+
+	if err == io.EOF {
+		err = ErrClosed
+	}
+	c.lock.Lock()
+	c.err = err
+	calls := c.calls
+	c.calls = nil
+	c.lock.Unlock()
+
+	for _, q := range calls {
+		q.close()
+	}
+	close(c.done)
+}
+
+// replyQueue holds the replies to a request until they are taken. It has no limit, so that a request
+// whose replies are taken slowly, like a command whose output is waiting for a window, doesn't hold
+// up the replies to the other requests.
+type replyQueue struct {
+	lock   sync.Mutex
+	frames []*Frame
+	closed bool
+	// ready has a value when frames were added or the queue was closed
+	ready chan struct{}
+}
+
+func newReplyQueue() *replyQueue {
+	return &replyQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *replyQueue) put(f *Frame) {
+	q.lock.Lock()
+	q.frames = append(q.frames, f)
+	q.lock.Unlock()
+	q.signal()
+}
+
+func (q *replyQueue) close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+	q.signal()
+}
+
+func (q *replyQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for the next reply. ok is false if the queue was closed and has no more replies.
+func (q *replyQueue) next() (f *Frame, ok bool) {
+	for {
+		q.lock.Lock()
+		if len(q.frames) > 0 {
+			f = q.frames[0]
+			q.frames[0] = nil
+			q.frames = q.frames[1:]
+			q.lock.Unlock()
+			return f, true
+		}
+		closed := q.closed
+		q.lock.Unlock()
+
+		if closed {
+			return nil, false
+		}
+		<-q.ready
+	}
+}
+
+// start sends a request with a new id and returns the queue its replies are put on.
+func (c *Client) start(f *Frame) (q *replyQueue, err error) {
+	q = newReplyQueue()
+
+	c.lock.Lock()
+	if c.calls == nil {
+		c.lock.Unlock()
+		return nil, ErrClosed
+	}
+	c.nextId++
+	f.Id = c.nextId
+	c.calls[f.Id] = q
+	c.lock.Unlock()
+
+	if err = c.send(f); err != nil {
+		c.finish(f.Id)
+		return nil, err
+	}
+	return
+}
+
+func (c *Client) send(f *Frame) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return WriteFrame(c.conn, f)
+}
+
+// finish stops delivering the replies to the request.
+func (c *Client) finish(id uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.calls != nil {
+		delete(c.calls, id)
+	}
+}
+
+// call sends a request and returns its ok reply. Data frames before it are passed to data.
+func (c *Client) call(f *Frame, data func([]byte) error) (reply *Frame, err error) {
+	q, err := c.start(f)
+	if err != nil {
+		return
+	}
+	defer c.finish(f.Id)
+
+	for {
+		r, ok := q.next()
+		if !ok {
+			break
+		}
+		switch r.Type {
+		case TypeOk:
+			return r, err
+		case TypeError:
+			return nil, errors.New(r.Error)
+		case TypeData:
+			if data != nil && err == nil {
+				err = data(r.Data)
+			}
+		}
+	}
+	return nil, ErrClosed
+}
+
+// Hello returns the version of the protocol that the agent speaks.
+func (c *Client) Hello() (version int, err error) {
+	r, err := c.call(&Frame{Type: TypeHello}, nil)
+	if err != nil {
+		return
+	}
+	return r.Version, nil
+}
+
+func (c *Client) Stat(path string) (info FileInfo, err error) {
+	r, err := c.call(&Frame{Type: TypeStat, Path: path}, nil)
+	if err != nil {
+		return
+	}
+	if r.Info != nil {
+		info = *r.Info
+	}
+	return
+}
+
+func (c *Client) ReadFile(path string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := c.ReadFileTo(path, &buf)
+	return buf.Bytes(), err
+}
+
+// ReadFileTo writes the contents of the file to w as they arrive.
+func (c *Client) ReadFileTo(path string, w io.Writer) error {
+	_, err := c.call(&Frame{Type: TypeRead, Path: path}, func(b []byte) error {
+		_, err := w.Write(b)
+		return err
+	})
+	return err
+}
+
+func (c *Client) WriteFile(path string, contents []byte) error {
+	_, err := c.call(&Frame{Type: TypeWrite, Path: path, Data: contents}, nil)
+	return err
+}
+
+// List returns the entries of the directory.
+func (c *Client) List(path string) ([]FileInfo, error) {
+	r, err := c.call(&Frame{Type: TypeList, Path: path}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.Entries, nil
+}
+
+// ExecOptions describe a command to run.
+type ExecOptions struct {
+	Argv []string
+	// Env are variables in the form name=value added to the agent's environment
+	Env []string
+	Dir string
+	// Stdin, if not nil, is copied to the command's standard input, which is then closed. If it is nil
+	// standard input is closed immediately if CloseStdin is set, and otherwise left open.
+	Stdin      io.Reader
+	CloseStdin bool
+	Stdout     io.Writer
+	Stderr     io.Writer
+}
+
+// Process is a command started by the agent.
+type Process struct {
+	c   *Client
+	id  uint64
+	Pid int
+
+	done chan struct{}
+	err  error
+}
+
+// Start starts a command.
+func (c *Client) Start(opts ExecOptions) (p *Process, err error) {
+	f := &Frame{Type: TypeExec, Argv: opts.Argv, Env: opts.Env, Dir: opts.Dir}
+	q, err := c.start(f)
+	if err != nil {
+		return
+	}
+
+	r, ok := q.next()
+	switch {
+	case !ok:
+		c.finish(f.Id)
+		return nil, ErrClosed
+	case r.Type == TypeError:
+		c.finish(f.Id)
+		return nil, errors.New(r.Error)
+	}
+
+	p = &Process{c: c, id: f.Id, Pid: r.Pid, done: make(chan struct{})}
+
+	switch {
+	case opts.Stdin != nil:
+		go p.copyStdin(opts.Stdin)
+	case opts.CloseStdin:
+		c.send(&Frame{Id: p.id, Type: TypeStdin})
+	}
+
+	go p.receive(q, opts.Stdout, opts.Stderr)
+	return
+}
+
+// Run runs a command and waits for it to finish.
+func (c *Client) Run(opts ExecOptions) error {
+	p, err := c.Start(opts)
+	if err != nil {
+		return err
+	}
+	return p.Wait()
+}
+
+func (p *Process) receive(q *replyQueue, stdout, stderr io.Writer) {
+	defer close(p.done)
+	defer p.c.finish(p.id)
+
+	for {
+		r, ok := q.next()
+		if !ok {
+			break
+		}
+		switch r.Type {
+		case TypeStdout:
+			if stdout != nil {
+				stdout.Write(r.Data)
+			}
+		case TypeStderr:
+			if stderr != nil {
+				stderr.Write(r.Data)
+			}
+		case TypeExit:
+			switch {
+			case r.Error != "":
+				p.err = errors.New(r.Error)
+			case r.Code != 0:
+				p.err = &ExitError{Code: r.Code}
+			}
+			return
+		}
+	}
+	p.err = ErrClosed
+}
+
+func (p *Process) copyStdin(r io.Reader) {
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if p.c.send(&Frame{Id: p.id, Type: TypeStdin, Data: buf[:n]}) != nil {
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	p.c.send(&Frame{Id: p.id, Type: TypeStdin})
+}
+
+// Signal sends one of the signals SigInt, SigTerm or SigKill to the command.
+func (p *Process) Signal(sig string) error {
+	return p.c.send(&Frame{Id: p.id, Type: TypeSignal, Signal: sig})
+}
+
+// Wait waits for the command to exit and returns an *ExitError if its status was not zero.
+func (p *Process) Wait() error {
+	<-p.done
+	return p.err
+}
@@ -0,0 +1,155 @@
+// Package agent implements a small helper program that Anvil runs on remote hosts, and the client
+// that talks to it. The agent runs commands from an argument vector and reads, writes, stats and lists
+// files, so that none of these depend on how the remote shell quotes and interprets command lines.
+//
+// The agent is only used on Unix hosts. Anvil finds the host's platform with uname and installs the
+// agent using a POSIX shell, and builds of the agent are only made for Unix platforms.
+//
+// The client and agent exchange frames over the agent's standard input and output. Each frame is a
+// 4-byte big-endian length followed by that many bytes of JSON encoding a Frame. Every request has an
+// id chosen by the client, and all the frames the agent sends in reply carry the same id.
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Version is the version of the protocol. The agent reports it in reply to a hello request.
+const Version = 1
+
+// MaxFrameSize is the largest frame that is accepted.
+const MaxFrameSize = 64 * 1024 * 1024
+
+// chunkSize is the size of the data in the frames that stream file contents and command output.
+const chunkSize = 64 * 1024
+
+// The types of request frames.
+const (
+	// TypeHello asks for the protocol version. It is answered with an ok frame.
+	TypeHello = "hello"
+	// TypeStat asks for the FileInfo of Path. It is answered with an ok frame.
+	TypeStat = "stat"
+	// TypeRead asks for the contents of the file Path. They are sent in data frames followed by an ok frame.
+	TypeRead = "read"
+	// TypeWrite replaces the contents of the file Path with Data. It is answered with an ok frame.
+	TypeWrite = "write"
+	// TypeList asks for the entries of the directory Path. It is answered with an ok frame.
+	TypeList = "list"
+	// TypeExec runs Argv in Dir with Env added to the agent's environment. A started frame is sent
+	// once it is running, then stdout and stderr frames with its output, then an exit frame.
+	TypeExec = "exec"
+	// TypeStdin sends Data to the standard input of the command started by the exec request with the
+	// same id. An empty Data closes its standard input.
+	TypeStdin = "stdin"
+	// TypeSignal sends Signal to the command started by the exec request with the same id.
+	TypeSignal = "signal"
+)
+
+// The types of reply frames.
+const (
+	TypeOk      = "ok"
+	TypeError   = "error"
+	TypeData    = "data"
+	TypeStarted = "started"
+	TypeStdout  = "stdout"
+	TypeStderr  = "stderr"
+	TypeExit    = "exit"
+)
+
+// Signals that can be sent to commands.
+const (
+	SigInt  = "INT"
+	SigTerm = "TERM"
+	SigKill = "KILL"
+)
+
+// Frame is a request or a reply. The fields that are used depend on the Type.
+type Frame struct {
+	Id   uint64 `json:"id"`
+	Type string `json:"type"`
+
+	Path string   `json:"path,omitempty"`
+	Argv []string `json:"argv,omitempty"`
+	Env  []string `json:"env,omitempty"`
+	Dir  string   `json:"dir,omitempty"`
+	Data []byte   `json:"data,omitempty"`
+
+	Signal string `json:"signal,omitempty"`
+
+	Version int        `json:"version,omitempty"`
+	Pid     int        `json:"pid,omitempty"`
+	Code    int        `json:"code,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Info    *FileInfo  `json:"info,omitempty"`
+	Entries []FileInfo `json:"entries,omitempty"`
+}
+
+// FileInfo describes a file. A file that does not exist has Exists false and no other information.
+type FileInfo struct {
+	Name    string      `json:"name"`
+	Exists  bool        `json:"exists"`
+	IsDir   bool        `json:"isDir,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	ModTime time.Time   `json:"modTime,omitempty"`
+}
+
+func fileInfoOf(fi os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    fi.Name(),
+		Exists:  true,
+		IsDir:   fi.IsDir(),
+		Size:    fi.Size(),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+}
+
+// WriteFrame writes the frame preceded by its length.
+func WriteFrame(w io.Writer, f *Frame) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if len(b) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes is too large", len(b))
+	}
+
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a frame preceded by its length.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes is too large", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var f Frame
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("frame is not valid: %w", err)
+	}
+	return &f, nil
+}
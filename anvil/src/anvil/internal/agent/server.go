@@ -0,0 +1,290 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// Serve answers the requests read from r, writing the replies to w, until r ends. Commands that are
+// still running are killed when it returns.
+func Serve(r io.Reader, w io.Writer) error {
+	s := &server{
+		w:     w,
+		procs: map[uint64]*process{},
+	}
+	defer s.stopAll()
+
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		s.handle(f)
+	}
+}
+
+type server struct {
+	writeLock sync.Mutex
+	w         io.Writer
+
+	lock  sync.Mutex
+	procs map[uint64]*process
+}
+
+// process is a command started by an exec request.
+type process struct {
+	cmd *exec.Cmd
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	stdin   io.WriteCloser
+	pending [][]byte
+	// closing is set once the client asks for standard input to be closed
+	closing bool
+}
+
+func (s *server) send(f *Frame) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	WriteFrame(s.w, f)
+}
+
+func (s *server) sendError(id uint64, err error) {
+	s.send(&Frame{Id: id, Type: TypeError, Error: err.Error()})
+}
+
+func (s *server) handle(f *Frame) {
+	switch f.Type {
+	case TypeHello:
+		s.send(&Frame{Id: f.Id, Type: TypeOk, Version: Version})
+	case TypeStat:
+		go s.stat(f)
+	case TypeRead:
+		go s.read(f)
+	case TypeWrite:
+		go s.write(f)
+	case TypeList:
+		go s.list(f)
+	case TypeExec:
+		s.exec(f)
+	case TypeStdin:
+		if p, ok := s.process(f.Id); ok {
+			p.queueStdin(f.Data)
+		}
+	case TypeSignal:
+		if p, ok := s.process(f.Id); ok {
+			if err := signalProcess(p.cmd.Process, f.Signal); err != nil {
+				s.sendError(f.Id, err)
+			}
+		}
+	default:
+		s.send(&Frame{Id: f.Id, Type: TypeError, Error: "unknown request " + f.Type})
+	}
+}
+
+func statFile(path string) (FileInfo, error) {
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return FileInfo{Name: filepath.Base(path)}, nil
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return fileInfoOf(fi), nil
+}
+
+func (s *server) stat(f *Frame) {
+	info, err := statFile(f.Path)
+	if err != nil {
+		s.sendError(f.Id, err)
+		return
+	}
+	s.send(&Frame{Id: f.Id, Type: TypeOk, Info: &info})
+}
+
+func (s *server) read(f *Frame) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		s.sendError(f.Id, err)
+		return
+	}
+	defer file.Close()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			s.send(&Frame{Id: f.Id, Type: TypeData, Data: buf[:n]})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.sendError(f.Id, err)
+			return
+		}
+	}
+	s.send(&Frame{Id: f.Id, Type: TypeOk})
+}
+
+func (s *server) write(f *Frame) {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(f.Path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	if err := os.WriteFile(f.Path, f.Data, mode); err != nil {
+		s.sendError(f.Id, err)
+		return
+	}
+	s.send(&Frame{Id: f.Id, Type: TypeOk})
+}
+
+func (s *server) list(f *Frame) {
+	entries, err := os.ReadDir(f.Path)
+	if err != nil {
+		s.sendError(f.Id, err)
+		return
+	}
+
+	infos := make([]FileInfo, 0, len(entries))
+	for _, e := range entries {
+		// Follow symbolic links so that links to directories are listed as directories
+		fi, err := os.Stat(filepath.Join(f.Path, e.Name()))
+		if err != nil {
+			if fi, err = e.Info(); err != nil {
+				continue
+			}
+		}
+		info := fileInfoOf(fi)
+		info.Name = e.Name()
+		infos = append(infos, info)
+	}
+	s.send(&Frame{Id: f.Id, Type: TypeOk, Entries: infos})
+}
+
+func (s *server) exec(f *Frame) {
+	if len(f.Argv) == 0 {
+		s.send(&Frame{Id: f.Id, Type: TypeError, Error: "no command to run"})
+		return
+	}
+
+	cmd := exec.Command(f.Argv[0], f.Argv[1:]...)
+	cmd.Dir = f.Dir
+	cmd.Env = append(os.Environ(), f.Env...)
+	cmd.Stdout = &frameWriter{s: s, id: f.Id, typ: TypeStdout}
+	cmd.Stderr = &frameWriter{s: s, id: f.Id, typ: TypeStderr}
+	setProcAttrs(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		s.sendError(f.Id, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		s.sendError(f.Id, err)
+		return
+	}
+
+	p := &process{cmd: cmd, stdin: stdin}
+	p.cond = sync.NewCond(&p.lock)
+	s.lock.Lock()
+	s.procs[f.Id] = p
+	s.lock.Unlock()
+
+	s.send(&Frame{Id: f.Id, Type: TypeStarted, Pid: cmd.Process.Pid})
+
+	go p.writeStdin()
+	go func() {
+		err := cmd.Wait()
+		p.queueStdin(nil)
+
+		s.lock.Lock()
+		delete(s.procs, f.Id)
+		s.lock.Unlock()
+
+		reply := &Frame{Id: f.Id, Type: TypeExit}
+		var exitErr *exec.ExitError
+		switch {
+		case errors.As(err, &exitErr):
+			reply.Code = exitErr.ExitCode()
+		case err != nil:
+			reply.Code = -1
+			reply.Error = err.Error()
+		}
+		s.send(reply)
+	}()
+}
+
+func (s *server) process(id uint64) (p *process, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p, ok = s.procs[id]
+	return
+}
+
+// queueStdin queues data to write to the standard input of the process. Empty data closes it once
+// the data before it is written.
+func (p *process) queueStdin(data []byte) {
+	p.lock.Lock()
+	if len(data) == 0 {
+		p.closing = true
+	} else {
+		p.pending = append(p.pending, data)
+	}
+	p.lock.Unlock()
+	p.cond.Signal()
+}
+
+func (p *process) writeStdin() {
+	defer p.stdin.Close()
+	for {
+		p.lock.Lock()
+		for len(p.pending) == 0 && !p.closing {
+			p.cond.Wait()
+		}
+		if len(p.pending) == 0 {
+			p.lock.Unlock()
+			return
+		}
+		data := p.pending[0]
+		p.pending = p.pending[1:]
+		p.lock.Unlock()
+
+		if _, err := p.stdin.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+// frameWriter sends what is written to it in frames of the type.
+type frameWriter struct {
+	s   *server
+	id  uint64
+	typ string
+}
+
+func (w *frameWriter) Write(b []byte) (int, error) {
+	for i := 0; i < len(b); i += chunkSize {
+		end := min(i+chunkSize, len(b))
+		w.s.send(&Frame{Id: w.id, Type: w.typ, Data: b[i:end]})
+	}
+	return len(b), nil
+}
+
+func (s *server) stopAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, p := range s.procs {
+		signalProcess(p.cmd.Process, SigKill)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcAttrs runs the command in its own process group, so that signals reach the processes it starts.
+func setProcAttrs(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcess sends the signal to the process group of the process.
+func signalProcess(p *os.Process, sig string) error {
+	var s syscall.Signal
+	switch sig {
+	case SigInt:
+		s = syscall.SIGINT
+	case SigTerm:
+		s = syscall.SIGTERM
+	case SigKill:
+		s = syscall.SIGKILL
+	default:
+		return fmt.Errorf("unknown signal %s", sig)
+	}
+
+	if err := syscall.Kill(-p.Pid, s); err != nil {
+		return p.Signal(s)
+	}
+	return nil
+}
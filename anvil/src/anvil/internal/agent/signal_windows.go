@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func setProcAttrs(cmd *exec.Cmd) {
+}
+
+// signalProcess kills the process, since Windows has no signals that can be sent to other processes.
+func signalProcess(p *os.Process, sig string) error {
+	switch sig {
+	case SigInt, SigTerm, SigKill:
+		return p.Kill()
+	}
+	return fmt.Errorf("unknown signal %s", sig)
+}
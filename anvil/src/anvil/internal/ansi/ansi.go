@@ -53,3 +53,11 @@ func NRGBAToAnsiRgb(c *color.NRGBA) ansip.Rgb {
 	}
 	return ansip.Rgb{R: c.R, G: c.G, B: c.B}
 }
+
+// PaletteColor returns the color at index i in the 256 color palette. The first 16 are those set by InitColors.
+func PaletteColor(i uint8) color.NRGBA {
+	if int(i) >= len(ansip.Cols) {
+		return color.NRGBA{A: 0xff}
+	}
+	return ansiColorToNRGBA(ansip.Cols[i])
+}
@@ -0,0 +1,367 @@
+// Package bidi implements the parts of the Unicode Bidirectional Algorithm (UAX #9) needed
+// to display lines of plain text that mix left-to-right and right-to-left scripts.
+//
+// Each line of text is its own paragraph. The algorithm resolves the embedding level of each
+// rune of the paragraph, and then the runes of each displayed line are reordered into visual order.
+//
+// Two parts of the algorithm are not implemented: the explicit embedding, override and isolate
+// formatting characters (rules X1-X8) are treated as boundary neutrals and so have no effect, and
+// paired brackets are resolved as ordinary neutrals (rule N0 is skipped).
+package bidi
+
+import (
+	xbidi "golang.org/x/text/unicode/bidi"
+)
+
+// Level is an embedding level. Runes at even levels are displayed left-to-right and runes at odd
+// levels right-to-left.
+type Level uint8
+
+// IsRTL returns true if runes at the level are displayed right-to-left.
+func (l Level) IsRTL() bool {
+	return l&1 == 1
+}
+
+type class = xbidi.Class
+
+func classOf(r rune) class {
+	p, _ := xbidi.LookupRune(r)
+	c := p.Class()
+	if c == xbidi.Control || c > xbidi.Control {
+		// Explicit formatting characters are not supported.
+		return xbidi.BN
+	}
+	return c
+}
+
+// RequiresReordering returns true if the text contains runes that may not be displayed in
+// logical order when the paragraph direction is left-to-right. If it returns false, Levels
+// would return all zeros.
+func RequiresReordering(text []rune) bool {
+	for _, r := range text {
+		if r < 0x590 {
+			continue
+		}
+		switch classOf(r) {
+		case xbidi.R, xbidi.AL, xbidi.AN:
+			return true
+		}
+	}
+	return false
+}
+
+// ParagraphLevel returns the embedding level of the paragraph: 1 if the first strong rune is
+// right-to-left and 0 otherwise (rules P2 and P3).
+func ParagraphLevel(text []rune) Level {
+	for _, r := range text {
+		switch classOf(r) {
+		case xbidi.L:
+			return 0
+		case xbidi.R, xbidi.AL:
+			return 1
+		}
+	}
+	return 0
+}
+
+// Levels resolves the embedding level of each rune of the paragraph text, and returns the levels
+// and the paragraph embedding level. The text should not contain the paragraph separator that
+// ends it.
+//
+// Rule L1 is applied to segment separators, paragraph separators and the whitespace before them,
+// but not to the whitespace at the end of the text, which depends on how the text is broken into
+// lines; see VisualOrder.
+func Levels(text []rune) (levels []Level, paragraph Level) {
+	paragraph = ParagraphLevel(text)
+
+	levels = make([]Level, len(text))
+	for i := range levels {
+		levels[i] = paragraph
+	}
+	if paragraph == 0 && !RequiresReordering(text) {
+		return
+	}
+
+	orig := make([]class, len(text))
+	for i, r := range text {
+		orig[i] = classOf(r)
+	}
+
+	// Boundary neutrals are removed from the text before the weak and neutral rules are applied (X9)
+	// so the rules only look at the indices of the other runes.
+	idx := make([]int, 0, len(text))
+	for i, c := range orig {
+		if c != xbidi.BN {
+			idx = append(idx, i)
+		}
+	}
+	cls := make([]class, len(idx))
+	for j, i := range idx {
+		cls[j] = orig[i]
+	}
+
+	sos := xbidi.L
+	if paragraph.IsRTL() {
+		sos = xbidi.R
+	}
+	// The whole paragraph is one level run, so the end-of-sequence type is the same as the start.
+	eos := sos
+
+	resolveWeakTypes(cls, sos)
+	resolveNeutralTypes(cls, sos, eos, paragraph)
+
+	for j, i := range idx {
+		levels[i] = implicitLevel(paragraph, cls[j])
+	}
+
+	// Boundary neutrals take the level of the rune before them (or after them at the start of the text).
+	for i, c := range orig {
+		if c != xbidi.BN {
+			continue
+		}
+		switch {
+		case i > 0:
+			levels[i] = levels[i-1]
+		case len(idx) > 0:
+			levels[i] = levels[idx[0]]
+		}
+	}
+
+	resetSeparatorLevels(orig, levels, paragraph)
+	return
+}
+
+// resolveWeakTypes applies rules W1 to W7.
+func resolveWeakTypes(cls []class, sos class) {
+	// W1: non-spacing marks take the type of the previous rune.
+	prev := sos
+	for i, c := range cls {
+		if c == xbidi.NSM {
+			cls[i] = prev
+		}
+		prev = cls[i]
+	}
+
+	// W2: European numbers after Arabic letters are Arabic numbers. W3: Arabic letters are R.
+	lastStrong := sos
+	for i, c := range cls {
+		switch c {
+		case xbidi.L, xbidi.R, xbidi.AL:
+			lastStrong = c
+		case xbidi.EN:
+			if lastStrong == xbidi.AL {
+				cls[i] = xbidi.AN
+			}
+		}
+	}
+	for i, c := range cls {
+		if c == xbidi.AL {
+			cls[i] = xbidi.R
+		}
+	}
+
+	// W4: a single separator between two numbers of the same type takes the type of the numbers.
+	for i := 1; i+1 < len(cls); i++ {
+		before, after := cls[i-1], cls[i+1]
+		switch cls[i] {
+		case xbidi.ES:
+			if before == xbidi.EN && after == xbidi.EN {
+				cls[i] = xbidi.EN
+			}
+		case xbidi.CS:
+			if before == after && (before == xbidi.EN || before == xbidi.AN) {
+				cls[i] = before
+			}
+		}
+	}
+
+	// W5: terminators next to European numbers are European numbers.
+	for i := 0; i < len(cls); {
+		if cls[i] != xbidi.ET {
+			i++
+			continue
+		}
+		end := i
+		for end < len(cls) && cls[end] == xbidi.ET {
+			end++
+		}
+		if (i > 0 && cls[i-1] == xbidi.EN) || (end < len(cls) && cls[end] == xbidi.EN) {
+			for k := i; k < end; k++ {
+				cls[k] = xbidi.EN
+			}
+		}
+		i = end
+	}
+
+	// W6: the remaining separators and terminators are neutral.
+	for i, c := range cls {
+		switch c {
+		case xbidi.ES, xbidi.ET, xbidi.CS:
+			cls[i] = xbidi.ON
+		}
+	}
+
+	// W7: European numbers after left-to-right text are L.
+	lastStrong = sos
+	for i, c := range cls {
+		switch c {
+		case xbidi.L, xbidi.R:
+			lastStrong = c
+		case xbidi.EN:
+			if lastStrong == xbidi.L {
+				cls[i] = xbidi.L
+			}
+		}
+	}
+}
+
+func isNeutral(c class) bool {
+	switch c {
+	case xbidi.B, xbidi.S, xbidi.WS, xbidi.ON:
+		return true
+	}
+	return false
+}
+
+// strongDirection returns the direction a rune of the class counts as when resolving neutrals.
+func strongDirection(c class) class {
+	if c == xbidi.L {
+		return xbidi.L
+	}
+	// R, EN and AN
+	return xbidi.R
+}
+
+// resolveNeutralTypes applies rules N1 and N2.
+func resolveNeutralTypes(cls []class, sos, eos class, paragraph Level) {
+	embedding := xbidi.L
+	if paragraph.IsRTL() {
+		embedding = xbidi.R
+	}
+
+	for i := 0; i < len(cls); {
+		if !isNeutral(cls[i]) {
+			i++
+			continue
+		}
+
+		end := i
+		for end < len(cls) && isNeutral(cls[end]) {
+			end++
+		}
+
+		before := sos
+		if i > 0 {
+			before = strongDirection(cls[i-1])
+		}
+		after := eos
+		if end < len(cls) {
+			after = strongDirection(cls[end])
+		}
+
+		dir := embedding
+		if before == after {
+			dir = before
+		}
+		for k := i; k < end; k++ {
+			cls[k] = dir
+		}
+		i = end
+	}
+}
+
+// implicitLevel applies rules I1 and I2.
+func implicitLevel(l Level, c class) Level {
+	if !l.IsRTL() {
+		switch c {
+		case xbidi.R:
+			return l + 1
+		case xbidi.AN, xbidi.EN:
+			return l + 2
+		}
+		return l
+	}
+
+	switch c {
+	case xbidi.L, xbidi.EN, xbidi.AN:
+		return l + 1
+	}
+	return l
+}
+
+// resetSeparatorLevels applies rule L1 to segment and paragraph separators and the whitespace
+// before them.
+func resetSeparatorLevels(orig []class, levels []Level, paragraph Level) {
+	for i, c := range orig {
+		if c != xbidi.S && c != xbidi.B {
+			continue
+		}
+		levels[i] = paragraph
+		for k := i - 1; k >= 0 && isWhitespaceForReset(orig[k]); k-- {
+			levels[k] = paragraph
+		}
+	}
+}
+
+func isWhitespaceForReset(c class) bool {
+	return c == xbidi.WS || c == xbidi.BN
+}
+
+// VisualOrder returns the indices of the runes of a line of text in the order they are displayed,
+// from left to right. The line is part of a paragraph, and levels are the levels Levels resolved for
+// its runes.
+func VisualOrder(line []rune, levels []Level, paragraph Level) []int {
+	return Reorder(LineLevels(line, levels, paragraph))
+}
+
+// LineLevels returns a copy of the levels of the runes of a line of text with the whitespace at the
+// end of the line set to the paragraph level (rule L1).
+func LineLevels(line []rune, levels []Level, paragraph Level) []Level {
+	lv := make([]Level, len(levels))
+	copy(lv, levels)
+	for k := len(line) - 1; k >= 0 && isWhitespaceForReset(classOf(line[k])); k-- {
+		lv[k] = paragraph
+	}
+	return lv
+}
+
+// Reorder returns the indices of the items of a line with the levels in the order they are displayed,
+// from left to right. The runs of items at each level are reversed, starting at the highest level
+// (rule L2). The items may be runes, or clusters of runes that have the same level.
+func Reorder(levels []Level) []int {
+	order := make([]int, len(levels))
+	for i := range order {
+		order[i] = i
+	}
+
+	var highest, lowest Level = 0, 255
+	for _, l := range levels {
+		highest = max(highest, l)
+		lowest = min(lowest, l)
+	}
+	lowestOdd := lowest | 1
+
+	// Reversing a run at one level keeps the runs at lower levels in place, so the items at each
+	// position are at least the level being reversed if the items there originally were.
+	for level := highest; level >= lowestOdd; level-- {
+		for i := 0; i < len(levels); {
+			if levels[order[i]] < level {
+				i++
+				continue
+			}
+			end := i
+			for end < len(levels) && levels[order[end]] >= level {
+				end++
+			}
+			reverse(order[i:end])
+			i = end
+		}
+	}
+	return order
+}
+
+func reverse(s []int) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
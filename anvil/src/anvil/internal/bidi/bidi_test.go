@@ -0,0 +1,180 @@
+package bidi
+
+import (
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		paragraph Level
+		// levels is the expected level of each rune, one digit per rune
+		levels string
+	}{
+		{
+			name:      "ltr",
+			input:     "abc def",
+			paragraph: 0,
+			levels:    "0000000",
+		},
+		{
+			name:      "rtl",
+			input:     "אבג דה",
+			paragraph: 1,
+			levels:    "111111",
+		},
+		{
+			name:      "rtl in ltr",
+			input:     "ab אב cd",
+			paragraph: 0,
+			levels:    "00011000",
+		},
+		{
+			name:      "neutrals between different directions take the paragraph level",
+			input:     "ab - אב",
+			paragraph: 0,
+			levels:    "0000011",
+		},
+		{
+			name:      "numbers in rtl",
+			input:     "אב 12.5",
+			paragraph: 1,
+			levels:    "1112222",
+		},
+		{
+			name:      "european numbers after arabic letters are arabic numbers",
+			input:     "ab عب 12",
+			paragraph: 0,
+			levels:    "00011122",
+		},
+		{
+			name:      "european numbers in ltr",
+			input:     "ab 12",
+			paragraph: 0,
+			levels:    "00000",
+		},
+		{
+			name:      "terminators next to numbers",
+			input:     "א $12",
+			paragraph: 1,
+			levels:    "11222",
+		},
+		{
+			name:      "non-spacing marks take the level of their base",
+			input:     "aאּb",
+			paragraph: 0,
+			levels:    "0110",
+		},
+		{
+			name:      "tabs are at the paragraph level",
+			input:     "א \tב",
+			paragraph: 1,
+			levels:    "1111",
+		},
+		{
+			name:      "tabs in rtl text in ltr paragraph",
+			input:     "a א \tב",
+			paragraph: 0,
+			levels:    "001001",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			levels, paragraph := Levels([]rune(tc.input))
+			if paragraph != tc.paragraph {
+				t.Fatalf("expected paragraph level %d but got %d", tc.paragraph, paragraph)
+			}
+			if s := levelString(levels); s != tc.levels {
+				t.Fatalf("expected levels %s but got %s", tc.levels, s)
+			}
+		})
+	}
+}
+
+func levelString(levels []Level) string {
+	b := make([]byte, len(levels))
+	for i, l := range levels {
+		b[i] = '0' + byte(l)
+	}
+	return string(b)
+}
+
+func TestVisualOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "ltr",
+			input:    "abc",
+			expected: "abc",
+		},
+		{
+			name:     "rtl",
+			input:    "אבג דה",
+			expected: "הד גבא",
+		},
+		{
+			name:     "rtl in ltr",
+			input:    "ab אבג cd",
+			expected: "ab גבא cd",
+		},
+		{
+			name:     "ltr in rtl",
+			input:    "אב cd גד",
+			expected: "דג cd בא",
+		},
+		{
+			name:     "numbers in rtl keep their order",
+			input:    "אב 12.5 ג",
+			expected: "ג 12.5 בא",
+		},
+		{
+			name:     "trailing whitespace is at the paragraph level",
+			input:    "ab אב  ",
+			expected: "ab בא  ",
+		},
+		{
+			name:     "trailing whitespace of rtl paragraph",
+			input:    "אב cd  ",
+			expected: "  cd בא",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			text := []rune(tc.input)
+			levels, paragraph := Levels(text)
+			order := VisualOrder(text, levels, paragraph)
+
+			visual := make([]rune, len(order))
+			for i, j := range order {
+				visual[i] = text[j]
+			}
+			if string(visual) != tc.expected {
+				t.Fatalf("expected '%s' but got '%s'", tc.expected, string(visual))
+			}
+		})
+	}
+}
+
+func TestRequiresReordering(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"plain ascii", false},
+		{"café ñ", false},
+		{"ab אב", true},
+		{"ab ١٢", true},
+	}
+
+	for _, tc := range tests {
+		if got := RequiresReordering([]rune(tc.input)); got != tc.expected {
+			t.Errorf("for '%s' expected %v but got %v", tc.input, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrClosed is returned for requests made after the connection to the adapter was closed or lost.
+var ErrClosed = errors.New("connection to the debug adapter is closed")
+
+// ResponseError is returned when the adapter reports that a request failed.
+type ResponseError struct {
+	Command string
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s failed", e.Command)
+	}
+	return fmt.Sprintf("%s failed: %s", e.Command, e.Message)
+}
+
+// EventHandler is called with each event sent by the adapter, in the order they are sent. It is called
+// from the goroutine that reads from the adapter and so must not make requests itself.
+type EventHandler func(ev *Message)
+
+// Client is a connection to a debug adapter. Its methods may be called from multiple goroutines.
+type Client struct {
+	conn    io.ReadWriteCloser
+	onEvent EventHandler
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	seq     int
+	pending map[int]chan *Message
+	err     error
+
+	initialized     chan struct{}
+	initializedOnce sync.Once
+	done            chan struct{}
+}
+
+// NewClient starts a client that speaks to the adapter over conn.
+func NewClient(conn io.ReadWriteCloser, onEvent EventHandler) *Client {
+	c := &Client{
+		conn:        conn,
+		onEvent:     onEvent,
+		pending:     map[int]chan *Message{},
+		initialized: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go c.read()
+	return c
+}
+
+// Done is closed when the connection to the adapter ends.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, once Done is closed.
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Close closes the connection to the adapter.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) read() {
+	r := bufio.NewReader(c.conn)
+	var err error
+	for {
+		var m *Message
+		m, err = ReadMessage(r)
+		if err != nil {
+			break
+		}
+
+		switch m.Type {
+		case TypeResponse:
+			c.lock.Lock()
+			ch, ok := c.pending[m.RequestSeq]
+			delete(c.pending, m.RequestSeq)
+			c.lock.Unlock()
+			if ok {
+				ch <- m
+			}
+		case TypeEvent:
+			if m.Event == "initialized" {
+				c.initializedOnce.Do(func() { close(c.initialized) })
+			}
+			if c.onEvent != nil {
+				c.onEvent(m)
+			}
+		case TypeRequest:
+			// Reverse requests such as runInTerminal are not supported.
+			go c.send(&Message{
+				Type:       TypeResponse,
+				RequestSeq: m.Seq,
+				Command:    m.Command,
+				Message:    "not supported",
+			})
+		}
+	}
+
+	if err == io.EOF {
+		err = ErrClosed
+	}
+	c.lock.Lock()
+	c.err = err
+	pending := c.pending
+	c.pending = nil
+	c.lock.Unlock()
+
+	for _, ch := range pending {
+		close(ch)
+	}
+	close(c.done)
+}
+
+func (c *Client) send(m *Message) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.lock.Lock()
+	c.seq++
+	m.Seq = c.seq
+	c.lock.Unlock()
+
+	return WriteMessage(c.conn, m)
+}
+
+// Request sends a request with the arguments and waits for its response. If body is not nil the body
+// of the response is decoded into it.
+func (c *Client) Request(command string, args, body interface{}) error {
+	ch, err := c.sendRequest(command, args)
+	if err != nil {
+		return err
+	}
+	return c.waitForResponse(command, ch, body)
+}
+
+// sendRequest sends a request and returns the channel its response is sent on.
+func (c *Client) sendRequest(command string, args interface{}) (<-chan *Message, error) {
+	m := &Message{Type: TypeRequest, Command: command}
+	if args != nil {
+		a, err := json.Marshal(args)
+		if err != nil {
+			return nil, err
+		}
+		m.Arguments = a
+	}
+
+	ch := make(chan *Message, 1)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.lock.Lock()
+	if c.pending == nil {
+		c.lock.Unlock()
+		return nil, ErrClosed
+	}
+	c.seq++
+	m.Seq = c.seq
+	c.pending[m.Seq] = ch
+	c.lock.Unlock()
+
+	err := WriteMessage(c.conn, m)
+	if err != nil {
+		c.lock.Lock()
+		if c.pending != nil {
+			delete(c.pending, m.Seq)
+		}
+		c.lock.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (c *Client) waitForResponse(command string, ch <-chan *Message, body interface{}) error {
+	resp, ok := <-ch
+	if !ok {
+		return ErrClosed
+	}
+	if !resp.Success {
+		return &ResponseError{Command: command, Message: resp.Message}
+	}
+	return resp.DecodeBody(body)
+}
+
+// Start initializes the adapter and starts the debuggee with the launch request and its arguments. The
+// breakpoints, which are lines by source file path, are set before the debuggee runs. It returns the
+// breakpoints as the adapter set them.
+func (c *Client) Start(adapterId string, launchArgs interface{}, breakpoints map[string][]int) (set map[string][]Breakpoint, err error) {
+	err = c.Request("initialize", InitializeArguments{
+		ClientID:        "anvil",
+		ClientName:      "Anvil",
+		AdapterID:       adapterId,
+		PathFormat:      "path",
+		LinesStartAt1:   true,
+		ColumnsStartAt1: true,
+	}, nil)
+	if err != nil {
+		return
+	}
+
+	// Adapters may not respond to launch until the configuration is done, which happens after they send the
+	// initialized event.
+	ch, err := c.sendRequest("launch", launchArgs)
+	if err != nil {
+		return
+	}
+	launched := make(chan error, 1)
+	go func() {
+		launched <- c.waitForResponse("launch", ch, nil)
+	}()
+
+	select {
+	case <-c.initialized:
+	case err = <-launched:
+		if err != nil {
+			return
+		}
+		launched = nil
+		select {
+		case <-c.initialized:
+		case <-c.done:
+			return nil, c.Err()
+		}
+	case <-c.done:
+		return nil, c.Err()
+	}
+
+	set = map[string][]Breakpoint{}
+	for file, lines := range breakpoints {
+		var bps []Breakpoint
+		bps, err = c.SetBreakpoints(file, lines)
+		if err != nil {
+			return
+		}
+		set[file] = bps
+	}
+
+	err = c.Request("configurationDone", nil, nil)
+	if err != nil {
+		return
+	}
+
+	if launched != nil {
+		err = <-launched
+	}
+	return
+}
+
+// SetBreakpoints replaces the breakpoints in the source file with ones on the lines.
+func (c *Client) SetBreakpoints(file string, lines []int) ([]Breakpoint, error) {
+	args := SetBreakpointsArguments{
+		Source:      Source{Path: file},
+		Breakpoints: []SourceBreakpoint{},
+	}
+	for _, l := range lines {
+		args.Breakpoints = append(args.Breakpoints, SourceBreakpoint{Line: l})
+	}
+
+	var body SetBreakpointsResponseBody
+	err := c.Request("setBreakpoints", args, &body)
+	return body.Breakpoints, err
+}
+
+// StackTrace returns the frames of the thread, innermost first.
+func (c *Client) StackTrace(threadId int) ([]StackFrame, error) {
+	var body StackTraceResponseBody
+	err := c.Request("stackTrace", StackTraceArguments{ThreadId: threadId}, &body)
+	return body.StackFrames, err
+}
+
+// Scopes returns the scopes of the variables of a stack frame.
+func (c *Client) Scopes(frameId int) ([]Scope, error) {
+	var body ScopesResponseBody
+	err := c.Request("scopes", ScopesArguments{FrameId: frameId}, &body)
+	return body.Scopes, err
+}
+
+// Variables returns the variables of a scope, or the members of a variable.
+func (c *Client) Variables(ref int) ([]Variable, error) {
+	var body VariablesResponseBody
+	err := c.Request("variables", VariablesArguments{VariablesReference: ref}, &body)
+	return body.Variables, err
+}
+
+// Disconnect ends the debug session, terminating the debuggee if terminate is true.
+func (c *Client) Disconnect(terminate bool) error {
+	return c.Request("disconnect", DisconnectArguments{TerminateDebuggee: terminate}, nil)
+}
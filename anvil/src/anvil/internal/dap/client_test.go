@@ -0,0 +1,300 @@
+package dap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a debug adapter that answers requests using a script of handlers by command.
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+
+	handlers map[string]func(s *fakeServer, req *Message)
+
+	lock     sync.Mutex
+	seq      int
+	requests []*Message
+}
+
+func startFakeServer(t *testing.T, handlers map[string]func(s *fakeServer, req *Message)) (s *fakeServer, client net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	s = &fakeServer{t: t, conn: server, handlers: handlers}
+	t.Cleanup(func() { server.Close() })
+	go s.serve()
+	return
+}
+
+func (s *fakeServer) serve() {
+	r := bufio.NewReader(s.conn)
+	for {
+		req, err := ReadMessage(r)
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.requests = append(s.requests, req)
+		s.lock.Unlock()
+
+		h, ok := s.handlers[req.Command]
+		if !ok {
+			s.respond(req, nil)
+			continue
+		}
+		h(s, req)
+	}
+}
+
+func (s *fakeServer) write(m *Message) {
+	s.lock.Lock()
+	s.seq++
+	m.Seq = s.seq
+	s.lock.Unlock()
+	WriteMessage(s.conn, m)
+}
+
+func (s *fakeServer) respond(req *Message, body interface{}) {
+	m := &Message{Type: TypeResponse, RequestSeq: req.Seq, Command: req.Command, Success: true}
+	if body != nil {
+		m.Body, _ = json.Marshal(body)
+	}
+	s.write(m)
+}
+
+func (s *fakeServer) fail(req *Message, msg string) {
+	s.write(&Message{Type: TypeResponse, RequestSeq: req.Seq, Command: req.Command, Message: msg})
+}
+
+func (s *fakeServer) event(name string, body interface{}) {
+	m := &Message{Type: TypeEvent, Event: name}
+	if body != nil {
+		m.Body, _ = json.Marshal(body)
+	}
+	s.write(m)
+}
+
+func (s *fakeServer) commands() (cmds []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range s.requests {
+		cmds = append(cmds, r.Command)
+	}
+	return
+}
+
+func (s *fakeServer) request(cmd string) *Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range s.requests {
+		if r.Command == cmd {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestReadWriteMessage(t *testing.T) {
+	var buf bytes.Buffer
+	m := &Message{Seq: 3, Type: TypeRequest, Command: "next", Arguments: json.RawMessage(`{"threadId":1}`)}
+	err := WriteMessage(&buf, m)
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte("Content-Length: ")) {
+		t.Fatalf("message has no header: %q", buf.String())
+	}
+
+	got, err := ReadMessage(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Fatalf("expected %#v but got %#v", m, got)
+	}
+}
+
+func TestReadMessageWithoutLength(t *testing.T) {
+	_, err := ReadMessage(bufio.NewReader(bytes.NewBufferString("Content-Type: x\r\n\r\n{}")))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestStart(t *testing.T) {
+	var launch *Message
+	handlers := map[string]func(s *fakeServer, req *Message){
+		"initialize": func(s *fakeServer, req *Message) {
+			s.respond(req, nil)
+			s.event("initialized", nil)
+		},
+		// Like debugpy, respond to launch only once the configuration is done
+		"launch": func(s *fakeServer, req *Message) {
+			launch = req
+		},
+		"setBreakpoints": func(s *fakeServer, req *Message) {
+			var args SetBreakpointsArguments
+			json.Unmarshal(req.Arguments, &args)
+			var body SetBreakpointsResponseBody
+			for _, b := range args.Breakpoints {
+				body.Breakpoints = append(body.Breakpoints, Breakpoint{Verified: true, Line: b.Line})
+			}
+			s.respond(req, body)
+		},
+		"configurationDone": func(s *fakeServer, req *Message) {
+			s.respond(req, nil)
+			s.respond(launch, nil)
+		},
+	}
+
+	s, conn := startFakeServer(t, handlers)
+	c := NewClient(conn, nil)
+	defer c.Close()
+
+	set, err := c.Start("go", map[string]interface{}{"mode": "debug", "program": "/src/x"}, map[string][]int{"/src/x/main.go": {3, 7}})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	expected := []string{"initialize", "launch", "setBreakpoints", "configurationDone"}
+	if got := s.commands(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected requests %v but got %v", expected, got)
+	}
+
+	bps := set["/src/x/main.go"]
+	if len(bps) != 2 || bps[0].Line != 3 || bps[1].Line != 7 || !bps[0].Verified {
+		t.Fatalf("unexpected breakpoints %#v", bps)
+	}
+
+	var args map[string]interface{}
+	json.Unmarshal(s.request("launch").Arguments, &args)
+	if args["program"] != "/src/x" {
+		t.Fatalf("unexpected launch arguments %v", args)
+	}
+}
+
+func TestStartLaunchFails(t *testing.T) {
+	handlers := map[string]func(s *fakeServer, req *Message){
+		"launch": func(s *fakeServer, req *Message) {
+			s.fail(req, "could not build")
+		},
+	}
+
+	_, conn := startFakeServer(t, handlers)
+	c := NewClient(conn, nil)
+	defer c.Close()
+
+	_, err := c.Start("go", nil, nil)
+	var rerr *ResponseError
+	if !errors.As(err, &rerr) || rerr.Command != "launch" || rerr.Message != "could not build" {
+		t.Fatalf("expected the launch to fail but got %v", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	handlers := map[string]func(s *fakeServer, req *Message){
+		"next": func(s *fakeServer, req *Message) {
+			s.respond(req, nil)
+			s.event("output", OutputEventBody{Category: "stdout", Output: "hello\n"})
+			s.event("stopped", StoppedEventBody{Reason: "step", ThreadId: 4})
+		},
+	}
+
+	events := make(chan *Message, 10)
+	_, conn := startFakeServer(t, handlers)
+	c := NewClient(conn, func(ev *Message) { events <- ev })
+	defer c.Close()
+
+	if err := c.Request("next", ThreadArguments{ThreadId: 4}, nil); err != nil {
+		t.Fatalf("next failed: %v", err)
+	}
+
+	next := func() *Message {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for an event")
+		}
+		return nil
+	}
+
+	ev := next()
+	var out OutputEventBody
+	if ev.Event != "output" || ev.DecodeBody(&out) != nil || out.Output != "hello\n" {
+		t.Fatalf("unexpected event %#v", ev)
+	}
+
+	ev = next()
+	var stopped StoppedEventBody
+	if ev.Event != "stopped" || ev.DecodeBody(&stopped) != nil || stopped.ThreadId != 4 {
+		t.Fatalf("unexpected event %#v", ev)
+	}
+}
+
+func TestStackAndVariables(t *testing.T) {
+	handlers := map[string]func(s *fakeServer, req *Message){
+		"stackTrace": func(s *fakeServer, req *Message) {
+			s.respond(req, StackTraceResponseBody{StackFrames: []StackFrame{
+				{Id: 1000, Name: "main.f", Source: &Source{Path: "/src/x/main.go"}, Line: 12},
+				{Id: 1001, Name: "main.main", Source: &Source{Path: "/src/x/main.go"}, Line: 4},
+			}})
+		},
+		"scopes": func(s *fakeServer, req *Message) {
+			s.respond(req, ScopesResponseBody{Scopes: []Scope{{Name: "Locals", VariablesReference: 7}}})
+		},
+		"variables": func(s *fakeServer, req *Message) {
+			s.respond(req, VariablesResponseBody{Variables: []Variable{{Name: "n", Value: "3", Type: "int"}}})
+		},
+	}
+
+	_, conn := startFakeServer(t, handlers)
+	c := NewClient(conn, nil)
+	defer c.Close()
+
+	frames, err := c.StackTrace(1)
+	if err != nil || len(frames) != 2 || frames[0].Name != "main.f" || frames[0].Line != 12 {
+		t.Fatalf("unexpected frames %#v (err %v)", frames, err)
+	}
+
+	scopes, err := c.Scopes(frames[0].Id)
+	if err != nil || len(scopes) != 1 || scopes[0].VariablesReference != 7 {
+		t.Fatalf("unexpected scopes %#v (err %v)", scopes, err)
+	}
+
+	vars, err := c.Variables(scopes[0].VariablesReference)
+	if err != nil || len(vars) != 1 || vars[0].Value != "3" {
+		t.Fatalf("unexpected variables %#v (err %v)", vars, err)
+	}
+}
+
+func TestRequestAfterClose(t *testing.T) {
+	handlers := map[string]func(s *fakeServer, req *Message){
+		// Never respond, so that the request is pending when the connection closes
+		"continue": func(s *fakeServer, req *Message) {
+			s.conn.Close()
+		},
+	}
+
+	_, conn := startFakeServer(t, handlers)
+	c := NewClient(conn, nil)
+
+	err := c.Request("continue", ThreadArguments{ThreadId: 1}, nil)
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed but got %v", err)
+	}
+
+	<-c.Done()
+	err = c.Request("continue", ThreadArguments{ThreadId: 1}, nil)
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after the connection ended but got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+// Package dap is a client for the Debug Adapter Protocol, which editors use to control debuggers such as
+// Delve through a debug adapter. Only the parts of the protocol that Anvil uses are implemented.
+package dap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Message is a request, response or event. The fields that are used depend on the Type.
+type Message struct {
+	Seq  int    `json:"seq"`
+	Type string `json:"type"`
+
+	// Command is the command of a request or response
+	Command   string          `json:"command,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+
+	RequestSeq int    `json:"request_seq,omitempty"`
+	Success    bool   `json:"success,omitempty"`
+	Message    string `json:"message,omitempty"`
+
+	// Event is the kind of an event
+	Event string          `json:"event,omitempty"`
+	Body  json.RawMessage `json:"body,omitempty"`
+}
+
+const (
+	TypeRequest  = "request"
+	TypeResponse = "response"
+	TypeEvent    = "event"
+)
+
+// ReadMessage reads a message preceded by its Content-Length header.
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	hdr, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	l := hdr.Get("Content-Length")
+	if l == "" {
+		return nil, fmt.Errorf("message has no Content-Length header")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(l))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("message has an invalid Content-Length: %s", l)
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	var m Message
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("message is not valid: %w", err)
+	}
+	return &m, nil
+}
+
+// WriteMessage writes a message preceded by its Content-Length header.
+func WriteMessage(w io.Writer, m *Message) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Content-Length: %d\r\n\r\n", len(body))
+	buf.Write(body)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// DecodeBody decodes the body of a response or event into v.
+func (m *Message) DecodeBody(v interface{}) error {
+	if len(m.Body) == 0 || v == nil {
+		return nil
+	}
+	return json.Unmarshal(m.Body, v)
+}
+
+type InitializeArguments struct {
+	ClientID        string `json:"clientID"`
+	ClientName      string `json:"clientName"`
+	AdapterID       string `json:"adapterID"`
+	PathFormat      string `json:"pathFormat"`
+	LinesStartAt1   bool   `json:"linesStartAt1"`
+	ColumnsStartAt1 bool   `json:"columnsStartAt1"`
+}
+
+type Source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type SourceBreakpoint struct {
+	Line int `json:"line"`
+}
+
+type SetBreakpointsArguments struct {
+	Source      Source             `json:"source"`
+	Breakpoints []SourceBreakpoint `json:"breakpoints"`
+}
+
+type Breakpoint struct {
+	Id       int    `json:"id,omitempty"`
+	Verified bool   `json:"verified"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+type SetBreakpointsResponseBody struct {
+	Breakpoints []Breakpoint `json:"breakpoints"`
+}
+
+// ThreadArguments are the arguments of the requests that act on a thread: continue, next, stepIn,
+// stepOut and pause.
+type ThreadArguments struct {
+	ThreadId int `json:"threadId"`
+}
+
+type Thread struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type ThreadsResponseBody struct {
+	Threads []Thread `json:"threads"`
+}
+
+type StackTraceArguments struct {
+	ThreadId   int `json:"threadId"`
+	StartFrame int `json:"startFrame,omitempty"`
+	Levels     int `json:"levels,omitempty"`
+}
+
+type StackFrame struct {
+	Id     int     `json:"id"`
+	Name   string  `json:"name"`
+	Source *Source `json:"source,omitempty"`
+	Line   int     `json:"line"`
+	Column int     `json:"column"`
+}
+
+type StackTraceResponseBody struct {
+	StackFrames []StackFrame `json:"stackFrames"`
+	TotalFrames int          `json:"totalFrames,omitempty"`
+}
+
+type ScopesArguments struct {
+	FrameId int `json:"frameId"`
+}
+
+type Scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type ScopesResponseBody struct {
+	Scopes []Scope `json:"scopes"`
+}
+
+type VariablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+}
+
+type Variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type VariablesResponseBody struct {
+	Variables []Variable `json:"variables"`
+}
+
+type DisconnectArguments struct {
+	TerminateDebuggee bool `json:"terminateDebuggee"`
+}
+
+type StoppedEventBody struct {
+	Reason            string `json:"reason"`
+	Description       string `json:"description,omitempty"`
+	ThreadId          int    `json:"threadId,omitempty"`
+	Text              string `json:"text,omitempty"`
+	AllThreadsStopped bool   `json:"allThreadsStopped,omitempty"`
+}
+
+type OutputEventBody struct {
+	Category string `json:"category,omitempty"`
+	Output   string `json:"output"`
+}
+
+type ExitedEventBody struct {
+	ExitCode int `json:"exitCode"`
+}
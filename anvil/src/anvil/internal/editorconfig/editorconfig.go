@@ -0,0 +1,385 @@
+// Package editorconfig reads EditorConfig files (https://editorconfig.org) and finds the
+// properties that apply to a file.
+//
+// The .editorconfig files in the directory of the file and each directory above it are read,
+// stopping at a file that sets root = true. Sections of files closer to the file override
+// those of files further away, and later sections in a file override earlier ones.
+package editorconfig
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filename is the name of EditorConfig files.
+const Filename = ".editorconfig"
+
+// maxSectionNameLen is the longest glob a section may have; the specification allows
+// implementations to ignore longer sections.
+const maxSectionNameLen = 4096
+
+// Properties are the properties that apply to a file, keyed by lowercase property name.
+// The values of the properties defined by the specification are lowercase.
+type Properties map[string]string
+
+// File is a parsed EditorConfig file.
+type File struct {
+	// Root is true if the file sets root = true, so files in directories above it are not read.
+	Root     bool
+	sections []*section
+}
+
+type section struct {
+	glob  *glob
+	props []prop
+}
+
+type prop struct {
+	name, value string
+}
+
+// knownProperties are the properties whose values are case insensitive.
+var knownProperties = map[string]bool{
+	"indent_style":             true,
+	"indent_size":              true,
+	"tab_width":                true,
+	"end_of_line":              true,
+	"charset":                  true,
+	"trim_trailing_whitespace": true,
+	"insert_final_newline":     true,
+	"root":                     true,
+}
+
+// Parse parses an EditorConfig file.
+func Parse(r io.Reader) (*File, error) {
+	f := &File{}
+	var cur *section
+	preamble := true
+
+	s := bufio.NewScanner(r)
+	lineNum := 0
+	for s.Scan() {
+		lineNum++
+		line := strings.TrimSpace(s.Text())
+		if lineNum == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("line %d: section header is not closed", lineNum)
+			}
+			preamble = false
+			name := line[1 : len(line)-1]
+			cur = nil
+			if len(name) > maxSectionNameLen {
+				continue
+			}
+			g, err := compileGlob(name)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			cur = &section{glob: g}
+			f.sections = append(f.sections, cur)
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a section or a key = value pair", lineNum)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if knownProperties[name] {
+			value = strings.ToLower(value)
+		}
+
+		if preamble {
+			if name == "root" {
+				f.Root = value == "true"
+			}
+			continue
+		}
+		if cur != nil {
+			cur.props = append(cur.props, prop{name, value})
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Apply sets the properties of the sections of the file that match the file at path in props.
+// dir is the directory containing the EditorConfig file, and both paths use forward slashes.
+func (f *File) Apply(dir, filePath string, props Properties) {
+	rel, ok := relativePath(dir, filePath)
+	if !ok {
+		return
+	}
+
+	for _, s := range f.sections {
+		if !s.glob.match(rel) {
+			continue
+		}
+		for _, p := range s.props {
+			props[p.name] = p.value
+		}
+	}
+}
+
+func relativePath(dir, filePath string) (string, bool) {
+	if dir == "/" {
+		return strings.TrimPrefix(filePath, "/"), true
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if !strings.HasPrefix(filePath, dir+"/") {
+		return "", false
+	}
+	return filePath[len(dir)+1:], true
+}
+
+// ReadFunc reads the file at path. It returns an error for which errors.Is(err, fs.ErrNotExist)
+// is true if there is no such file.
+type ReadFunc func(path string) ([]byte, error)
+
+// Resolve finds the properties that apply to the file at filePath, which is an absolute path that
+// uses forward slashes, by reading the EditorConfig files above it using read.
+//
+// Properties set to "unset" are removed, and indent_size and tab_width are given their default
+// values as the specification describes.
+func Resolve(filePath string, read ReadFunc) (Properties, error) {
+	type found struct {
+		dir  string
+		file *File
+	}
+
+	var files []found
+	dir := path.Dir(filePath)
+	for {
+		b, err := read(path.Join(dir, Filename))
+		switch {
+		case err == nil:
+			f, err := Parse(strings.NewReader(string(b)))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path.Join(dir, Filename), err)
+			}
+			files = append(files, found{dir, f})
+			if f.Root {
+				dir = "/"
+			}
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+
+		parent := path.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	props := Properties{}
+	for i := len(files) - 1; i >= 0; i-- {
+		files[i].file.Apply(files[i].dir, filePath, props)
+	}
+	props.normalize()
+	return props, nil
+}
+
+func (p Properties) normalize() {
+	for k, v := range p {
+		if v == "unset" {
+			delete(p, k)
+		}
+	}
+
+	if p["indent_style"] == "tab" {
+		if _, ok := p["indent_size"]; !ok {
+			p["indent_size"] = "tab"
+		}
+	}
+	if tw, ok := p["tab_width"]; !ok && p["indent_size"] != "" && p["indent_size"] != "tab" {
+		p["tab_width"] = p["indent_size"]
+	} else if ok && p["indent_size"] == "tab" {
+		p["indent_size"] = tw
+	}
+}
+
+// Int returns the value of the property name as a positive integer, or 0 if it isn't one.
+func (p Properties) Int(name string) int {
+	n, err := strconv.Atoi(p[name])
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Bool returns the value of the property name as a boolean, and whether it's set to true or false.
+func (p Properties) Bool(name string) (value, ok bool) {
+	switch p[name] {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+	return false, false
+}
+
+// glob is a section name compiled to a regular expression. Numeric ranges like {1..3} are matched
+// as a number and checked separately.
+type glob struct {
+	re     *regexp.Regexp
+	ranges [][2]int
+}
+
+func (g *glob) match(p string) bool {
+	m := g.re.FindStringSubmatch(p)
+	if m == nil {
+		return false
+	}
+	for i, r := range g.ranges {
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil || n < r[0] || n > r[1] {
+			return false
+		}
+	}
+	return true
+}
+
+var numRangeRe = regexp.MustCompile(`^\{([+-]?\d+)\.\.([+-]?\d+)\}`)
+
+// compileGlob compiles a section name. A name that doesn't contain a slash matches files with that
+// name in any directory; otherwise it's matched against the path relative to the EditorConfig file.
+func compileGlob(name string) (*glob, error) {
+	g := &glob{}
+	var b strings.Builder
+	b.WriteString("^")
+
+	if !strings.Contains(name, "/") {
+		b.WriteString("(?:.*/)?")
+	}
+	name = strings.TrimPrefix(name, "/")
+
+	braceDepth := 0
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch c {
+		case '\\':
+			if i+1 < len(name) {
+				i++
+				b.WriteString(regexp.QuoteMeta(name[i : i+1]))
+			}
+		case '*':
+			if i+1 < len(name) && name[i+1] == '*' {
+				i++
+				if i+1 < len(name) && name[i+1] == '/' && (i < 2 || name[i-2] == '/') {
+					// "**/" matches zero or more directories
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(name[i+1:], ']')
+			if end < 0 || strings.Contains(name[i+1:i+1+end], "/") {
+				b.WriteString(`\[`)
+				break
+			}
+			class := name[i+1 : i+1+end]
+			i += end + 1
+			negate := strings.HasPrefix(class, "!") || strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			b.WriteString("[")
+			if negate {
+				b.WriteString("^")
+			}
+			b.WriteString(strings.ReplaceAll(class, `\`, `\\`))
+			b.WriteString("]")
+		case '{':
+			if m := numRangeRe.FindStringSubmatch(name[i:]); m != nil {
+				lo, _ := strconv.Atoi(m[1])
+				hi, _ := strconv.Atoi(m[2])
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				g.ranges = append(g.ranges, [2]int{lo, hi})
+				b.WriteString(`([+-]?\d+)`)
+				i += len(m[0]) - 1
+				break
+			}
+			if !hasAlternatives(name[i:]) {
+				b.WriteString(`\{`)
+				break
+			}
+			braceDepth++
+			b.WriteString("(?:")
+		case '}':
+			if braceDepth == 0 {
+				b.WriteString(`\}`)
+				break
+			}
+			braceDepth--
+			b.WriteString(")")
+		case ',':
+			if braceDepth == 0 {
+				b.WriteString(",")
+				break
+			}
+			b.WriteString("|")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid section name: %w", err)
+	}
+	g.re = re
+	return g, nil
+}
+
+// hasAlternatives returns true if the text, which starts with an opening brace, has a matching
+// closing brace with a comma between them. Other braces are matched literally.
+func hasAlternatives(s string) bool {
+	depth := 0
+	comma := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return comma
+			}
+		case ',':
+			if depth == 1 {
+				comma = true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package editorconfig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGlobs(t *testing.T) {
+	tests := []struct {
+		glob    string
+		matches []string
+		misses  []string
+	}{
+		{
+			glob:    "*",
+			matches: []string{"a.go", "dir/a.go"},
+		},
+		{
+			glob:    "*.go",
+			matches: []string{"a.go", "dir/sub/a.go"},
+			misses:  []string{"a.goo", "a.c"},
+		},
+		{
+			glob:    "Makefile",
+			matches: []string{"Makefile", "dir/Makefile"},
+			misses:  []string{"Makefile.am"},
+		},
+		{
+			glob:    "lib/*.js",
+			matches: []string{"lib/a.js"},
+			misses:  []string{"lib/sub/a.js", "dir/lib/a.js"},
+		},
+		{
+			glob:    "/top.txt",
+			matches: []string{"top.txt"},
+			misses:  []string{"dir/top.txt"},
+		},
+		{
+			glob:    "src/**/*.go",
+			matches: []string{"src/a.go", "src/x/y/a.go"},
+			misses:  []string{"a.go"},
+		},
+		{
+			glob:    "*.{js,py}",
+			matches: []string{"a.js", "a.py"},
+			misses:  []string{"a.c", "a.{js,py}"},
+		},
+		{
+			glob:    "{package.json,.travis.yml}",
+			matches: []string{"package.json", "dir/.travis.yml"},
+		},
+		{
+			glob:    "file?.[ch]",
+			matches: []string{"file1.c", "filex.h"},
+			misses:  []string{"file.c", "file1.o"},
+		},
+		{
+			glob:    "file[!ab].txt",
+			matches: []string{"filec.txt"},
+			misses:  []string{"filea.txt"},
+		},
+		{
+			glob:    "f{1..3}.txt",
+			matches: []string{"f1.txt", "f3.txt"},
+			misses:  []string{"f4.txt", "f0.txt", "fx.txt"},
+		},
+		{
+			glob:    "{single}.txt",
+			matches: []string{"{single}.txt"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.glob, func(t *testing.T) {
+			g, err := compileGlob(tc.glob)
+			if err != nil {
+				t.Fatalf("compiling failed: %v", err)
+			}
+			for _, p := range tc.matches {
+				if !g.match(p) {
+					t.Errorf("expected %s to match", p)
+				}
+			}
+			for _, p := range tc.misses {
+				if g.match(p) {
+					t.Errorf("expected %s not to match", p)
+				}
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	files := map[string]string{
+		"/.editorconfig": `
+[*]
+indent_style = tab
+`,
+		"/proj/.editorconfig": `
+# top of the project
+root = true
+
+[*]
+indent_style = space
+indent_size = 4
+end_of_line = LF
+insert_final_newline = true
+
+[*.go]
+indent_style = tab
+indent_size = unset
+
+[Makefile]
+indent_style = tab
+tab_width = 8
+`,
+		"/proj/docs/.editorconfig": `
+[*.md]
+trim_trailing_whitespace = false
+indent_size = 2
+`,
+	}
+
+	root := t.TempDir()
+	for path, contents := range files {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		expected Properties
+	}{
+		{
+			path: "/proj/src/main.py",
+			expected: Properties{
+				"indent_style":         "space",
+				"indent_size":          "4",
+				"tab_width":            "4",
+				"end_of_line":          "lf",
+				"insert_final_newline": "true",
+			},
+		},
+		{
+			path: "/proj/main.go",
+			expected: Properties{
+				"indent_style":         "tab",
+				"indent_size":          "tab",
+				"end_of_line":          "lf",
+				"insert_final_newline": "true",
+			},
+		},
+		{
+			path: "/proj/Makefile",
+			expected: Properties{
+				"indent_style":         "tab",
+				"indent_size":          "4",
+				"tab_width":            "8",
+				"end_of_line":          "lf",
+				"insert_final_newline": "true",
+			},
+		},
+		{
+			path: "/proj/docs/guide.md",
+			expected: Properties{
+				"indent_style":             "space",
+				"indent_size":              "2",
+				"tab_width":                "2",
+				"end_of_line":              "lf",
+				"insert_final_newline":     "true",
+				"trim_trailing_whitespace": "false",
+			},
+		},
+		{
+			path: "/other/a.c",
+			expected: Properties{
+				"indent_style": "tab",
+				"indent_size":  "tab",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			props, err := Resolve(filepath.ToSlash(root)+tc.path, os.ReadFile)
+			if err != nil {
+				t.Fatalf("resolving failed: %v", err)
+			}
+			if !reflect.DeepEqual(props, tc.expected) {
+				t.Fatalf("expected %v but got %v", tc.expected, props)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse(strings.NewReader("[*.go\nindent_style = tab\n"))
+	if err == nil {
+		t.Fatalf("expected an unclosed section to be an error")
+	}
+
+	_, err = Parse(strings.NewReader("[*]\nindent_style\n"))
+	if err == nil {
+		t.Fatalf("expected a line without a value to be an error")
+	}
+}
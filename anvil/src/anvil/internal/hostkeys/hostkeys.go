@@ -0,0 +1,321 @@
+// Package hostkeys verifies the host keys presented by SSH servers against known_hosts files,
+// and implements trust-on-first-use for the keys of hosts that are not yet known.
+package hostkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Policy controls what happens when a host presents a key that is not in any known_hosts file.
+// A key that differs from the known key for a host is always rejected.
+type Policy string
+
+const (
+	// PolicyAsk rejects the key of an unknown host but remembers it so that the user may accept it.
+	PolicyAsk Policy = "ask"
+	// PolicyAcceptNew trusts the key of an unknown host and records it in the trust file.
+	PolicyAcceptNew Policy = "accept-new"
+	// PolicyStrict only trusts keys that are already in a known_hosts file.
+	PolicyStrict Policy = "strict"
+	// PolicyInsecure does not check host keys at all.
+	PolicyInsecure Policy = "insecure"
+)
+
+// ParsePolicy parses a policy name. The empty string means PolicyAsk.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case "":
+		return PolicyAsk, nil
+	case PolicyAsk, PolicyAcceptNew, PolicyStrict, PolicyInsecure:
+		return p, nil
+	}
+	return PolicyAsk, fmt.Errorf("invalid host key policy '%s'. Expected one of ask, accept-new, strict or insecure", s)
+}
+
+// UnknownKey is a key presented by a host that has no key in any known_hosts file.
+type UnknownKey struct {
+	// Host is the address of the host in the normalized known_hosts form
+	Host string
+	Key  ssh.PublicKey
+}
+
+func (k UnknownKey) Fingerprint() string {
+	return ssh.FingerprintSHA256(k.Key)
+}
+
+// UnknownHostError is returned by the host key callback when the key of an unknown host is rejected.
+type UnknownHostError struct {
+	UnknownKey
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("the authenticity of host %s can't be established: it presented the unknown %s key %s",
+		e.Host, e.Key.Type(), e.Fingerprint())
+}
+
+// MismatchError is returned by the host key callback when a host presents a key that differs from the
+// key recorded for it. This may mean that someone is intercepting the connection.
+type MismatchError struct {
+	Host string
+	Key  ssh.PublicKey
+	Want []knownhosts.KnownKey
+}
+
+func (e *MismatchError) Error() string {
+	msg := fmt.Sprintf("HOST KEY MISMATCH for %s: it presented the %s key %s", e.Host, e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+	for _, w := range e.Want {
+		msg += fmt.Sprintf("; expected %s", w.String())
+	}
+	return msg
+}
+
+// Verifier checks host keys against the user's known_hosts files and a trust file that holds
+// the keys accepted through the Verifier.
+type Verifier struct {
+	lock            sync.Mutex
+	policy          Policy
+	trustFile       string
+	knownHostsFiles []string
+	pending         map[string]UnknownKey
+	onUnknownKey    func(k UnknownKey)
+}
+
+// New creates a Verifier that reads known keys from the knownHostsFiles and from the trustFile,
+// and writes accepted keys to the trustFile. None of the files need exist.
+func New(policy Policy, trustFile string, knownHostsFiles ...string) *Verifier {
+	return &Verifier{
+		policy:          policy,
+		trustFile:       trustFile,
+		knownHostsFiles: knownHostsFiles,
+		pending:         map[string]UnknownKey{},
+	}
+}
+
+func (v *Verifier) SetPolicy(p Policy) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.policy = p
+}
+
+func (v *Verifier) Policy() Policy {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.policy
+}
+
+// OnUnknownKey sets a function that is called when the key of an unknown host is rejected
+// under PolicyAsk, so that the user may be asked to accept it.
+func (v *Verifier) OnUnknownKey(fn func(k UnknownKey)) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.onUnknownKey = fn
+}
+
+// HostKeyCallback returns a callback for use in an ssh.ClientConfig.
+func (v *Verifier) HostKeyCallback() ssh.HostKeyCallback {
+	return v.check
+}
+
+func (v *Verifier) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	v.lock.Lock()
+	policy := v.policy
+	v.lock.Unlock()
+
+	if policy == PolicyInsecure {
+		return nil
+	}
+
+	host := knownhosts.Normalize(hostname)
+
+	err := v.checkKnownHosts(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+
+	// As with OpenSSH, a key of a type that isn't known for the host is treated like the key of an
+	// unknown host rather than as a changed key.
+	for _, w := range keyErr.Want {
+		if w.Key.Type() == key.Type() {
+			return &MismatchError{Host: host, Key: key, Want: keyErr.Want}
+		}
+	}
+
+	unknown := UnknownKey{Host: host, Key: key}
+
+	switch policy {
+	case PolicyAcceptNew:
+		return v.trust(unknown)
+	case PolicyStrict:
+		return &UnknownHostError{unknown}
+	}
+
+	v.lock.Lock()
+	v.pending[host] = unknown
+	fn := v.onUnknownKey
+	v.lock.Unlock()
+
+	if fn != nil {
+		fn(unknown)
+	}
+	return &UnknownHostError{unknown}
+}
+
+func (v *Verifier) checkKnownHosts(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	var files []string
+	for _, f := range append([]string{v.trustFile}, v.knownHostsFiles...) {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+
+	if len(files) == 0 {
+		return &knownhosts.KeyError{}
+	}
+
+	cb, err := knownhosts.New(files...)
+	if err != nil {
+		return err
+	}
+
+	return cb(hostname, remote, key)
+}
+
+// hostKeyAlgorithms lists the host key algorithms for each type of key, in order of preference.
+var hostKeyAlgorithms = []struct {
+	keyType string
+	algos   []string
+}{
+	{ssh.KeyAlgoED25519, []string{ssh.KeyAlgoED25519}},
+	{ssh.KeyAlgoECDSA256, []string{ssh.KeyAlgoECDSA256}},
+	{ssh.KeyAlgoECDSA384, []string{ssh.KeyAlgoECDSA384}},
+	{ssh.KeyAlgoECDSA521, []string{ssh.KeyAlgoECDSA521}},
+	{ssh.KeyAlgoSKED25519, []string{ssh.KeyAlgoSKED25519}},
+	{ssh.KeyAlgoSKECDSA256, []string{ssh.KeyAlgoSKECDSA256}},
+	{ssh.KeyAlgoRSA, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}},
+	{ssh.KeyAlgoDSA, []string{ssh.KeyAlgoDSA}},
+}
+
+// HostKeyAlgorithms returns the host key algorithms for the types of keys known for the host, given as
+// host:port, for use in an ssh.ClientConfig. Otherwise the server may present a key of another type
+// than the known one. It returns nil if no keys are known for the host.
+func (v *Verifier) HostKeyAlgorithms(hostport string) []string {
+	known := map[string]bool{}
+	for _, k := range v.knownKeys(hostport) {
+		known[k.Key.Type()] = true
+	}
+
+	var algos []string
+	for _, a := range hostKeyAlgorithms {
+		if known[a.keyType] {
+			algos = append(algos, a.algos...)
+		}
+	}
+	return algos
+}
+
+// knownKeys returns the known keys for the host, one of each type.
+func (v *Verifier) knownKeys(hostport string) []knownhosts.KnownKey {
+	probe, err := probeKey()
+	if err != nil {
+		return nil
+	}
+
+	// The known keys are listed in the error for a key that can't match them. The remote address
+	// is only used when no hostname is given.
+	err = v.checkKnownHosts(hostport, &net.TCPAddr{IP: net.IPv4zero}, probe)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+	return keyErr.Want
+}
+
+var (
+	probeKeyOnce sync.Once
+	probeKeyPub  ssh.PublicKey
+	probeKeyErr  error
+)
+
+// probeKey returns a newly generated key, which is not known for any host.
+func probeKey() (ssh.PublicKey, error) {
+	probeKeyOnce.Do(func() {
+		var pub ed25519.PublicKey
+		pub, _, probeKeyErr = ed25519.GenerateKey(rand.Reader)
+		if probeKeyErr == nil {
+			probeKeyPub, probeKeyErr = ssh.NewPublicKey(pub)
+		}
+	})
+	return probeKeyPub, probeKeyErr
+}
+
+// Pending returns the rejected keys of unknown hosts that may be accepted, sorted by host.
+func (v *Verifier) Pending() []UnknownKey {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := make([]UnknownKey, 0, len(v.pending))
+	for _, k := range v.pending {
+		r = append(r, k)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Host < r[j].Host
+	})
+	return r
+}
+
+// Accept trusts the pending key of the host by writing it to the trust file. The host may be given
+// as host, host:port or in the normalized known_hosts form.
+func (v *Verifier) Accept(host string) error {
+	v.lock.Lock()
+	k, ok := v.pending[host]
+	if !ok {
+		k, ok = v.pending[knownhosts.Normalize(host)]
+	}
+	v.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no unknown host key is pending for %s", host)
+	}
+
+	return v.trust(k)
+}
+
+func (v *Verifier) trust(k UnknownKey) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(v.trustFile), 0o700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(v.trustFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{k.Host}, k.Key))
+	if err != nil {
+		return err
+	}
+
+	delete(v.pending, k.Host)
+	return nil
+}
@@ -0,0 +1,269 @@
+package hostkeys
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startServer starts an in-process SSH server that presents one of the host keys and accepts any client.
+// It returns the address of the server.
+func startServer(t *testing.T, hostKeys ...ssh.Signer) string {
+	t.Helper()
+
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	for _, k := range hostKeys {
+		conf.AddHostKey(k)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, conf)
+				if err != nil {
+					c.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func newHostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key failed: %v", err)
+	}
+	s, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("making signer failed: %v", err)
+	}
+	return s
+}
+
+func newSigner(t *testing.T, key interface{}) ssh.Signer {
+	t.Helper()
+
+	s, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("making signer failed: %v", err)
+	}
+	return s
+}
+
+func dial(addr string, v *Verifier, hostKeyAlgos ...string) error {
+	c, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:              "test",
+		HostKeyCallback:   v.HostKeyCallback(),
+		HostKeyAlgorithms: hostKeyAlgos,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	dir := t.TempDir()
+	addr := startServer(t, newHostKey(t))
+
+	v := New(PolicyAsk, filepath.Join(dir, "known_hosts"), filepath.Join(dir, "missing"))
+
+	var notified []UnknownKey
+	v.OnUnknownKey(func(k UnknownKey) {
+		notified = append(notified, k)
+	})
+
+	err := dial(addr, v)
+	var unknownErr *UnknownHostError
+	if !errors.As(err, &unknownErr) {
+		t.Fatalf("expected an unknown host error for a new host but got %v", err)
+	}
+
+	if len(notified) != 1 {
+		t.Fatalf("expected to be notified once of the unknown key but was notified %d times", len(notified))
+	}
+
+	pending := v.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 pending key but got %d", len(pending))
+	}
+
+	err = v.Accept(addr)
+	if err != nil {
+		t.Fatalf("accepting the key failed: %v", err)
+	}
+
+	if len(v.Pending()) != 0 {
+		t.Fatalf("expected no pending keys after accepting")
+	}
+
+	err = dial(addr, v)
+	if err != nil {
+		t.Fatalf("dial after accepting the key failed: %v", err)
+	}
+
+	// A new verifier reading the same trust file should also trust the key
+	v2 := New(PolicyStrict, filepath.Join(dir, "known_hosts"))
+	err = dial(addr, v2)
+	if err != nil {
+		t.Fatalf("dial using the trust file failed: %v", err)
+	}
+}
+
+func TestStrictRejectsUnknownHost(t *testing.T) {
+	dir := t.TempDir()
+	addr := startServer(t, newHostKey(t))
+
+	v := New(PolicyStrict, filepath.Join(dir, "known_hosts"))
+
+	err := dial(addr, v)
+	var unknownErr *UnknownHostError
+	if !errors.As(err, &unknownErr) {
+		t.Fatalf("expected an unknown host error but got %v", err)
+	}
+
+	if len(v.Pending()) != 0 {
+		t.Fatalf("strict policy should not remember keys to accept")
+	}
+}
+
+func TestMismatchIsRejected(t *testing.T) {
+	dir := t.TempDir()
+	trustFile := filepath.Join(dir, "known_hosts")
+
+	// The server presents a different key than the one recorded for its address
+	recorded := newHostKey(t)
+	addr := startServer(t, newHostKey(t))
+
+	v := New(PolicyAcceptNew, trustFile)
+	err := v.trust(UnknownKey{Host: knownhosts.Normalize(addr), Key: recorded.PublicKey()})
+	if err != nil {
+		t.Fatalf("writing trust file failed: %v", err)
+	}
+
+	err = dial(addr, v)
+	var mismatchErr *MismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("expected a mismatch error but got %v", err)
+	}
+
+	if len(v.Pending()) != 0 {
+		t.Fatalf("a mismatched key should never be pending")
+	}
+}
+
+func TestHostWithSeveralKeyTypes(t *testing.T) {
+	dir := t.TempDir()
+	trustFile := filepath.Join(dir, "known_hosts")
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key failed: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key failed: %v", err)
+	}
+
+	// Only the ed25519 key of the server is known
+	known := newHostKey(t)
+	addr := startServer(t, known, newSigner(t, ecdsaKey), newSigner(t, rsaKey))
+
+	v := New(PolicyStrict, trustFile)
+	if algos := v.HostKeyAlgorithms(addr); algos != nil {
+		t.Fatalf("expected no algorithms for an unknown host but got %v", algos)
+	}
+
+	err = v.trust(UnknownKey{Host: knownhosts.Normalize(addr), Key: known.PublicKey()})
+	if err != nil {
+		t.Fatalf("writing trust file failed: %v", err)
+	}
+
+	algos := v.HostKeyAlgorithms(addr)
+	if len(algos) != 1 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("expected the ed25519 algorithm but got %v", algos)
+	}
+
+	err = dial(addr, v, algos...)
+	if err != nil {
+		t.Fatalf("dial using the known key type failed: %v", err)
+	}
+
+	// Left to choose, the client prefers an ecdsa key, which is of a type not known for the host
+	err = dial(addr, v)
+	var unknownErr *UnknownHostError
+	if !errors.As(err, &unknownErr) {
+		t.Fatalf("expected an unknown host error for a key of another type but got %v", err)
+	}
+	if unknownErr.Key.Type() != ssh.KeyAlgoECDSA256 {
+		t.Fatalf("expected the server to present its ecdsa key but got %s", unknownErr.Key.Type())
+	}
+}
+
+func TestAcceptNewTrustsUnknownHost(t *testing.T) {
+	dir := t.TempDir()
+	addr := startServer(t, newHostKey(t))
+
+	v := New(PolicyAcceptNew, filepath.Join(dir, "known_hosts"))
+	err := dial(addr, v)
+	if err != nil {
+		t.Fatalf("accept-new should trust a new host but got %v", err)
+	}
+
+	v2 := New(PolicyStrict, filepath.Join(dir, "known_hosts"))
+	err = dial(addr, v2)
+	if err != nil {
+		t.Fatalf("the key accepted by accept-new was not recorded: %v", err)
+	}
+}
+
+func TestInsecureAcceptsAnything(t *testing.T) {
+	dir := t.TempDir()
+	addr := startServer(t, newHostKey(t))
+
+	v := New(PolicyInsecure, filepath.Join(dir, "known_hosts"))
+	err := dial(addr, v)
+	if err != nil {
+		t.Fatalf("insecure policy should accept any key but got %v", err)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy("")
+	if err != nil || p != PolicyAsk {
+		t.Fatalf("expected the empty policy to mean ask but got %v, %v", p, err)
+	}
+
+	_, err = ParsePolicy("bogus")
+	if err == nil {
+		t.Fatalf("expected an error for an invalid policy")
+	}
+}
@@ -0,0 +1,577 @@
+// Package inclex tokenises text using a syn lexer incrementally. The state of the lexer is saved at
+// checkpoints while the text is lexed, and when the text is changed lexing resumes from the last
+// checkpoint before the change rather than from the start of the text. Lexing stops once it is past
+// the change and the state of the lexer is the same as the state it had at a checkpoint at the same
+// place in the text before the change, since from there on the tokens must be the same as before.
+//
+// The tokens before the checkpoint are assumed not to depend on the text after it, which is not always
+// true: a pattern may look past the end of the text it matches, and a pattern that fails to match may have
+// needed the text after it. For example a block comment that is not terminated is lexed differently once a
+// terminator is added after it, even much later in the text. To lower the chance of that making a
+// difference lexing resumes a number of lines before the change, and before any error tokens.
+package inclex
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jeffwilliams/syn"
+)
+
+// Token is a token found by the lexer. Start and End are rune indexes into the text.
+type Token struct {
+	Start, End int
+	Type       syn.TokenType
+}
+
+// Lexer lexes a text incrementally. It is safe to call Changed concurrently with the other methods.
+type Lexer struct {
+	lexer      *syn.Lexer
+	interval   int
+	lookbehind int
+
+	changesLock    sync.Mutex
+	changes        []change
+	changesUnknown bool
+
+	lock    sync.Mutex
+	text    []rune
+	hasText bool
+	// incremental is false if the text can only be lexed from the start. This is the case when it
+	// contains carriage returns, since the syn lexers keep the positions of those in their state.
+	incremental bool
+
+	// tokens and checkpoints are up to date for the text before lexedTo.
+	tokens      []Token
+	checkpoints []checkpoint
+	lexedTo     int
+	done        bool
+
+	// tailTokens and tailCheckpoints are the tokens and checkpoints from before the text was changed that
+	// lie after the change. They are used once the lexer state converges.
+	tailTokens      []Token
+	tailCheckpoints []checkpoint
+
+	iter syn.Iterator
+	// fromCheckpoint is true if iter was resumed from a checkpoint rather than started at the beginning
+	fromCheckpoint bool
+	resumedFrom    *checkpoint
+	// endOfFirstTokenUnknown is true until the token after the first one after resuming is read
+	endOfFirstTokenUnknown bool
+	candidate              *candidate
+	linesSinceCheckpoint   int
+
+	// lexedTokens counts the tokens produced by the lexer, for testing.
+	lexedTokens int
+}
+
+// checkpoint is the saved state of the lexer at a point in the text.
+type checkpoint struct {
+	// pos is the end of the last token produced before the checkpoint. That token is never empty, so
+	// the tokens at or after pos are the ones produced after the checkpoint.
+	pos int
+	// index is the index of the next rune the lexer reads when it's resumed from the checkpoint. It is
+	// after pos because the lexer reads ahead to join adjacent tokens of the same type.
+	index int
+	state syn.IteratorState
+	// next is the type of the token at pos. The lexer had already started reading it at the checkpoint, but
+	// the type of the token isn't part of what the state compares.
+	next syn.TokenType
+}
+
+// candidate is a possible checkpoint whose index is not yet known.
+type candidate struct {
+	pos          int
+	state, probe syn.IteratorState
+}
+
+// maxReadAhead limits how far past a candidate checkpoint its index is searched for.
+const maxReadAhead = 4096
+
+// New creates a Lexer that uses lexer to tokenise, and saves a checkpoint about every interval lines.
+// After a change lexing resumes from a checkpoint at least lookbehind lines before the change.
+func New(lexer *syn.Lexer, interval, lookbehind int) *Lexer {
+	if interval < 1 {
+		interval = 1
+	}
+	if lookbehind < 0 {
+		lookbehind = 0
+	}
+	return &Lexer{
+		lexer:      lexer,
+		interval:   interval,
+		lookbehind: lookbehind,
+	}
+}
+
+// SynLexer returns the lexer used to tokenise.
+func (l *Lexer) SynLexer() *syn.Lexer {
+	return l.lexer
+}
+
+// Changed records that the text was changed since it was last set with SetText. If length is positive
+// it is the number of runes inserted at offset, and if it is negative it is the number of runes deleted
+// at offset. A length of zero means the change is unknown, and the text is lexed again from the start.
+func (l *Lexer) Changed(offset, length int) {
+	l.changesLock.Lock()
+	defer l.changesLock.Unlock()
+
+	if length == 0 || offset < 0 || len(l.changes) >= maxChanges {
+		l.changesUnknown = true
+		return
+	}
+	l.changes = append(l.changes, change{offset, length})
+}
+
+// SetText sets the text to lex. The changes recorded using Changed since the last call to SetText
+// must be the ones that turned the previous text into this one. Lexing starts from the last checkpoint
+// before the first change.
+func (l *Lexer) SetText(text []rune) {
+	l.changesLock.Lock()
+	changes, unknown := l.changes, l.changesUnknown
+	l.changes, l.changesUnknown = nil, false
+	l.changesLock.Unlock()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	old := l.text
+	l.text = text
+
+	if !l.hasText || !l.incremental || containsCR(text) || unknown {
+		l.reset()
+		return
+	}
+
+	if len(changes) == 0 {
+		if !runesEqual(old, text) {
+			// The text was changed without us being told.
+			l.reset()
+		}
+		return
+	}
+
+	head, tail, newLen, ok := summarize(changes, len(old))
+	if !ok || newLen != len(text) {
+		l.reset()
+		return
+	}
+
+	l.resume(len(old), head, tail)
+}
+
+func (l *Lexer) reset() {
+	l.hasText = true
+	l.incremental = !containsCR(l.text)
+	l.tokens = l.tokens[:0]
+	l.checkpoints = nil
+	l.tailTokens = nil
+	l.tailCheckpoints = nil
+	l.lexedTo = 0
+	l.done = false
+	l.iter = l.lexer.Tokenise(l.text)
+	l.fromCheckpoint = false
+	l.resumedFrom = nil
+	l.endOfFirstTokenUnknown = false
+	l.candidate = nil
+	l.linesSinceCheckpoint = 0
+}
+
+// resume prepares to lex from the last checkpoint before the changes.
+func (l *Lexer) resume(oldLen, head, tail int) {
+	delta := len(l.text) - oldLen
+
+	// Keep the tokens and checkpoints that are in the unchanged end of the text, moved to their new position.
+	// If lexing wasn't done, the text between where it stopped and the end of the previous change has no tokens,
+	// so only the tokens after that are kept.
+	oldTokens, oldCheckpoints := l.tokens, l.checkpoints
+	if !l.done {
+		oldTokens, oldCheckpoints = l.remainingTailTokens(), l.tailCheckpoints
+	}
+	unchangedFrom := oldLen - tail
+	var tailTokens []Token
+	for _, t := range oldTokens {
+		if t.Start >= unchangedFrom {
+			tailTokens = append(tailTokens, Token{Start: t.Start + delta, End: t.End + delta, Type: t.Type})
+		}
+	}
+	var tailCheckpoints []checkpoint
+	for _, c := range oldCheckpoints {
+		if c.pos >= unchangedFrom {
+			tailCheckpoints = append(tailCheckpoints, c.moved(delta))
+		}
+	}
+	l.tailTokens, l.tailCheckpoints = tailTokens, tailCheckpoints
+
+	// Lexing at a checkpoint may look at text after the index of the checkpoint on the same line, so
+	// use a checkpoint from before the line that was changed. Also, when a pattern fails to match it may have
+	// looked at the text up to the change. For example a comment that is not terminated may be terminated by
+	// the change. Those can't be found, so lex the lookbehind lines before the change again in case, as well as
+	// the text after the first error since an unterminated string often appears as one.
+	limit := lineStart(l.text, head)
+	for n := 0; n < l.lookbehind && limit > 0; n++ {
+		limit = lineStart(l.text, limit-1)
+	}
+	for _, t := range l.tokens {
+		if t.Start >= limit {
+			break
+		}
+		if t.Type == syn.Error {
+			limit = t.Start
+			break
+		}
+	}
+	i := len(l.checkpoints) - 1
+	for ; i >= 0; i-- {
+		if l.checkpoints[i].index <= limit {
+			break
+		}
+	}
+
+	l.done = false
+	l.candidate = nil
+	l.linesSinceCheckpoint = 0
+	l.endOfFirstTokenUnknown = false
+
+	if i < 0 {
+		l.tokens = l.tokens[:0]
+		l.checkpoints = nil
+		l.lexedTo = 0
+		l.iter = l.lexer.Tokenise(l.text)
+		l.fromCheckpoint = false
+		l.resumedFrom = nil
+		return
+	}
+
+	c := &l.checkpoints[i]
+	l.checkpoints = l.checkpoints[:i+1]
+
+	l.tokens = l.tokens[:tokensBefore(l.tokens, c.pos)]
+	l.lexedTo = c.pos
+
+	l.iter = l.lexer.Tokenise(l.text)
+	l.iter.SetState(c.state)
+	// The iterator now shares parts of the saved state and changes them as it goes, so save a copy.
+	c.state = l.iter.State()
+	r := *c
+	l.resumedFrom = &r
+	l.fromCheckpoint = true
+}
+
+func (c checkpoint) moved(delta int) checkpoint {
+	c.pos += delta
+	c.index += delta
+	c.state.SetIndex(c.index)
+	return c
+}
+
+// Lex lexes the text until the part before until has been lexed, or to the end if until is negative.
+// Lexing ends early once the lexer state converges with the state from before the text was changed.
+// It returns ctx.Err() if the context is done before then.
+func (l *Lexer) Lex(ctx context.Context, until int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for !l.done && (until < 0 || l.lexedTo < until) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		err := l.step()
+		if err != nil {
+			l.finish()
+			return err
+		}
+	}
+	return nil
+}
+
+// Done returns true if the tokens are up to date for the whole text.
+func (l *Lexer) Done() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.done
+}
+
+// Tokens returns the tokens. If lexing is not done the tokens up to the point lexed are up to date and
+// are followed by the tokens from before the change for the unchanged end of the text.
+func (l *Lexer) Tokens() []Token {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	tail := l.remainingTailTokens()
+	r := make([]Token, 0, len(l.tokens)+len(tail))
+	r = append(r, l.tokens...)
+	return append(r, tail...)
+}
+
+// remainingTailTokens returns the tokens from before the change that are after the text lexed so far.
+func (l *Lexer) remainingTailTokens() []Token {
+	i := 0
+	for i < len(l.tailTokens) && l.tailTokens[i].Start < l.lexedTo {
+		i++
+	}
+	if i < len(l.tailTokens) && len(l.tokens) > 0 && l.tailTokens[i] == l.tokens[len(l.tokens)-1] {
+		i++
+	}
+	return l.tailTokens[i:]
+}
+
+func (l *Lexer) step() error {
+	tok, err := l.next()
+	if err == errStaleCheckpoint {
+		l.reset()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if l.endOfFirstTokenUnknown {
+		// Tokens are contiguous, so the first token after resuming ends where this one starts.
+		l.tokens[len(l.tokens)-1].End = tok.Start
+		l.endOfFirstTokenUnknown = false
+		if tok.Type == syn.EOFType {
+			l.tokens[len(l.tokens)-1].End = len(l.text)
+		}
+	}
+
+	if tok.Type == syn.EOFType {
+		l.finish()
+		return nil
+	}
+
+	l.lexedTokens++
+
+	if l.resumedFrom != nil {
+		// The first token after resuming was read ahead before the checkpoint was saved, and may have been
+		// joined with the tokens after it since. Its bounds are from when it was read, which may have been
+		// before the checkpoint was moved, so they are corrected once the next token is read.
+		tok.Start = l.resumedFrom.pos
+		tok.End = l.resumedFrom.index
+		l.resumedFrom = nil
+		l.endOfFirstTokenUnknown = true
+	}
+
+	l.tokens = append(l.tokens, Token{Start: tok.Start, End: tok.End, Type: tok.Type})
+	l.lexedTo = tok.End
+
+	if !l.incremental || l.endOfFirstTokenUnknown {
+		// A checkpoint needs to know where the token before it ends
+		return nil
+	}
+
+	if l.candidate != nil {
+		c := l.candidate
+		l.candidate = nil
+		if index, ok := c.index(tok.End); ok {
+			l.linesSinceCheckpoint = 0
+			if l.addCheckpoint(checkpoint{pos: c.pos, index: index, state: c.state, next: tok.Type}) {
+				return nil
+			}
+		}
+	}
+
+	for len(l.tailCheckpoints) > 0 && l.tailCheckpoints[0].pos < tok.End {
+		l.tailCheckpoints = l.tailCheckpoints[1:]
+	}
+	// Checkpoints are placed every interval lines, but after a change the lines are counted from a different
+	// place. So also try to checkpoint where there was one before the change, since only there can the
+	// state converge.
+	atOldCheckpoint := len(l.tailCheckpoints) > 0 && l.tailCheckpoints[0].pos == tok.End
+
+	l.linesSinceCheckpoint += countNewlines(l.text, tok.Start, tok.End)
+	if (l.linesSinceCheckpoint >= l.interval || atOldCheckpoint) && tok.End > tok.Start {
+		l.candidate = &candidate{pos: tok.End, state: l.iter.State(), probe: l.iter.State()}
+	}
+	return nil
+}
+
+// index finds the index of the candidate. The syn iterator state doesn't expose it, so it's found by
+// comparing the state with a copy in which the index is set to each possible value. The state only
+// matches a copy when the lexer is between tokens rather than in the middle of a match that is split
+// into groups or lexed by a nested lexer, which are the only states that can safely be moved.
+func (c *candidate) index(limit int) (int, bool) {
+	if limit > c.pos+maxReadAhead {
+		limit = c.pos + maxReadAhead
+	}
+	for i := c.pos + 1; i <= limit; i++ {
+		c.probe.SetIndex(i)
+		if statesEqual(c.state, c.probe) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// addCheckpoint saves the checkpoint. If the state at the checkpoint is the same as the state at a checkpoint
+// from before the text was changed the lexer has converged and the rest of the tokens are taken from before
+// the change. It returns true in that case.
+func (l *Lexer) addCheckpoint(c checkpoint) (converged bool) {
+	l.checkpoints = append(l.checkpoints, c)
+
+	for len(l.tailCheckpoints) > 0 && l.tailCheckpoints[0].pos < c.pos {
+		l.tailCheckpoints = l.tailCheckpoints[1:]
+	}
+
+	if len(l.tailCheckpoints) == 0 {
+		return false
+	}
+
+	old := l.tailCheckpoints[0]
+	if old.pos != c.pos || old.index != c.index || old.next != c.next || !statesEqual(c.state, old.state) {
+		return false
+	}
+
+	l.tokens = l.tokens[:tokensBefore(l.tokens, c.pos)]
+
+	for _, t := range l.tailTokens {
+		if t.Start >= c.pos {
+			l.tokens = append(l.tokens, t)
+		}
+	}
+	l.checkpoints = append(l.checkpoints, l.tailCheckpoints[1:]...)
+	l.finish()
+	return true
+}
+
+func (l *Lexer) finish() {
+	l.done = true
+	l.lexedTo = len(l.text)
+	l.tailTokens = nil
+	l.tailCheckpoints = nil
+	l.iter = nil
+	l.candidate = nil
+	l.resumedFrom = nil
+	l.endOfFirstTokenUnknown = false
+}
+
+var errStaleCheckpoint = errors.New("the checkpoint refers to an earlier text")
+
+// next returns the next token from the iterator. The token that the syn lexer had read ahead when a checkpoint
+// was saved refers to the text at that time, and the syn lexer panics if that token grows past the end of that
+// text. errStaleCheckpoint is returned when that happens, and the text must be lexed from the start instead.
+func (l *Lexer) next() (tok syn.Token, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if !l.fromCheckpoint {
+				panic(r)
+			}
+			err = errStaleCheckpoint
+		}
+	}()
+	return l.iter.Next()
+}
+
+// tokensBefore returns the number of tokens before a checkpoint at pos.
+func tokensBefore(toks []Token, pos int) int {
+	j := len(toks)
+	for j > 0 && (toks[j-1].End > pos || toks[j-1].Start >= pos) {
+		j--
+	}
+	return j
+}
+
+// statesEqual compares iterator states. Equal on states with a different number of nested lexers
+// indexes past the end of one of them, which means they are not equal.
+func statesEqual(a, b syn.IteratorState) (eq bool) {
+	defer func() {
+		if recover() != nil {
+			eq = false
+		}
+	}()
+	return a.Equal(b) && b.Equal(a)
+}
+
+// change is a change to the text as passed to Changed.
+type change struct {
+	offset, length int
+}
+
+// maxChanges is the number of changes that may be recorded between calls to SetText before the
+// changes are treated as unknown.
+const maxChanges = 4096
+
+// summarize returns the number of runes at the start (head) and at the end (tail) of the text that the changes
+// left unchanged, and the length of the text after the changes. It returns false if the changes don't fit a text
+// of length oldLen.
+func summarize(changes []change, oldLen int) (head, tail, newLen int, ok bool) {
+	head, tail, newLen = oldLen, oldLen, oldLen
+	for _, c := range changes {
+		end := c.offset
+		if c.length > 0 {
+			if c.offset > newLen {
+				return
+			}
+			newLen += c.length
+			end += c.length
+		} else {
+			if c.offset-c.length > newLen {
+				return
+			}
+			newLen += c.length
+		}
+
+		if c.offset < head {
+			head = c.offset
+		}
+		if newLen-end < tail {
+			tail = newLen - end
+		}
+	}
+
+	if tail > newLen-head {
+		tail = newLen - head
+	}
+	if tail > oldLen-head {
+		tail = oldLen - head
+	}
+	ok = true
+	return
+}
+
+func containsCR(text []rune) bool {
+	for _, r := range text {
+		if r == '\r' {
+			return true
+		}
+	}
+	return false
+}
+
+func runesEqual(a, b []rune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func lineStart(text []rune, i int) int {
+	if i > len(text) {
+		i = len(text)
+	}
+	for i > 0 && text[i-1] != '\n' {
+		i--
+	}
+	return i
+}
+
+func countNewlines(text []rune, start, end int) (n int) {
+	if end > len(text) {
+		end = len(text)
+	}
+	for i := start; i < end; i++ {
+		if text[i] == '\n' {
+			n++
+		}
+	}
+	return
+}
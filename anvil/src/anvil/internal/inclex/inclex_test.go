@@ -0,0 +1,311 @@
+package inclex
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/jeffwilliams/syn"
+	synlexers "github.com/jeffwilliams/syn/lexers"
+)
+
+const goSample = `package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* A block comment
+   that spans
+   a few lines */
+
+// Point is a point
+type Point struct {
+	X, Y int
+}
+
+func (p Point) String() string {
+	return fmt.Sprintf("(%d, %d)", p.X, p.Y)
+}
+
+var raw = ` + "`" + `a raw string
+that spans lines
+` + "`" + `
+
+func main() {
+	p := Point{1, 2}
+	s := strings.Repeat("ab", 3)
+	for i := 0; i < 10; i++ {
+		fmt.Println(p, s, i, 'x', 0x1f, 3.5e2)
+	}
+}
+`
+
+const pythonSample = `import os
+
+def f(a, b=2):
+    """A docstring
+    over two lines"""
+    return a + b  # add them
+
+class C(object):
+    def __init__(self):
+        self.x = '''triple
+quoted'''
+
+if __name__ == "__main__":
+    print(f(1), os.getcwd())
+`
+
+const markdownSample = "# Heading\n\nSome *emphasis* and **strong** text.\n\n```go\nfunc f() {}\n```\n\n" +
+	"* a list\n* with items\n\n## Another\n\n> quoted `code`\n"
+
+// fullTokens lexes the text from the start using the syn lexer directly.
+func fullTokens(t *testing.T, lexer *syn.Lexer, text []rune) []Token {
+	t.Helper()
+
+	var toks []Token
+	iter := lexer.Tokenise(text)
+	for {
+		tok, err := iter.Next()
+		if err != nil {
+			t.Fatalf("lexing failed: %v", err)
+		}
+		if tok.Type == syn.EOFType {
+			return toks
+		}
+		toks = append(toks, Token{Start: tok.Start, End: tok.End, Type: tok.Type})
+	}
+}
+
+func lexAll(t *testing.T, l *Lexer) {
+	t.Helper()
+	err := l.Lex(context.Background(), -1)
+	if err != nil {
+		t.Fatalf("lexing failed: %v", err)
+	}
+	if !l.Done() {
+		t.Fatalf("lexing to the end didn't finish")
+	}
+}
+
+func tokensString(text []rune, toks []Token) string {
+	var b strings.Builder
+	for _, t := range toks {
+		fmt.Fprintf(&b, "%d-%d %s %q\n", t.Start, t.End, t.Type, string(text[t.Start:t.End]))
+	}
+	return b.String()
+}
+
+func checkSame(t *testing.T, what string, text []rune, got, want []Token) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d tokens but expected %d.\nGot:\n%s\nExpected:\n%s", what, len(got), len(want),
+			tokensString(text, got), tokensString(text, want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s: token %d differs. Got %v but expected %v.\nGot:\n%s\nExpected:\n%s", what, i, got[i], want[i],
+				tokensString(text, got), tokensString(text, want))
+		}
+	}
+}
+
+var snippets = []string{
+	"/*", "*/", "\"", "`", "'", "\n", "x", "  ", "// c\n", "func g() {}\n", "'''", "\"\"\"", "#", "*", "```\n", "{", "}",
+}
+
+// edit applies a random change to the text and returns the new text and the change.
+func edit(r *rand.Rand, text []rune) ([]rune, int, int) {
+	if len(text) > 0 && r.Intn(3) == 0 {
+		off := r.Intn(len(text))
+		n := 1 + r.Intn(10)
+		if off+n > len(text) {
+			n = len(text) - off
+		}
+		out := append(append([]rune{}, text[:off]...), text[off+n:]...)
+		return out, off, -n
+	}
+
+	off := r.Intn(len(text) + 1)
+	ins := []rune(snippets[r.Intn(len(snippets))])
+	out := append(append(append([]rune{}, text[:off]...), ins...), text[off:]...)
+	return out, off, len(ins)
+}
+
+func TestIncrementalMatchesFull(t *testing.T) {
+	samples := []struct {
+		lang string
+		text string
+	}{
+		{"go", goSample},
+		{"python", pythonSample},
+		{"markdown", markdownSample},
+		{"c", strings.ReplaceAll(goSample, "func", "int")},
+	}
+
+	for _, s := range samples {
+		t.Run(s.lang, func(t *testing.T) {
+			lexer := synlexers.Get(s.lang)
+			if lexer == nil {
+				t.Fatalf("no lexer for %s", s.lang)
+			}
+
+			r := rand.New(rand.NewSource(1))
+			for _, interval := range []int{1, 2, 5} {
+				text := []rune(s.text)
+				// The random edits often terminate comments and strings a few lines after where they
+				// start, so resume a few lines before each change. See the package comment.
+				l := New(lexer, interval, 3)
+				l.SetText(text)
+				lexAll(t, l)
+				checkSame(t, "initial", text, l.Tokens(), fullTokens(t, lexer, text))
+
+				for i := 0; i < 150; i++ {
+					// Sometimes make several changes before lexing again
+					for n := 1 + r.Intn(3); n > 0; n-- {
+						var off, length int
+						text, off, length = edit(r, text)
+						l.Changed(off, length)
+					}
+					l.SetText(text)
+					if r.Intn(4) == 0 {
+						// Sometimes change the text again before lexing is done
+						err := l.Lex(context.Background(), r.Intn(len(text)+1))
+						if err != nil {
+							t.Fatalf("lexing failed: %v", err)
+						}
+						continue
+					}
+					lexAll(t, l)
+					checkSame(t, fmt.Sprintf("interval %d edit %d", interval, i), text, l.Tokens(), fullTokens(t, lexer, text))
+				}
+			}
+		})
+	}
+}
+
+func TestChangeLexesLess(t *testing.T) {
+	lexer := synlexers.Get("go")
+	text := []rune(strings.Repeat(goSample, 20))
+
+	l := New(lexer, 5, 3)
+	l.SetText(text)
+	lexAll(t, l)
+	full := l.lexedTokens
+
+	// Change a number near the end of the text
+	off := len(text) - 10
+	for text[off] != '3' {
+		off--
+	}
+	text = append(append(append([]rune{}, text[:off]...), '4'), text[off+1:]...)
+	l.Changed(off, -1)
+	l.Changed(off, 1)
+
+	l.lexedTokens = 0
+	l.SetText(text)
+	lexAll(t, l)
+
+	checkSame(t, "after change", text, l.Tokens(), fullTokens(t, lexer, text))
+	if l.lexedTokens*10 > full {
+		t.Fatalf("expected a change near the end to lex few tokens, but it lexed %d of %d", l.lexedTokens, full)
+	}
+
+	// A change near the start converges quickly as well
+	text = append([]rune("// x\n"), text...)
+	l.Changed(0, 5)
+
+	l.lexedTokens = 0
+	l.SetText(text)
+	lexAll(t, l)
+
+	checkSame(t, "after change at start", text, l.Tokens(), fullTokens(t, lexer, text))
+	if l.lexedTokens*10 > full {
+		t.Fatalf("expected a change near the start to converge quickly, but it lexed %d of %d", l.lexedTokens, full)
+	}
+}
+
+func TestTerminatingEarlierComment(t *testing.T) {
+	lexer := synlexers.Get("go")
+	text := []rune(strings.Repeat(goSample, 3))
+
+	l := New(lexer, 1, 10)
+	l.SetText(text)
+	lexAll(t, l)
+
+	// Start a comment, which isn't terminated, and then terminate it a few lines later
+	off := strings.Index(string(text), "type Point")
+	text = append(append(append([]rune{}, text[:off]...), []rune("/*")...), text[off:]...)
+	l.Changed(off, 2)
+	l.SetText(text)
+	lexAll(t, l)
+	checkSame(t, "after starting comment", text, l.Tokens(), fullTokens(t, lexer, text))
+
+	off = strings.Index(string(text), "func (p Point)")
+	text = append(append(append([]rune{}, text[:off]...), []rune("*/")...), text[off:]...)
+	l.Changed(off, 2)
+	l.SetText(text)
+	lexAll(t, l)
+	checkSame(t, "after terminating comment", text, l.Tokens(), fullTokens(t, lexer, text))
+}
+
+func TestLexUntil(t *testing.T) {
+	lexer := synlexers.Get("go")
+	text := []rune(strings.Repeat(goSample, 5))
+
+	l := New(lexer, 5, 3)
+	l.SetText(text)
+
+	err := l.Lex(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("lexing failed: %v", err)
+	}
+	if l.Done() {
+		t.Fatalf("expected lexing to stop after the requested part")
+	}
+
+	toks := l.Tokens()
+	if len(toks) == 0 || toks[len(toks)-1].End < 100 {
+		t.Fatalf("expected the text before 100 to be lexed")
+	}
+
+	lexAll(t, l)
+	checkSame(t, "continued", text, l.Tokens(), fullTokens(t, lexer, text))
+}
+
+func TestCancel(t *testing.T) {
+	lexer := synlexers.Get("go")
+	l := New(lexer, 5, 3)
+	l.SetText([]rune(goSample))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := l.Lex(ctx, -1)
+	if err != context.Canceled {
+		t.Fatalf("expected the lexing to be cancelled but got %v", err)
+	}
+	if l.Done() {
+		t.Fatalf("cancelled lexing should not be done")
+	}
+}
+
+func TestCarriageReturnsLexFromStart(t *testing.T) {
+	lexer := synlexers.Get("go")
+	text := []rune(strings.ReplaceAll(goSample, "\n", "\r\n"))
+
+	l := New(lexer, 1, 3)
+	l.SetText(text)
+	lexAll(t, l)
+
+	text = append([]rune("// x\r\n"), text...)
+	l.Changed(0, 6)
+	l.SetText(text)
+	lexAll(t, l)
+
+	checkSame(t, "crlf", text, l.Tokens(), fullTokens(t, lexer, text))
+}
@@ -0,0 +1,164 @@
+// Package linediff finds the edits that change one text into another, line by line.
+//
+// It's used to apply the output of a program that rewrites a whole file, like a formatter, as a few
+// small changes so that text which didn't change keeps its position.
+package linediff
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Edit replaces the runes from Start up to End in the old text with Text.
+type Edit struct {
+	Start, End int
+	Text       string
+}
+
+// maxTableSize is the largest number of cells in the table used to compare the lines that differ. If
+// more would be needed the lines are replaced in a single edit instead.
+const maxTableSize = 4 * 1024 * 1024
+
+// Edits returns the edits that change old into new, in increasing order of position. The edits don't
+// overlap, and positions are rune indexes into old, so applying them from last to first gives new.
+func Edits(old, new string) []Edit {
+	a, b := splitLines(old), splitLines(new)
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []Edit
+	pos := runesInLines(a[:prefix])
+	hunks := matchLines(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	for _, h := range hunks {
+		pos += runesInLines(a[prefix+h.aPos : prefix+h.aStart])
+		before := a[prefix+h.aStart : prefix+h.aEnd]
+		after := b[prefix+h.bStart : prefix+h.bEnd]
+		if len(before) == len(after) {
+			// Lines that were changed in place are compared separately so that the rest of each
+			// line is left alone.
+			for i := range before {
+				edits = append(edits, trim(pos, before[i], after[i]))
+				pos += utf8.RuneCountInString(before[i])
+			}
+			continue
+		}
+		edits = append(edits, trim(pos, strings.Join(before, ""), strings.Join(after, "")))
+		pos += runesInLines(before)
+	}
+	return edits
+}
+
+// hunk is a range of lines in a that is replaced by a range of lines in b. aPos is the end of the
+// previous hunk in a.
+type hunk struct {
+	aPos         int
+	aStart, aEnd int
+	bStart, bEnd int
+}
+
+// matchLines finds the longest common subsequence of the lines and returns the ranges between the
+// matching lines.
+func matchLines(a, b []string) (hunks []hunk) {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	if len(a)*len(b) > maxTableSize {
+		return []hunk{{aEnd: len(a), bEnd: len(b)}}
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j, last := 0, 0, 0
+	cur := hunk{}
+	inHunk := false
+	flush := func() {
+		if inHunk {
+			cur.aEnd, cur.bEnd = i, j
+			hunks = append(hunks, cur)
+			last = i
+			inHunk = false
+		}
+	}
+	start := func() {
+		if !inHunk {
+			cur = hunk{aPos: last, aStart: i, bStart: j}
+			inHunk = true
+		}
+	}
+
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			flush()
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			start()
+			j++
+		default:
+			start()
+			i++
+		}
+	}
+	flush()
+	return
+}
+
+// trim makes an edit that replaces before, which starts at pos, with after, leaving out the runes at
+// the start and end that are the same in both.
+func trim(pos int, before, after string) Edit {
+	for len(before) > 0 && len(after) > 0 {
+		r1, n1 := utf8.DecodeRuneInString(before)
+		r2, n2 := utf8.DecodeRuneInString(after)
+		if r1 != r2 {
+			break
+		}
+		before, after = before[n1:], after[n2:]
+		pos++
+	}
+	for len(before) > 0 && len(after) > 0 {
+		r1, n1 := utf8.DecodeLastRuneInString(before)
+		r2, n2 := utf8.DecodeLastRuneInString(after)
+		if r1 != r2 {
+			break
+		}
+		before, after = before[:len(before)-n1], after[:len(after)-n2]
+	}
+	return Edit{Start: pos, End: pos + utf8.RuneCountInString(before), Text: after}
+}
+
+// splitLines splits s into lines, each of which keeps its terminating newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func runesInLines(lines []string) (n int) {
+	for _, l := range lines {
+		n += utf8.RuneCountInString(l)
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package linediff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func apply(old string, edits []Edit) string {
+	r := []rune(old)
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		r = append(r[:e.Start], append([]rune(e.Text), r[e.End:]...)...)
+	}
+	return string(r)
+}
+
+func TestEdits(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		expected []Edit
+	}{
+		{
+			name: "same",
+			old:  "a\nb\n",
+			new:  "a\nb\n",
+		},
+		{
+			name:     "change within a line",
+			old:      "func f(){\n\treturn  1\n}\n",
+			new:      "func f() {\n\treturn 1\n}\n",
+			expected: []Edit{{Start: 8, End: 8, Text: " "}, {Start: 18, End: 19}},
+		},
+		{
+			name:     "inserted line",
+			old:      "a\nc\n",
+			new:      "a\nb\nc\n",
+			expected: []Edit{{Start: 2, End: 2, Text: "b\n"}},
+		},
+		{
+			name:     "deleted lines",
+			old:      "a\nb\nc\nd\n",
+			new:      "a\nd\n",
+			expected: []Edit{{Start: 2, End: 6}},
+		},
+		{
+			name:     "runes",
+			old:      "αβ\nγ\n",
+			new:      "αβ\nγδ\n",
+			expected: []Edit{{Start: 4, End: 4, Text: "δ"}},
+		},
+		{
+			name:     "final newline added",
+			old:      "a\nb",
+			new:      "a\nb\n",
+			expected: []Edit{{Start: 3, End: 3, Text: "\n"}},
+		},
+		{
+			name:     "from empty",
+			old:      "",
+			new:      "x\n",
+			expected: []Edit{{Start: 0, End: 0, Text: "x\n"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			edits := Edits(tc.old, tc.new)
+			if !reflect.DeepEqual(edits, tc.expected) {
+				t.Fatalf("expected %v but got %v", tc.expected, edits)
+			}
+			if got := apply(tc.old, edits); got != tc.new {
+				t.Fatalf("applying the edits gave %q instead of %q", got, tc.new)
+			}
+		})
+	}
+}
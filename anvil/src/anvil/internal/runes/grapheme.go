@@ -0,0 +1,87 @@
+package runes
+
+import (
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// A grapheme cluster is what a user thinks of as a single character: a base rune followed by
+// combining marks, a pair of regional indicators forming a flag, an emoji ZWJ sequence or a
+// CR LF pair. The grapheme methods of the Walker move over whole clusters so that the cursor
+// never ends up inside one.
+
+// maxGraphemeScan is the most runes before the current position that are scanned to find the start
+// of the grapheme cluster containing it. Clusters don't span lines, so the scan also stops at the
+// start of the line.
+const maxGraphemeScan = 256
+
+// ForwardGrapheme moves forward to the start of the next grapheme cluster.
+func (r *Walker) ForwardGrapheme() {
+	if r.AtEnd() {
+		return
+	}
+
+	cluster, _, _, _ := uniseg.FirstGraphemeCluster(r.bytes[r.bytePos:], -1)
+	r.ForwardBytes(len(cluster))
+}
+
+// BackwardGrapheme moves backward to the start of the grapheme cluster that ends at the
+// current position.
+func (r *Walker) BackwardGrapheme() {
+	if r.AtStart() {
+		return
+	}
+
+	b := r.graphemeScanStart()
+	start := b
+	state := -1
+	for b < r.bytePos {
+		start = b
+		var cluster []byte
+		cluster, _, _, state = uniseg.FirstGraphemeCluster(r.bytes[b:r.bytePos], state)
+		b += len(cluster)
+	}
+	r.backwardToByte(start)
+}
+
+// AlignToGraphemeStart moves backward to the start of the grapheme cluster containing the current
+// position, if the position is inside a cluster.
+func (r *Walker) AlignToGraphemeStart() {
+	if r.AtStart() || r.AtEnd() {
+		return
+	}
+
+	b := r.graphemeScanStart()
+	state := -1
+	for b < r.bytePos {
+		var cluster []byte
+		cluster, _, _, state = uniseg.FirstGraphemeCluster(r.bytes[b:], state)
+		if b+len(cluster) > r.bytePos {
+			r.backwardToByte(b)
+			return
+		}
+		b += len(cluster)
+	}
+}
+
+// graphemeScanStart returns the byte offset that the scan for the start of the grapheme cluster
+// before the current position starts at.
+func (r *Walker) graphemeScanStart() int {
+	b := r.bytePos
+	for n := 0; b > 0 && n < maxGraphemeScan; n++ {
+		rn, size := utf8.DecodeLastRune(r.bytes[:b])
+		// A newline just before the position may be the end of a CR LF pair.
+		if rn == '\n' && b < r.bytePos {
+			break
+		}
+		b -= size
+	}
+	return b
+}
+
+func (r *Walker) backwardToByte(p int) {
+	for r.bytePos > p {
+		r.backward1()
+	}
+}
@@ -0,0 +1,85 @@
+package runes
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWalkerGraphemes(t *testing.T) {
+	tests := []struct {
+		name string
+		// input is the text to walk
+		input string
+		// starts are the rune positions of the starts of the grapheme clusters, and the end of the text
+		starts []int
+	}{
+		{
+			name:   "ascii",
+			input:  "abc",
+			starts: []int{0, 1, 2, 3},
+		},
+		{
+			name:   "combining marks",
+			input:  "éạ̈b",
+			starts: []int{0, 2, 5, 6},
+		},
+		{
+			name:   "flags",
+			input:  "\U0001F1E8\U0001F1E6\U0001F1EF\U0001F1F5x",
+			starts: []int{0, 2, 4, 5},
+		},
+		{
+			name:   "zwj sequence",
+			input:  "a\U0001F469‍\U0001F4BBb",
+			starts: []int{0, 1, 4, 5},
+		},
+		{
+			name:   "crlf",
+			input:  "a\r\nb",
+			starts: []int{0, 1, 3, 4},
+		},
+		{
+			name:   "hangul jamo",
+			input:  "각ᄀ",
+			starts: []int{0, 3, 4},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := NewWalker([]byte(tc.input))
+			forward := []int{0}
+			for !w.AtEnd() {
+				w.ForwardGrapheme()
+				forward = append(forward, w.RunePos())
+			}
+			if !reflect.DeepEqual(forward, tc.starts) {
+				t.Fatalf("moving forward got %v but expected %v", forward, tc.starts)
+			}
+
+			var backward []int
+			for {
+				backward = append([]int{w.RunePos()}, backward...)
+				if w.AtStart() {
+					break
+				}
+				w.BackwardGrapheme()
+			}
+			if !reflect.DeepEqual(backward, tc.starts) {
+				t.Fatalf("moving backward got %v but expected %v", backward, tc.starts)
+			}
+
+			j := 0
+			for p := 0; p <= len([]rune(tc.input)); p++ {
+				for j+1 < len(tc.starts) && tc.starts[j+1] <= p {
+					j++
+				}
+				w.SetRunePos(p)
+				w.AlignToGraphemeStart()
+				if w.RunePos() != tc.starts[j] {
+					t.Fatalf("aligning rune position %d got %d but expected %d", p, w.RunePos(), tc.starts[j])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+// Package snippet expands snippet templates into text with tab stops.
+//
+// The body of a snippet is text that may contain these fields:
+//
+//	$1, ${1}         a tab stop. The cursor is moved to the tab stops in increasing order, and $0 is the last.
+//	${1:text}        a tab stop with placeholder text, which may itself contain fields.
+//	$NAME, ${NAME}   the value of a variable.
+//	${NAME:text}     the value of a variable, or text if the variable is not set or is empty.
+//
+// A tab stop that appears more than once is mirrored: each copy starts with the same placeholder
+// text, and all of them are edited together. A backslash before $, } or \ makes it ordinary text.
+// Variables that are not known are left in the text as they were written.
+package snippet
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Range is a range of runes in the expanded text, from Start up to End.
+type Range struct {
+	Start, End int
+}
+
+// Stop is a tab stop and the ranges of each of its copies in the expanded text.
+type Stop struct {
+	Number int
+	Ranges []Range
+}
+
+// Expansion is the result of expanding a snippet.
+type Expansion struct {
+	Text string
+	// Stops are the tab stops in the order they are visited. The last is always $0; if the snippet
+	// doesn't contain one it's at the end of the text.
+	Stops []Stop
+}
+
+// Vars looks up the value of a variable.
+type Vars func(name string) (value string, ok bool)
+
+// Expand expands the snippet body.
+func Expand(body string, vars Vars) (Expansion, error) {
+	p := parser{src: body}
+	nodes, err := p.parse(false)
+	if err != nil {
+		return Expansion{}, err
+	}
+
+	r := renderer{
+		vars:     vars,
+		defaults: map[int][]node{},
+		stops:    map[int]*Stop{},
+	}
+	r.collectDefaults(nodes)
+	r.render(nodes)
+
+	exp := Expansion{Text: r.buf.String()}
+	for _, s := range r.stops {
+		exp.Stops = append(exp.Stops, *s)
+	}
+	sort.Slice(exp.Stops, func(i, j int) bool {
+		a, b := exp.Stops[i].Number, exp.Stops[j].Number
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		return a < b
+	})
+	if _, ok := r.stops[0]; !ok {
+		exp.Stops = append(exp.Stops, Stop{Ranges: []Range{{r.pos, r.pos}}})
+	}
+	return exp, nil
+}
+
+type nodeKind int
+
+const (
+	textNode nodeKind = iota
+	tabStopNode
+	variableNode
+)
+
+type node struct {
+	kind     nodeKind
+	text     string
+	number   int
+	name     string
+	children []node
+	// hasChildren is true if the field had a colon, even if the text after it is empty.
+	hasChildren bool
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+// parse parses fields and text until the end of the body or, if inField is set, until the closing
+// brace of the field.
+func (p *parser) parse(inField bool) (nodes []node, err error) {
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, node{kind: textNode, text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '\\' && p.pos+1 < len(p.src) && strings.IndexByte(`$}\`, p.src[p.pos+1]) >= 0:
+			text.WriteByte(p.src[p.pos+1])
+			p.pos += 2
+		case c == '}' && inField:
+			flush()
+			p.pos++
+			return nodes, nil
+		case c == '$':
+			n, ok, err := p.field()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				text.WriteByte(c)
+				p.pos++
+				continue
+			}
+			flush()
+			nodes = append(nodes, n)
+		default:
+			text.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	if inField {
+		return nil, fmt.Errorf("a field is missing its closing brace")
+	}
+	flush()
+	return nodes, nil
+}
+
+// field parses the field starting with the $ at the current position. ok is false if the $ doesn't
+// start a field.
+func (p *parser) field() (n node, ok bool, err error) {
+	start := p.pos
+	p.pos++
+	braced := p.pos < len(p.src) && p.src[p.pos] == '{'
+	if braced {
+		p.pos++
+	}
+
+	if num, isNum := p.number(); isNum {
+		n = node{kind: tabStopNode, number: num}
+	} else if name := p.name(); name != "" {
+		n = node{kind: variableNode, name: name}
+	} else {
+		p.pos = start
+		return n, false, nil
+	}
+
+	if !braced {
+		return n, true, nil
+	}
+
+	if p.pos < len(p.src) && p.src[p.pos] == ':' {
+		p.pos++
+		n.hasChildren = true
+		n.children, err = p.parse(true)
+		return n, err == nil, err
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '}' {
+		p.pos++
+		return n, true, nil
+	}
+	return n, false, fmt.Errorf("invalid field at offset %d", start)
+}
+
+func (p *parser) number() (num int, ok bool) {
+	for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+		num = num*10 + int(p.src[p.pos]-'0')
+		p.pos++
+		ok = true
+	}
+	return
+}
+
+func (p *parser) name() string {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (p.pos > start && c >= '0' && c <= '9') {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.src[start:p.pos]
+}
+
+type renderer struct {
+	vars Vars
+	// defaults are the placeholders of the tab stops, used for the copies that don't have their own.
+	defaults map[int][]node
+	stops    map[int]*Stop
+	buf      strings.Builder
+	pos      int
+}
+
+func (r *renderer) collectDefaults(nodes []node) {
+	for _, n := range nodes {
+		if n.kind == tabStopNode && n.hasChildren {
+			if _, ok := r.defaults[n.number]; !ok {
+				r.defaults[n.number] = n.children
+			}
+		}
+		r.collectDefaults(n.children)
+	}
+}
+
+func (r *renderer) write(s string) {
+	r.buf.WriteString(s)
+	r.pos += utf8.RuneCountInString(s)
+}
+
+func (r *renderer) render(nodes []node) {
+	for _, n := range nodes {
+		switch n.kind {
+		case textNode:
+			r.write(n.text)
+		case tabStopNode:
+			start := r.pos
+			if n.hasChildren {
+				r.render(n.children)
+			} else {
+				r.render(r.defaults[n.number])
+			}
+			s, ok := r.stops[n.number]
+			if !ok {
+				s = &Stop{Number: n.number}
+				r.stops[n.number] = s
+			}
+			s.Ranges = append(s.Ranges, Range{start, r.pos})
+		case variableNode:
+			if v, ok := r.lookup(n.name); ok && v != "" {
+				r.write(v)
+			} else if n.hasChildren {
+				r.render(n.children)
+			} else if !ok {
+				r.write("$" + n.name)
+			}
+		}
+	}
+}
+
+func (r *renderer) lookup(name string) (string, bool) {
+	if r.vars == nil {
+		return "", false
+	}
+	return r.vars(name)
+}
+
+// Shift moves the range to account for a change to the text at startOfChange. A positive length is an
+// insertion and a negative one a deletion. Text inserted within the range or at either end of it is
+// added to the range if grow is true; otherwise text inserted at the start moves the range, and text
+// inserted at the end is not part of it.
+func (r *Range) Shift(startOfChange, lengthOfChange int, grow bool) {
+	if lengthOfChange >= 0 {
+		switch {
+		case startOfChange < r.Start || (startOfChange == r.Start && !grow):
+			r.Start += lengthOfChange
+			r.End += lengthOfChange
+		case startOfChange < r.End || (startOfChange == r.End && grow):
+			r.End += lengthOfChange
+		}
+		return
+	}
+
+	endOfChange := startOfChange - lengthOfChange
+	shift := func(i int) int {
+		switch {
+		case i <= startOfChange:
+			return i
+		case i < endOfChange:
+			return startOfChange
+		default:
+			return i + lengthOfChange
+		}
+	}
+	r.Start, r.End = shift(r.Start), shift(r.End)
+}
+
+// Contains returns true if the index is within the range or at either end of it.
+func (r Range) Contains(i int) bool {
+	return i >= r.Start && i <= r.End
+}
@@ -0,0 +1,138 @@
+package snippet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	vars := func(name string) (string, bool) {
+		switch name {
+		case "FILENAME":
+			return "main.go", true
+		case "EMPTY":
+			return "", true
+		}
+		return "", false
+	}
+
+	tests := []struct {
+		name  string
+		body  string
+		text  string
+		stops []Stop
+	}{
+		{
+			name:  "plain text",
+			body:  "hello",
+			text:  "hello",
+			stops: []Stop{{0, []Range{{5, 5}}}},
+		},
+		{
+			name: "tab stops in order",
+			body: "if err != nil {\n\treturn ${1:err}\n}\n$0",
+			text: "if err != nil {\n\treturn err\n}\n",
+			stops: []Stop{
+				{1, []Range{{24, 27}}},
+				{0, []Range{{30, 30}}},
+			},
+		},
+		{
+			name: "final stop before others is visited last",
+			body: "$0 ${2:b} $1",
+			text: " b ",
+			stops: []Stop{
+				{1, []Range{{3, 3}}},
+				{2, []Range{{1, 2}}},
+				{0, []Range{{0, 0}}},
+			},
+		},
+		{
+			name: "mirrors take the placeholder",
+			body: "func Test${1:Name}(t *testing.T) { // $1",
+			text: "func TestName(t *testing.T) { // Name",
+			stops: []Stop{
+				{1, []Range{{9, 13}, {33, 37}}},
+				{0, []Range{{37, 37}}},
+			},
+		},
+		{
+			name: "nested",
+			body: "${1:a ${2:b}}",
+			text: "a b",
+			stops: []Stop{
+				{1, []Range{{0, 3}}},
+				{2, []Range{{2, 3}}},
+				{0, []Range{{3, 3}}},
+			},
+		},
+		{
+			name:  "variables",
+			body:  "// $FILENAME ${EMPTY:none} ${UNKNOWN} $5x",
+			text:  "// main.go none $UNKNOWN x",
+			stops: []Stop{{5, []Range{{25, 25}}}, {0, []Range{{26, 26}}}},
+		},
+		{
+			name:  "escapes and lone dollars",
+			body:  `\$1 costs $ and \} \\`,
+			text:  `$1 costs $ and } \`,
+			stops: []Stop{{0, []Range{{18, 18}}}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			exp, err := Expand(tc.body, vars)
+			if err != nil {
+				t.Fatalf("expanding failed: %v", err)
+			}
+			if exp.Text != tc.text {
+				t.Fatalf("expected text %q but got %q", tc.text, exp.Text)
+			}
+			if !reflect.DeepEqual(exp.Stops, tc.stops) {
+				t.Fatalf("expected stops %v but got %v", tc.stops, exp.Stops)
+			}
+		})
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	for _, body := range []string{"${1:abc", "${1x}", "${NAME"} {
+		_, err := Expand(body, nil)
+		if err == nil {
+			t.Errorf("expected expanding %q to fail", body)
+		}
+	}
+}
+
+func TestRangeShift(t *testing.T) {
+	tests := []struct {
+		name          string
+		r             Range
+		start, length int
+		grow          bool
+		expected      Range
+	}{
+		{"insert before", Range{5, 8}, 2, 3, false, Range{8, 11}},
+		{"insert after", Range{5, 8}, 9, 3, false, Range{5, 8}},
+		{"insert inside", Range{5, 8}, 6, 2, false, Range{5, 10}},
+		{"insert at start", Range{5, 8}, 5, 2, false, Range{7, 10}},
+		{"insert at start growing", Range{5, 8}, 5, 2, true, Range{5, 10}},
+		{"insert at end", Range{5, 8}, 8, 2, false, Range{5, 8}},
+		{"insert at end growing", Range{5, 8}, 8, 2, true, Range{5, 10}},
+		{"insert into empty growing", Range{5, 5}, 5, 1, true, Range{5, 6}},
+		{"delete before", Range{5, 8}, 1, -2, false, Range{3, 6}},
+		{"delete inside", Range{5, 8}, 6, -1, false, Range{5, 7}},
+		{"delete all", Range{5, 8}, 5, -3, false, Range{5, 5}},
+		{"delete overlapping start", Range{5, 8}, 3, -3, false, Range{3, 5}},
+		{"delete overlapping end", Range{5, 8}, 7, -3, false, Range{5, 7}},
+	}
+
+	for _, tc := range tests {
+		r := tc.r
+		r.Shift(tc.start, tc.length, tc.grow)
+		if r != tc.expected {
+			t.Errorf("%s: expected %v but got %v", tc.name, tc.expected, r)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// Package sshconfig reads the subset of the OpenSSH client configuration file (~/.ssh/config)
+// needed to resolve the address, user, keys and jump hosts used to reach a host.
+//
+// The keywords Host, HostName, User, Port, IdentityFile, ProxyJump and Include are understood.
+// Other keywords are ignored, and Match blocks other than "Match all" never apply.
+package sshconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Config is a parsed ssh client configuration file.
+type Config struct {
+	blocks []*block
+}
+
+// block is the directives that follow a Host or Match line, or the directives at the start of
+// a file which apply to all hosts.
+type block struct {
+	patterns []string
+	never    bool
+	params   []param
+}
+
+type param struct {
+	keyword string
+	args    []string
+}
+
+// Host is the configuration that applies to a host.
+type Host struct {
+	// HostName is the real name of the host. It is the alias that was looked up if the
+	// configuration doesn't set it.
+	HostName string
+	User     string
+	Port     string
+	// IdentityFiles are the private key files to authenticate with, with ~ and tokens expanded.
+	IdentityFiles []string
+	// ProxyJump lists the jump hosts in the order they are dialed, each in the form [user@]host[:port].
+	ProxyJump []string
+}
+
+// maxIncludeDepth limits how deeply Include directives may nest, to stop include loops.
+const maxIncludeDepth = 16
+
+// ParseFile parses the configuration file at path. A file that doesn't exist is an empty
+// configuration.
+func ParseFile(path string) (*Config, error) {
+	c := &Config{}
+	err := c.parseFile(path, nil, 0)
+	return c, err
+}
+
+// Parse parses a configuration. Relative paths in Include directives are relative to ~/.ssh.
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{}
+	err := c.parse(r, nil, 0)
+	return c, err
+}
+
+func (c *Config) parseFile(path string, cur *block, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	err = c.parse(f, cur, depth)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// parse appends the blocks in r to the configuration. Directives before the first Host or Match
+// line are added to cur, which is the block containing the Include that named r, if any.
+func (c *Config) parse(r io.Reader, cur *block, depth int) error {
+	if cur == nil {
+		cur = &block{}
+		c.blocks = append(c.blocks, cur)
+	}
+
+	s := bufio.NewScanner(r)
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		keyword, args, err := splitLine(s.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if keyword == "" {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			cur = &block{patterns: args}
+			c.blocks = append(c.blocks, cur)
+		case "match":
+			all := len(args) == 1 && strings.EqualFold(args[0], "all")
+			cur = &block{never: !all}
+			c.blocks = append(c.blocks, cur)
+		case "include":
+			if depth >= maxIncludeDepth {
+				return fmt.Errorf("line %d: too many nested includes", lineNo)
+			}
+			for _, a := range args {
+				err = c.include(a, cur, depth+1)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			cur.params = append(cur.params, param{keyword, args})
+		}
+	}
+	return s.Err()
+}
+
+func (c *Config) include(pattern string, cur *block, depth int) error {
+	pattern = expandTilde(pattern)
+	if !filepath.IsAbs(pattern) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		pattern = filepath.Join(home, ".ssh", pattern)
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		err = c.parseFile(p, cur, depth)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitLine splits a configuration line into its lowercased keyword and its arguments. The
+// keyword may be separated from the arguments by whitespace or by '=', and arguments may be
+// double quoted.
+func splitLine(line string) (keyword string, args []string, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword = strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	}
+
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" || rest[0] == '#' {
+			return
+		}
+
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote")
+			}
+			args = append(args, rest[1:end+1])
+			rest = rest[end+2:]
+			continue
+		}
+
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = rest[end:]
+	}
+}
+
+// Lookup returns the configuration that applies to the host alias. As in OpenSSH, the first value
+// found for a keyword is used, except for IdentityFile where all values are used.
+func (c *Config) Lookup(alias string) Host {
+	var h Host
+	var identityFiles []string
+	var proxyJump string
+
+	for _, b := range c.blocks {
+		if !b.matches(alias) {
+			continue
+		}
+
+		for _, p := range b.params {
+			if len(p.args) == 0 {
+				continue
+			}
+			arg := p.args[0]
+
+			switch p.keyword {
+			case "hostname":
+				if h.HostName == "" {
+					h.HostName = arg
+				}
+			case "user":
+				if h.User == "" {
+					h.User = arg
+				}
+			case "port":
+				if h.Port == "" {
+					h.Port = arg
+				}
+			case "identityfile":
+				identityFiles = append(identityFiles, arg)
+			case "proxyjump":
+				if proxyJump == "" {
+					proxyJump = arg
+				}
+			}
+		}
+	}
+
+	if h.HostName == "" {
+		h.HostName = alias
+	} else {
+		h.HostName = expandTokens(h.HostName, map[byte]string{'h': alias})
+	}
+
+	tokens := map[byte]string{
+		'h': h.HostName,
+		'r': h.User,
+		'd': homeDir(),
+		'u': localUser(),
+	}
+	for _, f := range identityFiles {
+		h.IdentityFiles = append(h.IdentityFiles, expandTokens(expandTilde(f), tokens))
+	}
+
+	if proxyJump != "" && !strings.EqualFold(proxyJump, "none") {
+		for _, j := range strings.Split(proxyJump, ",") {
+			j = strings.TrimPrefix(strings.TrimSpace(j), "ssh://")
+			if j != "" {
+				h.ProxyJump = append(h.ProxyJump, j)
+			}
+		}
+	}
+
+	return h
+}
+
+func (b *block) matches(host string) bool {
+	if b.never {
+		return false
+	}
+	if b.patterns == nil {
+		return true
+	}
+
+	matched := false
+	for _, p := range b.patterns {
+		negated := strings.HasPrefix(p, "!")
+		if negated {
+			p = p[1:]
+		}
+
+		if !match(p, host) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// match reports whether s matches the pattern, in which '*' matches any sequence of characters
+// and '?' matches exactly one character. Matching ignores case.
+func match(pattern, s string) bool {
+	pattern = strings.ToLower(pattern)
+	s = strings.ToLower(s)
+
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = pattern[1:]
+			for i := 0; i <= len(s); i++ {
+				if match(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+func expandTokens(s string, tokens map[byte]string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 >= len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if s[i] == '%' {
+			buf.WriteByte('%')
+		} else if v, ok := tokens[s[i]]; ok {
+			buf.WriteString(v)
+		} else {
+			buf.WriteByte('%')
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+func expandTilde(path string) string {
+	if path == "~" {
+		return homeDir()
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(homeDir(), path[2:])
+	}
+	return path
+}
+
+func homeDir() string {
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+func localUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
@@ -0,0 +1,160 @@
+package sshconfig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+# Settings for the hosts behind the bastion
+Host db web-?
+	HostName %h.internal.example.com
+	User deploy
+	ProxyJump jump1,admin@jump2:2222
+
+Host jump1
+	HostName bastion.example.com
+	Port 2200
+	IdentityFile /keys/bastion
+
+Host !web-2 web-*
+	Port 2022
+
+Host "quoted"
+	HostName=quoted.example.com
+
+Match host secret
+	User nobody
+
+Host *
+	User everyone
+	IdentityFile /keys/default
+	ProxyJump none
+`
+
+func parseTest(t *testing.T) *Config {
+	t.Helper()
+	c, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+	return c
+}
+
+func TestLookup(t *testing.T) {
+	c := parseTest(t)
+
+	tests := []struct {
+		alias string
+		want  Host
+	}{
+		{
+			alias: "db",
+			want: Host{
+				HostName:      "db.internal.example.com",
+				User:          "deploy",
+				IdentityFiles: []string{"/keys/default"},
+				ProxyJump:     []string{"jump1", "admin@jump2:2222"},
+			},
+		},
+		{
+			alias: "web-1",
+			want: Host{
+				HostName:      "web-1.internal.example.com",
+				User:          "deploy",
+				Port:          "2022",
+				IdentityFiles: []string{"/keys/default"},
+				ProxyJump:     []string{"jump1", "admin@jump2:2222"},
+			},
+		},
+		{
+			// The negated pattern excludes web-2 from the block that sets the port
+			alias: "web-2",
+			want: Host{
+				HostName:      "web-2.internal.example.com",
+				User:          "deploy",
+				IdentityFiles: []string{"/keys/default"},
+				ProxyJump:     []string{"jump1", "admin@jump2:2222"},
+			},
+		},
+		{
+			alias: "jump1",
+			want: Host{
+				HostName:      "bastion.example.com",
+				User:          "everyone",
+				Port:          "2200",
+				IdentityFiles: []string{"/keys/bastion", "/keys/default"},
+			},
+		},
+		{
+			alias: "quoted",
+			want: Host{
+				HostName:      "quoted.example.com",
+				User:          "everyone",
+				IdentityFiles: []string{"/keys/default"},
+			},
+		},
+		{
+			// Match blocks are not evaluated
+			alias: "secret",
+			want: Host{
+				HostName:      "secret",
+				User:          "everyone",
+				IdentityFiles: []string{"/keys/default"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.alias, func(t *testing.T) {
+			got := c.Lookup(tc.alias)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %#v but got %#v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+
+	inc := filepath.Join(dir, "hosts.conf")
+	err := os.WriteFile(inc, []byte("Port 2222\nHost other\n\tUser included\n"), 0o600)
+	if err != nil {
+		t.Fatalf("writing include failed: %v", err)
+	}
+
+	main := filepath.Join(dir, "config")
+	err = os.WriteFile(main, []byte("Host box\n\tInclude "+filepath.Join(dir, "*.conf")+"\n"), 0o600)
+	if err != nil {
+		t.Fatalf("writing config failed: %v", err)
+	}
+
+	c, err := ParseFile(main)
+	if err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+
+	// The directives at the start of the included file belong to the block that included it
+	if h := c.Lookup("box"); h.Port != "2222" || h.User != "" {
+		t.Fatalf("unexpected config for box: %#v", h)
+	}
+	if h := c.Lookup("other"); h.Port != "" || h.User != "included" {
+		t.Fatalf("unexpected config for other: %#v", h)
+	}
+}
+
+func TestMissingFileIsEmpty(t *testing.T) {
+	c, err := ParseFile(filepath.Join(t.TempDir(), "missing"))
+	if err != nil {
+		t.Fatalf("expected no error for a missing file but got %v", err)
+	}
+
+	h := c.Lookup("host")
+	if !reflect.DeepEqual(h, Host{HostName: "host"}) {
+		t.Fatalf("expected an empty config but got %#v", h)
+	}
+}
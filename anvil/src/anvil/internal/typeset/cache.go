@@ -11,6 +11,7 @@ func layoutCacheForConstraints(constraints Constraints) cache.Cache[string, []Li
 		constraints.FontSize,
 		constraints.FontFaceId,
 		constraints.WrapWidth,
+		constraints.WrapMode,
 		constraints.TabStopInterval,
 	}
 
@@ -35,5 +36,6 @@ type layoutCacheKey struct {
 	FontSize        int
 	FaceId          string
 	WrapWidth       int
+	WrapMode        WrapMode
 	TabStopInterval int
 }
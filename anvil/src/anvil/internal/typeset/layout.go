@@ -3,12 +3,17 @@ package typeset
 
 import (
 	"fmt"
+	"unicode"
 	"unicode/utf8"
 
+	"gioui.org/io/system"
 	"gioui.org/text"
 	"github.com/ddkwork/golibrary/mylog"
 	"github.com/go-text/typesetting/shaping"
+	"github.com/jeffwilliams/anvil/internal/bidi"
 	"github.com/jeffwilliams/anvil/internal/cache"
+	"github.com/jeffwilliams/anvil/internal/runes"
+	"github.com/rivo/uniseg"
 	"golang.org/x/image/math/fixed"
 )
 
@@ -17,6 +22,19 @@ var (
 	shaper         shaping.HarfbuzzShaper
 )
 
+const (
+	// maxShapingRunLen is the most runes that are shaped together. Longer runs of text with the same
+	// direction are split, preferably after a space.
+	maxShapingRunLen = 256
+	// shapingMaxWidth is the width in pixels that runs are shaped within. It's large enough that the
+	// shaper never wraps a run; the layouter does the wrapping itself.
+	shapingMaxWidth = 1 << 24
+)
+
+// Layout lays out the text into lines. Each input line is shaped in runs of text with the same
+// direction so that ligatures, combining marks and the joining forms of scripts like Arabic are
+// displayed correctly, and the runs are reordered for display using the Unicode bidirectional
+// algorithm. Lines are only wrapped between glyph clusters.
 func Layout(text []byte, constraints Constraints) (Text, []error) {
 	runes := []rune(string(text))
 	l := newLayouter(runes, constraints)
@@ -28,7 +46,6 @@ type layouter struct {
 	input       []rune
 	constraints Constraints
 
-	currentLine     []rune
 	nextRune        int
 	wrapWidth       fixed.Int26_6
 	tabStopInterval fixed.Int26_6
@@ -36,7 +53,6 @@ type layouter struct {
 	height          fixed.Int26_6
 	extraLineGap    fixed.Int26_6
 	text            Text
-	lineBuilder     lineBuilder
 
 	spaceGlyph   text.Glyph
 	tofuGlyph    text.Glyph
@@ -54,83 +70,39 @@ func newLayouter(input []rune, constraints Constraints) layouter {
 }
 
 func (l *layouter) layout() Text {
-	for {
-		offset, r, eof := l.nextInputRune()
-		if eof {
-			break
-		}
-
+	for l.nextRune < len(l.input) {
 		if l.isAnotherLineTooMuch() {
 			break
 		}
 
-		// Checks our cache of previously output lines.
-		// The cache is keyed by the unwrapped input line. We read all the way to the newline
-		// then check the cache for which lines that turns into.
-		if l.currentLineEmpty() && cachingEnabled {
-			// TODO: this []rune to string conversion should be avoided.
-			e := l.cache.Get(string(l.currentLine))
-			if e != nil {
-				lines := e.Val
-				// We already processed a line like this before.
-				// Advance the line length, but -1 because we just processed the first char of the next line.
-				l.forwardBy(len(l.currentLine) - 1)
-				l.outputLines(lines)
-				l.currentLine = l.lineStartingAt(l.nextRune)
-				l.incrementSourceLineCount()
-				continue
-			}
-		}
+		src := l.lineStartingAt(l.nextRune)
+		l.nextRune += len(src)
+		l.incrementSourceLineCount()
 
-		if r == '\n' {
-			l.incrementSourceLineCount()
-			l.appendNewlineToLine()
-			l.cacheAndOutputLine()
-			l.currentLine = l.lineStartingAt(l.nextRune)
+		// Checks our cache of previously output lines.
+		// The cache is keyed by the unwrapped input line. We don't want to cache an input line
+		// that doesn't end in a newline since it might continue past the end of the input.
+		if !cachingEnabled || src[len(src)-1] != '\n' {
+			l.outputLines(l.layoutSourceLine(src))
 			continue
 		}
 
-		output := l.layoutRune(r, offset)
-		if l.wrapWidth > 0 && l.lineWidthPlus(&output) > l.wrapWidth {
-			l.cacheAndOutputLine()
+		// TODO: this []rune to string conversion should be avoided.
+		key := string(src)
+		e := l.cache.Get(key)
+		if e != nil {
+			l.outputLines(e.Val)
+			continue
 		}
 
-		l.appendRuneToLine(r, &output)
+		lines := l.layoutSourceLine(src)
+		l.cache.Set(key, lines)
+		l.outputLines(lines)
 	}
 
-	if !l.currentLineEmpty() {
-		l.incrementSourceLineCount()
-		// We don't want to cache an input line that we didn't fully
-		// process into output lines.
-		l.deleteCurrentLineFromCache()
-		l.outputLine()
-	}
-
-	// l.beautifyText(&l.text)
 	return l.text
 }
 
-func (l *layouter) nextInputRune() (offset int, rn rune, eof bool) {
-	if l.nextRune >= len(l.input) {
-		eof = true
-		return
-	}
-
-	if l.currentLine == nil /*|| rn == '\n' */ {
-		l.currentLine = l.lineStartingAt(l.nextRune)
-	}
-
-	offset = l.nextRune
-	rn = l.input[l.nextRune]
-	l.nextRune++
-
-	return
-}
-
-func (l *layouter) forwardBy(n int) {
-	l.nextRune += n
-}
-
 func (l *layouter) lineStartingAt(offset int) []rune {
 	if offset >= len(l.input) {
 		return nil
@@ -243,126 +215,449 @@ func (l *layouter) incrementSourceLineCount() {
 	l.text.sourceLineCount++
 }
 
-func (l *layouter) appendNewlineToLine() {
-	l.lineBuilder.append_('\n', l.newlineGlyph)
+func (l *layouter) outputLines(lines []Line) {
+	for i, ln := range lines {
+		if i > 0 && l.isAnotherLineTooMuch() {
+			break
+		}
+		l.text.lines = append(l.text.lines, ln)
+		l.text.byteCount += ln.byteCount
+		l.height += l.text.lineHeight
+	}
 }
 
-func (l *layouter) cacheAndOutputLine() {
-	line := l.lineBuilder.getAndReset()
-	l.cacheLine(line)
-	l.text.lines = append(l.text.lines, line)
-	l.text.byteCount += line.byteCount
-	l.height += l.text.lineHeight
+// cluster is a glyph cluster: a sequence of runes that are shaped into a sequence of glyphs that
+// can't be separated. Usually it's one rune and one glyph, but ligatures represent several runes with
+// one glyph and combining marks are often separate glyphs drawn over the glyph of the base rune.
+type cluster struct {
+	// start is the index in the input line of the first rune of the cluster
+	start int
+	// count is the number of runes in the cluster
+	count   int
+	level   bidi.Level
+	advance fixed.Int26_6
+	// glyphs are the glyphs of the cluster. Their X is relative to the left of the cluster.
+	glyphs []text.Glyph
+	isTab  bool
+}
+
+// layoutSourceLine lays out a line of the input, which ends in a newline unless it's the last line
+// of the input, into one or more lines wrapped at the wrap width.
+func (l *layouter) layoutSourceLine(src []rune) []Line {
+	body := src
+	hasNewline := src[len(src)-1] == '\n'
+	if hasNewline {
+		body = src[:len(src)-1]
+	}
+
+	levels, paragraph := bidi.Levels(body)
+	clusters := l.shapeLine(body, levels)
+
+	words := l.constraints.WrapMode == WrapWords
+	var indent fixed.Int26_6
+	if words {
+		indent = l.hangingIndent(body, clusters)
+	}
+
+	var lines []Line
+	var width, lineIndent fixed.Int26_6
+	start := 0
+	// breakAt is the index of the cluster the current line would be broken before when wrapping
+	// at word boundaries, or -1 if there is no word boundary in the line yet.
+	breakAt := -1
+	seenWord := false
+	for i := 0; i < len(clusters); i++ {
+		c := &clusters[i]
+		if c.isTab {
+			c.advance = l.tabAdvance(width)
+		}
+		space := isSpaceCluster(body, c)
+		if !space && seenWord && i > start && isSpaceCluster(body, &clusters[i-1]) {
+			breakAt = i
+		}
+
+		// When wrapping at words whitespace may extend past the wrap width rather than
+		// starting the next line.
+		if l.wrapWidth > 0 && i > start && width+c.advance > l.wrapWidth && !(words && space) {
+			end := i
+			if words && breakAt > start {
+				end = breakAt
+			}
+			lines = append(lines, l.buildLine(src, levels, paragraph, clusters[start:end], lineIndent, false))
+			start, width, lineIndent = end, indent, indent
+			breakAt, seenWord = -1, false
+			// Lay out the clusters after the break again on the new line.
+			i = end - 1
+			continue
+		}
+
+		if !space {
+			seenWord = true
+		}
+		width += c.advance
+	}
+
+	lines = append(lines, l.buildLine(src, levels, paragraph, clusters[start:], lineIndent, hasNewline))
+	return lines
 }
 
-func (l *layouter) cacheLine(line Line) {
-	if cachingEnabled {
-		// TODO: this []rune to string conversion should be avoided
-		s := string(l.currentLine)
-		e := l.cache.Get(s)
-		if e != nil {
-			e.Val = append(e.Val, line)
+// hangingIndent returns the indent of the lines that a source line is wrapped onto when wrapping at
+// words, which is the width of the leading whitespace of the source line. If the leading whitespace
+// takes up too much of the wrap width there is no indent.
+func (l *layouter) hangingIndent(line []rune, clusters []cluster) fixed.Int26_6 {
+	var width fixed.Int26_6
+	for i := range clusters {
+		c := &clusters[i]
+		if !isSpaceCluster(line, c) {
+			break
+		}
+		if c.isTab {
+			width += l.tabAdvance(width)
 		} else {
-			l.cache.Set(s, []Line{line})
+			width += c.advance
 		}
 	}
+
+	if l.wrapWidth > 0 && width > l.wrapWidth/2 {
+		return 0
+	}
+	return width
 }
 
-func (l *layouter) outputLine() {
-	line := l.lineBuilder.getAndReset()
-	l.text.lines = append(l.text.lines, line)
-	l.text.byteCount += line.byteCount
-	l.height += l.text.lineHeight
+func isSpaceCluster(line []rune, c *cluster) bool {
+	return unicode.IsSpace(line[c.start])
 }
 
-func (l *layouter) deleteCurrentLineFromCache() {
-	s := string(l.currentLine)
-	l.cache.Del(s)
+func (l *layouter) tabAdvance(lineWidth fixed.Int26_6) fixed.Int26_6 {
+	nextTabStop := (lineWidth/l.tabStopInterval + 1) * l.tabStopInterval
+	return nextTabStop - lineWidth
 }
 
-func (l *layouter) outputLines(lines []Line) {
-	l.text.lines = append(l.text.lines, lines...)
-	for _, ln := range lines {
-		l.text.byteCount += ln.byteCount
-		l.height += l.text.lineHeight
+// shapeLine shapes the runes of a line that doesn't contain a newline into glyph clusters, in logical
+// order.
+func (l *layouter) shapeLine(line []rune, levels []bidi.Level) []cluster {
+	clusters := make([]cluster, 0, len(line))
+	for start := 0; start < len(line); {
+		r := line[start]
+		if r == '\t' || r == '\r' {
+			clusters = append(clusters, l.controlCluster(r, start, levels[start]))
+			start++
+			continue
+		}
+
+		end := shapingRunEnd(line, levels, start)
+		clusters = l.appendShapedRun(clusters, line[start:end], start, levels[start])
+		start = end
 	}
+	return clusters
 }
 
-func (l *layouter) layoutRune(r rune, offset int) text.Glyph {
-	g := mylog.Check2(l.shapeOneRune(r))
+// shapingRunEnd returns the end of the run of runes starting at start that are shaped together.
+func shapingRunEnd(line []rune, levels []bidi.Level, start int) int {
+	end := start
+	for end < len(line) && end-start < maxShapingRunLen && levels[end] == levels[start] && line[end] != '\t' && line[end] != '\r' {
+		end++
+	}
 
-	l.expandTabsInGlyph(r, &g)
-	l.replaceCarriageReturnsInGlyph(r, &g)
+	if end-start < maxShapingRunLen || end == len(line) {
+		return end
+	}
 
-	return g
+	for i := end - 1; i > start; i-- {
+		if unicode.IsSpace(line[i]) {
+			end = i + 1
+			break
+		}
+	}
+	return graphemeStart(line, start, end)
+}
+
+// graphemeStart returns the start of the grapheme cluster containing the rune at end, so that a run
+// ending there doesn't split the cluster. If the cluster begins at start the run is split at end anyway.
+func graphemeStart(line []rune, start, end int) int {
+	// Whether a cluster continues past end only depends on the runes up to the one at end
+	w := runes.NewWalker([]byte(string(line[start : end+1])))
+	w.SetRunePos(end - start)
+	w.AlignToGraphemeStart()
+	if w.RunePos() == 0 {
+		return end
+	}
+	return start + w.RunePos()
 }
 
-func (l *layouter) expandTabsInGlyph(r rune, g *text.Glyph) {
-	if r != '\t' {
-		return
+// appendShapedRun shapes a run of runes that all have the same level and appends the glyph clusters
+// to clusters. offset is the index of the first rune of the run in the line.
+func (l *layouter) appendShapedRun(clusters []cluster, run []rune, offset int, level bidi.Level) []cluster {
+	params := text.Parameters{
+		Font:     l.constraints.FontFace.Font,
+		PxPerEm:  fixed.I(l.constraints.FontSize),
+		MaxWidth: shapingMaxWidth,
+	}
+	if level.IsRTL() {
+		params.Locale = system.Locale{Direction: system.RTL}
+	}
+
+	l.shaper.LayoutString(params, string(run))
+
+	n := len(clusters)
+	var glyphs []text.Glyph
+	count := 0
+	for {
+		g, ok := l.shaper.NextGlyph()
+		if !ok {
+			break
+		}
+		glyphs = append(glyphs, g)
+		if g.Flags&text.FlagClusterBreak == 0 || g.Runes == 0 {
+			continue
+		}
+
+		clusters = append(clusters, newCluster(glyphs, offset+count, g.Runes, level))
+		count += g.Runes
+		glyphs = nil
+	}
+
+	if count != len(run) {
+		// The shaper didn't account for each rune of the run, so the glyphs can't be
+		// mapped back to the runes. Lay out each rune on its own instead.
+		l.errors = append(l.errors, fmt.Errorf("shaping '%s' produced glyphs for %d of %d runes", string(run), count, len(run)))
+		clusters = clusters[:n]
+		for i, r := range run {
+			clusters = append(clusters, l.runeCluster(r, offset+i, level))
+		}
+		return clusters
+	}
+
+	merged := mergeGraphemes(clusters[n:], run, offset)
+	return clusters[:n+len(merged)]
+}
+
+// mergeGraphemes merges the clusters of a shaped run so that none of them splits a grapheme cluster.
+// The shaper doesn't always keep a grapheme cluster together, such as when the font doesn't have a glyph
+// for an emoji ZWJ sequence or a combining mark, and the cursor should never be placed within one.
+func mergeGraphemes(clusters []cluster, run []rune, offset int) []cluster {
+	isStart := make([]bool, len(run)+1)
+	state := -1
+	rest := string(run)
+	i := 0
+	for rest != "" {
+		isStart[i] = true
+		var g string
+		g, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		i += utf8.RuneCountInString(g)
 	}
 
-	nextTabStop := (l.lineBuilder.lineWidth()/l.tabStopInterval + 1) * l.tabStopInterval
-	advance := nextTabStop - l.lineWidth()
-	g.Advance = advance
-	g.Offset = fixed.Point26_6{0, 0}
-	g.ID = l.spaceGlyph.ID
+	merged := clusters[:0]
+	for _, c := range clusters {
+		if len(merged) > 0 && !isStart[c.start-offset] {
+			merged[len(merged)-1].merge(c)
+			continue
+		}
+		merged = append(merged, c)
+	}
+	return merged
 }
 
-func (l *layouter) replaceCarriageReturnsInGlyph(r rune, g *text.Glyph) {
-	if r != '\r' || l.tofuGlyph.ID == 0 || !l.constraints.ReplaceCRWithTofu {
-		return
+// merge appends the cluster next, which follows c in logical order, to c.
+func (c *cluster) merge(next cluster) {
+	shift, nextShift := fixed.Int26_6(0), c.advance
+	if c.level.IsRTL() {
+		shift, nextShift = next.advance, 0
 	}
 
-	*g = l.tofuGlyph
+	for i := range c.glyphs {
+		c.glyphs[i].X += shift
+	}
+	for _, g := range next.glyphs {
+		g.X += nextShift
+		c.glyphs = append(c.glyphs, g)
+	}
+	c.count += next.count
+	c.advance += next.advance
 }
 
-func (l *layouter) lineWidthPlus(g *text.Glyph) fixed.Int26_6 {
-	return g.Advance + l.lineBuilder.lineWidth()
+// newCluster makes a cluster from the glyphs the shaper produced for it.
+func newCluster(glyphs []text.Glyph, start, count int, level bidi.Level) cluster {
+	left := glyphs[0].X
+	var advance fixed.Int26_6
+	for _, g := range glyphs {
+		left = min(left, g.X)
+		advance += g.Advance
+	}
+
+	c := cluster{
+		start:   start,
+		count:   count,
+		level:   level,
+		advance: roundFixed(advance),
+		glyphs:  make([]text.Glyph, len(glyphs)),
+	}
+	for i, g := range glyphs {
+		g.X -= left
+		c.glyphs[i] = g
+	}
+	return c
 }
 
-func (l *layouter) lineWidth() fixed.Int26_6 {
-	return l.lineBuilder.line.width
+func (l *layouter) runeCluster(r rune, start int, level bidi.Level) cluster {
+	g := mylog.Check2(l.shapeOneRune(r))
+	g.X = 0
+	return cluster{
+		start:   start,
+		count:   1,
+		level:   level,
+		advance: roundFixed(g.Advance),
+		glyphs:  []text.Glyph{g},
+	}
 }
 
-func (l *layouter) appendRuneToLine(r rune, g *text.Glyph) {
-	g.X = l.lineBuilder.get().Width()
-	g.Advance = roundFixed(g.Advance)
+// controlCluster makes the cluster for a tab or carriage return. A tab is drawn as a space whose advance
+// reaches the next tab stop, and is set when the line is wrapped.
+func (l *layouter) controlCluster(r rune, start int, level bidi.Level) cluster {
+	if r == '\t' {
+		g := l.spaceGlyph
+		g.X = 0
+		g.Offset = fixed.Point26_6{}
+		return cluster{
+			start:  start,
+			count:  1,
+			level:  level,
+			glyphs: []text.Glyph{g},
+			isTab:  true,
+		}
+	}
+
+	if l.tofuGlyph.ID == 0 || !l.constraints.ReplaceCRWithTofu {
+		return l.runeCluster(r, start, level)
+	}
 
-	l.lineBuilder.append_(r, *g)
+	g := l.tofuGlyph
+	g.X = 0
+	return cluster{
+		start:   start,
+		count:   1,
+		level:   level,
+		advance: roundFixed(g.Advance),
+		glyphs:  []text.Glyph{g},
+	}
 }
 
-func (l *layouter) beautifyText(text *Text) {
-	for i := range text.lines {
-		l.beautifyLine(&text.lines[i])
+// buildLine makes a line from the clusters of the source line src, placing them in visual order.
+// levels are the levels of the runes of src and paragraph is its level. The first cluster is placed at x
+// position indent.
+func (l *layouter) buildLine(src []rune, levels []bidi.Level, paragraph bidi.Level, clusters []cluster, indent fixed.Int26_6, withNewline bool) Line {
+	first := len(src)
+	if withNewline {
+		first--
+	}
+	end := first
+	if len(clusters) > 0 {
+		first = clusters[0].start
+		last := clusters[len(clusters)-1]
+		end = last.start + last.count
+	}
+	if withNewline {
+		end++
+	}
+
+	line := Line{
+		runes:  src[first:end],
+		glyphs: make([]text.Glyph, end-first),
+	}
+	if len(line.runes) == 0 {
+		return emptyLine()
+	}
+	for _, r := range line.runes {
+		line.byteCount += utf8.RuneLen(r)
+	}
+
+	order := l.visualOrder(src, levels, paragraph, clusters, first)
+
+	x := indent
+	for i, ci := range order {
+		if ci != i {
+			line.reordered = true
+		}
+
+		c := &clusters[ci]
+		rel := c.start - first
+		for _, g := range c.glyphs {
+			g.X += x
+			line.drawGlyphs = append(line.drawGlyphs, g)
+			line.drawRunes = append(line.drawRunes, rel)
+		}
+		c.fillSlots(line.glyphs[rel:rel+c.count], x)
+		x += c.advance
 	}
+	line.width = x
+
+	if withNewline {
+		g := l.newlineGlyph
+		g.X = x
+		line.glyphs[len(line.glyphs)-1] = g
+	}
+
+	return line
 }
 
-// beautifyLine is meant to adjust the spacing between the glyphs within the line
-// so that it looks better. The idea is that we re-layout all the runes of the entire
-// line together so that the text layout engine can figure out the internal spacing.
-// However, visually I didn't see any improvement so it's not used for now.
-func (l *layouter) beautifyLine(line *Line) {
-	params := text.Parameters{
-		Font:    l.constraints.FontFace.Font,
-		PxPerEm: fixed.I(l.constraints.FontSize),
+// visualOrder returns the indices of the clusters in the order they are displayed from left to right.
+func (l *layouter) visualOrder(src []rune, levels []bidi.Level, paragraph bidi.Level, clusters []cluster, first int) []int {
+	order := make([]int, len(clusters))
+	for i := range order {
+		order[i] = i
+	}
+	if len(clusters) == 0 || !needsReordering(levels) {
+		return order
 	}
 
-	l.shaper.LayoutString(params, string(line.runes))
+	last := clusters[len(clusters)-1]
+	end := last.start + last.count
+	lineLevels := bidi.LineLevels(src[first:end], levels[first:end], paragraph)
 
-	line.glyphs = line.glyphs[:0]
-	for i := 0; ; i++ {
-		g, ok := l.shaper.NextGlyph()
-		if !ok {
-			break
+	clusterLevels := make([]bidi.Level, len(clusters))
+	for i, c := range clusters {
+		clusterLevels[i] = lineLevels[c.start-first]
+	}
+	return bidi.Reorder(clusterLevels)
+}
+
+func needsReordering(levels []bidi.Level) bool {
+	for _, lv := range levels {
+		if lv > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fillSlots sets the glyphs in slots, one for each rune of the cluster, that are used to find the
+// positions of the runes in the line. The advance of the cluster is shared evenly between the runes
+// so that the cursor can be placed within a ligature, and for right-to-left clusters the runes are
+// placed from right to left and marked with FlagTowardOrigin. The cluster is placed at x.
+func (c *cluster) fillSlots(slots []text.Glyph, x fixed.Int26_6) {
+	proto := c.glyphs[0]
+	proto.X = 0
+	proto.Offset = fixed.Point26_6{}
+	proto.Flags = 0
+	proto.Runes = 0
+
+	n := fixed.Int26_6(len(slots))
+	for k := range slots {
+		lo := c.advance * fixed.Int26_6(k) / n
+		hi := c.advance * fixed.Int26_6(k+1) / n
+
+		g := proto
+		g.Advance = hi - lo
+		g.X = x + lo
+		if c.level.IsRTL() {
+			g.X = x + c.advance - hi
+			g.Flags |= text.FlagTowardOrigin
 		}
-		if i < len(line.runes) {
-			r := line.runes[i]
-			// This is not working right yet:
-			l.expandTabsInGlyph(r, &g)
-			l.replaceCarriageReturnsInGlyph(r, &g)
+		if k == len(slots)-1 {
+			g.Flags |= text.FlagClusterBreak
+			g.Runes = len(slots)
 		}
-		line.glyphs = append(line.glyphs, g)
+		slots[k] = g
 	}
 }
 
@@ -383,45 +678,11 @@ func fixedAsString(i fixed.Int26_6) string {
 	return fmt.Sprintf("%d %d/%d", i>>6, i&0x3F, 0x40)
 }
 
-func (l *layouter) currentLineEmpty() bool {
-	return l.lineBuilder.empty()
-}
-
-type lineBuilder struct {
-	line Line
-}
-
-func (b *lineBuilder) append_(r rune, g text.Glyph) {
-	b.line.runes = append(b.line.runes, r)
-	b.line.glyphs = append(b.line.glyphs, g)
-	b.line.byteCount += utf8.RuneLen(r)
-	b.line.width += g.Advance
-}
-
-func (b *lineBuilder) getAndReset() (line Line) {
-	line = b.get()
-	b.line.runes = nil
-	b.line.glyphs = nil
-	b.line.width = 0
-	b.line.byteCount = 0
-	return
-}
-
-func (b *lineBuilder) get() (line Line) {
-	if b.line.runes == nil {
-		line.runes = emptyRuneSlice
-		line.glyphs = emptyGlyphSlice
+func emptyLine() Line {
+	return Line{
+		runes:  emptyRuneSlice,
+		glyphs: emptyGlyphSlice,
 	}
-	line = b.line
-	return
-}
-
-func (b *lineBuilder) empty() bool {
-	return len(b.line.runes) == 0
-}
-
-func (b *lineBuilder) lineWidth() fixed.Int26_6 {
-	return b.line.width
 }
 
 var (
@@ -429,6 +690,17 @@ var (
 	emptyGlyphSlice = []text.Glyph{}
 )
 
+// WrapMode controls where lines that are wider than the WrapWidth are broken.
+type WrapMode int
+
+const (
+	// WrapAnywhere breaks lines between any two glyph clusters.
+	WrapAnywhere WrapMode = iota
+	// WrapWords breaks lines after the whitespace between words where possible, and indents the
+	// lines a source line is wrapped onto to match its leading whitespace.
+	WrapWords
+)
+
 // Constraints constrain how the text is layed out
 type Constraints struct {
 	FontSize int
@@ -438,6 +710,7 @@ type Constraints struct {
 	FontFace   text.FontFace
 	// a WrapWidth of 0 means do not wrap.
 	WrapWidth       int // in pixels
+	WrapMode        WrapMode
 	TabStopInterval int // in pixels
 	// a MaxHeight of 0 means process all the input text, no matter how many lines it creates.
 	MaxHeight         int // stop laying out when this height is reached. Use -1 to layout all text.
@@ -0,0 +1,251 @@
+package typeset
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gioui.org/f32"
+	"gioui.org/font"
+	"gioui.org/text"
+	"github.com/ddkwork/golibrary/mylog"
+	"github.com/jeffwilliams/anvil/internal/bidi"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+)
+
+func testConstraints(wrapWidth int) Constraints {
+	face := mylog.Check2(ParseTTFBytes(goregular.TTF))
+	return Constraints{
+		FontSize:        14,
+		FontFaceId:      "goregular",
+		FontFace:        text.FontFace{Font: font.Font{}, Face: face},
+		WrapWidth:       wrapWidth,
+		TabStopInterval: 40,
+	}
+}
+
+// lineMapping describes how the runes of a line map to glyphs: the left edge in pixels of each rune,
+// which runes are right-to-left, and the index of the first rune of the cluster of each glyph drawn,
+// in the order they are drawn.
+type lineMapping struct {
+	runeX     []int
+	rtl       []bool
+	drawRunes []int
+}
+
+func mappingOf(l Line) lineMapping {
+	var m lineMapping
+	for _, g := range l.Glyphs() {
+		m.runeX = append(m.runeX, g.X.Round())
+		m.rtl = append(m.rtl, isRTL(g))
+	}
+	m.drawRunes = l.drawRunes
+	return m
+}
+
+func TestLayoutGlyphMapping(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wrapWidth int
+		wrapMode  WrapMode
+		expected  []lineMapping
+	}{
+		{
+			name:  "ltr",
+			input: "ab c",
+			expected: []lineMapping{
+				{
+					runeX:     []int{0, 8, 16, 20},
+					rtl:       []bool{false, false, false, false},
+					drawRunes: []int{0, 1, 2, 3},
+				},
+			},
+		},
+		{
+			name:  "rtl is reordered",
+			input: "ab אב",
+			expected: []lineMapping{
+				{
+					runeX:     []int{0, 8, 16, 31, 20},
+					rtl:       []bool{false, false, false, true, true},
+					drawRunes: []int{0, 1, 2, 4, 3},
+				},
+			},
+		},
+		{
+			name:  "zwj sequence is one cluster",
+			input: "a\U0001F469‍\U0001F4BB",
+			expected: []lineMapping{
+				{
+					runeX:     []int{0, 8, 15, 23},
+					rtl:       []bool{false, false, false, false},
+					drawRunes: []int{0, 1, 1, 1},
+				},
+			},
+		},
+		{
+			name:  "tab and newline",
+			input: "a\tb\n",
+			expected: []lineMapping{
+				{
+					runeX:     []int{0, 8, 40, 48},
+					rtl:       []bool{false, false, false, false},
+					drawRunes: []int{0, 1, 2},
+				},
+			},
+		},
+		{
+			name:      "clusters are not split when wrapping",
+			input:     "ab\U0001F469‍\U0001F4BB",
+			wrapWidth: 25,
+			expected: []lineMapping{
+				{
+					runeX:     []int{0, 8},
+					rtl:       []bool{false, false},
+					drawRunes: []int{0, 1},
+				},
+				{
+					runeX:     []int{0, 7, 15},
+					rtl:       []bool{false, false, false},
+					drawRunes: []int{0, 0, 0},
+				},
+			},
+		},
+		{
+			name:      "words are not split when wrapping at words",
+			input:     "ab cd",
+			wrapWidth: 30,
+			wrapMode:  WrapWords,
+			expected: []lineMapping{
+				{
+					runeX:     []int{0, 8, 16},
+					rtl:       []bool{false, false, false},
+					drawRunes: []int{0, 1, 2},
+				},
+				{
+					runeX:     []int{0, 7},
+					rtl:       []bool{false, false},
+					drawRunes: []int{0, 1},
+				},
+			},
+		},
+		{
+			name:      "wrapped lines are indented like the source line",
+			input:     "\tab cd ef",
+			wrapWidth: 82,
+			wrapMode:  WrapWords,
+			expected: []lineMapping{
+				{
+					runeX:     []int{0, 40, 48, 56, 60, 67, 75},
+					rtl:       []bool{false, false, false, false, false, false, false},
+					drawRunes: []int{0, 1, 2, 3, 4, 5, 6},
+				},
+				{
+					runeX:     []int{40, 48},
+					rtl:       []bool{false, false},
+					drawRunes: []int{0, 1},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testConstraints(tc.wrapWidth)
+			c.WrapMode = tc.wrapMode
+			txt, errs := Layout([]byte(tc.input), c)
+			if len(errs) > 0 {
+				t.Fatalf("layout failed: %v", errs)
+			}
+
+			var got []lineMapping
+			for _, l := range txt.Lines() {
+				got = append(got, mappingOf(l))
+			}
+
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected\n%+v\nbut got\n%+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestBidiCaretPositions(t *testing.T) {
+	// The runes of "ab אב" are displayed as "ab בא", with ב from x=20 to 31 and א from 31 to 42.
+	txt, errs := Layout([]byte("ab אב"), testConstraints(0))
+	if len(errs) > 0 {
+		t.Fatalf("layout failed: %v", errs)
+	}
+	line := txt.Lines()[0]
+
+	caretX := []int{0, 8, 16, 42, 31, 20}
+	for i, x := range caretX {
+		if got := line.XOfRuneIndex(i); got != x {
+			t.Errorf("caret before rune %d: expected x %d but got %d", i, x, got)
+		}
+	}
+
+	runeIndexAtX := map[int]int{0: 0, 9: 1, 41: 3, 33: 4, 21: 5, 100: 3}
+	for x, i := range runeIndexAtX {
+		if got := line.RuneIndexAtX(x); got != i {
+			t.Errorf("rune index at x %d: expected %d but got %d", x, i, got)
+		}
+	}
+
+	indexOfPixel := map[float32]int{1: 0, 25: 4, 35: 3, 100: 3}
+	for x, i := range indexOfPixel {
+		if got := txt.IndexOfPixelCoord(f32.Pt(x, 0)); got != i {
+			t.Errorf("index of pixel at x %v: expected %d but got %d", x, i, got)
+		}
+	}
+}
+
+func TestSplitKeepsPositions(t *testing.T) {
+	txt, errs := Layout([]byte("ab אב"), testConstraints(0))
+	if len(errs) > 0 {
+		t.Fatalf("layout failed: %v", errs)
+	}
+	line := txt.Lines()[0]
+
+	first, rest := line.Split(4)
+
+	if !reflect.DeepEqual(first.drawRunes, []int{0, 1, 2, 3}) || !reflect.DeepEqual(rest.drawRunes, []int{0}) {
+		t.Fatalf("draw runes were split wrong: %v %v", first.drawRunes, rest.drawRunes)
+	}
+
+	if x := rest.DrawGlyphs()[0].X.Round(); x != 20 {
+		t.Fatalf("expected the second part to be drawn at 20 but it's at %d", x)
+	}
+
+	expected := []Span{{fixed.I(0), fixed.I(20)}, {fixed.I(31), fixed.I(42)}}
+	if spans := first.Spans(); !reflect.DeepEqual(spans, expected) {
+		t.Fatalf("expected spans %v but got %v", expected, spans)
+	}
+}
+
+func TestShapingRunEndKeepsGraphemes(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected int
+	}{
+		{name: "short", line: "abc", expected: 3},
+		{name: "cut at space", line: strings.Repeat("a", 200) + " " + strings.Repeat("b", 100), expected: 201},
+		{name: "cut between letters", line: strings.Repeat("a", 300), expected: maxShapingRunLen},
+		{name: "combining mark at cut", line: strings.Repeat("a", maxShapingRunLen-1) + "e\u0301" + "bc", expected: maxShapingRunLen - 1},
+		{name: "emoji sequence at cut", line: strings.Repeat("a", maxShapingRunLen-2) + "👩\u200d💻" + "bc", expected: maxShapingRunLen - 2},
+		{name: "space then combining mark at cut", line: strings.Repeat("a", maxShapingRunLen-1) + " \u0301" + "bc", expected: maxShapingRunLen - 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			line := []rune(tc.line)
+			levels := make([]bidi.Level, len(line))
+			if end := shapingRunEnd(line, levels, 0); end != tc.expected {
+				t.Fatalf("expected the run to end at %d but it ends at %d", tc.expected, end)
+			}
+		})
+	}
+}
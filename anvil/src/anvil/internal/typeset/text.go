@@ -2,6 +2,7 @@ package typeset
 
 import (
 	"math"
+	"sort"
 	"unicode/utf8"
 
 	"gioui.org/f32"
@@ -91,31 +92,22 @@ func (t Text) IndexOfPixelCoord(pos f32.Point) int {
 		runeIndex += t.lines[i].RuneCount()
 	}
 
-	var xoffset fixed.Int26_6
 	posX := fixed.I(int(math.Round(float64(pos.X))))
-
-	reachedEnd := true
-	for _, glyph := range line.glyphs {
-		adv := glyph.Advance
-		if xoffset+adv > posX {
-			reachedEnd = false
-			break
-		}
-		xoffset += adv
-		runeIndex++
-	}
-
-	if reachedEnd && line.EndsWith('\n') {
-		// This is to treat a click past the end of a complete (newline terminated) line as a click at the end of the line
-		runeIndex--
-	}
-
-	return runeIndex
+	return runeIndex + line.runeIndexContainingX(posX)
 }
 
+// Line is a line of layed-out text.
 type Line struct {
-	runes     []rune // Should this be []byte to get the length in bytes easier?
-	glyphs    []text.Glyph
+	runes []rune // Should this be []byte to get the length in bytes easier?
+	// glyphs has an entry for each rune that describes the horizontal span of the line the
+	// rune occupies. See Glyphs.
+	glyphs []text.Glyph
+	// drawGlyphs are the glyphs to draw in visual order, and drawRunes are the indices in runes of
+	// the first rune of the cluster that each of them belongs to.
+	drawGlyphs []text.Glyph
+	drawRunes  []int
+	// reordered is true if the glyphs are not drawn in the same order as the runes.
+	reordered bool
 	byteCount int
 	width     fixed.Int26_6
 	ascent    fixed.Int26_6
@@ -129,10 +121,25 @@ func (l Line) RuneCount() int {
 	return len(l.runes)
 }
 
+// Glyphs returns one glyph for each rune of the line, which gives the position the rune has in
+// the line. The X of the glyph is the left edge of the rune relative to the start of the line
+// (before it was split), and its Advance is the width of the rune. When several runes are
+// shaped into one glyph cluster, such as a ligature or a letter with combining marks, the width
+// of the cluster is shared evenly between them. The glyphs of runes displayed right-to-left have
+// FlagTowardOrigin set, and the glyph of the last rune of each cluster has FlagClusterBreak set.
+//
+// These glyphs are not meant to be drawn: use DrawGlyphs for that.
 func (l Line) Glyphs() []text.Glyph {
 	return l.glyphs
 }
 
+// DrawGlyphs returns the glyphs to draw the line with, in visual order. Their X is relative to the
+// start of the line (before it was split) and so the glyphs of a line that is not the first part
+// of a split line don't start at 0.
+func (l Line) DrawGlyphs() []text.Glyph {
+	return l.drawGlyphs
+}
+
 func (l Line) EndsWith(r rune) bool {
 	if l.RuneCount() == 0 {
 		return false
@@ -156,6 +163,9 @@ func (l Line) Ascent() fixed.Int26_6 {
 	return l.ascent
 }
 
+// Split splits the line into the runes before index and the runes from index on. The parts keep
+// the horizontal positions the runes had in the line, so that when the line contains text
+// displayed right-to-left each part is drawn in the right place.
 func (l *Line) Split(index int) (first, rest *Line) {
 	if index < 0 || index > l.RuneCount() {
 		first = l
@@ -171,7 +181,7 @@ func (l *Line) Split(index int) (first, rest *Line) {
 
 	firstByteCount := 0
 	for _, r := range firstRunes {
-		firstByteCount = utf8.RuneLen(r)
+		firstByteCount += utf8.RuneLen(r)
 	}
 	lastByteCount := l.byteCount - firstByteCount
 
@@ -184,6 +194,7 @@ func (l *Line) Split(index int) (first, rest *Line) {
 	first = &Line{
 		runes:     firstRunes,
 		glyphs:    firstGlyphs,
+		reordered: l.reordered,
 		byteCount: firstByteCount,
 		width:     firstWidth,
 	}
@@ -191,9 +202,188 @@ func (l *Line) Split(index int) (first, rest *Line) {
 	rest = &Line{
 		runes:     lastRunes,
 		glyphs:    lastGlyphs,
+		reordered: l.reordered,
 		byteCount: lastByteCount,
 		width:     lastWidth,
 	}
 
+	l.splitDrawGlyphs(index, first, rest)
 	return
 }
+
+func (l *Line) splitDrawGlyphs(index int, first, rest *Line) {
+	if !l.reordered {
+		// The glyphs are in the same order as the runes.
+		n := sort.SearchInts(l.drawRunes, index)
+		first.drawGlyphs, first.drawRunes = l.drawGlyphs[:n], l.drawRunes[:n]
+		rest.drawGlyphs = l.drawGlyphs[n:]
+		rest.drawRunes = make([]int, len(l.drawRunes)-n)
+		for i, r := range l.drawRunes[n:] {
+			rest.drawRunes[i] = r - index
+		}
+		return
+	}
+
+	for i, g := range l.drawGlyphs {
+		r := l.drawRunes[i]
+		if r < index {
+			first.drawGlyphs = append(first.drawGlyphs, g)
+			first.drawRunes = append(first.drawRunes, r)
+		} else {
+			rest.drawGlyphs = append(rest.drawGlyphs, g)
+			rest.drawRunes = append(rest.drawRunes, r-index)
+		}
+	}
+}
+
+// Span is a horizontal range of a line.
+type Span struct {
+	Left, Right fixed.Int26_6
+}
+
+// Spans returns the horizontal ranges of the line that its runes occupy, from left to right. A line
+// that is part of a split line with text displayed right-to-left may occupy several separate ranges.
+func (l Line) Spans() []Span {
+	var spans []Span
+	for _, g := range l.glyphs {
+		if g.Advance == 0 {
+			continue
+		}
+		spans = append(spans, Span{g.X, g.X + g.Advance})
+	}
+
+	if l.reordered {
+		sort.Slice(spans, func(i, j int) bool {
+			return spans[i].Left < spans[j].Left
+		})
+	}
+
+	merged := spans[:0]
+	for _, s := range spans {
+		if len(merged) > 0 && merged[len(merged)-1].Right == s.Left {
+			merged[len(merged)-1].Right = s.Right
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// contentLen returns the number of runes in the line, not counting a trailing newline.
+func (l Line) contentLen() int {
+	n := l.RuneCount()
+	if l.EndsWith('\n') {
+		n--
+	}
+	return n
+}
+
+func isRTL(g text.Glyph) bool {
+	return g.Flags&text.FlagTowardOrigin != 0
+}
+
+// CaretX returns the horizontal offset of the cursor when it is before the rune at index in the line,
+// relative to the start of the line. For a rune displayed right-to-left that is its right edge. An index
+// at the end of the line puts the cursor after the last rune.
+func (l Line) CaretX(index int) fixed.Int26_6 {
+	if index < 0 {
+		index = 0
+	}
+	if index < len(l.glyphs) {
+		g := l.glyphs[index]
+		if isRTL(g) {
+			return g.X + g.Advance
+		}
+		return g.X
+	}
+
+	if len(l.glyphs) == 0 {
+		return 0
+	}
+	g := l.glyphs[len(l.glyphs)-1]
+	if isRTL(g) {
+		return g.X
+	}
+	return g.X + g.Advance
+}
+
+// visualEnds returns the indices of the leftmost and rightmost runes of the line that have a width,
+// not counting a trailing newline. ok is false if there are no such runes.
+func (l Line) visualEnds() (left, right int, ok bool) {
+	for i, g := range l.glyphs[:l.contentLen()] {
+		if g.Advance == 0 {
+			continue
+		}
+		if !ok || g.X < l.glyphs[left].X {
+			left = i
+		}
+		if !ok || g.X > l.glyphs[right].X {
+			right = i
+		}
+		ok = true
+	}
+	return
+}
+
+// RuneIndexAtX returns the index of the rune boundary in the line that is closest to the horizontal
+// pixel offset x. A trailing newline is not counted, so an x past the end of the line returns the
+// index of the end of the line.
+func (l Line) RuneIndexAtX(x int) int {
+	n := l.contentLen()
+	posX := fixed.I(x)
+
+	for i, g := range l.glyphs[:n] {
+		if posX < g.X || posX >= g.X+g.Advance {
+			continue
+		}
+		beforeMiddle := posX < g.X+g.Advance/2
+		if beforeMiddle != isRTL(g) {
+			return i
+		}
+		return i + 1
+	}
+
+	left, right, ok := l.visualEnds()
+	if !ok {
+		return n
+	}
+	if posX < l.glyphs[left].X {
+		if isRTL(l.glyphs[left]) {
+			return left + 1
+		}
+		return left
+	}
+	if isRTL(l.glyphs[right]) {
+		return right
+	}
+	return right + 1
+}
+
+// runeIndexContainingX returns the index of the rune in the line that is displayed at the horizontal
+// offset x. An x past the right of the line returns the end of the line, but before a trailing newline.
+func (l Line) runeIndexContainingX(x fixed.Int26_6) int {
+	n := l.contentLen()
+	for i, g := range l.glyphs[:n] {
+		if x >= g.X && x < g.X+g.Advance {
+			return i
+		}
+	}
+
+	left, right, ok := l.visualEnds()
+	if !ok {
+		return n
+	}
+	if x < l.glyphs[left].X {
+		return left
+	}
+	if isRTL(l.glyphs[right]) {
+		return right
+	}
+	return n
+}
+
+// XOfRuneIndex returns the horizontal pixel offset of the cursor before the rune at index in the line.
+// See CaretX.
+func (l Line) XOfRuneIndex(index int) int {
+	return l.CaretX(index).Round()
+}
@@ -0,0 +1,936 @@
+// Package vt emulates the screen of a VT100/xterm compatible terminal.
+//
+// Output from a program is written to a Terminal, which interprets the control characters and escape
+// sequences in it and keeps the resulting grid of characters, their attributes and the cursor position.
+// Lines that scroll off the top of the main screen are kept until they are taken with TakeScrollback.
+//
+// The common subset of xterm's sequences that full screen programs use is supported: cursor movement,
+// erasing, inserting and deleting characters and lines, scroll regions, the alternate screen, colours
+// and text attributes, and the device status reports. All characters are treated as one column wide.
+package vt
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ColorKind is how a Color is specified.
+type ColorKind uint8
+
+const (
+	// DefaultColor is the default foreground or background color.
+	DefaultColor ColorKind = iota
+	// IndexedColor is a color from the 256 color palette. The first 16 are the ANSI colors.
+	IndexedColor
+	// RGBColor is a 24-bit color.
+	RGBColor
+)
+
+// Color is the foreground or background color of a cell.
+type Color struct {
+	Kind    ColorKind
+	Index   uint8
+	R, G, B uint8
+}
+
+// Attr are the colors and attributes of a cell.
+type Attr struct {
+	Fg, Bg    Color
+	Bold      bool
+	Faint     bool
+	Italic    bool
+	Underline bool
+	Reverse   bool
+}
+
+// Cell is one character on the screen. A Rune of 0 is a blank that was never written to.
+type Cell struct {
+	Rune rune
+	Attr Attr
+}
+
+// Line is a row of the screen.
+type Line struct {
+	Cells []Cell
+	// Wrapped is true if the text on the line continues on the next line because it was too long.
+	Wrapped bool
+}
+
+// String returns the text of the line. Blanks at the end of the line are left out unless it is wrapped.
+func (l Line) String() string {
+	var b strings.Builder
+	for _, c := range l.Cells {
+		if c.Rune == 0 {
+			b.WriteByte(' ')
+			continue
+		}
+		b.WriteRune(c.Rune)
+	}
+	if l.Wrapped {
+		return b.String()
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+func (l Line) blank() bool {
+	for _, c := range l.Cells {
+		if c.Rune != 0 && c.Rune != ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+type cursor struct {
+	row, col int
+	attr     Attr
+	// wrapNext is set when a character was written in the last column. The next character is written
+	// at the start of the next line.
+	wrapNext   bool
+	originMode bool
+}
+
+type parserState int
+
+const (
+	stateGround parserState = iota
+	stateEscape
+	stateEscapeConsume
+	stateCSI
+	stateOSC
+	stateString
+	stateStringEscape
+)
+
+// Terminal is the state of the emulated terminal. It is not safe to use from multiple goroutines.
+type Terminal struct {
+	rows, cols int
+	main, alt  []Line
+	// screen is main or alt
+	screen   []Line
+	altShown bool
+
+	cur             cursor
+	saved, savedAlt cursor
+	top, bottom     int
+	tabs            []bool
+	autowrap        bool
+	cursorVisible   bool
+	appCursorKeys   bool
+	insertMode      bool
+	bracketedPaste  bool
+	lastRune        rune
+	title           string
+	scrollback      []Line
+	replies         []byte
+	pending         []byte
+	state           parserState
+	params          []int
+	paramStarted    bool
+	private         byte
+	intermediate    byte
+	str             []byte
+	strIsOSC        bool
+}
+
+// New returns a terminal with a screen of the given size.
+func New(rows, cols int) *Terminal {
+	t := &Terminal{}
+	t.Resize(max(rows, 1), max(cols, 1))
+	t.reset()
+	return t
+}
+
+func (t *Terminal) reset() {
+	t.main = blankLines(t.rows, t.cols)
+	t.alt = blankLines(t.rows, t.cols)
+	t.screen = t.main
+	t.altShown = false
+	t.cur = cursor{}
+	t.saved = cursor{}
+	t.savedAlt = cursor{}
+	t.top, t.bottom = 0, t.rows-1
+	t.autowrap = true
+	t.cursorVisible = true
+	t.appCursorKeys = false
+	t.insertMode = false
+	t.bracketedPaste = false
+	t.resetTabs()
+	t.state = stateGround
+}
+
+func blankLines(rows, cols int) []Line {
+	lines := make([]Line, rows)
+	for i := range lines {
+		lines[i] = Line{Cells: make([]Cell, cols)}
+	}
+	return lines
+}
+
+func (t *Terminal) resetTabs() {
+	t.tabs = make([]bool, t.cols)
+	for i := 8; i < t.cols; i += 8 {
+		t.tabs[i] = true
+	}
+}
+
+// Size returns the number of rows and columns of the screen.
+func (t *Terminal) Size() (rows, cols int) {
+	return t.rows, t.cols
+}
+
+// Lines returns the lines of the screen being shown. They must not be modified.
+func (t *Terminal) Lines() []Line {
+	return t.screen
+}
+
+// Cursor returns the position of the cursor.
+func (t *Terminal) Cursor() (row, col int) {
+	return t.cur.row, t.cur.col
+}
+
+// CursorVisible returns false if the program hid the cursor.
+func (t *Terminal) CursorVisible() bool {
+	return t.cursorVisible
+}
+
+// AltScreen returns true if the alternate screen, which full screen programs use, is shown.
+func (t *Terminal) AltScreen() bool {
+	return t.altShown
+}
+
+// AppCursorKeys returns true if the program asked for the cursor keys to send application sequences.
+func (t *Terminal) AppCursorKeys() bool {
+	return t.appCursorKeys
+}
+
+// BracketedPaste returns true if the program asked for pasted text to be surrounded by markers.
+func (t *Terminal) BracketedPaste() bool {
+	return t.bracketedPaste
+}
+
+// Title returns the title the program set for the window.
+func (t *Terminal) Title() string {
+	return t.title
+}
+
+// TakeScrollback returns the lines that scrolled off the top of the main screen since it was last called.
+func (t *Terminal) TakeScrollback() []Line {
+	s := t.scrollback
+	t.scrollback = nil
+	return s
+}
+
+// TakeReplies returns the responses to queries from the program, like the cursor position report, that
+// should be sent to the program as input.
+func (t *Terminal) TakeReplies() []byte {
+	r := t.replies
+	t.replies = nil
+	return r
+}
+
+// Resize changes the size of the screen. Lines are not rewrapped. When the main screen gets shorter the
+// lines at the top move to the scrollback, unless there are blank lines below the cursor to remove.
+func (t *Terminal) Resize(rows, cols int) {
+	if rows < 1 || cols < 1 || (rows == t.rows && cols == t.cols) {
+		return
+	}
+
+	t.main = t.resizeLines(t.main, rows, cols, true)
+	t.alt = t.resizeLines(t.alt, rows, cols, false)
+	if t.altShown {
+		t.screen = t.alt
+	} else {
+		t.screen = t.main
+	}
+
+	t.rows, t.cols = rows, cols
+	t.top, t.bottom = 0, rows-1
+	oldTabs := t.tabs
+	t.resetTabs()
+	copy(t.tabs, oldTabs)
+	t.cur.row = clamp(t.cur.row, 0, rows-1)
+	t.cur.col = clamp(t.cur.col, 0, cols-1)
+	t.cur.wrapNext = false
+	t.saved.row, t.saved.col = clamp(t.saved.row, 0, rows-1), clamp(t.saved.col, 0, cols-1)
+	t.savedAlt.row, t.savedAlt.col = clamp(t.savedAlt.row, 0, rows-1), clamp(t.savedAlt.col, 0, cols-1)
+}
+
+func (t *Terminal) resizeLines(lines []Line, rows, cols int, isMain bool) []Line {
+	cursorOnThis := isMain != t.altShown
+	for len(lines) > rows {
+		last := len(lines) - 1
+		if (!cursorOnThis || t.cur.row < last) && lines[last].blank() {
+			lines = lines[:last]
+			continue
+		}
+		if isMain {
+			t.scrollback = append(t.scrollback, lines[0])
+		}
+		lines = lines[1:]
+		if cursorOnThis {
+			t.cur.row--
+		}
+	}
+	for len(lines) < rows {
+		lines = append(lines, Line{Cells: make([]Cell, cols)})
+	}
+
+	resized := make([]Line, rows)
+	for i, l := range lines {
+		cells := make([]Cell, cols)
+		copy(cells, l.Cells)
+		resized[i] = Line{Cells: cells, Wrapped: l.Wrapped && len(l.Cells) <= cols}
+	}
+	return resized
+}
+
+// Write interprets the output of a program.
+func (t *Terminal) Write(p []byte) (int, error) {
+	data := p
+	if len(t.pending) > 0 {
+		data = append(t.pending, p...)
+		t.pending = nil
+	}
+
+	for i := 0; i < len(data); {
+		b := data[i]
+		if b >= 0x80 && t.state == stateGround {
+			if !utf8.FullRune(data[i:]) {
+				t.pending = append([]byte(nil), data[i:]...)
+				break
+			}
+			r, n := utf8.DecodeRune(data[i:])
+			t.print(r)
+			i += n
+			continue
+		}
+		t.byte(b)
+		i++
+	}
+	return len(p), nil
+}
+
+func (t *Terminal) byte(b byte) {
+	switch t.state {
+	case stateOSC, stateString:
+		switch b {
+		case 0x07:
+			t.endString()
+		case 0x1b:
+			t.state = stateStringEscape
+		default:
+			if t.strIsOSC && len(t.str) < 4096 {
+				t.str = append(t.str, b)
+			}
+		}
+		return
+	case stateStringEscape:
+		// ESC \ ends the string. Anything else ends it too, and is ignored.
+		t.endString()
+		return
+	}
+
+	if b < 0x20 || b == 0x7f {
+		switch b {
+		case 0x1b:
+			t.state = stateEscape
+			t.intermediate = 0
+		case 0x18, 0x1a:
+			t.state = stateGround
+		default:
+			t.control(b)
+		}
+		return
+	}
+
+	switch t.state {
+	case stateGround:
+		t.print(rune(b))
+	case stateEscape:
+		t.escape(b)
+	case stateEscapeConsume:
+		t.state = stateGround
+	case stateCSI:
+		t.csiByte(b)
+	}
+}
+
+func (t *Terminal) endString() {
+	if t.strIsOSC {
+		t.osc(string(t.str))
+	}
+	t.str = t.str[:0]
+	t.state = stateGround
+}
+
+func (t *Terminal) control(b byte) {
+	switch b {
+	case '\b':
+		if t.cur.col > 0 {
+			t.cur.col--
+		}
+		t.cur.wrapNext = false
+	case '\t':
+		t.tabForward(1)
+	case '\n', '\v', '\f':
+		t.lineFeed()
+	case '\r':
+		t.cur.col = 0
+		t.cur.wrapNext = false
+	}
+}
+
+func (t *Terminal) escape(b byte) {
+	t.state = stateGround
+	switch b {
+	case '[':
+		t.state = stateCSI
+		t.params = t.params[:0]
+		t.paramStarted = false
+		t.private = 0
+		t.intermediate = 0
+	case ']':
+		t.state = stateOSC
+		t.strIsOSC = true
+		t.str = t.str[:0]
+	case 'P', 'X', '^', '_':
+		t.state = stateString
+		t.strIsOSC = false
+	case '(', ')', '*', '+', '#', '%':
+		// Character sets and line sizes aren't supported. The designator that follows is skipped.
+		t.state = stateEscapeConsume
+	case '7':
+		t.saveCursor()
+	case '8':
+		t.restoreCursor()
+	case 'D':
+		t.lineFeed()
+	case 'E':
+		t.cur.col = 0
+		t.lineFeed()
+	case 'H':
+		t.tabs[t.cur.col] = true
+	case 'M':
+		t.reverseIndex()
+	case 'c':
+		t.reset()
+		t.main = blankLines(t.rows, t.cols)
+		t.screen = t.main
+	}
+}
+
+func (t *Terminal) csiByte(b byte) {
+	switch {
+	case b >= '0' && b <= '9':
+		if !t.paramStarted {
+			t.params = append(t.params, 0)
+			t.paramStarted = true
+		}
+		n := &t.params[len(t.params)-1]
+		if *n < 100000 {
+			*n = *n*10 + int(b-'0')
+		}
+	case b == ';' || b == ':':
+		if !t.paramStarted {
+			t.params = append(t.params, 0)
+		}
+		t.paramStarted = false
+	case b >= '<' && b <= '?':
+		t.private = b
+	case b >= 0x20 && b <= 0x2f:
+		t.intermediate = b
+	case b >= 0x40 && b <= 0x7e:
+		t.state = stateGround
+		t.dispatchCSI(b)
+	}
+}
+
+// param returns the nth parameter, or def if it's missing or 0.
+func (t *Terminal) param(n, def int) int {
+	if n >= len(t.params) || t.params[n] == 0 {
+		return def
+	}
+	return t.params[n]
+}
+
+func (t *Terminal) dispatchCSI(final byte) {
+	if t.intermediate != 0 {
+		if t.intermediate == '!' && final == 'p' {
+			// Soft reset
+			t.cur.attr = Attr{}
+			t.insertMode = false
+			t.cur.originMode = false
+			t.autowrap = true
+			t.cursorVisible = true
+			t.top, t.bottom = 0, t.rows-1
+		}
+		return
+	}
+
+	switch t.private {
+	case '?':
+		switch final {
+		case 'h':
+			t.setPrivateModes(true)
+		case 'l':
+			t.setPrivateModes(false)
+		}
+		return
+	case '>':
+		if final == 'c' {
+			t.reply("\x1b[>0;0;0c")
+		}
+		return
+	case 0:
+	default:
+		return
+	}
+
+	n := t.param(0, 1)
+	switch final {
+	case '@':
+		t.insertCells(n)
+	case 'A':
+		t.moveCursor(t.cur.row-n, t.cur.col)
+	case 'B', 'e':
+		t.moveCursor(t.cur.row+n, t.cur.col)
+	case 'C', 'a':
+		t.moveCursor(t.cur.row, t.cur.col+n)
+	case 'D':
+		t.moveCursor(t.cur.row, t.cur.col-n)
+	case 'E':
+		t.moveCursor(t.cur.row+n, 0)
+	case 'F':
+		t.moveCursor(t.cur.row-n, 0)
+	case 'G', '`':
+		t.moveCursor(t.cur.row, n-1)
+	case 'H', 'f':
+		row := t.param(0, 1) - 1
+		if t.cur.originMode {
+			row += t.top
+		}
+		t.moveCursor(row, t.param(1, 1)-1)
+	case 'I':
+		t.tabForward(n)
+	case 'J':
+		t.eraseInDisplay(t.param(0, 0))
+	case 'K':
+		t.eraseInLine(t.param(0, 0))
+	case 'L':
+		t.insertLines(n)
+	case 'M':
+		t.deleteLines(n)
+	case 'P':
+		t.deleteCells(n)
+	case 'S':
+		t.scrollUp(t.top, t.bottom, n)
+	case 'T':
+		t.scrollDown(t.top, t.bottom, n)
+	case 'X':
+		t.eraseCells(t.cur.row, t.cur.col, min(t.cur.col+n, t.cols))
+	case 'Z':
+		t.tabBackward(n)
+	case 'b':
+		if t.lastRune != 0 {
+			for i := 0; i < n; i++ {
+				t.print(t.lastRune)
+			}
+		}
+	case 'c':
+		t.reply("\x1b[?1;2c")
+	case 'd':
+		row := n - 1
+		if t.cur.originMode {
+			row += t.top
+		}
+		t.moveCursor(row, t.cur.col)
+	case 'g':
+		switch t.param(0, 0) {
+		case 0:
+			t.tabs[t.cur.col] = false
+		case 3:
+			t.tabs = make([]bool, t.cols)
+		}
+	case 'h', 'l':
+		for i := range t.params {
+			if t.params[i] == 4 {
+				t.insertMode = final == 'h'
+			}
+		}
+	case 'm':
+		t.sgr()
+	case 'n':
+		switch t.param(0, 0) {
+		case 5:
+			t.reply("\x1b[0n")
+		case 6:
+			row := t.cur.row
+			if t.cur.originMode {
+				row -= t.top
+			}
+			t.reply("\x1b[" + strconv.Itoa(row+1) + ";" + strconv.Itoa(t.cur.col+1) + "R")
+		}
+	case 'r':
+		top, bottom := t.param(0, 1)-1, t.param(1, t.rows)-1
+		if top < bottom && bottom < t.rows {
+			t.top, t.bottom = top, bottom
+			t.moveCursor(0, 0)
+			if t.cur.originMode {
+				t.cur.row = t.top
+			}
+		}
+	case 's':
+		t.saveCursor()
+	case 'u':
+		t.restoreCursor()
+	}
+}
+
+func (t *Terminal) setPrivateModes(on bool) {
+	for _, p := range t.params {
+		switch p {
+		case 1:
+			t.appCursorKeys = on
+		case 6:
+			t.cur.originMode = on
+			t.moveCursor(0, 0)
+			if on {
+				t.cur.row = t.top
+			}
+		case 7:
+			t.autowrap = on
+		case 25:
+			t.cursorVisible = on
+		case 47, 1047:
+			t.showAltScreen(on, p == 1047)
+		case 1048:
+			if on {
+				t.saveCursor()
+			} else {
+				t.restoreCursor()
+			}
+		case 1049:
+			if on {
+				t.saveCursor()
+				t.showAltScreen(true, true)
+			} else {
+				t.showAltScreen(false, false)
+				t.restoreCursor()
+			}
+		case 2004:
+			t.bracketedPaste = on
+		}
+	}
+}
+
+func (t *Terminal) showAltScreen(on, clear bool) {
+	if on == t.altShown {
+		return
+	}
+	t.altShown = on
+	if on {
+		if clear {
+			t.alt = blankLines(t.rows, t.cols)
+		}
+		t.screen = t.alt
+	} else {
+		t.screen = t.main
+	}
+}
+
+func (t *Terminal) saveCursor() {
+	if t.altShown {
+		t.savedAlt = t.cur
+		return
+	}
+	t.saved = t.cur
+}
+
+func (t *Terminal) restoreCursor() {
+	if t.altShown {
+		t.cur = t.savedAlt
+	} else {
+		t.cur = t.saved
+	}
+	t.cur.row = clamp(t.cur.row, 0, t.rows-1)
+	t.cur.col = clamp(t.cur.col, 0, t.cols-1)
+}
+
+func (t *Terminal) reply(s string) {
+	t.replies = append(t.replies, s...)
+}
+
+func (t *Terminal) osc(s string) {
+	num, text, ok := strings.Cut(s, ";")
+	if !ok {
+		return
+	}
+	switch num {
+	case "0", "2":
+		t.title = text
+	}
+}
+
+func (t *Terminal) print(r rune) {
+	if t.cur.wrapNext {
+		t.screen[t.cur.row].Wrapped = true
+		t.cur.col = 0
+		t.lineFeed()
+	}
+
+	if t.insertMode {
+		t.insertCells(1)
+	}
+	t.screen[t.cur.row].Cells[t.cur.col] = Cell{Rune: r, Attr: t.cur.attr}
+	t.lastRune = r
+
+	if t.cur.col < t.cols-1 {
+		t.cur.col++
+	} else if t.autowrap {
+		t.cur.wrapNext = true
+	}
+}
+
+func (t *Terminal) lineFeed() {
+	t.cur.wrapNext = false
+	if t.cur.row == t.bottom {
+		t.scrollUp(t.top, t.bottom, 1)
+		return
+	}
+	if t.cur.row < t.rows-1 {
+		t.cur.row++
+	}
+}
+
+func (t *Terminal) reverseIndex() {
+	t.cur.wrapNext = false
+	if t.cur.row == t.top {
+		t.scrollDown(t.top, t.bottom, 1)
+		return
+	}
+	if t.cur.row > 0 {
+		t.cur.row--
+	}
+}
+
+func (t *Terminal) blankLine() Line {
+	cells := make([]Cell, t.cols)
+	t.fillBlank(cells)
+	return Line{Cells: cells}
+}
+
+// fillBlank erases the cells. Erased cells keep the current background color.
+func (t *Terminal) fillBlank(cells []Cell) {
+	blank := Cell{Attr: Attr{Bg: t.cur.attr.Bg}}
+	for i := range cells {
+		cells[i] = blank
+	}
+}
+
+// scrollUp moves the lines from top to bottom up by n. Lines scrolled off the top of the main screen
+// are added to the scrollback.
+func (t *Terminal) scrollUp(top, bottom, n int) {
+	n = min(n, bottom-top+1)
+	if top == 0 && !t.altShown {
+		for _, l := range t.screen[:n] {
+			t.scrollback = append(t.scrollback, l)
+		}
+	}
+	copy(t.screen[top:bottom+1], t.screen[top+n:bottom+1])
+	for i := bottom - n + 1; i <= bottom; i++ {
+		t.screen[i] = t.blankLine()
+	}
+}
+
+func (t *Terminal) scrollDown(top, bottom, n int) {
+	n = min(n, bottom-top+1)
+	copy(t.screen[top+n:bottom+1], t.screen[top:bottom+1-n])
+	for i := top; i < top+n; i++ {
+		t.screen[i] = t.blankLine()
+	}
+}
+
+func (t *Terminal) moveCursor(row, col int) {
+	top, bottom := 0, t.rows-1
+	if t.cur.originMode {
+		top, bottom = t.top, t.bottom
+	}
+	t.cur.row = clamp(row, top, bottom)
+	t.cur.col = clamp(col, 0, t.cols-1)
+	t.cur.wrapNext = false
+}
+
+func (t *Terminal) tabForward(n int) {
+	for ; n > 0 && t.cur.col < t.cols-1; n-- {
+		t.cur.col++
+		for t.cur.col < t.cols-1 && !t.tabs[t.cur.col] {
+			t.cur.col++
+		}
+	}
+	t.cur.wrapNext = false
+}
+
+func (t *Terminal) tabBackward(n int) {
+	for ; n > 0 && t.cur.col > 0; n-- {
+		t.cur.col--
+		for t.cur.col > 0 && !t.tabs[t.cur.col] {
+			t.cur.col--
+		}
+	}
+	t.cur.wrapNext = false
+}
+
+func (t *Terminal) eraseCells(row, from, to int) {
+	if from < to {
+		t.fillBlank(t.screen[row].Cells[from:to])
+	}
+}
+
+func (t *Terminal) eraseInLine(mode int) {
+	row := t.cur.row
+	switch mode {
+	case 0:
+		t.eraseCells(row, t.cur.col, t.cols)
+		t.screen[row].Wrapped = false
+	case 1:
+		t.eraseCells(row, 0, t.cur.col+1)
+	case 2:
+		t.eraseCells(row, 0, t.cols)
+		t.screen[row].Wrapped = false
+	}
+}
+
+func (t *Terminal) eraseInDisplay(mode int) {
+	switch mode {
+	case 0:
+		t.eraseInLine(0)
+		for i := t.cur.row + 1; i < t.rows; i++ {
+			t.screen[i] = t.blankLine()
+		}
+	case 1:
+		t.eraseInLine(1)
+		for i := 0; i < t.cur.row; i++ {
+			t.screen[i] = t.blankLine()
+		}
+	case 2, 3:
+		for i := range t.screen {
+			t.screen[i] = t.blankLine()
+		}
+		if mode == 3 {
+			t.scrollback = nil
+		}
+	}
+}
+
+func (t *Terminal) insertLines(n int) {
+	if t.cur.row < t.top || t.cur.row > t.bottom {
+		return
+	}
+	t.scrollDown(t.cur.row, t.bottom, n)
+	t.cur.col = 0
+	t.cur.wrapNext = false
+}
+
+func (t *Terminal) deleteLines(n int) {
+	if t.cur.row < t.top || t.cur.row > t.bottom {
+		return
+	}
+	n = min(n, t.bottom-t.cur.row+1)
+	copy(t.screen[t.cur.row:t.bottom+1], t.screen[t.cur.row+n:t.bottom+1])
+	for i := t.bottom - n + 1; i <= t.bottom; i++ {
+		t.screen[i] = t.blankLine()
+	}
+	t.cur.col = 0
+	t.cur.wrapNext = false
+}
+
+func (t *Terminal) insertCells(n int) {
+	cells := t.screen[t.cur.row].Cells
+	n = min(n, t.cols-t.cur.col)
+	copy(cells[t.cur.col+n:], cells[t.cur.col:])
+	t.fillBlank(cells[t.cur.col : t.cur.col+n])
+	t.cur.wrapNext = false
+}
+
+func (t *Terminal) deleteCells(n int) {
+	cells := t.screen[t.cur.row].Cells
+	n = min(n, t.cols-t.cur.col)
+	copy(cells[t.cur.col:], cells[t.cur.col+n:])
+	t.fillBlank(cells[t.cols-n:])
+	t.cur.wrapNext = false
+}
+
+func (t *Terminal) sgr() {
+	if len(t.params) == 0 {
+		t.cur.attr = Attr{}
+		return
+	}
+
+	a := &t.cur.attr
+	for i := 0; i < len(t.params); i++ {
+		p := t.params[i]
+		switch {
+		case p == 0:
+			*a = Attr{}
+		case p == 1:
+			a.Bold = true
+		case p == 2:
+			a.Faint = true
+		case p == 3:
+			a.Italic = true
+		case p == 4:
+			a.Underline = true
+		case p == 7:
+			a.Reverse = true
+		case p == 22:
+			a.Bold, a.Faint = false, false
+		case p == 23:
+			a.Italic = false
+		case p == 24:
+			a.Underline = false
+		case p == 27:
+			a.Reverse = false
+		case p >= 30 && p <= 37:
+			a.Fg = Color{Kind: IndexedColor, Index: uint8(p - 30)}
+		case p == 38:
+			a.Fg, i = t.extendedColor(i)
+		case p == 39:
+			a.Fg = Color{}
+		case p >= 40 && p <= 47:
+			a.Bg = Color{Kind: IndexedColor, Index: uint8(p - 40)}
+		case p == 48:
+			a.Bg, i = t.extendedColor(i)
+		case p == 49:
+			a.Bg = Color{}
+		case p >= 90 && p <= 97:
+			a.Fg = Color{Kind: IndexedColor, Index: uint8(p - 90 + 8)}
+		case p >= 100 && p <= 107:
+			a.Bg = Color{Kind: IndexedColor, Index: uint8(p - 100 + 8)}
+		}
+	}
+}
+
+// extendedColor parses the 256 color or 24-bit color that follows the parameter 38 or 48 at i, and
+// returns the index of the last parameter it used.
+func (t *Terminal) extendedColor(i int) (Color, int) {
+	if i+1 >= len(t.params) {
+		return Color{}, i
+	}
+	switch t.params[i+1] {
+	case 5:
+		if i+2 < len(t.params) {
+			return Color{Kind: IndexedColor, Index: uint8(t.params[i+2])}, i + 2
+		}
+	case 2:
+		if i+4 < len(t.params) {
+			return Color{Kind: RGBColor, R: uint8(t.params[i+2]), G: uint8(t.params[i+3]), B: uint8(t.params[i+4])}, i + 4
+		}
+	}
+	return Color{}, len(t.params)
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
@@ -0,0 +1,345 @@
+package vt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func screenText(t *Terminal) []string {
+	var lines []string
+	for _, l := range t.Lines() {
+		lines = append(lines, l.String())
+	}
+	return lines
+}
+
+func linesText(lines []Line) []string {
+	var s []string
+	for _, l := range lines {
+		s = append(s, l.String())
+	}
+	return s
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		rows, cols int
+		input      string
+		screen     []string
+		row, col   int
+	}{
+		{
+			name:  "plain text",
+			rows:  3,
+			cols:  10,
+			input: "hello\r\nworld",
+			screen: []string{
+				"hello",
+				"world",
+				"",
+			},
+			row: 1, col: 5,
+		},
+		{
+			name:  "cursor addressing",
+			rows:  3,
+			cols:  10,
+			input: "\x1b[2;4Hab\x1b[1;1Hc\x1b[3Gd",
+			screen: []string{
+				"c d",
+				"   ab",
+				"",
+			},
+			row: 0, col: 3,
+		},
+		{
+			name:  "relative movement is clamped",
+			rows:  3,
+			cols:  5,
+			input: "\x1b[10Bx\x1b[10Ay\x1b[10Cz\x1b[2Dw",
+			screen: []string{
+				" yw z",
+				"",
+				"x",
+			},
+			row: 0, col: 3,
+		},
+		{
+			name:  "erase in line",
+			rows:  2,
+			cols:  10,
+			input: "abcdefgh\x1b[1;4H\x1b[K\r\nabcdefgh\x1b[2;4H\x1b[1K",
+			screen: []string{
+				"abc",
+				"    efgh",
+			},
+			row: 1, col: 3,
+		},
+		{
+			name:  "clear screen",
+			rows:  2,
+			cols:  10,
+			input: "abc\r\ndef\x1b[2J\x1b[Hx",
+			screen: []string{
+				"x",
+				"",
+			},
+			row: 0, col: 1,
+		},
+		{
+			name:  "autowrap",
+			rows:  3,
+			cols:  4,
+			input: "abcdef",
+			screen: []string{
+				"abcd",
+				"ef",
+				"",
+			},
+			row: 1, col: 2,
+		},
+		{
+			name:  "writing in the last column doesn't wrap until the next character",
+			rows:  2,
+			cols:  4,
+			input: "abcd\rx",
+			screen: []string{
+				"xbcd",
+				"",
+			},
+			row: 0, col: 1,
+		},
+		{
+			name:  "tabs and backspace",
+			rows:  1,
+			cols:  20,
+			input: "a\tb\bc",
+			screen: []string{
+				"a       c",
+			},
+			row: 0, col: 9,
+		},
+		{
+			name:  "insert and delete characters",
+			rows:  1,
+			cols:  10,
+			input: "abcdef\x1b[1;2H\x1b[2@xy\x1b[1;6H\x1b[2P",
+			screen: []string{
+				"axybcf",
+			},
+			row: 0, col: 5,
+		},
+		{
+			name:  "insert and delete lines",
+			rows:  4,
+			cols:  5,
+			input: "1\r\n2\r\n3\r\n4\x1b[2;1H\x1b[L\x1b[4;1H\x1b[M",
+			screen: []string{
+				"1",
+				"",
+				"2",
+				"",
+			},
+			row: 3, col: 0,
+		},
+		{
+			name:  "scroll region",
+			rows:  4,
+			cols:  5,
+			input: "top\x1b[2;3r\x1b[2;1Ha\r\nb\r\nc\x1b[4;1Hbot",
+			screen: []string{
+				"top",
+				"b",
+				"c",
+				"bot",
+			},
+			row: 3, col: 3,
+		},
+		{
+			name:  "reverse index at the top scrolls down",
+			rows:  3,
+			cols:  5,
+			input: "a\r\nb\x1b[H\x1bMc",
+			screen: []string{
+				"c",
+				"a",
+				"b",
+			},
+			row: 0, col: 1,
+		},
+		{
+			name:  "save and restore cursor",
+			rows:  2,
+			cols:  5,
+			input: "ab\x1b7\r\ncd\x1b8e",
+			screen: []string{
+				"abe",
+				"cd",
+			},
+			row: 0, col: 3,
+		},
+		{
+			name:  "utf-8 and unknown sequences",
+			rows:  1,
+			cols:  10,
+			input: "\x1b(Bé\x1b[>4;1m\x1b]0;title\x07ü\x1bP1$r\x1b\\!",
+			screen: []string{
+				"éü!",
+			},
+			row: 0, col: 3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			term := New(tc.rows, tc.cols)
+			term.Write([]byte(tc.input))
+			if s := screenText(term); !reflect.DeepEqual(s, tc.screen) {
+				t.Fatalf("expected screen %q but got %q", tc.screen, s)
+			}
+			row, col := term.Cursor()
+			if row != tc.row || col != tc.col {
+				t.Fatalf("expected cursor at %d,%d but it is at %d,%d", tc.row, tc.col, row, col)
+			}
+		})
+	}
+}
+
+func TestWriteSplitSequences(t *testing.T) {
+	term := New(2, 10)
+	for _, b := range []byte("\x1b[2;3Hé\x1b[31mx") {
+		term.Write([]byte{b})
+	}
+
+	if s := screenText(term); !reflect.DeepEqual(s, []string{"", "  éx"}) {
+		t.Fatalf("unexpected screen %q", s)
+	}
+	if a := term.Lines()[1].Cells[3].Attr; a.Fg != (Color{Kind: IndexedColor, Index: 1}) {
+		t.Fatalf("unexpected attributes %+v", a)
+	}
+}
+
+func TestScrollback(t *testing.T) {
+	term := New(2, 5)
+	term.Write([]byte("1\r\n2\r\n3\r\n4"))
+
+	if s := linesText(term.TakeScrollback()); !reflect.DeepEqual(s, []string{"1", "2"}) {
+		t.Fatalf("unexpected scrollback %q", s)
+	}
+	if s := term.TakeScrollback(); len(s) != 0 {
+		t.Fatalf("scrollback was not taken: %v", s)
+	}
+
+	// Lines scrolled on the alternate screen or in a scroll region below the top are not kept.
+	term.Write([]byte("\x1b[?1049h\r\na\r\nb\r\nc"))
+	if s := term.TakeScrollback(); len(s) != 0 {
+		t.Fatalf("alternate screen added scrollback: %v", s)
+	}
+}
+
+func TestAltScreen(t *testing.T) {
+	term := New(2, 10)
+	term.Write([]byte("shell\r\n$ "))
+	term.Write([]byte("\x1b[?1049h\x1b[Hfull screen"))
+
+	if !term.AltScreen() {
+		t.Fatalf("alternate screen not shown")
+	}
+	if s := screenText(term); !reflect.DeepEqual(s, []string{"full scree", "n"}) {
+		t.Fatalf("unexpected alternate screen %q", s)
+	}
+
+	term.Write([]byte("\x1b[?1049l"))
+	if term.AltScreen() {
+		t.Fatalf("alternate screen still shown")
+	}
+	if s := screenText(term); !reflect.DeepEqual(s, []string{"shell", "$"}) {
+		t.Fatalf("main screen not restored: %q", s)
+	}
+	if row, col := term.Cursor(); row != 1 || col != 2 {
+		t.Fatalf("cursor not restored: %d,%d", row, col)
+	}
+}
+
+func TestWrapped(t *testing.T) {
+	term := New(3, 4)
+	term.Write([]byte("abcdef\r\ngh"))
+
+	lines := term.Lines()
+	if !lines[0].Wrapped || lines[1].Wrapped {
+		t.Fatalf("unexpected wrapped flags %v %v", lines[0].Wrapped, lines[1].Wrapped)
+	}
+}
+
+func TestSGR(t *testing.T) {
+	term := New(1, 10)
+	term.Write([]byte("\x1b[1;4;32;45ma\x1b[38;5;200;48;2;1;2;3mb\x1b[0;7mc\x1b[93md"))
+
+	cells := term.Lines()[0].Cells
+	expected := []Attr{
+		{Fg: Color{Kind: IndexedColor, Index: 2}, Bg: Color{Kind: IndexedColor, Index: 5}, Bold: true, Underline: true},
+		{Fg: Color{Kind: IndexedColor, Index: 200}, Bg: Color{Kind: RGBColor, R: 1, G: 2, B: 3}, Bold: true, Underline: true},
+		{Reverse: true},
+		{Fg: Color{Kind: IndexedColor, Index: 11}, Reverse: true},
+	}
+	for i, a := range expected {
+		if cells[i].Attr != a {
+			t.Errorf("cell %d: expected %+v but got %+v", i, a, cells[i].Attr)
+		}
+	}
+}
+
+func TestReplies(t *testing.T) {
+	term := New(5, 10)
+	term.Write([]byte("\x1b[3;4H\x1b[6n\x1b[c"))
+
+	if r := string(term.TakeReplies()); r != "\x1b[3;4R\x1b[?1;2c" {
+		t.Fatalf("unexpected replies %q", r)
+	}
+	if r := term.TakeReplies(); len(r) != 0 {
+		t.Fatalf("replies were not taken: %q", r)
+	}
+}
+
+func TestModes(t *testing.T) {
+	term := New(2, 10)
+	term.Write([]byte("\x1b[?1h\x1b[?25l\x1b[?2004h\x1b]2;my title\x1b\\"))
+
+	if !term.AppCursorKeys() || term.CursorVisible() || !term.BracketedPaste() {
+		t.Fatalf("modes not set")
+	}
+	if term.Title() != "my title" {
+		t.Fatalf("unexpected title %q", term.Title())
+	}
+
+	term.Write([]byte("\x1b[?1l\x1b[?25h\x1b[?2004l"))
+	if term.AppCursorKeys() || !term.CursorVisible() || term.BracketedPaste() {
+		t.Fatalf("modes not reset")
+	}
+}
+
+func TestResize(t *testing.T) {
+	term := New(4, 5)
+	term.Write([]byte("1\r\n2\r\n3"))
+
+	// There is a blank line below the cursor to remove, and then the top line is scrolled off.
+	term.Resize(2, 3)
+	if s := screenText(term); !reflect.DeepEqual(s, []string{"2", "3"}) {
+		t.Fatalf("unexpected screen %q", s)
+	}
+	if s := linesText(term.TakeScrollback()); !reflect.DeepEqual(s, []string{"1"}) {
+		t.Fatalf("unexpected scrollback %q", s)
+	}
+	if row, col := term.Cursor(); row != 1 || col != 1 {
+		t.Fatalf("unexpected cursor %d,%d", row, col)
+	}
+
+	term.Resize(3, 6)
+	if s := screenText(term); !reflect.DeepEqual(s, []string{"2", "3", ""}) {
+		t.Fatalf("unexpected screen after growing %q", s)
+	}
+	if rows, cols := term.Size(); rows != 3 || cols != 6 {
+		t.Fatalf("unexpected size %d,%d", rows, cols)
+	}
+}
@@ -2,6 +2,9 @@ package words
 
 import (
 	"bytes"
+	"math"
+	"sort"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 
@@ -12,6 +15,7 @@ import (
 type Completion struct {
 	word    string
 	sources []string
+	score   int
 }
 
 func (c Completion) Word() string {
@@ -22,26 +26,70 @@ func (c Completion) Sources() []string {
 	return c.sources
 }
 
+// Score is how well the completion matched the query it was returned for. Higher is better.
+func (c Completion) Score() int {
+	return c.score
+}
+
+// Completer stores the words completions are chosen from, and which sources they came from.
+// It is safe for concurrent use.
 type Completer struct {
-	tree *radix.Tree
+	lock     sync.Mutex
+	tree     *radix.Tree
+	accepted map[string]acceptance
+	// acceptances counts the calls to Accepted. It is used to age the acceptances.
+	acceptances int
+}
+
+// acceptance records how often a completion was accepted. The weight decays with the number of
+// acceptances of other completions since, so that recent acceptances count for more.
+type acceptance struct {
+	weight float64
+	at     int
 }
 
+const (
+	// acceptanceDecay is how much the weight of an acceptance decays by for each later acceptance.
+	acceptanceDecay = 0.97
+	// maxAccepted is the number of accepted completions remembered.
+	maxAccepted = 1000
+
+	// MaxCompletions is the most completions returned by Completions.
+	MaxCompletions = 200
+	// ProximityRange is the distance from the cursor at which a word stops being ranked higher for being near it.
+	ProximityRange = 4000
+
+	proximityBonus = 40
+	frequencyBonus = 15
+	maxFrequency   = 60
+)
+
 func NewCompleter() *Completer {
 	return &Completer{
-		tree: radix.New(),
+		tree:     radix.New(),
+		accepted: map[string]acceptance{},
 	}
 }
 
 func (c *Completer) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.tree.Len()
 }
 
 // Build deletes all completion information from the specified source from the tree,
 // then replaces it with the words in `text`.
 func (c *Completer) Build(source string, text []byte) {
-	c.DeleteAllFromSource(source)
+	c.BuildFromWords(source, wordsIn(text))
+}
 
-	words := wordsIn(text)
+// BuildFromWords deletes all completion information from the specified source from the tree,
+// then replaces it with `words`.
+func (c *Completer) BuildFromWords(source string, words []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.deleteAllFromSource(source)
 	for _, w := range words {
 		c.insert(w, source)
 	}
@@ -68,6 +116,12 @@ func (c *Completer) insert(word string, source string) {
 }
 
 func (c *Completer) DeleteAllFromSource(source string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deleteAllFromSource(source)
+}
+
+func (c *Completer) deleteAllFromSource(source string) {
 	var toDelFromTree []string
 
 	fn := func(s string, v interface{}) bool {
@@ -93,29 +147,147 @@ func (c *Completer) DeleteAllFromSource(source string) {
 	}
 }
 
-func (c *Completer) Completions(word string) (comps []Completion, commonPrefix string) {
+// Query describes the completions to find.
+type Query struct {
+	// Pattern is matched against the words using FuzzyMatch.
+	Pattern string
+	// Nearby maps the words near the cursor to their distance from it. Words that are closer rank higher.
+	Nearby map[string]int
+	// Sources, if not nil, limits the completions to words from the sources it returns true for.
+	Sources func(source string) bool
+}
+
+// Completions returns the words that match the query, best first. Words are ranked by how well they
+// match the pattern, how near they are to the cursor and how often and how recently they were accepted.
+// A word equal to the pattern is not returned.
+func (c *Completer) Completions(q Query) (comps []Completion) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	fn := func(s string, v interface{}) bool {
-		if s == word {
+		if s == q.Pattern {
+			return false
+		}
+
+		score, ok := FuzzyMatch(q.Pattern, s)
+		if !ok {
 			return false
 		}
-		comps = append(comps, *v.(*Completion))
+
+		compl := *v.(*Completion)
+		if q.Sources != nil {
+			compl.sources = filterSources(compl.sources, q.Sources)
+			if len(compl.sources) == 0 {
+				return false
+			}
+		}
+
+		if d, ok := q.Nearby[s]; ok && d < ProximityRange {
+			score += proximityBonus * (ProximityRange - d) / ProximityRange
+		}
+		score += c.frequencyScore(s)
+
+		compl.score = score
+		comps = append(comps, compl)
 		// walk all values
 		return false
 	}
 
-	c.tree.WalkPrefix(word, fn)
-	commonPrefix = c.commonPrefix(comps)
+	c.tree.Walk(fn)
 
+	sort.Slice(comps, func(i, j int) bool {
+		a, b := comps[i], comps[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if len(a.word) != len(b.word) {
+			return len(a.word) < len(b.word)
+		}
+		return a.word < b.word
+	})
+
+	if len(comps) > MaxCompletions {
+		comps = comps[:MaxCompletions]
+	}
 	return
 }
 
-func (c *Completer) commonPrefix(comps []Completion) string {
-	strs := make([]string, len(comps))
-	for i, s := range comps {
-		strs[i] = s.word
+func filterSources(sources []string, keep func(source string) bool) []string {
+	var r []string
+	for _, s := range sources {
+		if keep(s) {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+// Accepted records that the completion `word` was chosen, so that it ranks higher in later completions.
+func (c *Completer) Accepted(word string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.acceptances++
+	c.accepted[word] = acceptance{
+		weight: c.acceptanceWeight(word) + 1,
+		at:     c.acceptances,
+	}
+
+	if len(c.accepted) > maxAccepted {
+		c.forgetOldestAcceptance()
+	}
+}
+
+func (c *Completer) acceptanceWeight(word string) float64 {
+	a, ok := c.accepted[word]
+	if !ok {
+		return 0
+	}
+	return a.weight * math.Pow(acceptanceDecay, float64(c.acceptances-a.at))
+}
+
+func (c *Completer) frequencyScore(word string) int {
+	w := c.acceptanceWeight(word)
+	if w == 0 {
+		return 0
 	}
+	return min(int(frequencyBonus*math.Log2(1+w)), maxFrequency)
+}
 
-	return CommonPrefix(strs...)
+func (c *Completer) forgetOldestAcceptance() {
+	oldest := ""
+	at := c.acceptances + 1
+	for w, a := range c.accepted {
+		if a.at < at {
+			oldest, at = w, a.at
+		}
+	}
+	delete(c.accepted, oldest)
+}
+
+// WordDistances returns the words in `text` that are within ProximityRange bytes of the byte offset `pos`,
+// mapped to their distance in bytes from it.
+func WordDistances(text []byte, pos int) map[string]int {
+	pos = min(max(pos, 0), len(text))
+	start := max(pos-ProximityRange, 0)
+	end := min(pos+ProximityRange, len(text))
+
+	dists := map[string]int{}
+	eachWordIn(text[start:end], func(word string, offset int) {
+		offset += start
+		d := pos - (offset + len(word))
+		if offset >= pos {
+			d = offset - pos
+		}
+		if d < 0 {
+			// The cursor is inside the word
+			return
+		}
+		if o, ok := dists[word]; !ok || d < o {
+			dists[word] = d
+		}
+	})
+	return dists
 }
 
 func CommonPrefix(s ...string) string {
@@ -159,6 +331,14 @@ func commonPrefix(s1, s2 string) string {
 }
 
 func wordsIn(text []byte) (words []string) {
+	eachWordIn(text, func(word string, offset int) {
+		words = append(words, word)
+	})
+	return
+}
+
+// eachWordIn calls fn with each word in text and its byte offset.
+func eachWordIn(text []byte, fn func(word string, offset int)) {
 	t := text
 
 	isWordChar := func(r rune) bool {
@@ -166,10 +346,11 @@ func wordsIn(text []byte) (words []string) {
 	}
 
 	var word bytes.Buffer
+	start := 0
 
 	pack := func() {
 		if word.Len() > 0 {
-			words = append(words, word.String())
+			fn(word.String(), start)
 		}
 	}
 
@@ -178,6 +359,9 @@ func wordsIn(text []byte) (words []string) {
 		r, size := utf8.DecodeRune(t)
 
 		if isWordChar(r) {
+			if word.Len() == 0 {
+				start = len(text) - len(t)
+			}
 			word.WriteRune(r)
 		} else {
 			pack()
@@ -188,6 +372,4 @@ func wordsIn(text []byte) (words []string) {
 	}
 
 	pack()
-
-	return
 }
@@ -59,3 +59,98 @@ func TestCommonPrefix(t *testing.T) {
 	testCommonPrefixFn("fellow", "fell", "fell")
 	testCommonPrefixFn("fell", "fellow", "fell")
 }
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		pattern, word string
+		ok            bool
+	}{
+		{"", "word", true},
+		{"wd", "word", true},
+		{"dw", "word", false},
+		{"gfn", "getFileName", true},
+		{"GFN", "getFileName", false},
+		{"FN", "getFileName", true},
+		{"wordy", "word", false},
+	}
+
+	for _, tc := range tests {
+		_, ok := FuzzyMatch(tc.pattern, tc.word)
+		if ok != tc.ok {
+			t.Fatalf("FuzzyMatch(%q, %q): expected %v but got %v", tc.pattern, tc.word, tc.ok, ok)
+		}
+	}
+
+	better := func(pattern, a, b string) {
+		sa, _ := FuzzyMatch(pattern, a)
+		sb, _ := FuzzyMatch(pattern, b)
+		if sa <= sb {
+			t.Fatalf("expected %q to match %q better than %q, but scores were %d and %d", pattern, a, b, sa, sb)
+		}
+	}
+
+	better("fil", "file", "profile")
+	better("gfn", "getFileName", "gifname")
+	better("gfn", "get_file_name", "gofundme")
+	better("name", "name", "nxaxmxe")
+}
+
+func completionWords(comps []Completion) []string {
+	var w []string
+	for _, c := range comps {
+		w = append(w, c.Word())
+	}
+	return w
+}
+
+func TestCompletionsRanking(t *testing.T) {
+	c := NewCompleter()
+	c.Build("a", []byte("format formatter fmt firmament"))
+	c.Build("b", []byte("foreman"))
+
+	got := completionWords(c.Completions(Query{Pattern: "fmt"}))
+	expected := []string{"fmt", "format", "formatter", "firmament"}
+	// fmt is not returned since it's equal to the pattern
+	expected = expected[1:]
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v but got %v", expected, got)
+	}
+
+	// Words near the cursor rank higher
+	got = completionWords(c.Completions(Query{Pattern: "fmt", Nearby: map[string]int{"firmament": 10}}))
+	if got[0] != "firmament" {
+		t.Fatalf("expected the nearby word to be first but got %v", got)
+	}
+
+	// Accepted words rank higher
+	c.Accepted("formatter")
+	c.Accepted("formatter")
+	got = completionWords(c.Completions(Query{Pattern: "fmt"}))
+	if got[0] != "formatter" {
+		t.Fatalf("expected the accepted word to be first but got %v", got)
+	}
+
+	// Sources limit the completions
+	got = completionWords(c.Completions(Query{Pattern: "f", Sources: func(s string) bool { return s == "b" }}))
+	if !reflect.DeepEqual(got, []string{"foreman"}) {
+		t.Fatalf("expected only the words from source b but got %v", got)
+	}
+}
+
+func TestWordDistances(t *testing.T) {
+	text := []byte("alpha beta gamma beta")
+	d := WordDistances(text, 11)
+
+	expected := map[string]int{"alpha": 6, "beta": 1, "gamma": 0}
+	if !reflect.DeepEqual(d, expected) {
+		t.Fatalf("expected %v but got %v", expected, d)
+	}
+
+	// Offsets outside the text are treated as its ends
+	for _, pos := range []int{-ProximityRange - 5, -1, len(text) + 1, len(text) + ProximityRange + 5} {
+		d = WordDistances(text, pos)
+		if len(d) != 3 {
+			t.Fatalf("for offset %d expected all of the words but got %v", pos, d)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package words
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	fuzzyMatchScore       = 10
+	fuzzyConsecutiveBonus = 15
+	fuzzyBoundaryBonus    = 20
+	fuzzyFirstRuneBonus   = 30
+	fuzzyExactCaseBonus   = 1
+	fuzzyMaxGapPenalty    = 10
+)
+
+// FuzzyMatch reports whether the runes of pattern appear in order in word, and if so
+// scores how well they match. Matches of consecutive runes, matches at the start of word
+// and matches at the start of the parts of an identifier (after an underscore, or an
+// upper case letter following a lower case one) score higher, and runes of word skipped
+// between matches score lower.
+//
+// The match ignores case unless pattern contains an upper case letter.
+func FuzzyMatch(pattern, word string) (score int, ok bool) {
+	if pattern == "" {
+		return 0, true
+	}
+
+	ignoreCase := !hasUpper(pattern)
+
+	p := pattern
+	prev := rune(-1)
+	lastMatch := -1
+	i := 0
+	for _, r := range word {
+		if p == "" {
+			break
+		}
+
+		pr, size := utf8.DecodeRuneInString(p)
+		if runesEqual(pr, r, ignoreCase) {
+			score += fuzzyMatchScore
+			if pr == r {
+				score += fuzzyExactCaseBonus
+			}
+			if i == 0 {
+				score += fuzzyFirstRuneBonus
+			} else if isBoundary(prev, r) {
+				score += fuzzyBoundaryBonus
+			}
+
+			if lastMatch >= 0 {
+				if lastMatch == i-1 {
+					score += fuzzyConsecutiveBonus
+				} else {
+					score -= min(i-lastMatch-1, fuzzyMaxGapPenalty)
+				}
+			}
+			lastMatch = i
+			p = p[size:]
+		}
+
+		prev = r
+		i++
+	}
+
+	if p != "" {
+		return 0, false
+	}
+	return score, true
+}
+
+func hasUpper(s string) bool {
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func runesEqual(a, b rune, ignoreCase bool) bool {
+	if a == b {
+		return true
+	}
+	return ignoreCase && unicode.ToLower(a) == unicode.ToLower(b)
+}
+
+// isBoundary returns true if r starts a new part of an identifier when it follows prev.
+func isBoundary(prev, r rune) bool {
+	if prev == '_' || prev == '-' {
+		return true
+	}
+	return unicode.IsUpper(r) && unicode.IsLower(prev)
+}
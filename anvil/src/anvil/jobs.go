@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// jobsWindowName is the name of the window that Jobs lists the external commands in.
+const jobsWindowName = "+Jobs"
+
+// numberedJob is a Job that runs an external command. Its number is the id of the command in the
+// command history, and can be used to refer to the job in place of its name.
+type numberedJob interface {
+	Job
+	HistoryId() int
+}
+
+// interruptibleJob is a Job that can be interrupted instead of killed, which lets a command clean up.
+type interruptibleJob interface {
+	Job
+	Interrupt()
+}
+
+// jobOutputFileName is the name of the window that the output of the command with the history id is
+// written to when jobs have their own output windows.
+func jobOutputFileName(dir string, id int) string {
+	return fmt.Sprintf("%s+Job%d", dir, id)
+}
+
+// findJob returns the first job if name is empty, the job numbered name if name is a number, or otherwise
+// the first job with the name.
+func (e *Editor) findJob(name string) Job {
+	if len(e.jobs) == 0 {
+		return nil
+	}
+
+	if name == "" {
+		return e.jobs[0]
+	}
+
+	if id, err := strconv.Atoi(name); err == nil {
+		for _, j := range e.jobs {
+			if n, ok := j.(numberedJob); ok && n.HistoryId() == id {
+				return j
+			}
+		}
+	}
+
+	for _, j := range e.jobs {
+		if j.Name() == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// InterruptJob interrupts the job found like findJob, or kills it if it can't be interrupted.
+func (e *Editor) InterruptJob(name string) {
+	j := e.findJob(name)
+	if j == nil {
+		return
+	}
+
+	if i, ok := j.(interruptibleJob); ok {
+		i.Interrupt()
+		return
+	}
+	j.Kill()
+}
+
+// ShowJobs lists the running and finished external commands in the Jobs window.
+func (e *Editor) ShowJobs() {
+	w := e.FindOrCreateWindow(jobsWindowName)
+	if w == nil {
+		return
+	}
+
+	w.SetFilenameAndTag(jobsWindowName, typeFile)
+	w.Body.SetTextString(formatJobs(cmdHistory.Entries(CommandHistoryFilter{}), time.Now()))
+	w.markTextAsUnchanged()
+	w.GrowIfBodyTooSmall()
+}
+
+// notifyJobEnded shows the exit status of the command with the history id in the tag of the window
+// named winName that its output was written to, if the window exists.
+func (e *Editor) notifyJobEnded(id int, winName string) {
+	h, ok := cmdHistory.Find(id)
+	w := e.FindWindowForFile(winName)
+	if !ok || w == nil {
+		return
+	}
+
+	status := h.exitStatus()
+	if status == "" {
+		status = "done"
+	}
+	cmd, _ := h.cmdAndArg()
+	w.setJobStatus(fmt.Sprintf("[%s: %s]", cmd, status))
+}
+
+// formatJobs formats the history entries as a table with the running commands first, followed by the
+// finished commands from most to least recent. Running commands are followed by commands to interrupt
+// and kill them.
+func formatJobs(entries []CommandHistoryEntry, now time.Time) string {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Job\tState\tPid\tHost\tTime\tStatus\tCommand\n")
+	write := func(e CommandHistoryEntry) {
+		pid := "-"
+		if e.pid != 0 {
+			pid = strconv.Itoa(e.pid)
+		}
+		status := e.exitStatus()
+		if status == "" {
+			status = "-"
+		}
+		actions := ""
+		if e.state == Running {
+			actions = fmt.Sprintf("  ◊Kill -INT %d◊ ◊Kill %d◊", e.id, e.id)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s%s\n", e.id, e.state, pid, hostOfGlobalPath(e.dir),
+			e.duration(now), status, e.cmd, actions)
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].state == Running {
+			write(entries[i])
+		}
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].state != Running {
+			write(entries[i])
+		}
+	}
+
+	tw.Flush()
+	return buf.String()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatJobs(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	entries := []CommandHistoryEntry{
+		{id: 1, cmd: "make ", dir: "/src/", state: Completed, started: now.Add(-time.Minute), ended: now.Add(-50 * time.Second), exitCode: 2, exitCodeSet: true, pid: 100},
+		{id: 2, cmd: "sleep 60", dir: "/src/", state: Running, started: now.Add(-5 * time.Second), pid: 101},
+		{id: 3, cmd: "yes ", dir: "/src/", state: Completed, started: now.Add(-3 * time.Second), ended: now, exitCode: -1, exitCodeSet: true},
+		{id: 4, cmd: "ls ", dir: "/src/", state: Orphaned, started: now.Add(-time.Hour)},
+	}
+
+	lines := strings.Split(strings.TrimSuffix(formatJobs(entries, now), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 lines but got %d:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+
+	expected := [][]string{
+		{"Job", "State", "Pid", "Host", "Time", "Status", "Command"},
+		{"2", "running", "101", "local", "5s", "-", "sleep", "60", "◊Kill", "-INT", "2◊", "◊Kill", "2◊"},
+		{"4", "orphaned", "-", "local", "0s", "-", "ls"},
+		{"3", "complete", "-", "local", "3s", "killed", "yes"},
+		{"1", "complete", "100", "local", "10s", "exit", "2", "make"},
+	}
+
+	for i, l := range lines {
+		if f := strings.Fields(l); strings.Join(f, " ") != strings.Join(expected[i], " ") {
+			t.Errorf("line %d: expected %q but got %q", i, expected[i], f)
+		}
+	}
+
+	// The columns are aligned
+	if i := strings.Index(lines[0], "Command"); strings.Index(lines[1], "sleep") != i {
+		t.Errorf("columns are not aligned:\n%s", strings.Join(lines, "\n"))
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// JumpList is the history of the positions that the cursor jumped away from, by Goto, acquiring a file,
+// searching and so on. It is walked backward and forward using Back and Fwd.
+type JumpList struct {
+	jumps []MarkPosition
+	// pos is the index of the current position in jumps while walking the list, or len(jumps) when
+	// the current position is not in the list.
+	pos int
+}
+
+const maxJumps = 100
+
+// Record adds the position that the cursor is jumping away from. Positions after the current one,
+// if the list was being walked, are discarded.
+func (j *JumpList) Record(from MarkPosition) {
+	if j.pos < len(j.jumps) {
+		j.jumps = j.jumps[:j.pos]
+	}
+
+	if n := len(j.jumps); n == 0 || j.jumps[n-1] != from {
+		j.jumps = append(j.jumps, from)
+	}
+
+	if len(j.jumps) > maxJumps {
+		j.jumps = j.jumps[len(j.jumps)-maxJumps:]
+	}
+	j.pos = len(j.jumps)
+}
+
+// Back returns the position before the current one. When the list is not being walked the current
+// position cur, if set, is added first so that Fwd can return to it.
+func (j *JumpList) Back(cur *MarkPosition) (to MarkPosition, ok bool) {
+	if j.pos >= len(j.jumps) {
+		j.pos = len(j.jumps)
+		if cur != nil {
+			if n := len(j.jumps); n == 0 || j.jumps[n-1] != *cur {
+				j.jumps = append(j.jumps, *cur)
+			}
+			j.pos = len(j.jumps) - 1
+		}
+	}
+
+	if j.pos <= 0 {
+		return
+	}
+
+	j.pos--
+	return j.jumps[j.pos], true
+}
+
+// Fwd returns the position after the current one, if the list was walked backward.
+func (j *JumpList) Fwd() (to MarkPosition, ok bool) {
+	if j.pos+1 >= len(j.jumps) {
+		return
+	}
+
+	j.pos++
+	return j.jumps[j.pos], true
+}
+
+func (j *JumpList) ShiftDueToTextModification(fileName string, startOfChange, lengthOfChange int) {
+	for i := range j.jumps {
+		if j.jumps[i].FileName == fileName {
+			j.jumps[i].Index = shiftIndexDueToTextModification(j.jumps[i].Index, startOfChange, lengthOfChange)
+		}
+	}
+}
+
+type JumpListState struct {
+	Jumps []MarkPosition
+	Pos   int
+}
+
+func (j *JumpList) State() *JumpListState {
+	return &JumpListState{
+		Jumps: j.jumps,
+		Pos:   j.pos,
+	}
+}
+
+func (j *JumpList) SetState(state *JumpListState) {
+	if state == nil {
+		return
+	}
+	j.jumps = state.Jumps
+	j.pos = min(max(state.Pos, 0), len(j.jumps))
+}
+
+// jumpPosition returns the position of the cursor in the body of the window, or of the focused window if w is nil.
+// Windows that don't show a file, such as +Errors, have no position.
+func (e *Editor) jumpPosition(w *Window) (pos MarkPosition, ok bool) {
+	if w == nil {
+		w = e.focusedWindow
+	}
+	if w == nil || w.file == "" || strings.HasPrefix(path.Base(w.file), "+") {
+		return
+	}
+	return MarkPosition{FileName: w.file, Index: w.Body.firstCursorIndex()}, true
+}
+
+// recordJump adds the cursor position in the window, or the focused window if w is nil, to the jump list
+// before the cursor jumps away from it.
+func (e *Editor) recordJump(w *Window) {
+	if pos, ok := e.jumpPosition(w); ok {
+		e.Jumps.Record(pos)
+	}
+}
+
+// walkJumpList moves to the previous position in the jump list, or the next if dir is Forward.
+func (e *Editor) walkJumpList(w *Window, dir direction) *Window {
+	var pos MarkPosition
+	var ok bool
+	if dir == Reverse {
+		var cur *MarkPosition
+		if p, ok := e.jumpPosition(w); ok {
+			cur = &p
+		}
+		pos, ok = e.Jumps.Back(cur)
+	} else {
+		pos, ok = e.Jumps.Fwd()
+	}
+
+	if !ok {
+		return nil
+	}
+
+	goTo := seek{
+		seekType: seekToRunePos,
+		runePos:  pos.Index,
+	}
+	return e.LoadFileOpts(pos.FileName, LoadFileOpts{GoTo: goTo, SelectBehaviour: dontSelectText})
+}
@@ -14,6 +14,7 @@ import (
 	"gioui.org/op"
 	"gioui.org/text"
 	"github.com/ddkwork/golibrary/mylog"
+	"github.com/ddkwork/golibrary/stream"
 
 	//"net/http"
 
@@ -24,6 +25,7 @@ import (
 	"github.com/jeffwilliams/anvil/internal/ansi"
 	adebug "github.com/jeffwilliams/anvil/internal/debug"
 	"github.com/jeffwilliams/anvil/internal/expr"
+	"github.com/jeffwilliams/anvil/internal/hostkeys"
 	"github.com/jeffwilliams/anvil/internal/typeset"
 )
 
@@ -52,7 +54,7 @@ func run() {
 	}
 	LoadSettings()
 	LoadStyle()
-	// HirePlumber() // todo
+	HirePlumber()
 	ansi.InitColors(WindowStyle.Ansi.AsColors())
 	editor = NewEditor(WindowStyle)
 	application = NewApplication()
@@ -102,9 +104,11 @@ var (
 	settingsLoadedFromFile bool
 	settings               = Settings{
 		Ssh: SshSettings{
-			Shell:      "sh",
-			CacheSize:  5,
-			CloseStdin: false,
+			Shell:             "sh",
+			CacheSize:         5,
+			CloseStdin:        false,
+			HostKeyPolicy:     string(hostkeys.PolicyAsk),
+			KeepaliveInterval: 30,
 		},
 		Layout: LayoutSettings{
 			EditorTag:         "Newcol Kill Putall Dump Load Exit Help ◊",
@@ -116,6 +120,7 @@ var (
 
 func LoadSettings() {
 	mylog.Check(LoadSettingsFromConfigFile(&settings))
+	applySshHostKeyPolicySetting()
 
 	log(LogCatgApp, "Loaded settings from config file %s\n", SettingsConfigFile())
 
@@ -124,15 +129,26 @@ func LoadSettings() {
 
 var plumbingLoadedFromFile bool
 
+// HirePlumber loads the plumbing rules from the plumbing config file, if there is one.
 func HirePlumber() {
-	HirePlumberUsingFile(PlumbingConfigFile())
+	path := PlumbingConfigFile()
+	if !stream.IsFilePath(path) {
+		return
+	}
+	if err := HirePlumberUsingFile(path); err != nil {
+		log(LogCatgApp, "Loading plumbing rules failed: %v\n", err)
+	}
 }
 
-func HirePlumberUsingFile(path string) {
-	rules := LoadPlumbingRulesFromFile(path)
-	log(LogCatgApp, "Loaded plumbing rules from config file %s\n", PlumbingConfigFile())
+func HirePlumberUsingFile(path string) (err error) {
+	rules, err := LoadPlumbingRulesFromFile(path)
+	if err != nil {
+		return
+	}
+	log(LogCatgApp, "Loaded plumbing rules from config file %s\n", path)
 	plumber = NewPlumber(rules)
 	plumbingLoadedFromFile = true
+	return
 }
 
 // https://colorhunt.co/palette/1624471f40681b1b2fe43f5a
@@ -175,6 +191,12 @@ var WindowStyle = Style{
 	TabStopInterval:           30, // in pixels
 	LineSpacing:               0,
 	TextLeftPadding:           3,
+	MarkColor:                 MustParseHexColor("#fa8072"),
+	BreakpointColor:           MustParseHexColor("#e5484d"),
+	DebugLineColor:            MustParseHexColor("#3d4a2e"),
+	TestPassColor:             MustParseHexColor("#99ad6a"),
+	TestFailColor:             MustParseHexColor("#cf6a4c"),
+	TestOtherColor:            MustParseHexColor("#ffb964"),
 	Syntax: SyntaxStyle{
 		// Colors borrowed from vim jellybeans color scheme https://github.com/nanotech/jellybeans.vim/blob/master/colors/jellybeans.vim
 		KeywordColor:      MustParseHexColor("#8fbfdc"), // jellybeans color for PreProc
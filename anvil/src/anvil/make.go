@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+	"golang.org/x/crypto/ssh"
+
+	anvilagent "github.com/jeffwilliams/anvil/internal/agent"
+)
+
+// makeProjectFileName is the name of the file that configures Make for the directory it is in and the
+// directories below it, when no project in the settings applies.
+const makeProjectFileName = ".anvil-make.toml"
+
+var maker = NewMaker()
+
+// Maker runs the build commands of projects and collects the locations of the errors in their output.
+type Maker struct {
+	lock sync.Mutex
+	// running is the set of project directories that a build is running in
+	running map[string]bool
+	// projectFiles caches the projects read from project files by the directory they were looked up from
+	projectFiles map[string]*MakeProject
+}
+
+func NewMaker() *Maker {
+	return &Maker{
+		running:      map[string]bool{},
+		projectFiles: map[string]*MakeProject{},
+	}
+}
+
+// Make runs the build command of the project that dir belongs to, or cmd if it is not empty, and
+// replaces the quickfix list with the errors in its output. It runs in the background.
+func (m *Maker) Make(dir, cmd string) {
+	go func() {
+		p, ok := m.project(dir, false)
+		if !ok {
+			p = &MakeProject{Dir: dir}
+		}
+		if cmd != "" {
+			p = &MakeProject{Dir: p.Dir, Cmd: cmd}
+		}
+
+		if p.Cmd == "" {
+			m.report(dir, fmt.Sprintf("No Make command is configured for %s. Add one to the settings or to a %s file, or pass the command to Make.", dir, makeProjectFileName))
+			return
+		}
+
+		if !m.run(p) {
+			m.report(p.Dir, fmt.Sprintf("Make is already running in %s", p.Dir))
+		}
+	}()
+}
+
+// MakeOnSave runs the build command of the project the file belongs to if the project is built when
+// files that match its patterns are saved.
+func (m *Maker) MakeOnSave(file string) {
+	gpath, err := NewGlobalPath(file, GlobalPathIsFile)
+	if err != nil {
+		return
+	}
+	dir := gpath.Dir().String()
+
+	go func() {
+		p, ok := m.project(dir, true)
+		if !ok || !p.OnSave || p.Cmd == "" || !p.matches(gpath.Path()) {
+			return
+		}
+		m.run(p)
+	}()
+}
+
+func (m *Maker) report(dir, msg string) {
+	editor.WorkChan() <- basicWork{func() {
+		editor.AppendError(dir, msg)
+	}}
+}
+
+// run starts the build command of the project as a job unless it is already being built. Its output
+// is shown as it is produced, and the quickfix list is replaced with the errors in it when it ends.
+func (m *Maker) run(p *MakeProject) (started bool) {
+	if !m.setRunning(p.Dir, true) {
+		return false
+	}
+
+	sfs, err := GetFs(p.Dir)
+	if err != nil {
+		m.setRunning(p.Dir, false)
+		m.report(p.Dir, fmt.Sprintf("Make failed: %v", err))
+		return true
+	}
+
+	editor.WorkChan() <- basicWork{func() {
+		m.start(sfs, p)
+	}}
+	return true
+}
+
+// start runs the build command of the project in the same way as commands executed from a tag are run.
+// It must be called from the UI goroutine.
+func (m *Maker) start(sfs simpleFs, p *MakeProject) {
+	log(LogCatgCmd, "Maker.start: running '%s' in %s\n", p.Cmd, p.Dir)
+	cmd, arg, _ := strings.Cut(p.Cmd, " ")
+
+	load := NewDataLoad()
+	done := make(chan struct{})
+	out := newMakeOutput()
+	hist := addCommandToHistory(p.Dir, cmd, arg)
+
+	ec := execCtx{
+		dir:       p.Dir,
+		cmd:       cmd,
+		arg:       arg,
+		contents:  out.collectContents(load.Contents),
+		errs:      snoopAndSaveFirstError(out.collectErrs(load.Errs), hist),
+		kill:      load.Kill,
+		interrupt: load.Interrupt,
+		done:      done,
+		started: func(pid int) {
+			cmdHistory.SetPid(hist, pid)
+		},
+	}
+	if err := sfs.execAsync(ec); err != nil {
+		markCommandCompletedInHistory(hist)
+		m.setRunning(p.Dir, false)
+		editor.AppendError(p.Dir, fmt.Sprintf("Make failed: %v", err))
+		return
+	}
+
+	winName := editor.ErrorsFileNameOf(p.Dir)
+	if settings.Jobs.OutputWindows {
+		winName = jobOutputFileName(p.Dir, hist.id)
+	}
+
+	go func() {
+		<-done
+		out.wait()
+		markCommandCompletedInHistory(hist)
+		m.setRunning(p.Dir, false)
+
+		items, msg := out.result(p.Dir)
+		editor.WorkChan() <- basicWork{func() {
+			editor.notifyJobEnded(hist.id, winName)
+			editor.Quickfix.Set(items)
+			editor.AppendError(p.Dir, msg)
+		}}
+	}()
+
+	wl := &WindowDataLoad{
+		DataLoad:          *load,
+		Win:               NewWindowHolderForName(winName),
+		Jobname:           "Make",
+		Tail:              true,
+		GrowBodyBehaviour: growBodyIfTooSmall,
+		CmdHistoryId:      hist.id,
+	}
+
+	wl.Start(editor.WorkChan())
+
+	editor.AddJob(wl)
+}
+
+// makeOutput collects the output and the first error of a build while they are passed on to the
+// window that shows them.
+type makeOutput struct {
+	out bytes.Buffer
+	err error
+	// collected is done once the output and the errors are both closed
+	collected sync.WaitGroup
+}
+
+func newMakeOutput() *makeOutput {
+	o := &makeOutput{}
+	o.collected.Add(2)
+	return o
+}
+
+// collectContents returns a channel whose contents are collected and copied to dest. dest is
+// closed when the returned channel is.
+func (o *makeOutput) collectContents(dest chan []byte) (src chan []byte) {
+	src = make(chan []byte)
+	go func() {
+		defer o.collected.Done()
+		for b := range src {
+			o.out.Write(b)
+			dest <- b
+		}
+		close(dest)
+	}()
+	return
+}
+
+// collectErrs returns a channel whose first error is kept and whose errors are copied to dest. dest is
+// closed when the returned channel is.
+func (o *makeOutput) collectErrs(dest chan error) (src chan error) {
+	src = make(chan error)
+	go func() {
+		defer o.collected.Done()
+		for e := range src {
+			if o.err == nil {
+				o.err = e
+			}
+			dest <- e
+		}
+		close(dest)
+	}()
+	return
+}
+
+// wait waits until all of the output and errors are collected.
+func (o *makeOutput) wait() {
+	o.collected.Wait()
+}
+
+// result returns the errors found in the output of the build that ran in dir, and a message
+// summarizing the build. It must only be called after wait.
+func (o *makeOutput) result(dir string) (items []QuickfixItem, msg string) {
+	raw := o.out.String()
+	out := decodeGoTestJson(raw)
+	items = resolveQuickfixItems(dir, parseQuickfixItems(out))
+
+	var buf bytes.Buffer
+	// The output was already shown as it was produced, unless it had to be decoded
+	if out != raw {
+		buf.WriteString(out)
+		if len(out) > 0 && !strings.HasSuffix(out, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	switch {
+	case len(items) > 0:
+		fmt.Fprintf(&buf, "Make: %d errors. Use Next and Prev to visit them.\n", len(items))
+	case o.err != nil:
+		fmt.Fprintf(&buf, "Make failed: %v\n", o.err)
+	default:
+		fmt.Fprintf(&buf, "Make: ok\n")
+	}
+	return items, buf.String()
+}
+
+func (m *Maker) setRunning(dir string, running bool) (changed bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.running[dir] == running {
+		return false
+	}
+	m.running[dir] = running
+	return true
+}
+
+// project returns the project that dir belongs to. Projects in the settings take precedence over
+// project files. If cached is true a project file found earlier for dir is used instead of looking again.
+func (m *Maker) project(dir string, cached bool) (p *MakeProject, ok bool) {
+	if p, ok := findMakeProject(settings.Make.Projects, dir); ok {
+		return p, true
+	}
+
+	if cached {
+		m.lock.Lock()
+		p, ok = m.projectFiles[dir]
+		m.lock.Unlock()
+		if ok {
+			return p, p != nil
+		}
+	}
+
+	p = loadMakeProjectFile(dir)
+	m.lock.Lock()
+	m.projectFiles[dir] = p
+	m.lock.Unlock()
+	return p, p != nil
+}
+
+// matches returns true if a saved file should cause the project to be built. With no patterns all files do.
+func (p *MakeProject) matches(file string) bool {
+	if len(p.Patterns) == 0 {
+		return true
+	}
+	for _, pat := range p.Patterns {
+		if saveHookMatches(pat, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// findMakeProject returns the project with the longest directory that contains dir.
+func findMakeProject(projects []MakeProject, dir string) (p *MakeProject, ok bool) {
+	withSlash := func(s string) string {
+		if strings.HasSuffix(s, "/") {
+			return s
+		}
+		return s + "/"
+	}
+
+	dir = withSlash(dir)
+	for i := range projects {
+		pdir := withSlash(projects[i].Dir)
+		if !strings.HasPrefix(dir, pdir) {
+			continue
+		}
+		if p == nil || len(pdir) > len(withSlash(p.Dir)) {
+			p = &projects[i]
+		}
+	}
+	return p, p != nil
+}
+
+// loadMakeProjectFile looks for a project file in dir and the directories above it, and returns the
+// project it describes, or nil if there is none. The project's directory is the one the file is in.
+func loadMakeProjectFile(dir string) *MakeProject {
+	gpath, err := NewGlobalPath(dir, GlobalPathIsDir)
+	if err != nil {
+		return nil
+	}
+	sfs, err := GetFs(dir)
+	if err != nil {
+		return nil
+	}
+
+	join, parent := filepath.Join, filepath.Dir
+	if gpath.IsRemote() {
+		join, parent = path.Join, path.Dir
+	}
+
+	for d := gpath.Path(); ; d = parent(d) {
+		file := *gpath
+		file.SetPath(join(d, makeProjectFileName))
+
+		if exists, err := sfs.fileExists(file.String()); err == nil && exists {
+			contents, err := sfs.loadFile(file.String())
+			if err != nil {
+				return nil
+			}
+			var p MakeProject
+			if err := toml.Unmarshal(contents, &p); err != nil {
+				log(LogCatgCmd, "loadMakeProjectFile: error parsing %s: %v\n", file.String(), err)
+				return nil
+			}
+			pdir := *gpath
+			pdir.SetPath(d)
+			p.Dir = pdir.String()
+			return &p
+		}
+
+		if parent(d) == d {
+			return nil
+		}
+	}
+}
+
+// exitCodeOfError returns the exit code of a command that ran locally or over ssh from the error
+// it failed with.
+func exitCodeOfError(err error) (code int, ok bool) {
+	switch t := err.(type) {
+	case *exec.ExitError:
+		return t.ExitCode(), true
+	case *ssh.ExitError:
+		return t.ExitStatus(), true
+	case *anvilagent.ExitError:
+		// Commands killed by a signal have no exit code
+		return t.Code, t.Code >= 0
+	}
+	return
+}
+
+// QuickfixItem is the location of an error found in the output of a build.
+type QuickfixItem struct {
+	File string
+	Line int
+	// Col is the column of the error, or 0 if it is not known
+	Col int
+	Msg string
+}
+
+// Location returns the item's position in the form understood by parseSeekFromFilename.
+func (q QuickfixItem) Location() string {
+	if q.Col > 0 {
+		return fmt.Sprintf("%s:%d:%d", q.File, q.Line, q.Col)
+	}
+	return fmt.Sprintf("%s:%d", q.File, q.Line)
+}
+
+// QuickfixList is the list of errors from the last build, and the one that was visited last.
+type QuickfixList struct {
+	items []QuickfixItem
+	pos   int
+}
+
+func (q *QuickfixList) Set(items []QuickfixItem) {
+	q.items = items
+	q.pos = -1
+}
+
+func (q *QuickfixList) Len() int {
+	return len(q.items)
+}
+
+// Next returns the item after the one visited last, or the first item if none was visited.
+func (q *QuickfixList) Next() (item QuickfixItem, ok bool) {
+	if q.pos+1 >= len(q.items) {
+		return
+	}
+	q.pos++
+	return q.items[q.pos], true
+}
+
+// Prev returns the item before the one visited last.
+func (q *QuickfixList) Prev() (item QuickfixItem, ok bool) {
+	if q.pos <= 0 || q.pos > len(q.items) {
+		return
+	}
+	q.pos--
+	return q.items[q.pos], true
+}
+
+// Pos returns the index of the item visited last, or -1 if none was.
+func (q *QuickfixList) Pos() int {
+	return q.pos
+}
+
+var (
+	// compilerErrorRe matches the errors of Go, gcc and most other compilers and linters, which are
+	// in the form file:line: message or file:line:col: message. The file must contain a dot or slash.
+	compilerErrorRe = regexp.MustCompile(`^\s*([^\s:"]*[./][^\s:"]*):(\d+)(?::(\d+))?:\s*(.*)$`)
+	// pythonFrameRe matches a frame of a Python traceback
+	pythonFrameRe = regexp.MustCompile(`^\s*File "([^"]+)", line (\d+)(?:, in (.*))?$`)
+)
+
+// parseQuickfixItems finds the locations of errors in the output of a build. The files are as they
+// appear in the output.
+func parseQuickfixItems(out string) (items []QuickfixItem) {
+	// traceback is the index in items of the first frame of the Python traceback being parsed, or -1
+	traceback := -1
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if strings.HasPrefix(line, "Traceback (most recent call last)") {
+			traceback = len(items)
+			continue
+		}
+
+		if traceback >= 0 {
+			if m := pythonFrameRe.FindStringSubmatch(line); m != nil {
+				n, _ := strconv.Atoi(m[2])
+				items = append(items, QuickfixItem{File: m[1], Line: n, Msg: strings.TrimSpace("in " + m[3])})
+				continue
+			}
+			if line == "" || line[0] == ' ' || line[0] == '\t' {
+				// The source line of a frame
+				continue
+			}
+			// The exception ends the traceback. It is the message of the innermost frame.
+			if len(items) > traceback {
+				items[len(items)-1].Msg = line
+			}
+			traceback = -1
+			continue
+		}
+
+		if m := compilerErrorRe.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			col, _ := strconv.Atoi(m[3])
+			items = append(items, QuickfixItem{File: m[1], Line: n, Col: col, Msg: m[4]})
+		}
+	}
+	return
+}
+
+// resolveQuickfixItems makes the files of the items that are relative to the directory the build ran in
+// into full paths on the same host.
+func resolveQuickfixItems(dir string, items []QuickfixItem) []QuickfixItem {
+	gdir, err := NewGlobalPath(dir, GlobalPathIsDir)
+	if err != nil {
+		return items
+	}
+
+	for i := range items {
+		f := GlobalPath{path: items[i].File, dirState: GlobalPathIsFile}
+		if path.IsAbs(f.path) || filepath.IsAbs(f.path) {
+			g := *gdir
+			g.path = f.path
+			items[i].File = g.String()
+			continue
+		}
+		items[i].File = f.MakeAbsoluteRelativeTo(gdir).String()
+	}
+	return items
+}
+
+// goTestEvent is a line of the output of go test -json
+type goTestEvent struct {
+	Action string
+	Output string
+}
+
+// decodeGoTestJson replaces the lines of go test -json output with the output of the tests they contain,
+// so that they are shown and parsed like the output of go test. Other lines are left as they are.
+func decodeGoTestJson(out string) string {
+	if !strings.Contains(out, `"Action"`) {
+		return out
+	}
+
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(out, "\n") {
+		if t := strings.TrimSpace(line); strings.HasPrefix(t, "{") {
+			var ev goTestEvent
+			if json.Unmarshal([]byte(t), &ev) == nil && ev.Action != "" {
+				if ev.Action == "output" {
+					buf.WriteString(ev.Output)
+				}
+				continue
+			}
+		}
+		buf.WriteString(line)
+	}
+	return buf.String()
+}
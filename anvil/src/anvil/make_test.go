@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuickfixItems(t *testing.T) {
+	tests := []struct {
+		name     string
+		out      string
+		expected []QuickfixItem
+	}{
+		{
+			name: "go build",
+			out:  "# example.com/pkg\n./main.go:12:3: undefined: x\n./util.go:4:1: missing return\n",
+			expected: []QuickfixItem{
+				{File: "./main.go", Line: 12, Col: 3, Msg: "undefined: x"},
+				{File: "./util.go", Line: 4, Col: 1, Msg: "missing return"},
+			},
+		},
+		{
+			name: "go test",
+			out:  "--- FAIL: TestX (0.00s)\n    x_test.go:20: expected 1 but got 2\nFAIL\nexit status 1\nFAIL\texample.com/pkg\t0.003s\n",
+			expected: []QuickfixItem{
+				{File: "x_test.go", Line: 20, Msg: "expected 1 but got 2"},
+			},
+		},
+		{
+			name: "gcc",
+			out:  "src/a.c: In function 'main':\nsrc/a.c:5:9: error: 'y' undeclared\n    5 |   return y;\n      |          ^\n",
+			expected: []QuickfixItem{
+				{File: "src/a.c", Line: 5, Col: 9, Msg: "error: 'y' undeclared"},
+			},
+		},
+		{
+			name: "python traceback",
+			out: "Traceback (most recent call last):\n" +
+				"  File \"/src/main.py\", line 10, in <module>\n" +
+				"    run()\n" +
+				"  File \"/src/lib.py\", line 3, in run\n" +
+				"    raise ValueError(\"bad\")\n" +
+				"ValueError: bad\n" +
+				"other.py:7: not part of the traceback\n",
+			expected: []QuickfixItem{
+				{File: "/src/main.py", Line: 10, Msg: "in <module>"},
+				{File: "/src/lib.py", Line: 3, Msg: "ValueError: bad"},
+				{File: "other.py", Line: 7, Msg: "not part of the traceback"},
+			},
+		},
+		{
+			name:     "no locations",
+			out:      "ok\nlistening on localhost:8080: done\nsee http://example.com:80/x\n",
+			expected: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			items := parseQuickfixItems(tc.out)
+			if !reflect.DeepEqual(items, tc.expected) {
+				t.Fatalf("expected %+v but got %+v", tc.expected, items)
+			}
+		})
+	}
+}
+
+func TestDecodeGoTestJson(t *testing.T) {
+	out := `{"Action":"start","Package":"example.com/pkg"}
+{"Action":"output","Package":"example.com/pkg","Test":"TestX","Output":"    x_test.go:20: bad\n"}
+{"Action":"fail","Package":"example.com/pkg","Test":"TestX"}
+# a line that is not json
+`
+	expected := "    x_test.go:20: bad\n# a line that is not json\n"
+	if s := decodeGoTestJson(out); s != expected {
+		t.Fatalf("expected %q but got %q", expected, s)
+	}
+
+	if s := decodeGoTestJson("plain {output}\n"); s != "plain {output}\n" {
+		t.Fatalf("plain output was changed to %q", s)
+	}
+}
+
+func TestMakeOutput(t *testing.T) {
+	contents, errs := make(chan []byte), make(chan error)
+	out := newMakeOutput()
+	src, srcErrs := out.collectContents(contents), out.collectErrs(errs)
+
+	go func() {
+		src <- []byte("x.go:3: bad\n")
+		src <- []byte("x.go:5:2: worse\n")
+		close(src)
+		srcErrs <- errors.New("exit status 1")
+		close(srcErrs)
+	}()
+
+	// The output is passed on as it is produced
+	var shown []byte
+	for b := range contents {
+		shown = append(shown, b...)
+	}
+	var shownErrs []error
+	for e := range errs {
+		shownErrs = append(shownErrs, e)
+	}
+	out.wait()
+
+	if string(shown) != "x.go:3: bad\nx.go:5:2: worse\n" || len(shownErrs) != 1 {
+		t.Fatalf("expected the output and error to be passed on but got %q and %v", shown, shownErrs)
+	}
+
+	items, msg := out.result("/src")
+	expected := []QuickfixItem{
+		{File: "/src/x.go", Line: 3, Msg: "bad"},
+		{File: "/src/x.go", Line: 5, Col: 2, Msg: "worse"},
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatalf("expected %+v but got %+v", expected, items)
+	}
+	if msg != "Make: 2 errors. Use Next and Prev to visit them.\n" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
+
+func TestFindMakeProject(t *testing.T) {
+	projects := []MakeProject{
+		{Dir: "/src", Cmd: "make"},
+		{Dir: "/src/sub/", Cmd: "go build"},
+		{Dir: "host:/src", Cmd: "remote"},
+	}
+
+	tests := []struct {
+		dir      string
+		expected string
+	}{
+		{"/src", "make"},
+		{"/src/a/", "make"},
+		{"/src/sub/pkg", "go build"},
+		{"/srcx/", ""},
+		{"host:/src/a/", "remote"},
+	}
+
+	for _, tc := range tests {
+		cmd := ""
+		if p, ok := findMakeProject(projects, tc.dir); ok {
+			cmd = p.Cmd
+		}
+		if cmd != tc.expected {
+			t.Errorf("dir %s: expected project %q but got %q", tc.dir, tc.expected, cmd)
+		}
+	}
+}
+
+func TestLoadMakeProjectFile(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := loadMakeProjectFile(sub); p != nil {
+		t.Fatalf("expected no project but got %+v", p)
+	}
+
+	contents := "cmd = \"go build\"\non-save = true\n"
+	if err := os.WriteFile(filepath.Join(root, "a", makeProjectFileName), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := loadMakeProjectFile(sub)
+	if p == nil {
+		t.Fatalf("expected the project in a parent directory to be found")
+	}
+	if p.Cmd != "go build" || !p.OnSave || filepath.Clean(p.Dir) != filepath.Join(root, "a") {
+		t.Fatalf("unexpected project %+v", p)
+	}
+}
+
+func TestQuickfixList(t *testing.T) {
+	var q QuickfixList
+	q.Set([]QuickfixItem{{File: "/a.go", Line: 1}, {File: "/b.go", Line: 2, Col: 3}})
+
+	if _, ok := q.Prev(); ok {
+		t.Fatalf("went back before the first error")
+	}
+	if i, ok := q.Next(); !ok || i.Location() != "/a.go:1" {
+		t.Fatalf("unexpected first error %v %v", i.Location(), ok)
+	}
+	if i, ok := q.Next(); !ok || i.Location() != "/b.go:2:3" {
+		t.Fatalf("unexpected second error %v %v", i.Location(), ok)
+	}
+	if _, ok := q.Next(); ok {
+		t.Fatalf("went past the last error")
+	}
+	if i, ok := q.Prev(); !ok || i.File != "/a.go" {
+		t.Fatalf("unexpected previous error %v %v", i, ok)
+	}
+}
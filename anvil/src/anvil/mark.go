@@ -8,6 +8,9 @@ import (
 
 type Marks struct {
 	marks map[string]*MarkPosition
+	// lines are the unnamed line marks of each file, as sorted rune indices in the marked lines. They
+	// are at the starts of the lines when made, but edits may move them within the lines.
+	lines map[string][]int
 }
 
 type MarkPosition struct {
@@ -36,6 +39,65 @@ func (m *Marks) Clear() {
 	m.marks = make(map[string]*MarkPosition)
 }
 
+// ToggleLine adds an unnamed mark to the line of the file from the rune index lineStart to lineEnd,
+// which is the index of the newline that ends the line, or removes its marks if the line is already marked.
+func (m *Marks) ToggleLine(fileName string, lineStart, lineEnd int) {
+	if m.lines == nil {
+		m.lines = make(map[string][]int)
+	}
+
+	lines := m.lines[fileName]
+	i := sort.SearchInts(lines, lineStart)
+	if j := sort.SearchInts(lines, lineEnd+1); j > i {
+		lines = append(lines[:i], lines[j:]...)
+	} else {
+		lines = append(lines, 0)
+		copy(lines[i+1:], lines[i:])
+		lines[i] = lineStart
+	}
+
+	if len(lines) == 0 {
+		delete(m.lines, fileName)
+		return
+	}
+	m.lines[fileName] = lines
+}
+
+// Lines returns rune indices in the marked lines of the file.
+func (m *Marks) Lines(fileName string) []int {
+	return m.lines[fileName]
+}
+
+func (m *Marks) ClearLines(fileName string) {
+	delete(m.lines, fileName)
+}
+
+// NextLine returns the mark of the next marked line in the file after the line from lineStart to lineEnd,
+// or of the previous one if dir is Reverse. The search wraps around the end of the file.
+func (m *Marks) NextLine(fileName string, lineStart, lineEnd int, dir direction) (index int, ok bool) {
+	lines := m.lines[fileName]
+	if len(lines) == 0 {
+		return
+	}
+
+	ok = true
+	if dir == Reverse {
+		i := sort.SearchInts(lines, lineStart)
+		if i == 0 {
+			i = len(lines)
+		}
+		index = lines[i-1]
+		return
+	}
+
+	i := sort.SearchInts(lines, lineEnd+1)
+	if i == len(lines) {
+		i = 0
+	}
+	index = lines[i]
+	return
+}
+
 func (m *Marks) Seek(name string) (fileName string, goTo seek, ok bool) {
 	if m.marks == nil {
 		return
@@ -79,29 +141,74 @@ func (m *Marks) String() string {
 		fmt.Fprintf(&buf, "Goto %s\n\t%s\n", v[0], v[1])
 	}
 
+	files := make([]string, 0, len(m.lines))
+	for f := range m.lines {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		for _, i := range m.lines[f] {
+			fmt.Fprintf(&buf, "Line mark\n\t%s#%d\n", f, i)
+		}
+	}
+
 	return buf.String()
 }
 
 type MarkState struct {
 	Marks map[string]*MarkPosition
+	Lines map[string][]int
 }
 
 func (m *Marks) State() MarkState {
 	return MarkState{
 		Marks: m.marks,
+		Lines: m.lines,
 	}
 }
 
 func (m *Marks) SetState(state MarkState) {
 	m.marks = state.Marks
+	m.lines = state.Lines
 }
 
 func (m *Marks) ShiftDueToTextModification(fileName string, startOfChange, lengthOfChange int) {
 	for _, mark := range m.marks {
 		if mark.FileName == fileName {
-			if mark.Index >= startOfChange {
-				mark.Index += lengthOfChange
-			}
+			mark.Index = shiftIndexDueToTextModification(mark.Index, startOfChange, lengthOfChange)
 		}
 	}
+
+	lines := m.lines[fileName]
+	if len(lines) == 0 {
+		return
+	}
+
+	// Marks on lines that are deleted end up at the same index; only one of them is kept.
+	// Text inserted at the start of a marked line is taken to be added to the line, so the mark
+	// stays at the start.
+	shifted := lines[:0]
+	for _, i := range lines {
+		if lengthOfChange < 0 || i != startOfChange {
+			i = shiftIndexDueToTextModification(i, startOfChange, lengthOfChange)
+		}
+		if len(shifted) == 0 || shifted[len(shifted)-1] != i {
+			shifted = append(shifted, i)
+		}
+	}
+	m.lines[fileName] = shifted
+}
+
+// shiftIndexDueToTextModification returns the new rune index of text at index after lengthOfChange runes are
+// inserted at startOfChange, or deleted if lengthOfChange is negative. An index in deleted text moves to the
+// start of the deletion.
+func shiftIndexDueToTextModification(index, startOfChange, lengthOfChange int) int {
+	if index < startOfChange {
+		return index
+	}
+	if lengthOfChange < 0 && index < startOfChange-lengthOfChange {
+		return startOfChange
+	}
+	return index + lengthOfChange
 }
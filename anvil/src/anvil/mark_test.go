@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineMarks(t *testing.T) {
+	var m Marks
+
+	// The lines of a.go are 10 runes long, including the newline
+	m.ToggleLine("a.go", 30, 39)
+	m.ToggleLine("a.go", 10, 19)
+	m.ToggleLine("a.go", 20, 29)
+	m.ToggleLine("b.go", 5, 9)
+	m.ToggleLine("a.go", 20, 29)
+
+	if l := m.Lines("a.go"); !reflect.DeepEqual(l, []int{10, 30}) {
+		t.Fatalf("unexpected line marks %v", l)
+	}
+
+	tests := []struct {
+		lineStart, lineEnd int
+		dir                direction
+		expected           int
+	}{
+		{0, 9, Forward, 10},
+		{10, 19, Forward, 30},
+		{20, 29, Forward, 30},
+		{30, 39, Forward, 10},
+		{30, 39, Reverse, 10},
+		{20, 29, Reverse, 10},
+		{10, 19, Reverse, 30},
+	}
+
+	for _, tc := range tests {
+		i, ok := m.NextLine("a.go", tc.lineStart, tc.lineEnd, tc.dir)
+		if !ok || i != tc.expected {
+			t.Errorf("from %d in direction %v: expected %d but got %d (%v)", tc.lineStart, tc.dir, tc.expected, i, ok)
+		}
+	}
+
+	if _, ok := m.NextLine("c.go", 0, 9, Forward); ok {
+		t.Fatalf("found a line mark in a file with none")
+	}
+}
+
+func TestLineMarksWithinLines(t *testing.T) {
+	var m Marks
+	m.ToggleLine("a.go", 10, 19)
+	m.ToggleLine("a.go", 30, 39)
+
+	// Deleting the text from 5 to 12 joins the start of the line before to the rest of the marked line,
+	// and moves the mark into the middle of the joined line.
+	m.ShiftDueToTextModification("a.go", 5, -7)
+	m.ShiftDueToTextModification("a.go", 2, 1)
+	if l := m.Lines("a.go"); !reflect.DeepEqual(l, []int{6, 24}) {
+		t.Fatalf("unexpected line marks %v", l)
+	}
+
+	// The joined line is 0 to 13
+	if i, ok := m.NextLine("a.go", 0, 13, Forward); !ok || i != 24 {
+		t.Fatalf("next line mark after the joined line is %d (%v)", i, ok)
+	}
+	if i, ok := m.NextLine("a.go", 24, 33, Reverse); !ok || i != 6 {
+		t.Fatalf("previous line mark before the last line is %d (%v)", i, ok)
+	}
+
+	m.ToggleLine("a.go", 0, 13)
+	if l := m.Lines("a.go"); !reflect.DeepEqual(l, []int{24}) {
+		t.Fatalf("toggling the joined line left marks %v", l)
+	}
+}
+
+func TestMarksShiftDueToTextModification(t *testing.T) {
+	var m Marks
+	m.Set("x", "a.go", 25)
+	m.Set("y", "b.go", 25)
+	m.ToggleLine("a.go", 10, 19)
+	m.ToggleLine("a.go", 20, 29)
+	m.ToggleLine("a.go", 40, 49)
+
+	// Insert 5 runes at the start of the marked line at 10, then delete the text from 15 to 35.
+	m.ShiftDueToTextModification("a.go", 10, 5)
+	m.ShiftDueToTextModification("a.go", 15, -20)
+
+	if l := m.Lines("a.go"); !reflect.DeepEqual(l, []int{10, 15, 25}) {
+		t.Fatalf("unexpected line marks %v", l)
+	}
+	if _, s, _ := m.Seek("x"); s.runePos != 15 {
+		t.Fatalf("mark in deleted text is at %d", s.runePos)
+	}
+	if _, s, _ := m.Seek("y"); s.runePos != 25 {
+		t.Fatalf("mark in another file moved to %d", s.runePos)
+	}
+}
+
+func TestJumpList(t *testing.T) {
+	pos := func(file string, i int) MarkPosition {
+		return MarkPosition{FileName: file, Index: i}
+	}
+
+	var j JumpList
+	if _, ok := j.Back(nil); ok {
+		t.Fatalf("went back in an empty jump list")
+	}
+
+	j.Record(pos("a", 1))
+	j.Record(pos("a", 1))
+	j.Record(pos("b", 2))
+
+	cur := pos("c", 3)
+	if p, ok := j.Back(&cur); !ok || p != pos("b", 2) {
+		t.Fatalf("unexpected first back %v %v", p, ok)
+	}
+	if p, ok := j.Back(&cur); !ok || p != pos("a", 1) {
+		t.Fatalf("unexpected second back %v %v", p, ok)
+	}
+	if _, ok := j.Back(&cur); ok {
+		t.Fatalf("went back past the start")
+	}
+	if p, ok := j.Fwd(); !ok || p != pos("b", 2) {
+		t.Fatalf("unexpected fwd %v %v", p, ok)
+	}
+	if p, ok := j.Fwd(); !ok || p != cur {
+		t.Fatalf("fwd didn't return to the position before walking back: %v %v", p, ok)
+	}
+	if _, ok := j.Fwd(); ok {
+		t.Fatalf("went forward past the end")
+	}
+
+	// Jumping while walking discards the later positions.
+	j.Back(nil)
+	j.Record(pos("d", 4))
+	if !reflect.DeepEqual(j.jumps, []MarkPosition{pos("a", 1), pos("d", 4)}) {
+		t.Fatalf("unexpected jumps %v", j.jumps)
+	}
+
+	j.ShiftDueToTextModification("d", 0, 10)
+	if p, _ := j.Back(nil); p != pos("d", 14) {
+		t.Fatalf("jump was not shifted: %v", p)
+	}
+}
@@ -4,24 +4,60 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-
-	"github.com/ddkwork/golibrary/mylog"
+	"unicode"
 )
 
 /*
 Plumbing file format:
 
-		match <regex>
-		do <command>
+A plumbing file is a list of rules. A rule is one or more condition lines followed by one or more
+action lines. A new rule begins at the first condition line after an action line. Blank lines and
+lines beginning with # are ignored.
+
+		# Go compiler errors
+		match ([^:]+\.go):([0-9]+)
+		isfile $1
+		open $file:$2
 
 		match <regex>
 		do <command>
 
+When text is plumbed the rules are tried in order. A rule matches if all of its conditions hold, and
+then its actions are performed in order. The first matching rule ends the search unless it performs
+the fallthrough action.
+
+Conditions:
+
+		match <regex>            the plumbed text matches the regex. The same as 'data matches <regex>'.
+		<var> matches <regex>    the value of the variable matches the regex. $0 is set to the matched text,
+		                         $1, $2, etc. to the submatches, and named submatches to variables of that name.
+		isfile <text>            <text> names an existing file. $file is set to its full path.
+		isdir <text>             <text> names an existing directory. $dir is set to its full path.
+
+Actions:
+
+		do <command>             execute an anvil or shell command as if it were typed in the source window.
+		open <file>              load the file into a window, or show the window if it is loaded. The file may
+		                         end with a seek such as :line, :line:col, #offset or !regex.
+		start <command>          run the shell command in the source window's directory, and put its output in
+		                         the +Errors window.
+		to <port>                send the message to the API sessions listening on the plumbing port. If none is
+		                         listening, the next start action of the rule is performed instead.
+		attr <name>=<value>      add an attribute to the message. Attributes are sent to ports and are also variables.
+		fallthrough              after this rule, continue trying the following rules.
 
-<regex> can contain submatches which can be referenced by $0 (the entire match), $1 (first group), $2, etc.
-<command> is an anvil or shell command.
+Variables are referenced as $name or ${name} in the arguments of conditions and actions:
+
+		$data    the plumbed text
+		$file    the file of the source window, or the file found by isfile
+		$dir     the directory of the source window, or the directory found by isdir
+		$winid   the id of the source window
+		$0-$9    the match and submatches of the last 'matches' condition
 
 */
 
@@ -35,76 +71,391 @@ func NewPlumber(rules []PlumbingRule) *Plumber {
 	}
 }
 
+// PlumbMsg is text being plumbed along with where it came from.
+type PlumbMsg struct {
+	Data string
+	// WinId is the id of the window the text came from, or 0 if it did not come from a window.
+	WinId int
+	// File is the file or directory of the source window and Dir is the directory.
+	File string
+	Dir  string
+}
+
+// plumbFileFinder completes a path named in plumbed text and reports if it exists and is a directory.
+type plumbFileFinder func(path string) (fullpath string, exists, isDir bool)
+
+// PlumbMatch is a rule that matched a message, with its actions expanded using the message.
+type PlumbMatch struct {
+	// Line is the line in the plumbing file where the rule begins.
+	Line    int
+	Actions []PlumbingAction
+	Attrs   map[string]string
+	msg     PlumbMsg
+}
+
 func (p Plumber) Plumb(obj string, executor *CommandExecutor, ctx *CmdContext) (ok bool, err error) {
-	for _, rule := range p.rules {
-		if rule.Try(obj, executor, ctx) {
-			ok = true
-			return
+	w, _ := executor.source.(*Window)
+	msg := PlumbMsg{Data: obj, Dir: ctx.Dir, File: ctx.Path}
+	if w != nil {
+		msg.WinId = w.Id
+	}
+
+	for _, m := range p.Match(msg, windowPlumbFileFinder(w)) {
+		ok = true
+		m.perform(executor, ctx)
+	}
+	return
+}
+
+// Match returns the rules that match the message without performing their actions.
+func (p Plumber) Match(msg PlumbMsg, finder plumbFileFinder) (matches []PlumbMatch) {
+	for i := range p.rules {
+		m, ok := p.rules[i].match(msg, finder)
+		if !ok {
+			continue
+		}
+		matches = append(matches, m)
+		if !m.fallsThrough() {
+			break
 		}
 	}
-	return false, nil
+	return
 }
 
 type PlumbingRule struct {
-	Match *regexp.Regexp
-	Do    string
+	Conditions []PlumbingCondition
+	Actions    []PlumbingAction
+	Line       int
 }
 
-func (rule PlumbingRule) Try(obj string, executor *CommandExecutor, ctx *CmdContext) (matched bool) {
-	submatches := rule.Match.FindStringSubmatchIndex(obj)
-	if submatches == nil {
-		return
+// PlumbingCondition is a condition of a rule. Verb is "matches", "isfile" or "isdir". For "matches"
+// Var is the variable to match against Re.
+type PlumbingCondition struct {
+	Verb string
+	Var  string
+	Re   *regexp.Regexp
+	Arg  string
+}
+
+// PlumbingAction is an action of a rule. Verb is one of "do", "open", "start", "to", "attr" or "fallthrough".
+type PlumbingAction struct {
+	Verb string
+	Arg  string
+}
+
+func (a PlumbingAction) String() string {
+	if a.Arg == "" {
+		return a.Verb
+	}
+	return a.Verb + " " + a.Arg
+}
+
+func (rule PlumbingRule) match(msg PlumbMsg, finder plumbFileFinder) (m PlumbMatch, ok bool) {
+	vars := map[string]string{
+		"data":  msg.Data,
+		"file":  msg.File,
+		"dir":   msg.Dir,
+		"winid": strconv.Itoa(msg.WinId),
 	}
 
-	matched = true
-	cmd := []byte{}
-	cmd = rule.Match.Expand(cmd, []byte(rule.Do), []byte(obj), submatches)
+	for _, c := range rule.Conditions {
+		if !c.holds(vars, finder) {
+			return
+		}
+	}
 
-	log(LogCatgPlumb, "Plumber: executing '%s'\n", cmd)
+	m = PlumbMatch{Line: rule.Line, msg: msg}
+	for _, a := range rule.Actions {
+		a.Arg = expandPlumbingVars(a.Arg, vars)
+		if a.Verb == "attr" {
+			name, val, _ := strings.Cut(a.Arg, "=")
+			if m.Attrs == nil {
+				m.Attrs = map[string]string{}
+			}
+			m.Attrs[name] = val
+			vars[name] = val
+		}
+		m.Actions = append(m.Actions, a)
+	}
 
-	executor.Do(string(cmd), ctx)
+	log(LogCatgPlumb, "Plumber: rule at line %d matched '%s'\n", rule.Line, msg.Data)
+	ok = true
 	return
 }
 
-func ParsePlumbingRules(f io.Reader) (rules []PlumbingRule) {
-	s := bufio.NewScanner(f)
+func (c PlumbingCondition) holds(vars map[string]string, finder plumbFileFinder) bool {
+	switch c.Verb {
+	case "matches":
+		val := vars[c.Var]
+		sub := c.Re.FindStringSubmatch(val)
+		if sub == nil {
+			return false
+		}
+		for i := 0; i < 10; i++ {
+			vars[strconv.Itoa(i)] = ""
+			if i < len(sub) {
+				vars[strconv.Itoa(i)] = sub[i]
+			}
+		}
+		for i, name := range c.Re.SubexpNames() {
+			if name != "" {
+				vars[name] = sub[i]
+			}
+		}
+		return true
+	case "isfile", "isdir":
+		if finder == nil {
+			return false
+		}
+		path := expandPlumbingVars(c.Arg, vars)
+		if path == "" {
+			return false
+		}
+		full, exists, isDir := finder(path)
+		if !exists || isDir != (c.Verb == "isdir") {
+			return false
+		}
+		if isDir {
+			vars["dir"] = full
+		} else {
+			vars["file"] = full
+		}
+		return true
+	}
+	return false
+}
+
+func expandPlumbingVars(s string, vars map[string]string) string {
+	return os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return vars[name]
+	})
+}
+
+func (m PlumbMatch) fallsThrough() bool {
+	for _, a := range m.Actions {
+		if a.Verb == "fallthrough" {
+			return true
+		}
+	}
+	return false
+}
+
+func (m PlumbMatch) perform(executor *CommandExecutor, ctx *CmdContext) {
+	delivered := false
+	for _, a := range m.Actions {
+		log(LogCatgPlumb, "Plumber: performing '%s'\n", a)
+
+		// The arguments of the command that plumbed the text are not passed on to the actions.
+		actx := *ctx
+		actx.Args = nil
+
+		switch a.Verb {
+		case "do":
+			executor.Do(a.Arg, &actx)
+		case "open":
+			executor.acquireFile(a.Arg, &actx)
+		case "to":
+			delivered = apiSessions.SendToPlumbingPort(a.Arg, m.notification(a.Arg)) || delivered
+		case "start":
+			if delivered {
+				delivered = false
+				continue
+			}
+			startPlumbedCommand(m.msg.Dir, a.Arg)
+		}
+	}
+}
 
-	const (
-		stateExpectMatch = iota
-		stateExpectDo
-	)
+func (m PlumbMatch) notification(port string) ApiNotification {
+	cmd := []string{port, m.msg.Data}
 
-	state := stateExpectMatch
+	names := make([]string, 0, len(m.Attrs))
+	for k := range m.Attrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		cmd = append(cmd, k+"="+m.Attrs[k])
+	}
+
+	return ApiNotification{
+		WinId: m.msg.WinId,
+		Op:    ApiNotificationOpPlumb,
+		Cmd:   cmd,
+	}
+}
+
+func startPlumbedCommand(dir, command string) {
+	go func() {
+		sfs, err := GetFs(dir)
+		if err != nil {
+			return
+		}
+
+		stdout, stderr, err := sfs.filter(dir, command, nil)
+		msg := string(stdout) + string(stderr)
+		if err != nil {
+			msg = fmt.Sprintf("%splumbed command '%s' failed: %v", msg, command, err)
+		}
+		if msg == "" {
+			return
+		}
+		editor.WorkChan() <- basicWork{func() {
+			editor.AppendError(dir, msg)
+		}}
+	}()
+}
+
+func windowPlumbFileFinder(w *Window) plumbFileFinder {
+	finder := NewFileFinder(w)
+	return func(path string) (fullpath string, exists, isDir bool) {
+		// Plumbed text is often not a path at all, so failures to complete it are not errors.
+		var gpath *GlobalPath
+		err := errorOfPanic(func() (err error) {
+			gpath, _, err = finder.Find(path)
+			return
+		})
+		if err != nil || gpath == nil {
+			return
+		}
+		fullpath = gpath.String()
+		if gpath.IsRemote() {
+			// Remote paths are not checked so as to not block the editor while an ssh connection is opened.
+			return fullpath, true, strings.HasSuffix(fullpath, "/")
+		}
+		fi, err := os.Stat(fullpath)
+		if err != nil {
+			return
+		}
+		return fullpath, true, fi.IsDir()
+	}
+}
+
+var plumbingActionVerbs = map[string]bool{
+	"do":          true,
+	"open":        true,
+	"start":       true,
+	"to":          true,
+	"attr":        true,
+	"fallthrough": true,
+}
+
+func ParsePlumbingRules(f io.Reader) (rules []PlumbingRule, err error) {
+	s := bufio.NewScanner(f)
 
 	var rule PlumbingRule
+	lineNo := 0
+
+	endRule := func() {
+		if len(rule.Actions) > 0 {
+			rules = append(rules, rule)
+		}
+		rule = PlumbingRule{}
+	}
 
 	for s.Scan() {
-		line := s.Text()
-		line = strings.TrimSpace(line)
+		lineNo++
+		line := strings.TrimSpace(s.Text())
 		if line == "" || line[0] == '#' {
 			continue
 		}
 
-		toks := strings.SplitN(line, " ", 2)
-		if len(toks) < 2 {
-			mylog.Check(fmt.Errorf("invalid line: expected a word, a space, then a string. Line is '%s'", line))
-		}
+		verb, rest := cutPlumbingWord(line)
 
-		switch state {
-		case stateExpectMatch:
-			if toks[0] != "match" {
-				mylog.Check(fmt.Errorf("expected line beginning with 'match' but got '%s'", line))
+		if plumbingActionVerbs[verb] {
+			if len(rule.Conditions) == 0 {
+				err = fmt.Errorf("line %d: action '%s' is not preceded by a condition", lineNo, verb)
+				return
 			}
-			rule.Match = mylog.Check2(regexp.Compile(toks[1]))
-			state = stateExpectDo
-		case stateExpectDo:
-			if toks[0] != "do" {
-				mylog.Check(fmt.Errorf("expected line beginning with 'do' but got '%s'", line))
+			if (verb == "fallthrough") != (rest == "") {
+				err = fmt.Errorf("line %d: wrong number of arguments for '%s'", lineNo, verb)
+				return
 			}
-			rule.Do = toks[1]
-			rules = append(rules, rule)
-			state = stateExpectMatch
+			if verb == "attr" && !strings.Contains(rest, "=") {
+				err = fmt.Errorf("line %d: expected attr <name>=<value>", lineNo)
+				return
+			}
+			rule.Actions = append(rule.Actions, PlumbingAction{Verb: verb, Arg: rest})
+			continue
+		}
+
+		if len(rule.Actions) > 0 {
+			endRule()
+		}
+		if len(rule.Conditions) == 0 {
+			rule.Line = lineNo
+		}
+
+		var cond PlumbingCondition
+		cond, err = parsePlumbingCondition(verb, rest)
+		if err != nil {
+			err = fmt.Errorf("line %d: %w", lineNo, err)
+			return
+		}
+		rule.Conditions = append(rule.Conditions, cond)
+	}
+
+	if len(rule.Conditions) > 0 && len(rule.Actions) == 0 {
+		err = fmt.Errorf("line %d: rule has no actions", rule.Line)
+		return
+	}
+	endRule()
+	err = s.Err()
+	return
+}
+
+func parsePlumbingCondition(verb, rest string) (cond PlumbingCondition, err error) {
+	switch verb {
+	case "match":
+		cond = PlumbingCondition{Verb: "matches", Var: "data"}
+	case "isfile", "isdir":
+		if rest == "" {
+			err = fmt.Errorf("expected an argument to '%s'", verb)
+			return
+		}
+		cond = PlumbingCondition{Verb: verb, Arg: rest}
+		return
+	default:
+		var word string
+		word, rest = cutPlumbingWord(rest)
+		if word != "matches" {
+			err = fmt.Errorf("unknown condition or action '%s'", verb)
+			return
 		}
+		cond = PlumbingCondition{Verb: "matches", Var: verb}
 	}
+
+	if rest == "" {
+		err = fmt.Errorf("expected a regular expression")
+		return
+	}
+	cond.Re, err = regexp.Compile(rest)
 	return
 }
+
+func cutPlumbingWord(s string) (word, rest string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+func formatPlumbMatches(data string, matches []PlumbMatch) string {
+	if len(matches) == 0 {
+		return fmt.Sprintf("Plumb: no rule matched '%s'", data)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plumb: rules matching '%s':\n", data)
+	for _, m := range matches {
+		fmt.Fprintf(&b, "  line %d:\n", m.Line)
+		for _, a := range m.Actions {
+			fmt.Fprintf(&b, "    %s\n", a)
+		}
+	}
+	return b.String()
+}
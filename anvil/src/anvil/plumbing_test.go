@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPlumbingRules = `
+# Old style rules are still accepted
+match ^https?://
+do browse $0
+
+match ([a-z]+\.go):([0-9]+)
+isfile $1
+open $file:$2
+
+match ^(?P<word>[a-z]+)$
+file matches \.md$
+attr kind=word
+to dict
+start dict $word
+
+match ^[a-z]+$
+do Look $0
+fallthrough
+isdir $data
+open $dir
+`
+
+func testPlumbFileFinder(path string) (fullpath string, exists, isDir bool) {
+	switch path {
+	case "main.go":
+		return "/src/main.go", true, false
+	case "docs":
+		return "/src/docs", true, true
+	}
+	return
+}
+
+func TestParsePlumbingRules(t *testing.T) {
+	rules, err := ParsePlumbingRules(strings.NewReader(testPlumbingRules))
+	if err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+
+	if len(rules) != 5 {
+		t.Fatalf("expected 5 rules but got %d", len(rules))
+	}
+
+	r := rules[2]
+	if r.Line != 10 || len(r.Conditions) != 2 || len(r.Actions) != 3 {
+		t.Fatalf("unexpected rule %+v", r)
+	}
+	if c := r.Conditions[1]; c.Verb != "matches" || c.Var != "file" || c.Re.String() != `\.md$` {
+		t.Fatalf("unexpected condition %+v", c)
+	}
+	if a := r.Actions[0]; a != (PlumbingAction{Verb: "attr", Arg: "kind=word"}) {
+		t.Fatalf("unexpected action %+v", a)
+	}
+}
+
+func TestParsePlumbingRulesErrors(t *testing.T) {
+	tests := []struct {
+		rules string
+		err   string
+	}{
+		{"do Look x", "line 1: action 'do' is not preceded by a condition"},
+		{"match (", "line 1: error parsing regexp"},
+		{"match x\n\nfrob y", "line 3: unknown condition or action 'frob'"},
+		{"match x\nfallthrough now", "line 2: wrong number of arguments for 'fallthrough'"},
+		{"match x\nattr kind", "line 2: expected attr <name>=<value>"},
+		{"match x\ndo y\nmatch z", "line 3: rule has no actions"},
+		{"isfile", "line 1: expected an argument to 'isfile'"},
+	}
+
+	for _, tc := range tests {
+		_, err := ParsePlumbingRules(strings.NewReader(tc.rules))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("rules %q: expected error %q but got %v", tc.rules, tc.err, err)
+		}
+	}
+}
+
+func TestPlumberMatch(t *testing.T) {
+	rules, err := ParsePlumbingRules(strings.NewReader(testPlumbingRules))
+	if err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+	p := NewPlumber(rules)
+
+	actions := func(msg PlumbMsg) (r []string) {
+		for _, m := range p.Match(msg, testPlumbFileFinder) {
+			for _, a := range m.Actions {
+				r = append(r, a.String())
+			}
+		}
+		return
+	}
+
+	tests := []struct {
+		name     string
+		msg      PlumbMsg
+		expected []string
+	}{
+		{
+			name:     "old style rule",
+			msg:      PlumbMsg{Data: "http://example.com"},
+			expected: []string{"do browse http://"},
+		},
+		{
+			name:     "existing file with line",
+			msg:      PlumbMsg{Data: "main.go:12"},
+			expected: []string{"open /src/main.go:12"},
+		},
+		{
+			name:     "missing file",
+			msg:      PlumbMsg{Data: "other.go:12"},
+			expected: nil,
+		},
+		{
+			name:     "window file and named submatch",
+			msg:      PlumbMsg{Data: "docs", File: "/src/README.md", WinId: 3},
+			expected: []string{"attr kind=word", "to dict", "start dict docs"},
+		},
+		{
+			name:     "fallthrough",
+			msg:      PlumbMsg{Data: "docs", File: "/src/main.go"},
+			expected: []string{"do Look docs", "fallthrough", "open /src/docs"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if a := actions(tc.msg); !reflect.DeepEqual(a, tc.expected) {
+				t.Fatalf("expected actions %q but got %q", tc.expected, a)
+			}
+		})
+	}
+}
+
+func TestPlumberMatchLocalFiles(t *testing.T) {
+	rules, err := ParsePlumbingRules(strings.NewReader(testPlumbingRules))
+	if err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+	p := NewPlumber(rules)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	find := windowPlumbFileFinder(nil)
+	if _, exists, _ := find(filepath.Join(dir, "missing.go")); exists {
+		t.Fatalf("a missing file was found")
+	}
+	if _, exists, isDir := find(filepath.Join(dir, "missing", "a.go")); exists || isDir {
+		t.Fatalf("a file in a missing directory was found")
+	}
+	if fullpath, exists, isDir := find(file); fullpath != file || !exists || isDir {
+		t.Fatalf("expected %s to be found as a file but got %s %v %v", file, fullpath, exists, isDir)
+	}
+	if _, exists, isDir := find(dir); !exists || !isDir {
+		t.Fatalf("expected %s to be found as a directory", dir)
+	}
+
+	m := p.Match(PlumbMsg{Data: "missing.go:12"}, find)
+	if len(m) != 0 {
+		t.Fatalf("expected no matches for a missing file but got %v", m)
+	}
+}
+
+func TestPlumbMatchNotification(t *testing.T) {
+	m := PlumbMatch{
+		Attrs: map[string]string{"kind": "word", "addr": "12"},
+		msg:   PlumbMsg{Data: "docs", WinId: 3},
+	}
+
+	n := m.notification("dict")
+	expected := ApiNotification{WinId: 3, Op: ApiNotificationOpPlumb, Cmd: []string{"dict", "docs", "addr=12", "kind=word"}}
+	if !reflect.DeepEqual(n, expected) {
+		t.Fatalf("expected %+v but got %+v", expected, n)
+	}
+}
+
+func TestExpandPlumbingVars(t *testing.T) {
+	vars := map[string]string{"1": "a", "file": "/x/y.go"}
+	if s := expandPlumbingVars("$1 ${file}:$2 $$", vars); s != "a /x/y.go: $" {
+		t.Fatalf("unexpected expansion %q", s)
+	}
+}
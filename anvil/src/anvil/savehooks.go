@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jeffwilliams/anvil/internal/linediff"
+)
+
+// saveHooksForFile returns the commands of the save hooks from the settings that apply to the file,
+// in the order they are listed. file is the path of the file without any remote host.
+func saveHooksForFile(hooks []SaveHook, file string) (pre, post []string) {
+	for _, h := range hooks {
+		if !saveHookMatches(h.Pattern, file) {
+			continue
+		}
+		pre = append(pre, h.Pre...)
+		post = append(post, h.Post...)
+	}
+	return
+}
+
+// saveHookMatches returns true if the pattern of a save hook matches the file. Patterns that contain
+// a slash are matched against the whole path, and others against the name of the file.
+func saveHookMatches(pattern, file string) bool {
+	file = filepath.ToSlash(file)
+	if !strings.Contains(pattern, "/") {
+		file = path.Base(file)
+	}
+	ok, err := path.Match(pattern, file)
+	return err == nil && ok
+}
+
+// saveHooks returns the pre- and post-save commands that apply to the file of the window.
+func (w *Window) saveHooks() (pre, post []string) {
+	if len(settings.Hooks.Save) == 0 {
+		return
+	}
+	gpath, err := NewGlobalPath(w.file, GlobalPathIsFile)
+	if err != nil {
+		return
+	}
+	return saveHooksForFile(settings.Hooks.Save, gpath.Path())
+}
+
+// hookDir returns the directory that save hooks for the window are run in, including the remote host
+// if the file is remote.
+func (w *Window) hookDir() string {
+	gpath, err := NewGlobalPath(w.file, GlobalPathIsFile)
+	if err != nil {
+		return filepath.Dir(w.file)
+	}
+	return gpath.Dir().String()
+}
+
+// runPreSaveHooks passes the body of the window through the commands one after the other, and then
+// replaces the body with the result and saves it. If a command fails the window is not saved.
+func (w *Window) runPreSaveHooks(cmds, post []string) {
+	file := w.file
+	dir := w.hookDir()
+	text := w.Body.Bytes()
+
+	fail := func(msg string) {
+		editor.WorkChan() <- basicWork{func() {
+			editor.AppendError(dir, msg)
+		}}
+	}
+
+	go func() {
+		sfs, err := GetFs(dir)
+		if err != nil {
+			fail(fmt.Sprintf("Not saving %s: %v", file, err))
+			return
+		}
+
+		out := text
+		for _, c := range cmds {
+			log(LogCatgWin, "running pre-save hook '%s' for %s\n", c, file)
+			stdout, stderr, err := sfs.filter(dir, c, out)
+			if err != nil {
+				fail(fmt.Sprintf("Not saving %s: save hook '%s' failed: %v\n%s", file, c, err, stderr))
+				return
+			}
+			// A command that writes nothing only checks the text.
+			if len(stdout) > 0 || len(out) == 0 {
+				out = stdout
+			}
+		}
+
+		editor.WorkChan() <- basicWork{func() {
+			if editor.FindWindowForId(w.Id) != w || w.file != file {
+				return
+			}
+			if !bytes.Equal(w.Body.Bytes(), text) {
+				editor.AppendError(dir, fmt.Sprintf("Not saving %s: it was changed while the save hooks were running", file))
+				return
+			}
+			w.Body.replaceTextByEdits(string(out))
+			w.save(post)
+		}}
+	}()
+}
+
+// runPostSaveHooks runs the commands after the window was saved and shows their output in +Errors.
+func (w *Window) runPostSaveHooks(cmds []string) {
+	file := w.file
+	dir := w.hookDir()
+
+	go func() {
+		sfs, err := GetFs(dir)
+		if err != nil {
+			return
+		}
+
+		for _, c := range cmds {
+			log(LogCatgWin, "running post-save hook '%s' for %s\n", c, file)
+			stdout, stderr, err := sfs.filter(dir, c, nil)
+			msg := string(stdout) + string(stderr)
+			if err != nil {
+				msg = fmt.Sprintf("%ssave hook '%s' for %s failed: %v", msg, c, file, err)
+			}
+			if msg == "" {
+				continue
+			}
+			editor.WorkChan() <- basicWork{func() {
+				editor.AppendError(dir, msg)
+			}}
+		}
+	}()
+}
+
+// replaceTextByEdits changes the text of the editable to text using as small changes as possible, so
+// that cursors and selections in the parts that don't change keep their place. The changes are
+// undone together.
+func (e *editable) replaceTextByEdits(text string) {
+	e.applyEdits(0, linediff.Edits(string(e.Bytes()), text))
+}
+
+// applyEdits applies the edits, whose positions are relative to offset, in one transaction.
+func (e *editable) applyEdits(offset int, edits []linediff.Edit) {
+	if len(edits) == 0 {
+		return
+	}
+
+	e.text.StartTransaction()
+	e.SetSaveDeletes(false)
+	for i := len(edits) - 1; i >= 0; i-- {
+		ed := edits[i]
+		if ed.End > ed.Start {
+			e.deleteFromPieceTable(offset+ed.Start, ed.End-ed.Start)
+		}
+		if ed.Text != "" {
+			e.insertToPieceTable(offset+ed.Start, ed.Text)
+		}
+	}
+	e.SetSaveDeletes(true)
+	e.text.EndTransaction()
+}
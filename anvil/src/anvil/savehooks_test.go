@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSaveHooksForFile(t *testing.T) {
+	hooks := []SaveHook{
+		{Pattern: "*.go", Pre: []string{"gofmt"}, Post: []string{"go vet ."}},
+		{Pattern: "*.go", Pre: []string{"goimports"}},
+		{Pattern: "/src/gen/*.go", Post: []string{"make"}},
+		{Pattern: "Makefile", Pre: []string{"check-tabs"}},
+	}
+
+	tests := []struct {
+		file      string
+		pre, post []string
+	}{
+		{"/src/main.go", []string{"gofmt", "goimports"}, []string{"go vet ."}},
+		{"/src/gen/a.go", []string{"gofmt", "goimports"}, []string{"go vet .", "make"}},
+		{"/src/Makefile", []string{"check-tabs"}, nil},
+		{"/src/main.c", nil, nil},
+	}
+
+	for _, tc := range tests {
+		pre, post := saveHooksForFile(hooks, tc.file)
+		if !reflect.DeepEqual(pre, tc.pre) || !reflect.DeepEqual(post, tc.post) {
+			t.Errorf("%s: expected %v and %v but got %v and %v", tc.file, tc.pre, tc.post, pre, post)
+		}
+	}
+}
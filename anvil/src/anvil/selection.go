@@ -60,11 +60,16 @@ func (e *editableModel) clearSelections() {
 	e.primarySel = nil
 	e.primarySelPurpose = SelectionPurposeSelect
 	e.selectionBeingBuilt = nil
+	e.blockSelected = false
 }
 
 func (e *editable) clearSelections() {
+	hadSelections := e.SelectionsPresent()
 	e.editableModel.clearSelections()
 	editor.clearLastSelectionIfOwnedBy(e)
+	if hadSelections {
+		e.adapter.selectionsChanged(e)
+	}
 }
 
 func (e *editableModel) addSelection(s *selection) {
@@ -147,6 +152,7 @@ func (e *editable) setPrimarySelection(start, end int) {
 		e.primarySel.start = start
 		e.primarySel.end = end
 		editor.setLastSelection(e, e.primarySel)
+		e.adapter.selectionsChanged(e)
 		return
 	}
 
@@ -160,6 +166,7 @@ func (e *editable) addPrimarySelection(start, end int) {
 	e.primarySelPurpose = SelectionPurposeSelect
 	editor.setLastSelection(e, sel)
 	e.selectionsModified()
+	e.adapter.selectionsChanged(e)
 }
 
 func (e *editableModel) selectionsModified() {
@@ -257,6 +264,7 @@ func (e *editable) stopBuildingSelection() {
 		newSel = append(newSel, s)
 	}
 	e.selections = newSel
+	e.adapter.selectionsChanged(e)
 }
 
 type SelectionRank int
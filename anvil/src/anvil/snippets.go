@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jeffwilliams/anvil/internal/snippet"
+	"github.com/pelletier/go-toml"
+)
+
+// snippetDef is a snippet from a snippet file. The files in SnippetDir are TOML files named after a
+// language, like go.toml, that contain a table for each snippet keyed by the word that triggers it.
+// The snippets in all.toml can be used in files of any language.
+type snippetDef struct {
+	Description string `toml:"description"`
+	Body        string `toml:"body"`
+}
+
+// allLanguagesSnippetFile is the name of the snippet file whose snippets apply to every file.
+const allLanguagesSnippetFile = "all"
+
+// snippets are the snippets loaded from the files in SnippetDir. A file is loaded again when it changes.
+var snippets snippetLibrary
+
+type snippetLibrary struct {
+	lock  sync.Mutex
+	files map[string]snippetFile
+}
+
+type snippetFile struct {
+	modTime  time.Time
+	snippets map[string]snippetDef
+}
+
+// ForFile returns the snippets that can be used in the file, keyed by trigger. Snippets for the language
+// of the file override those for all languages.
+func (l *snippetLibrary) ForFile(filename string) map[string]snippetDef {
+	result := map[string]snippetDef{}
+	l.addFrom(result, allLanguagesSnippetFile)
+
+	// The language name comes first and overrides its aliases.
+	names := languageNamesForFile(filename)
+	for i := len(names) - 1; i >= 0; i-- {
+		l.addFrom(result, strings.ToLower(names[i]))
+	}
+	return result
+}
+
+func (l *snippetLibrary) addFrom(result map[string]snippetDef, name string) {
+	for k, v := range l.load(name) {
+		result[k] = v
+	}
+}
+
+func (l *snippetLibrary) load(name string) map[string]snippetDef {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.files == nil {
+		l.files = map[string]snippetFile{}
+	}
+
+	path := filepath.Join(SnippetDir(), name+".toml")
+	info, err := os.Stat(path)
+	if err != nil {
+		delete(l.files, path)
+		return nil
+	}
+
+	if f, ok := l.files[path]; ok && f.modTime.Equal(info.ModTime()) {
+		return f.snippets
+	}
+
+	f := snippetFile{modTime: info.ModTime()}
+	f.snippets, err = loadSnippetFile(path)
+	if err != nil {
+		log(LogCatgConf, "Error loading snippets %s: %v\n", path, err)
+		if editor != nil {
+			editor.AppendError("", fmt.Sprintf("Error loading snippets %s: %v", path, err))
+		}
+	}
+	l.files[path] = f
+	return f.snippets
+}
+
+func loadSnippetFile(path string) (defs map[string]snippetDef, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	err = toml.Unmarshal(b, &defs)
+	return
+}
+
+// snippetSession is the state of a snippet that was expanded and whose tab stops are being visited.
+// The ranges of the tab stops are moved as the text is changed.
+type snippetSession struct {
+	stops []snippet.Stop
+	// current is the index in stops of the tab stop being edited.
+	current int
+}
+
+func (s *snippetSession) active() bool {
+	return len(s.stops) > 0
+}
+
+func (s *snippetSession) end() {
+	s.stops = nil
+	s.current = 0
+}
+
+func (s *snippetSession) shiftDueToTextModification(startOfChange, lengthOfChange int) {
+	for i := range s.stops {
+		// Text typed at the edges of the tab stop being edited becomes part of it.
+		grow := i == s.current
+		for j := range s.stops[i].Ranges {
+			s.stops[i].Ranges[j].Shift(startOfChange, lengthOfChange, grow)
+		}
+	}
+}
+
+// cursorInCurrentStop returns true if the index is in or next to one of the copies of the tab stop
+// being edited.
+func (s *snippetSession) cursorInCurrentStop(index int) bool {
+	for _, r := range s.stops[s.current].Ranges {
+		if r.Contains(index) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *editable) EnableSnippets() {
+	e.snippetsEnabled = true
+}
+
+// expandSnippetBeforeCursor expands the snippet whose trigger is the word before the cursor, and returns
+// false if there is no such snippet.
+func (e *editable) expandSnippetBeforeCursor() bool {
+	if !e.snippetsEnabled || len(e.CursorIndices) != 1 || e.SelectionsPresent() {
+		return false
+	}
+
+	ci := e.firstCursorIndex()
+	word := triggerWordBefore(e.lineBeforeCursor(ci))
+	if word == "" {
+		return false
+	}
+
+	def, ok := snippets.ForFile(e.adapter.file())[word]
+	if !ok {
+		return false
+	}
+
+	e.expandSnippet(def, ci-len([]rune(word)), ci)
+	return true
+}
+
+// triggerWordBefore returns the word made of letters, digits and underscores at the end of text.
+func triggerWordBefore(text string) string {
+	r := []rune(text)
+	i := len(r)
+	for i > 0 && (unicode.IsLetter(r[i-1]) || unicode.IsDigit(r[i-1]) || r[i-1] == '_') {
+		i--
+	}
+	return string(r[i:])
+}
+
+// ExpandSnippet expands the snippet with the trigger at the cursor, and returns an error if there is
+// no such snippet for the file.
+func (e *editable) ExpandSnippet(trigger string) error {
+	def, ok := snippets.ForFile(e.adapter.file())[trigger]
+	if !ok {
+		return fmt.Errorf("there is no snippet named '%s' for this file", trigger)
+	}
+
+	ci := e.firstCursorIndex()
+	e.clearSelections()
+	e.setToOneCursorIndex(ci)
+	e.expandSnippet(def, ci, ci)
+	return nil
+}
+
+// expandSnippet replaces the text from start to end with the expanded snippet and moves to its first tab stop.
+func (e *editable) expandSnippet(def snippetDef, start, end int) {
+	_, space := e.leadingSpaceOfLine(start)
+	exp, err := snippet.Expand(e.indentSnippet(def.Body, space), e.snippetVars())
+	if err != nil {
+		e.adapter.appendError("", fmt.Sprintf("Error expanding snippet: %v", err))
+		return
+	}
+
+	e.snippet.end()
+	e.text.StartTransaction()
+	e.SetSaveDeletes(false)
+	if end > start {
+		e.deleteFromPieceTable(start, end-start)
+	}
+	e.insertToPieceTable(start, exp.Text)
+	e.SetSaveDeletes(true)
+	e.text.EndTransaction()
+
+	for i := range exp.Stops {
+		for j := range exp.Stops[i].Ranges {
+			exp.Stops[i].Ranges[j].Start += start
+			exp.Stops[i].Ranges[j].End += start
+		}
+	}
+	e.snippet = snippetSession{stops: exp.Stops, current: -1}
+	e.moveToSnippetStop(Forward)
+}
+
+// indentSnippet indents the lines of the body after the first by space, the indentation of the line the
+// snippet is expanded on, and changes the tabs at the start of lines to the indentation unit of the editable.
+func (e *editable) indentSnippet(body, space string) string {
+	lines := strings.Split(body, "\n")
+	unit := e.indent.unit()
+	for i, l := range lines {
+		trimmed := strings.TrimLeft(l, "\t")
+		l = strings.Repeat(unit, len(l)-len(trimmed)) + trimmed
+		if i > 0 && l != "" {
+			l = space + l
+		}
+		lines[i] = l
+	}
+	return strings.Join(lines, "\n")
+}
+
+// snippetVars returns the variables that may be used in snippets.
+func (e *editable) snippetVars() snippet.Vars {
+	file := e.adapter.file()
+	if gpath, err := NewGlobalPath(file, GlobalPathIsFile); err == nil {
+		file = filepath.ToSlash(gpath.Path())
+	}
+	now := time.Now()
+
+	return func(name string) (string, bool) {
+		switch name {
+		case "FILENAME":
+			return path.Base(file), file != ""
+		case "FILENAME_BASE":
+			base := path.Base(file)
+			return strings.TrimSuffix(base, path.Ext(base)), file != ""
+		case "FILEPATH":
+			return file, file != ""
+		case "DIRECTORY":
+			return path.Dir(file), file != ""
+		case "DATE":
+			return now.Format("2006-01-02"), true
+		case "TIME":
+			return now.Format("15:04:05"), true
+		case "YEAR":
+			return now.Format("2006"), true
+		case "USER":
+			return os.Getenv("USER"), true
+		}
+		return "", false
+	}
+}
+
+// moveToSnippetStop selects the next or previous tab stop of the snippet being edited. All copies of the
+// tab stop are selected, or if they are empty a cursor is placed at each. The snippet is finished when
+// the last tab stop is reached. It returns false if no snippet is being edited.
+func (e *editable) moveToSnippetStop(dir direction) bool {
+	s := &e.snippet
+	if !s.active() {
+		return false
+	}
+
+	// The snippet was left if the cursor was moved away from the tab stop.
+	if s.current >= 0 && !s.cursorInCurrentStop(e.firstCursorIndex()) {
+		s.end()
+		return false
+	}
+
+	next := s.current + 1
+	if dir == Reverse {
+		next = s.current - 1
+	}
+	if next < 0 {
+		return true
+	}
+	s.current = next
+
+	stop := s.stops[s.current]
+	e.clearSelections()
+	first := stop.Ranges[0]
+	if first.End > first.Start {
+		e.addPrimarySelection(first.Start, first.End)
+		for _, r := range stop.Ranges[1:] {
+			e.addSecondarySelection(r.Start, r.End)
+		}
+		e.setToOneCursorIndex(first.End)
+	} else {
+		cursors := make([]int, len(stop.Ranges))
+		for i, r := range stop.Ranges {
+			cursors[i] = r.Start
+		}
+		sort.Ints(cursors)
+		e.CursorIndices = cursors
+	}
+
+	if s.current == len(s.stops)-1 {
+		s.end()
+	}
+	return true
+}
+
+// snippetNames returns the triggers and descriptions of the snippets, sorted by trigger.
+func snippetNames(defs map[string]snippetDef) string {
+	triggers := make([]string, 0, len(defs))
+	for t := range defs {
+		triggers = append(triggers, t)
+	}
+	sort.Strings(triggers)
+
+	var b strings.Builder
+	for _, t := range triggers {
+		fmt.Fprintf(&b, "%s\t%s\n", t, defs[t].Description)
+	}
+	return b.String()
+}
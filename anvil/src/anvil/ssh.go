@@ -1,30 +1,137 @@
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ddkwork/golibrary/mylog"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/jeffwilliams/anvil/internal/hostkeys"
+	"github.com/jeffwilliams/anvil/internal/sshconfig"
 )
 
 var sshClientCache = NewSshClientCache(settings.Ssh.CacheSize)
 
+var (
+	sshHostKeysOnce sync.Once
+	sshHostKeys     *hostkeys.Verifier
+)
+
+// sshHostKeyVerifier returns the verifier used to check the host keys of all ssh connections.
+func sshHostKeyVerifier() *hostkeys.Verifier {
+	sshHostKeysOnce.Do(func() {
+		policy, err := hostkeys.ParsePolicy(settings.Ssh.HostKeyPolicy)
+		if err != nil {
+			log(LogCatgSsh, "%v\n", err)
+		}
+		sshHostKeys = hostkeys.New(policy, SshKnownHostsFile(), UserSshKnownHostsFile())
+		sshHostKeys.OnUnknownKey(reportUnknownSshHostKey)
+	})
+	return sshHostKeys
+}
+
+var (
+	sshConfigLock    sync.Mutex
+	sshConfigParsed  *sshconfig.Config
+	sshConfigPath    string
+	sshConfigModTime time.Time
+)
+
+// sshConfig returns the OpenSSH client config file named in the settings, which is read again
+// whenever it changes.
+func sshConfig() *sshconfig.Config {
+	sshConfigLock.Lock()
+	defer sshConfigLock.Unlock()
+
+	path := sshConfigFile()
+	if path == "" {
+		return &sshconfig.Config{}
+	}
+
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	if sshConfigParsed != nil && path == sshConfigPath && modTime.Equal(sshConfigModTime) {
+		return sshConfigParsed
+	}
+
+	c, err := sshconfig.ParseFile(path)
+	if err != nil {
+		log(LogCatgSsh, "error reading ssh config file: %v\n", err)
+	}
+	sshConfigParsed, sshConfigPath, sshConfigModTime = c, path, modTime
+	return c
+}
+
+// sshConfigFile returns the path of the ssh config file from the settings, or "" if it is disabled.
+func sshConfigFile() string {
+	switch path := settings.Ssh.ConfigFile; path {
+	case "none":
+		return ""
+	case "":
+		return UserSshConfigFile()
+	default:
+		if strings.HasPrefix(path, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				path = filepath.Join(home, path[2:])
+			}
+		}
+		return path
+	}
+}
+
+func applySshHostKeyPolicySetting() {
+	// An invalid policy falls back to the safe default of asking
+	policy, err := hostkeys.ParsePolicy(settings.Ssh.HostKeyPolicy)
+	if err != nil {
+		log(LogCatgConf, "settings: %v\n", err)
+	}
+	sshHostKeyVerifier().SetPolicy(policy)
+}
+
+// reportUnknownSshHostKey asks the user, in +Errors, whether to trust the key of a host that
+// was rejected because it is not known. It may be called from any goroutine.
+func reportUnknownSshHostKey(k hostkeys.UnknownKey) {
+	msg := fmt.Sprintf("The authenticity of host %s can't be established.\n"+
+		"Its %s key fingerprint is %s.\n"+
+		"If you trust this key, execute ◊Acceptkey %s◊ and run the command again.\n",
+		k.Host, k.Key.Type(), k.Fingerprint(), k.Host)
+
+	// The dial that found the key may be running on the main goroutine, so don't block on it.
+	go func() {
+		editor.WorkChan() <- basicWork{func() {
+			editor.AppendError("", msg)
+		}}
+	}()
+}
+
+// SshClientCache caches the connections to ssh endpoints. The connections are probed periodically and
+// re-opened if they were lost.
 // TODO: Support closing the connections after some delay.
-// Also detect a network issue and re-open the connection.
 type SshClientCache struct {
 	data             map[SshEndpt]SshClientCacheEntry
 	max              int
 	lock             sync.Mutex
 	keyfilePasswords map[string]string
 	sshHopPasswords  map[SshHop]string
-	keyfileAuths     []ssh.AuthMethod
+	keyfileSigners   []ssh.Signer
 	keys             map[string][]byte
+	// identitySigners holds the decoded IdentityFiles from the ssh config file by path
+	identitySigners map[string]ssh.Signer
+	// nextId is the number of the next connection made. Connections keep their number when re-opened.
+	nextId        int
+	keepaliveOnce sync.Once
 }
 
 func NewSshClientCache(max int) *SshClientCache {
@@ -34,30 +141,45 @@ func NewSshClientCache(max int) *SshClientCache {
 		keyfilePasswords: map[string]string{},
 		sshHopPasswords:  map[SshHop]string{},
 		keys:             map[string][]byte{},
+		identitySigners:  map[string]ssh.Signer{},
 	}
 }
 
 func (cache *SshClientCache) Get(endpt SshEndpt, kill chan struct{}) (client *SshClient, err error) {
-	cache.lock.Lock()
-	defer cache.lock.Unlock()
 	defer func() {
 		mylog.Check(prefixWithSshEndpt(endpt, "SshClientCache.Get", err))
 	}()
 
-	e, ok := cache.data[endpt]
-	if !ok {
-		client = mylog.Check2(cache.add(endpt, kill))
+	client, existed, err := cache.getOrAdd(endpt, kill)
+	if err != nil || !existed {
 		return
 	}
 
-	if !cache.isValid(e.client.Client()) {
-		// reconnect
-		client = mylog.Check2(cache.add(endpt, kill))
-		return
+	// The connection is probed and re-opened without the cache locked, since either may take a while
+	if !cache.isValid(client.Client()) {
+		return cache.reconnect(client, kill)
 	}
 
-	client = e.client
+	cache.lock.Lock()
+	if e, ok := cache.data[endpt]; ok && e.client == client {
+		e.lastUsed = time.Now()
+		cache.data[endpt] = e
+	}
+	cache.lock.Unlock()
+	return
+}
+
+// getOrAdd returns the cached connection to the endpoint, or makes a new one. New connections are made
+// with the cache locked so that only one is made to an endpoint.
+func (cache *SshClientCache) getOrAdd(endpt SshEndpt, kill chan struct{}) (client *SshClient, existed bool, err error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
 
+	if e, ok := cache.data[endpt]; ok {
+		return e.client, true, nil
+	}
+
+	client, err = cache.add(endpt, kill)
 	return
 }
 
@@ -72,12 +194,25 @@ func prefixWithSshEndpt(endpt SshEndpt, msg string, err error) error {
 	}
 }
 
+// sshKeepaliveTimeout is how long a connection has to answer a keepalive request before it's considered lost.
+const sshKeepaliveTimeout = 10 * time.Second
+
 func (cache *SshClientCache) isValid(client *ssh.Client) bool {
-	// See https://datatracker.ietf.org/doc/html/draft-ssh-global-requests-ok-00 section 4.1 (active keepalive)
-	status, payload := mylog.Check3(client.SendRequest("keep-alive@implementation.example.com", true, []byte("keep-alive")))
-	log(LogCatgSsh, "cache.isValid: %v, %v, %v\n", status, payload, nil)
+	errs := make(chan error, 1)
+	go func() {
+		// See https://datatracker.ietf.org/doc/html/draft-ssh-global-requests-ok-00 section 4.1 (active keepalive)
+		status, payload, err := client.SendRequest("keep-alive@implementation.example.com", true, []byte("keep-alive"))
+		log(LogCatgSsh, "cache.isValid: %v, %v, %v\n", status, payload, err)
+		errs <- err
+	}()
 
-	return true
+	select {
+	case err := <-errs:
+		return err == nil
+	case <-time.After(sshKeepaliveTimeout):
+		log(LogCatgSsh, "cache.isValid: no answer to keepalive after %s\n", sshKeepaliveTimeout)
+		return false
+	}
 }
 
 func (cache *SshClientCache) add(endpt SshEndpt, kill chan struct{}) (client *SshClient, err error) {
@@ -87,16 +222,28 @@ func (cache *SshClientCache) add(endpt SshEndpt, kill chan struct{}) (client *Ss
 
 	c := mylog.Check2(cache.dial(endpt, kill))
 
-	client = &SshClient{client: c, endpt: endpt}
+	cache.nextId++
+	client = newSshClient(c, endpt, cache.nextId)
 
 	cache.data[endpt] = SshClientCacheEntry{client: client, lastUsed: time.Now()}
+	cache.keepaliveOnce.Do(func() {
+		go cache.keepalive()
+	})
 	return
 }
 
+func newSshClient(c *ssh.Client, endpt SshEndpt, id int) *SshClient {
+	return &SshClient{client: c, endpt: endpt, id: id, created: time.Now(), remoteAgent: &remoteAgentState{}}
+}
+
 func (cache *SshClientCache) rmLeastRecentlyUsed() {
 	var minK SshEndpt
 	var minTime time.Time
 	for k, v := range cache.data {
+		// Connections with port forwards are kept since they are in use even when idle
+		if len(v.client.Forwards()) > 0 {
+			continue
+		}
 		if minTime.IsZero() || v.lastUsed.Before(minTime) {
 			minTime = v.lastUsed
 			minK = k
@@ -104,47 +251,109 @@ func (cache *SshClientCache) rmLeastRecentlyUsed() {
 		}
 	}
 
+	if minTime.IsZero() {
+		return
+	}
 	delete(cache.data, minK)
 }
 
 func (cache *SshClientCache) dial(endpt SshEndpt, kill chan struct{}) (client *ssh.Client, err error) {
 	log(LogCatgSsh, "SshClientCache: creating new ssh client object\n")
 
-	dest := cache.completeHop(endpt.Dest)
-	proxy := endpt.Proxy
+	route := mylog.Check2(cache.route(endpt))
+	log(LogCatgSsh, "SshClientCache: route to %s is %v\n", endpt, route)
+
+	client = mylog.Check2(cache.dialOrKill(route, kill))
+	return
+}
+
+// sshRouteHop is a hop on the route to an ssh endpoint, completed using the ssh config file.
+type sshRouteHop struct {
+	SshHop
+	identityFiles []string
+}
+
+func (h sshRouteHop) addr() string {
+	return net.JoinHostPort(h.Host, h.Port)
+}
+
+// maxSshRouteLen limits the number of hops on the route to an endpoint, to stop ProxyJump loops.
+const maxSshRouteLen = 16
+
+// route returns the hops that are dialed to reach the endpoint, in the order they are dialed,
+// ending with the destination. If the endpoint has no proxies, the ProxyJump for the destination
+// in the ssh config file is used. As with OpenSSH the ProxyJump of the first jump host is followed as well.
+func (cache *SshClientCache) route(endpt SshEndpt) (route []sshRouteHop, err error) {
+	dest, conf := cache.resolveHop(endpt.Dest)
+
+	var jumps []SshHop
 	if endpt.HasProxy() {
-		proxy = cache.completeHop(endpt.Proxy)
+		proxies := endpt.Proxies.Hops()
+		for i := len(proxies) - 1; i >= 0; i-- {
+			jumps = append(jumps, proxies[i])
+		}
+	} else {
+		jumps = parseProxyJump(conf.ProxyJump)
 	}
 
-	destAuths := cache.getAuths(dest)
+	// A route with no jumps is empty, which is valid: the destination is dialed directly
+	route, err = cache.routeThrough(jumps, 0)
+	if err != nil {
+		return nil, err
+	}
+	route = append(route, sshRouteHop{dest, conf.IdentityFiles})
+	return
+}
 
-	destConf := &ssh.ClientConfig{
-		User:            dest.User,
-		Auth:            destAuths,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// routeThrough returns the hops that are dialed to pass through the jump hosts.
+func (cache *SshClientCache) routeThrough(jumps []SshHop, depth int) (route []sshRouteHop, err error) {
+	if len(jumps) == 0 {
+		return
 	}
 
-	proxyConf := (*ssh.ClientConfig)(nil)
-	if endpt.HasProxy() {
-		proxyAuths := cache.getAuths(proxy)
-		proxyConf = &ssh.ClientConfig{
-			User:            proxy.User,
-			Auth:            proxyAuths,
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		}
+	if depth+len(jumps) > maxSshRouteLen {
+		return nil, fmt.Errorf("the route has more than %d hops. The ProxyJump settings in the ssh config file may form a loop", maxSshRouteLen)
 	}
 
-	addr := fmt.Sprintf("%s:%s", dest.Host, dest.Port)
-	proxyAddr := ""
-	if endpt.HasProxy() {
-		proxyAddr = fmt.Sprintf("%s:%s", proxy.Host, proxy.Port)
+	first, conf := cache.resolveHop(jumps[0])
+	route, err = cache.routeThrough(parseProxyJump(conf.ProxyJump), depth+len(jumps))
+	if err != nil {
+		return nil, err
 	}
+	route = append(route, sshRouteHop{first, conf.IdentityFiles})
 
-	client = mylog.Check2(cache.dialOrKill("tcp", addr, destConf, proxyAddr, proxyConf, kill))
+	for _, j := range jumps[1:] {
+		h, conf := cache.resolveHop(j)
+		route = append(route, sshRouteHop{h, conf.IdentityFiles})
+	}
 	return
 }
 
+// parseProxyJump parses jump hosts in the form [user@]host[:port] as used by ProxyJump.
+func parseProxyJump(jumps []string) []SshHop {
+	hops := make([]SshHop, len(jumps))
+	for i, j := range jumps {
+		hops[i].User, hops[i].Host, hops[i].Port, _ = parseHop(j + ":")
+	}
+	return hops
+}
+
 func (cache *SshClientCache) completeHop(h SshHop) SshHop {
+	h, _ = cache.resolveHop(h)
+	return h
+}
+
+// resolveHop replaces a host alias in the hop with the real host name from the ssh config file, and
+// fills in the user and port from the ssh config file or with defaults if they are not set.
+// It also returns the config that applies to the hop.
+func (cache *SshClientCache) resolveHop(h SshHop) (SshHop, sshconfig.Host) {
+	conf := sshConfig().Lookup(h.Host)
+	h.Host = conf.HostName
+
+	if h.User == "" {
+		h.User = conf.User
+	}
+
 	if h.User == "" {
 		if runtime.GOOS == "windows" {
 			h.User = os.Getenv("USERNAME")
@@ -153,63 +362,129 @@ func (cache *SshClientCache) completeHop(h SshHop) SshHop {
 		}
 	}
 
+	if h.Port == "" {
+		h.Port = conf.Port
+	}
+
 	if h.Port == "" {
 		h.Port = "22"
 	}
 
-	return h
+	return h, conf
 }
 
-func (cache *SshClientCache) dialOrKill(network, addr string, conf *ssh.ClientConfig, proxyAddr string, proxyConf *ssh.ClientConfig, kill chan struct{}) (client *ssh.Client, err error) {
-	c := make(chan struct{})
-
-	wakeup := func() {
-		c <- struct{}{}
+func (cache *SshClientCache) dialOrKill(route []sshRouteHop, kill chan struct{}) (client *ssh.Client, err error) {
+	type result struct {
+		client *ssh.Client
+		err    error
 	}
+	c := make(chan result, 1)
 
 	go func() {
-		if proxyAddr != "" {
-			client = mylog.Check2(cache.dialWithProxy(network, addr, conf, proxyAddr, proxyConf, kill))
-		} else {
-			client = mylog.Check2(ssh.Dial("tcp", addr, conf))
-		}
-		wakeup()
+		var r result
+		// dialRoute reports errors by panicking, which must not bring down the editor from this goroutine
+		r.err = errorOfPanic(func() (err error) {
+			r.client, err = cache.dialRoute(route)
+			return
+		})
+		c <- r
 	}()
 
 	select {
-	case <-c:
-		return
+	case r := <-c:
+		return r.client, r.err
 	case <-kill:
-		mylog.
-			// We just need to let the dial finish on it's own and we abandon the return values
-			Check(fmt.Errorf("Dial to %s was killed", addr))
-		return
+		// We just need to let the dial finish on it's own and we abandon the return values
+		return nil, fmt.Errorf("Dial to %s was killed", route[len(route)-1].addr())
 	}
 }
 
-func (cache *SshClientCache) dialWithProxy(network, addr string, conf *ssh.ClientConfig, proxyAddr string, proxyConf *ssh.ClientConfig, kill chan struct{}) (client *ssh.Client, err error) {
-	proxyClient := mylog.Check2(ssh.Dial("tcp", proxyAddr, proxyConf))
+// dialRoute dials the first hop of the route, then dials each following hop through the
+// connection to the one before it.
+func (cache *SshClientCache) dialRoute(route []sshRouteHop) (client *ssh.Client, err error) {
+	verifier := sshHostKeyVerifier()
+	hostKeyCallback := verifier.HostKeyCallback()
 
-	conn := mylog.Check2(proxyClient.Dial(network, addr))
+	for _, hop := range route {
+		conf := &ssh.ClientConfig{
+			User:            hop.User,
+			Auth:            cache.getAuths(hop),
+			HostKeyCallback: hostKeyCallback,
+			// Ask for a key of a type we know for the host, so that it isn't taken to have changed
+			HostKeyAlgorithms: verifier.HostKeyAlgorithms(hop.addr()),
+		}
 
-	ncc, chans, reqs := mylog.Check4(ssh.NewClientConn(conn, addr, conf))
+		if client == nil {
+			client = mylog.Check2(ssh.Dial("tcp", hop.addr(), conf))
+			continue
+		}
+
+		conn := mylog.Check2(client.Dial("tcp", hop.addr()))
+
+		ncc, chans, reqs := mylog.Check4(ssh.NewClientConn(conn, hop.addr(), conf))
 
-	client = ssh.NewClient(ncc, chans, reqs)
+		client = ssh.NewClient(ncc, chans, reqs)
+	}
 	return
 }
 
-func (cache *SshClientCache) getAuths(hop SshHop) []ssh.AuthMethod {
-	auths := cache.getKeyfileAuths()
-	a := cache.getPasswordAuth(hop)
+func (cache *SshClientCache) getAuths(hop sshRouteHop) []ssh.AuthMethod {
+	// The ssh package only tries one method of each type, so all the keys must be in the same method.
+	signers := cache.identityFileSigners(hop.identityFiles)
+	signers = append(signers, cache.getKeyfileSigners()...)
+
+	auths := []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+	a := cache.getPasswordAuth(hop.SshHop)
 	if a != nil {
-		r := make([]ssh.AuthMethod, len(auths)+1)
-		copy(r, auths)
-		r[len(auths)] = a
-		auths = r
+		auths = append(auths, a)
 	}
 	return auths
 }
 
+// identityFileSigners returns signers for the IdentityFiles from the ssh config file. Encrypted keys are
+// decoded using the password set with Keypass for either the full path or the file name of the key.
+func (cache *SshClientCache) identityFileSigners(paths []string) (signers []ssh.Signer) {
+	for _, path := range paths {
+		s, ok := cache.identitySigners[path]
+		if !ok {
+			s = cache.signerForIdentityFile(path)
+			cache.identitySigners[path] = s
+		}
+		if s != nil {
+			signers = append(signers, s)
+		}
+	}
+	return
+}
+
+func (cache *SshClientCache) signerForIdentityFile(path string) ssh.Signer {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		log(LogCatgSsh, "SshClientCache: can't read IdentityFile: %v\n", err)
+		return nil
+	}
+
+	pw, ok := cache.keyfilePasswords[path]
+	if !ok {
+		pw, ok = cache.keyfilePasswords[filepath.Base(path)]
+	}
+
+	var s ssh.Signer
+	if ok {
+		log(LogCatgSsh, "Decoding IdentityFile %s using password\n", path)
+		s, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(pw))
+	} else {
+		log(LogCatgSsh, "Decoding IdentityFile %s without password\n", path)
+		s, err = ssh.ParsePrivateKey(key)
+	}
+
+	if err != nil {
+		log(LogCatgSsh, "SshClientCache: can't decode IdentityFile %s: %v. If it is encrypted, set its password using Keypass\n", path, err)
+		return nil
+	}
+	return s
+}
+
 func (cache *SshClientCache) SetSshHopPassword(user, host, port, password string) {
 	h := SshHop{User: user, Host: host, Port: port}
 	h = cache.completeHop(h)
@@ -229,6 +504,7 @@ func (cache *SshClientCache) getPasswordAuth(hop SshHop) ssh.AuthMethod {
 func (cache *SshClientCache) SetKeyfilePassword(filename, password string) {
 	cache.keyfilePasswords[filename] = password
 	cache.invalidateKeyfileAuths()
+	cache.identitySigners = map[string]ssh.Signer{}
 }
 
 func (cache *SshClientCache) AddKeyFromFile(filename string, path string) {
@@ -238,17 +514,17 @@ func (cache *SshClientCache) AddKeyFromFile(filename string, path string) {
 }
 
 func (cache *SshClientCache) invalidateKeyfileAuths() {
-	cache.keyfileAuths = nil
+	cache.keyfileSigners = nil
 }
 
-func (cache *SshClientCache) getKeyfileAuths() []ssh.AuthMethod {
-	if cache.keyfileAuths == nil {
-		cache.makeKeyfileAuths()
+func (cache *SshClientCache) getKeyfileSigners() []ssh.Signer {
+	if cache.keyfileSigners == nil {
+		cache.makeKeyfileSigners()
 	}
-	return cache.keyfileAuths
+	return cache.keyfileSigners
 }
 
-func (cache *SshClientCache) makeKeyfileAuths() {
+func (cache *SshClientCache) makeKeyfileSigners() {
 	log(LogCatgSsh, "SshClientCache: building auths\n")
 
 	signers, _ := cache.sshAgentSigners()
@@ -263,7 +539,10 @@ func (cache *SshClientCache) makeKeyfileAuths() {
 		}
 	}
 
-	cache.keyfileAuths = []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+	if signers == nil {
+		signers = []ssh.Signer{}
+	}
+	cache.keyfileSigners = signers
 }
 
 func (cache *SshClientCache) signerForKey(filename string, key []byte) ssh.Signer {
@@ -284,7 +563,11 @@ func (cache *SshClientCache) signerForKey(filename string, key []byte) ssh.Signe
 
 func (cache *SshClientCache) sshAgentSigners() ([]ssh.Signer, error) {
 	socket := os.Getenv("SSH_AUTH_SOCK")
-	conn := mylog.Check2(net.Dial("unix", socket))
+	// Not having an agent is normal
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
 
 	log(LogCatgSsh, "Adding keys from ssh agent (SSH_AUTH_SOCK)\n")
 	return agent.NewClient(conn).Signers()
@@ -313,20 +596,19 @@ func (cache *SshClientCache) Entries() []SshClientCacheEntry {
 }
 
 type SshEndpt struct {
-	Dest  SshHop
-	Proxy SshHop
+	Dest SshHop
+	// Proxies are the proxies through which Dest is reached. The first is the one that
+	// connects to Dest, and the last is the one dialed first.
+	Proxies SshHopChain
 }
 
 func (k SshEndpt) HasProxy() bool {
-	return k.Proxy.Host != ""
+	return k.Proxies != ""
 }
 
 func (k SshEndpt) String() string {
 	if k.HasProxy() {
-		return fmt.Sprintf("%s@%s:%s%%%s@%s:%s",
-			k.Dest.User, k.Dest.Host, k.Dest.Port,
-			k.Proxy.User, k.Proxy.Host, k.Proxy.Port,
-		)
+		return fmt.Sprintf("%s@%s:%s%%%s", k.Dest.User, k.Dest.Host, k.Dest.Port, k.Proxies)
 	} else {
 		return fmt.Sprintf("%s@%s:%s", k.Dest.User, k.Dest.Host, k.Dest.Port)
 	}
@@ -336,20 +618,69 @@ type SshHop struct {
 	User, Host, Port string
 }
 
+// String returns the hop in the form used in paths: (User '@')? Host (':' Port)?
+func (h SshHop) String() string {
+	s := h.Host
+	if h.User != "" {
+		s = h.User + "@" + s
+	}
+	if h.Port != "" {
+		s += ":" + h.Port
+	}
+	return s
+}
+
+// SshHopChain is a sequence of hops, each in the form returned by SshHop.String, separated by '%'.
+// It's kept as a string so that an SshEndpt can be used as a map key.
+type SshHopChain string
+
+func NewSshHopChain(hops ...SshHop) SshHopChain {
+	s := make([]string, len(hops))
+	for i, h := range hops {
+		s[i] = h.String()
+	}
+	return SshHopChain(strings.Join(s, "%"))
+}
+
+func (c SshHopChain) Hops() []SshHop {
+	if c == "" {
+		return nil
+	}
+
+	parts := strings.Split(string(c), "%")
+	hops := make([]SshHop, len(parts))
+	for i, p := range parts {
+		hops[i].User, hops[i].Host, hops[i].Port, _ = parseHop(p + ":")
+	}
+	return hops
+}
+
 type SshClientCacheEntry struct {
 	client   *SshClient
 	lastUsed time.Time
 }
 
 type SshClient struct {
-	client       *ssh.Client
-	endpt        SshEndpt
+	client *ssh.Client
+	endpt  SshEndpt
+	// id is the number the connection is listed with by the Ssh command
+	id      int
+	created time.Time
+	// lock guards forwards, replacedBy and closed
+	lock     sync.Mutex
+	forwards []*SshForward
+	// replacedBy is the connection that took over from this one when it was re-opened
+	replacedBy   *SshClient
+	closed       bool
 	listener     net.Listener
 	listenerPort int
+	unixListener net.Listener
+	unixPath     string
 	userData     interface{}
+	remoteAgent  *remoteAgentState
 }
 
-func (s SshClient) Client() *ssh.Client {
+func (s *SshClient) Client() *ssh.Client {
 	return s.client
 }
 
@@ -373,6 +704,33 @@ func (s *SshClient) ListenerPort() int {
 	return s.listenerPort
 }
 
+// UnixListener returns a listener for a Unix domain socket created on the remote host. Connections
+// to the socket are tunnelled back to us. This requires the remote sshd to allow streamlocal forwarding;
+// OpenSSH creates the socket with mode 0600 by default.
+func (s *SshClient) UnixListener() (net.Listener, error) {
+	if s.unixListener != nil {
+		return s.unixListener, nil
+	}
+
+	buf := make([]byte, 8)
+	mylog.Check2(rand.Read(buf))
+	path := fmt.Sprintf("/tmp/anvil-api-%s-%x.sock", s.endpt.Dest.User, buf)
+
+	l, err := s.client.ListenUnix(path)
+	if err != nil {
+		return nil, prefixWithSshEndpt(s.endpt, "SshClient.UnixListener", err)
+	}
+
+	s.unixListener = l
+	s.unixPath = path
+	return s.unixListener, nil
+}
+
+// UnixListenerPath returns the path of the remote Unix socket, or the empty string if none was created.
+func (s *SshClient) UnixListenerPath() string {
+	return s.unixPath
+}
+
 func (s *SshClient) SetUserData(d interface{}) {
 	s.userData = d
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testRouteSshConfig = `
+Host dev
+	HostName dev.example.com
+	User alice
+	IdentityFile /keys/dev
+
+Host inner
+	HostName inner.example.com
+	ProxyJump bastion
+
+Host bastion
+	HostName bastion.example.com
+	Port 2200
+	ProxyJump gate
+
+Host loop
+	ProxyJump loop
+
+Host *
+	User bob
+`
+
+func TestSshRoute(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(testRouteSshConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfigFile := settings.Ssh.ConfigFile
+	settings.Ssh.ConfigFile = path
+	defer func() { settings.Ssh.ConfigFile = oldConfigFile }()
+
+	tests := []struct {
+		name      string
+		endpt     SshEndpt
+		expected  []SshHop
+		expectErr bool
+	}{
+		{
+			name:     "direct",
+			endpt:    SshEndpt{Dest: SshHop{Host: "dev"}},
+			expected: []SshHop{{User: "alice", Host: "dev.example.com", Port: "22"}},
+		},
+		{
+			name: "path proxies",
+			endpt: SshEndpt{
+				Dest:    SshHop{Host: "dev", Port: "2022"},
+				Proxies: NewSshHopChain(SshHop{User: "carol", Host: "p1"}, SshHop{Host: "p2", Port: "23"}),
+			},
+			expected: []SshHop{
+				{User: "bob", Host: "p2", Port: "23"},
+				{User: "carol", Host: "p1", Port: "22"},
+				{User: "alice", Host: "dev.example.com", Port: "2022"},
+			},
+		},
+		{
+			name:  "ProxyJump",
+			endpt: SshEndpt{Dest: SshHop{Host: "inner"}},
+			expected: []SshHop{
+				{User: "bob", Host: "gate", Port: "22"},
+				{User: "bob", Host: "bastion.example.com", Port: "2200"},
+				{User: "bob", Host: "inner.example.com", Port: "22"},
+			},
+		},
+		{
+			name:      "ProxyJump loop",
+			endpt:     SshEndpt{Dest: SshHop{Host: "loop"}},
+			expectErr: true,
+		},
+	}
+
+	cache := NewSshClientCache(1)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			route, err := cache.route(tc.endpt)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error but got route %v", route)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			var hops []SshHop
+			for _, h := range route {
+				hops = append(hops, h.SshHop)
+			}
+			if !reflect.DeepEqual(hops, tc.expected) {
+				t.Fatalf("expected route %v but got %v", tc.expected, hops)
+			}
+		})
+	}
+
+	route, _ := cache.route(SshEndpt{Dest: SshHop{Host: "dev"}})
+	if !reflect.DeepEqual(route[0].identityFiles, []string{"/keys/dev"}) {
+		t.Fatalf("expected the identity files of dev but got %v", route[0].identityFiles)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	anvilagent "github.com/jeffwilliams/anvil/internal/agent"
+)
+
+// remoteAgentHelloTimeout is how long a newly started anvil-agent has to answer.
+const remoteAgentHelloTimeout = 10 * time.Second
+
+// remoteAgentDir is the directory the agent is installed in on remote hosts, relative to the home directory.
+const remoteAgentDir = ".anvil"
+
+// remoteAgentState is the anvil-agent helper running on the host of an SshClient.
+type remoteAgentState struct {
+	lock  sync.Mutex
+	agent *anvilagent.Client
+	// err is why the agent could not be started. It is not retried for the same connection.
+	err error
+}
+
+// RemoteAgent returns a client for the anvil-agent helper on the remote host, uploading and starting
+// it if it is not running.
+func (s *SshClient) RemoteAgent() (*anvilagent.Client, error) {
+	st := s.remoteAgent
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.err != nil {
+		return nil, st.err
+	}
+
+	if st.agent != nil {
+		select {
+		case <-st.agent.Done():
+			log(LogCatgSsh, "SshClient.RemoteAgent: agent on %s exited (%v). Restarting it\n", s.endpt, st.agent.Err())
+		default:
+			return st.agent, nil
+		}
+	}
+
+	st.agent, st.err = startRemoteAgent(s)
+	if st.err != nil {
+		st.err = prefixWithSshEndpt(s.endpt, "starting anvil-agent", st.err)
+		log(LogCatgSsh, "SshClient.RemoteAgent: %v\n", st.err)
+	}
+	return st.agent, st.err
+}
+
+// startRemoteAgent installs the agent on the host if needed and starts it. It only supports Unix
+// hosts, since it runs uname and POSIX shell commands. On other hosts it fails and the remote shell is
+// used instead.
+func startRemoteAgent(s *SshClient) (*anvilagent.Client, error) {
+	out, err := runRemoteCommand(s, "uname -sm", nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't determine the platform of the host: %w", err)
+	}
+
+	goos, goarch, err := parseRemotePlatform(string(out))
+	if err != nil {
+		return nil, err
+	}
+
+	local := filepath.Join(SshAgentDir(), remoteAgentBinaryName(goos, goarch))
+	bin, err := os.ReadFile(local)
+	if err != nil {
+		return nil, fmt.Errorf("no agent for %s/%s: %w", goos, goarch, err)
+	}
+
+	path := remoteAgentPath(bin)
+	if err = installRemoteAgent(s, path, bin); err != nil {
+		return nil, err
+	}
+
+	return runRemoteAgent(s, path)
+}
+
+// runRemoteCommand runs the command in a new session and returns its standard output.
+func runRemoteCommand(s *SshClient, cmd string, stdin io.Reader) ([]byte, error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	return session.Output(cmd)
+}
+
+// installRemoteAgent uploads the agent to path on the host unless it is already there. The path is
+// named after the hash of the agent so that different builds don't replace each other.
+func installRemoteAgent(s *SshClient, path string, bin []byte) error {
+	out, err := runRemoteCommand(s, fmt.Sprintf("test -x %s && echo yes", path), nil)
+	if err == nil && string(out) == "yes\n" {
+		return nil
+	}
+
+	log(LogCatgSsh, "installRemoteAgent: uploading agent to %s on %s\n", path, s.endpt)
+	tmp := path + ".tmp"
+	cmd := fmt.Sprintf("mkdir -p %s && cat > %s && chmod 755 %s && mv %s %s", remoteAgentDir, tmp, tmp, tmp, path)
+	if _, err = runRemoteCommand(s, cmd, bytes.NewReader(bin)); err != nil {
+		return fmt.Errorf("uploading the agent failed: %w", err)
+	}
+	return nil
+}
+
+func runRemoteAgent(s *SshClient, path string) (*anvilagent.Client, error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err = session.Start(path); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	a := anvilagent.NewClient(sessionConn{Reader: stdout, WriteCloser: stdin, session: session})
+
+	type hello struct {
+		version int
+		err     error
+	}
+	c := make(chan hello, 1)
+	go func() {
+		v, err := a.Hello()
+		c <- hello{v, err}
+	}()
+
+	select {
+	case h := <-c:
+		if h.err != nil {
+			a.Close()
+			return nil, h.err
+		}
+		if h.version != anvilagent.Version {
+			a.Close()
+			return nil, fmt.Errorf("agent speaks version %d of the protocol but version %d is needed", h.version, anvilagent.Version)
+		}
+	case <-time.After(remoteAgentHelloTimeout):
+		a.Close()
+		return nil, fmt.Errorf("agent did not answer")
+	}
+
+	log(LogCatgSsh, "runRemoteAgent: started agent %s on %s\n", path, s.endpt)
+	return a, nil
+}
+
+// sessionConn is the standard input and output of an ssh session.
+type sessionConn struct {
+	io.Reader
+	io.WriteCloser
+	session *ssh.Session
+}
+
+func (c sessionConn) Close() error {
+	c.WriteCloser.Close()
+	return c.session.Close()
+}
+
+// parseRemotePlatform converts the output of `uname -sm` to Go's names for the operating system and
+// architecture.
+func parseRemotePlatform(uname string) (goos, goarch string, err error) {
+	fields := strings.Fields(uname)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected output from uname: %q", uname)
+	}
+
+	goos = strings.ToLower(fields[0])
+
+	switch arch := strings.ToLower(fields[1]); {
+	case arch == "x86_64" || arch == "amd64":
+		goarch = "amd64"
+	case arch == "aarch64" || arch == "arm64":
+		goarch = "arm64"
+	case arch == "i386" || arch == "i486" || arch == "i586" || arch == "i686":
+		goarch = "386"
+	case strings.HasPrefix(arch, "armv"):
+		goarch = "arm"
+	default:
+		goarch = arch
+	}
+	return
+}
+
+// remoteAgentBinaryName is the name of the build of the agent for the platform in the agents directory.
+func remoteAgentBinaryName(goos, goarch string) string {
+	return fmt.Sprintf("anvil-agent-%s-%s", goos, goarch)
+}
+
+// remoteAgentPath is where the agent is installed on a remote host.
+func remoteAgentPath(bin []byte) string {
+	sum := sha256.Sum256(bin)
+	return remoteAgentDir + "/agent-" + hex.EncodeToString(sum[:8])
+}
+
+// remoteAgentFs performs the operations of an sshFs using the anvil-agent helper.
+type remoteAgentFs struct {
+	f      *sshFs
+	agent  *anvilagent.Client
+	client *SshClient
+}
+
+// agentFor returns the agent for the host of path and the path on that host. ok is false if the agent
+// is not enabled or could not be started, in which case the remote shell should be used.
+func (f *sshFs) agentFor(path string, kill chan struct{}) (r remoteAgentFs, file string, ok bool) {
+	if !f.remoteAgent {
+		return
+	}
+
+	client, file, err := f.splitFilenameAndDial(path, kill)
+	if err != nil {
+		return
+	}
+
+	a, err := client.RemoteAgent()
+	if err != nil {
+		return
+	}
+
+	return remoteAgentFs{f: f, agent: a, client: client}, file, true
+}
+
+func (r remoteAgentFs) fileExists(file string) (ok bool, err error) {
+	info, err := r.agent.Stat(file)
+	return info.Exists, err
+}
+
+func (r remoteAgentFs) isDir(file string) (ok bool, err error) {
+	info, err := r.agent.Stat(file)
+	return info.Exists && info.IsDir, err
+}
+
+func (r remoteAgentFs) loadFile(file string) (contents []byte, err error) {
+	return r.agent.ReadFile(file)
+}
+
+func (r remoteAgentFs) loadFileAsync(file string, contents chan []byte, errs chan error, kill chan struct{}) {
+	pr, pw := io.Pipe()
+	go func() {
+		if err := r.agent.ReadFileTo(file, pw); err != nil {
+			errs <- err
+		}
+		pw.Close()
+	}()
+
+	copyBlocks(pr, contents, 4096, errs, kill)
+	pr.Close()
+	close(errs)
+}
+
+func (r remoteAgentFs) saveFile(file string, contents []byte) (err error) {
+	return r.agent.WriteFile(file, contents)
+}
+
+func (r remoteAgentFs) filenamesInDir(file string) (names []string, err error) {
+	entries, err := r.agent.List(file)
+	if err != nil {
+		return
+	}
+
+	names = make([]string, 0, len(entries))
+	for _, e := range entries {
+		n := e.Name
+		if e.IsDir {
+			n += "/"
+		}
+		names = append(names, n)
+	}
+	return
+}
+
+// shellArgv is the argument vector that runs the command line using the shell.
+func (r remoteAgentFs) shellArgv(command string) []string {
+	return []string{r.f.getShell(), "-c", command}
+}
+
+func (r remoteAgentFs) exec(dir, command, arg string) (output []byte, err error) {
+	var out bytes.Buffer
+	err = r.agent.Run(anvilagent.ExecOptions{
+		Argv:       r.shellArgv(command + " " + arg),
+		Dir:        dir,
+		CloseStdin: true,
+		Stdout:     &out,
+	})
+	return out.Bytes(), err
+}
+
+func (r remoteAgentFs) filter(dir, command string, input []byte) (stdout, stderr []byte, err error) {
+	var out, errOut bytes.Buffer
+	err = r.agent.Run(anvilagent.ExecOptions{
+		Argv:   r.shellArgv(command),
+		Dir:    dir,
+		Stdin:  bytes.NewReader(input),
+		Stdout: &out,
+		Stderr: &errOut,
+	})
+	return out.Bytes(), errOut.Bytes(), err
+}
+
+// execAsync runs the command of c in dir and waits for it to finish. The output is sent to c.contents.
+func (r remoteAgentFs) execAsync(dir string, c execCtx) {
+	env := append([]string{}, c.extraEnv...)
+
+	var apiSess *ApiSession
+	if err := r.f.maybeServeAPIOverSshClient(r.client); err == nil {
+		apiSess, _ = createApiSession(fmt.Sprintf("%s %s", c.cmd, c.arg))
+	}
+	if apiSess != nil {
+		env = append(env,
+			fmt.Sprintf("ANVIL_API_PORT=%s", strconv.Itoa(r.client.ListenerPort())),
+			fmt.Sprintf("ANVIL_API_SESS=%s", apiSess.Id()))
+		if r.client.UnixListenerPath() != "" {
+			env = append(env, fmt.Sprintf("ANVIL_API_SOCK=%s", r.client.UnixListenerPath()))
+		}
+	}
+
+	finish := func(err error) {
+		if err != nil {
+			log(LogCatgFS, "remoteAgentFs.execAsync: command ended with error: %v\n", err)
+			c.errs <- err
+		}
+		close(c.errs)
+		if c.done != nil {
+			close(c.done)
+		}
+		if apiSess != nil {
+			deleteApiSession(apiSess.Id())
+		}
+	}
+
+	// stop is closed when the command is killed, so that output that is no longer wanted doesn't hold up
+	// the connection to the agent.
+	stop := make(chan struct{})
+	c1, c2 := mergeContentsInto(c.contents)
+	opts := anvilagent.ExecOptions{
+		Argv:   r.shellArgv(c.cmd + " " + c.arg),
+		Env:    env,
+		Dir:    dir,
+		Stdout: chanWriter{c1, stop},
+		Stderr: chanWriter{c2, stop},
+	}
+	if c.stdin != nil {
+		opts.Stdin = bytes.NewReader(c.stdin)
+	} else {
+		opts.CloseStdin = r.f.closeStdin
+	}
+
+	log(LogCatgFS, "remoteAgentFs.execAsync: running %q in %s\n", opts.Argv, dir)
+	p, err := r.agent.Start(opts)
+	if err != nil {
+		close(c1)
+		close(c2)
+		finish(err)
+		return
+	}
+	if c.started != nil {
+		c.started(p.Pid)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c.interrupt:
+				log(LogCatgFS, "remoteAgentFs.execAsync: interrupt received\n")
+				p.Signal(anvilagent.SigInt)
+			case _, ok := <-c.kill:
+				if ok {
+					log(LogCatgFS, "remoteAgentFs.execAsync: kill received\n")
+					p.Signal(anvilagent.SigKill)
+				}
+				close(stop)
+				return
+			case <-exited:
+				return
+			}
+		}
+	}()
+
+	err = p.Wait()
+	close(exited)
+	close(c1)
+	close(c2)
+	finish(err)
+}
+
+// chanWriter sends copies of what is written to it on a channel, until stop is closed.
+type chanWriter struct {
+	c    chan []byte
+	stop chan struct{}
+}
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	select {
+	case w.c <- append([]byte(nil), b...):
+	case <-w.stop:
+	}
+	return len(b), nil
+}
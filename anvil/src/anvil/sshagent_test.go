@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRemotePlatform(t *testing.T) {
+	tests := []struct {
+		uname  string
+		goos   string
+		goarch string
+	}{
+		{uname: "Linux x86_64\n", goos: "linux", goarch: "amd64"},
+		{uname: "Linux aarch64\n", goos: "linux", goarch: "arm64"},
+		{uname: "Linux armv7l\n", goos: "linux", goarch: "arm"},
+		{uname: "Darwin arm64\n", goos: "darwin", goarch: "arm64"},
+		{uname: "FreeBSD amd64\n", goos: "freebsd", goarch: "amd64"},
+		{uname: "Linux i686\n", goos: "linux", goarch: "386"},
+		{uname: "Linux riscv64\n", goos: "linux", goarch: "riscv64"},
+	}
+
+	for _, tc := range tests {
+		goos, goarch, err := parseRemotePlatform(tc.uname)
+		if err != nil || goos != tc.goos || goarch != tc.goarch {
+			t.Fatalf("%q: expected %s/%s but got %s/%s (err %v)", tc.uname, tc.goos, tc.goarch, goos, goarch, err)
+		}
+	}
+
+	if _, _, err := parseRemotePlatform("'uname' is not recognized as an internal or external command"); err == nil {
+		t.Fatalf("expected unexpected output to fail")
+	}
+}
+
+func TestRemoteAgentPath(t *testing.T) {
+	a := remoteAgentPath([]byte("build 1"))
+	b := remoteAgentPath([]byte("build 2"))
+
+	if a == b {
+		t.Fatalf("different builds have the same path %s", a)
+	}
+	if a != remoteAgentPath([]byte("build 1")) {
+		t.Fatalf("the path of a build changed")
+	}
+	// The path is used unquoted in shell commands
+	if strings.Trim(a, "abcdefghijklmnopqrstuvwxyz0123456789./-") != "" {
+		t.Fatalf("path %s has characters that need quoting", a)
+	}
+}
+
+func TestChanWriter(t *testing.T) {
+	c := make(chan []byte, 1)
+	stop := make(chan struct{})
+	w := chanWriter{c, stop}
+
+	buf := []byte("hello")
+	w.Write(buf)
+	buf[0] = 'j'
+	if got := string(<-c); got != "hello" {
+		t.Fatalf("expected a copy of the data but got %q", got)
+	}
+
+	close(stop)
+	w.Write(buf)
+	if n, err := w.Write(buf); n != len(buf) || err != nil {
+		t.Fatalf("write after stop returned %d, %v", n, err)
+	}
+}
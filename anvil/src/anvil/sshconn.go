@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshWindowName is the name of the window that the Ssh command lists the connections in.
+const sshWindowName = "+Ssh"
+
+// keepalive probes the cached connections every Ssh.KeepaliveInterval seconds and re-opens the ones that
+// were lost. Connections that can't be re-opened are closed.
+func (cache *SshClientCache) keepalive() {
+	for {
+		interval := time.Duration(settings.Ssh.KeepaliveInterval) * time.Second
+		if interval <= 0 {
+			// Disabled, but the setting may be changed
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+		cache.checkConnections()
+	}
+}
+
+// checkConnections probes the cached connections and re-opens the ones that were lost.
+func (cache *SshClientCache) checkConnections() {
+	for _, e := range cache.Entries() {
+		if cache.isValid(e.client.Client()) {
+			continue
+		}
+
+		log(LogCatgSsh, "SshClientCache.keepalive: connection to %s was lost\n", e.client.endpt)
+		hadForwards := len(e.client.Forwards()) > 0
+		_, err := cache.Reconnect(e.client)
+		if err == nil {
+			continue
+		}
+
+		msg := fmt.Sprintf("The ssh connection to %s was lost and could not be re-opened: %v\n", e.client.endpt, err)
+		if hadForwards {
+			msg += "Its port forwards were closed.\n"
+		}
+		editor.WorkChan() <- basicWork{func() {
+			editor.AppendError("", msg)
+		}}
+	}
+}
+
+// Find returns the connection with the number in the list shown by the Ssh command, or whose endpoint or
+// destination host is name.
+func (cache *SshClientCache) Find(name string) (client *SshClient, ok bool) {
+	id, err := strconv.Atoi(name)
+	isId := err == nil
+
+	var byHost []*SshClient
+	for _, e := range cache.Entries() {
+		c := e.client
+		switch {
+		case isId && c.id == id, c.endpt.String() == name:
+			return c, true
+		case c.endpt.Dest.Host == name:
+			byHost = append(byHost, c)
+		}
+	}
+
+	if len(byHost) == 1 {
+		return byHost[0], true
+	}
+	return nil, false
+}
+
+// Close closes the connection and removes it from the cache.
+func (cache *SshClientCache) Close(client *SshClient) error {
+	cache.lock.Lock()
+	if e, ok := cache.data[client.endpt]; ok && e.client == client {
+		delete(cache.data, client.endpt)
+	}
+	cache.lock.Unlock()
+
+	return client.Close()
+}
+
+// Cached returns the cached connection to the endpoint without checking it, or nil if there is none.
+func (cache *SshClientCache) Cached(endpt SshEndpt) *SshClient {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.data[endpt].client
+}
+
+// Reconnect replaces the connection with a new connection to the same endpoint, which keeps its number
+// and port forwards. If the new connection can't be made the old one is closed.
+func (cache *SshClientCache) Reconnect(old *SshClient) (client *SshClient, err error) {
+	return cache.reconnect(old, nil)
+}
+
+func (cache *SshClientCache) reconnect(old *SshClient, kill chan struct{}) (client *SshClient, err error) {
+	current := func() (*SshClient, error) {
+		e, ok := cache.data[old.endpt]
+		if !ok {
+			return nil, fmt.Errorf("the connection to %s is closed", old.endpt)
+		}
+		return e.client, nil
+	}
+
+	cache.lock.Lock()
+	client, err = current()
+	cache.lock.Unlock()
+	if err != nil || client != old {
+		// It was closed, or already re-opened by someone else
+		return
+	}
+
+	// The cache isn't locked while dialing so that connections to other endpoints may be used meanwhile
+	log(LogCatgSsh, "SshClientCache: re-opening connection to %s\n", old.endpt)
+	var c *ssh.Client
+	err = errorOfPanic(func() (err error) {
+		c, err = cache.dial(old.endpt, kill)
+		return
+	})
+	if err != nil {
+		cache.Close(old)
+		return nil, err
+	}
+
+	cache.lock.Lock()
+	client, err = current()
+	if err != nil || client != old {
+		cache.lock.Unlock()
+		c.Close()
+		return
+	}
+	client = newSshClient(c, old.endpt, old.id)
+	cache.data[old.endpt] = SshClientCacheEntry{client: client, lastUsed: time.Now()}
+	cache.lock.Unlock()
+
+	client.takeForwardsFrom(old)
+	old.Close()
+	return
+}
+
+// Unforward closes the port forward with the id.
+func (cache *SshClientCache) Unforward(id int) error {
+	for _, e := range cache.Entries() {
+		if e.client.Unforward(id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("there is no port forward %d", id)
+}
+
+// errorOfPanic runs op and returns its error, or the value it panicked with as an error. The ssh code
+// reports errors by panicking, which must not bring down the editor when it runs in the background.
+func errorOfPanic(op func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return op()
+}
+
+// Close closes the connection and its port forwards.
+func (s *SshClient) Close() error {
+	s.lock.Lock()
+	forwards := s.forwards
+	s.forwards = nil
+	s.closed = true
+	s.lock.Unlock()
+
+	for _, f := range forwards {
+		f.listener.Close()
+	}
+	return s.client.Close()
+}
+
+// Forwards returns the port forwards made through the connection.
+func (s *SshClient) Forwards() []*SshForward {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*SshForward(nil), s.forwards...)
+}
+
+// sshForwardIds are the numbers given to port forwards.
+var sshForwardIds atomic.Int32
+
+// SshForward is a port forwarded through an ssh connection. A local forward listens on the local host and
+// makes connections to Target from the remote host. A remote forward listens on the remote host and makes
+// connections to Target from the local host.
+type SshForward struct {
+	Id     int
+	Remote bool
+	Listen string
+	Target string
+
+	listener net.Listener
+}
+
+// Forward starts forwarding connections to the address listen to the address target. If remote is
+// false listen is on the local host and target is reached from the remote host, and if remote is true it
+// is the other way round.
+func (s *SshClient) Forward(remote bool, listen, target string) (*SshForward, error) {
+	return s.forward(int(sshForwardIds.Add(1)), remote, listen, target)
+}
+
+func (s *SshClient) forward(id int, remote bool, listen, target string) (f *SshForward, err error) {
+	var l net.Listener
+	if remote {
+		l, err = s.client.Listen("tcp", listen)
+	} else {
+		l, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		if next := s.replacement(); next != nil {
+			// The connection was lost and re-opened while listening
+			return next.forward(id, remote, listen, target)
+		}
+		return
+	}
+
+	f = &SshForward{Id: id, Remote: remote, Listen: listen, Target: target, listener: l}
+	s.lock.Lock()
+	next, closed := s.replacedBy, s.closed
+	if next == nil && !closed {
+		s.forwards = append(s.forwards, f)
+	}
+	s.lock.Unlock()
+
+	switch {
+	case next != nil:
+		// The connection was re-opened after its forwards were moved to the new one, so this one
+		// must be moved as well.
+		l.Close()
+		return next.forward(id, remote, listen, target)
+	case closed:
+		l.Close()
+		return nil, fmt.Errorf("the connection to %s is closed", s.endpt)
+	}
+
+	log(LogCatgSsh, "SshClient.forward: forwarding %s to %s over %s (remote: %v)\n", listen, target, s.endpt, remote)
+	go f.serve(s)
+	return
+}
+
+func (s *SshClient) replacement() *SshClient {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.replacedBy
+}
+
+// takeForwardsFrom closes the port forwards of old and starts them again on the connection. Forwards
+// made on old afterwards are made on the connection instead.
+func (s *SshClient) takeForwardsFrom(old *SshClient) {
+	old.lock.Lock()
+	forwards := old.forwards
+	old.forwards = nil
+	old.replacedBy = s
+	old.lock.Unlock()
+
+	for _, f := range forwards {
+		f.listener.Close()
+		if _, err := s.forward(f.Id, f.Remote, f.Listen, f.Target); err != nil {
+			msg := fmt.Sprintf("Port forward %d from %s to %s could not be restarted after re-opening the ssh connection to %s: %v\n",
+				f.Id, f.Listen, f.Target, s.endpt, err)
+			go func() {
+				editor.WorkChan() <- basicWork{func() {
+					editor.AppendError("", msg)
+				}}
+			}()
+		}
+	}
+}
+
+// Unforward closes the port forward with the id, and returns false if it is not made through the connection.
+func (s *SshClient) Unforward(id int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, f := range s.forwards {
+		if f.Id == id {
+			f.listener.Close()
+			s.forwards = append(s.forwards[:i], s.forwards[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (f *SshForward) serve(s *SshClient) {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			log(LogCatgSsh, "SshForward.serve: forward %d stopped: %v\n", f.Id, err)
+			return
+		}
+		go f.connect(s, conn)
+	}
+}
+
+func (f *SshForward) connect(s *SshClient, conn net.Conn) {
+	defer conn.Close()
+
+	var target net.Conn
+	var err error
+	if f.Remote {
+		target, err = net.Dial("tcp", f.Target)
+	} else {
+		target, err = s.client.Dial("tcp", f.Target)
+	}
+	if err != nil {
+		log(LogCatgSsh, "SshForward.connect: forward %d can't connect to %s: %v\n", f.Id, f.Target, err)
+		return
+	}
+	defer target.Close()
+
+	// When either side is done, closing both ends the other copy
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// sshForwardAddrs returns the addresses to listen on and connect to for a port forward. A port alone is
+// taken to be on the loopback interface.
+func sshForwardAddrs(listen, target string) (string, string, error) {
+	addr := func(s, host string) (string, error) {
+		if _, err := strconv.ParseUint(s, 10, 16); err == nil {
+			return net.JoinHostPort(host, s), nil
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+
+	l, err := addr(listen, "127.0.0.1")
+	if err != nil {
+		return "", "", err
+	}
+	t, err := addr(target, "localhost")
+	if err != nil {
+		return "", "", err
+	}
+	return l, t, nil
+}
+
+// sshConnection describes a cached connection for listing.
+type sshConnection struct {
+	id       int
+	endpt    SshEndpt
+	created  time.Time
+	lastUsed time.Time
+	forwards []*SshForward
+}
+
+// ShowSshConnections lists the cached ssh connections in the Ssh window.
+func (e *Editor) ShowSshConnections() {
+	var conns []sshConnection
+	for _, en := range sshClientCache.Entries() {
+		c := en.client
+		conns = append(conns, sshConnection{c.id, c.endpt, c.created, en.lastUsed, c.Forwards()})
+	}
+
+	w := e.FindOrCreateWindow(sshWindowName)
+	if w == nil {
+		return
+	}
+
+	w.SetFilenameAndTag(sshWindowName, typeFile)
+	w.Body.SetTextString(formatSshConnections(conns, time.Now()))
+	w.markTextAsUnchanged()
+	w.GrowIfBodyTooSmall()
+}
+
+// formatSshConnections formats the connections as a table ordered by number, followed by a table of
+// their port forwards. The rows have commands to manage them.
+func formatSshConnections(conns []sshConnection, now time.Time) string {
+	if len(conns) == 0 {
+		return "No ssh connections\n"
+	}
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].id < conns[j].id
+	})
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Conn\tEndpoint\tAge\tIdle\t\n")
+	forwards := 0
+	for _, c := range conns {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t◊Ssh reconnect %d◊ ◊Ssh close %d◊\n", c.id, c.endpt,
+			now.Sub(c.created).Round(time.Second), now.Sub(c.lastUsed).Round(time.Second), c.id, c.id)
+		forwards += len(c.forwards)
+	}
+	tw.Flush()
+
+	if forwards == 0 {
+		return buf.String()
+	}
+
+	fmt.Fprintf(&buf, "\n")
+	fmt.Fprintf(tw, "Forward\tConn\tKind\tListen\tTarget\t\n")
+	for _, c := range conns {
+		for _, f := range c.forwards {
+			kind := "local"
+			if f.Remote {
+				kind = "remote"
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t◊Ssh unforward %d◊\n", f.Id, c.id, kind, f.Listen, f.Target, f.Id)
+		}
+	}
+	tw.Flush()
+
+	return buf.String()
+}
+
+// retryIfDisconnected runs op, which uses the connection to the host of path. If op fails and the
+// connection turns out to have been lost, op is run once more on a new connection, so op must be safe
+// to repeat.
+func (f *sshFs) retryIfDisconnected(path string, op func() error) error {
+	endpt, _, err := f.splitFilenameAndEndpt(path)
+	if err != nil {
+		return op()
+	}
+
+	before := sshClientCache.Cached(endpt)
+	err = errorOfPanic(op)
+	if err == nil || before == nil {
+		return err
+	}
+
+	// Getting the connection probes it and re-opens it if it was lost
+	var after *SshClient
+	if errorOfPanic(func() (err error) {
+		after, err = sshClientCache.Get(endpt, nil)
+		return
+	}) != nil || after == before {
+		return err
+	}
+
+	log(LogCatgFS, "sshFs: connection to %s was lost. Retrying on a new connection\n", endpt)
+	return errorOfPanic(op)
+}
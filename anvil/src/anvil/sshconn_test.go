@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffwilliams/anvil/internal/hostkeys"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSshForwardAddrs(t *testing.T) {
+	tests := []struct {
+		listen, target       string
+		expListen, expTarget string
+		expectErr            bool
+	}{
+		{listen: "8080", target: "3000", expListen: "127.0.0.1:8080", expTarget: "localhost:3000"},
+		{listen: "0.0.0.0:8080", target: "db.internal:5432", expListen: "0.0.0.0:8080", expTarget: "db.internal:5432"},
+		{listen: "[::1]:8080", target: "3000", expListen: "[::1]:8080", expTarget: "localhost:3000"},
+		{listen: "8080", target: "db.internal", expectErr: true},
+		{listen: "99999", target: "3000", expectErr: true},
+	}
+
+	for _, tc := range tests {
+		l, target, err := sshForwardAddrs(tc.listen, tc.target)
+		if tc.expectErr {
+			if err == nil {
+				t.Fatalf("%s %s: expected an error", tc.listen, tc.target)
+			}
+			continue
+		}
+		if err != nil || l != tc.expListen || target != tc.expTarget {
+			t.Fatalf("%s %s: expected %s %s but got %s %s (err %v)", tc.listen, tc.target, tc.expListen, tc.expTarget, l, target, err)
+		}
+	}
+}
+
+func TestFormatSshConnections(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if got := formatSshConnections(nil, now); got != "No ssh connections\n" {
+		t.Fatalf("unexpected text for no connections: %q", got)
+	}
+
+	conns := []sshConnection{
+		{
+			id:       2,
+			endpt:    SshEndpt{Dest: SshHop{User: "bob", Host: "dev", Port: "22"}},
+			created:  now.Add(-90 * time.Second),
+			lastUsed: now.Add(-5 * time.Second),
+			forwards: []*SshForward{
+				{Id: 1, Listen: "127.0.0.1:8080", Target: "localhost:3000"},
+				{Id: 3, Remote: true, Listen: "127.0.0.1:9000", Target: "localhost:9000"},
+			},
+		},
+		{
+			id:       1,
+			endpt:    SshEndpt{Dest: SshHop{User: "bob", Host: "build", Port: "22"}},
+			created:  now.Add(-time.Hour),
+			lastUsed: now.Add(-time.Minute),
+		},
+	}
+
+	expected := "" +
+		"Conn  Endpoint      Age     Idle  \n" +
+		"1     bob@build:22  1h0m0s  1m0s  ◊Ssh reconnect 1◊ ◊Ssh close 1◊\n" +
+		"2     bob@dev:22    1m30s   5s    ◊Ssh reconnect 2◊ ◊Ssh close 2◊\n" +
+		"\n" +
+		"Forward  Conn  Kind    Listen          Target          \n" +
+		"1        2     local   127.0.0.1:8080  localhost:3000  ◊Ssh unforward 1◊\n" +
+		"3        2     remote  127.0.0.1:9000  localhost:9000  ◊Ssh unforward 3◊\n"
+	if got := formatSshConnections(conns, now); got != expected {
+		t.Fatalf("expected\n%s\nbut got\n%s", expected, got)
+	}
+}
+
+func TestErrorOfPanic(t *testing.T) {
+	if err := errorOfPanic(func() error { return nil }); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	e := errors.New("failed")
+	if err := errorOfPanic(func() error { return e }); err != e {
+		t.Fatalf("expected the returned error but got %v", err)
+	}
+
+	err := errorOfPanic(func() error { panic("connection lost") })
+	if err == nil || err.Error() != "connection lost" {
+		t.Fatalf("expected the panic as an error but got %v", err)
+	}
+}
+
+// testSshServer is an in-process ssh server that accepts any client. Its connections can be dropped to
+// make clients lose their connection.
+type testSshServer struct {
+	listener net.Listener
+	conf     *ssh.ServerConfig
+
+	lock  sync.Mutex
+	conns []net.Conn
+	// held is closed to let handshakes that are being held up go ahead
+	held     chan struct{}
+	accepted chan struct{}
+}
+
+func startTestSshServer(t *testing.T) *testSshServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key failed: %v", err)
+	}
+	key, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("making signer failed: %v", err)
+	}
+
+	srv := &testSshServer{conf: &ssh.ServerConfig{NoClientAuth: true}, accepted: make(chan struct{}, 10)}
+	srv.conf.AddHostKey(key)
+
+	srv.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(srv.stop)
+
+	go srv.serve()
+	return srv
+}
+
+func (srv *testSshServer) serve() {
+	for {
+		c, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		srv.lock.Lock()
+		srv.conns = append(srv.conns, c)
+		held := srv.held
+		srv.lock.Unlock()
+		srv.accepted <- struct{}{}
+
+		go func() {
+			if held != nil {
+				<-held
+			}
+			_, chans, reqs, err := ssh.NewServerConn(c, srv.conf)
+			if err != nil {
+				c.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "no channels")
+			}
+		}()
+	}
+}
+
+// holdHandshakes holds up the handshakes of new connections until the returned function is called.
+func (srv *testSshServer) holdHandshakes() (release func()) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.held = make(chan struct{})
+	return func() { close(srv.held) }
+}
+
+func (srv *testSshServer) dropConnections() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for _, c := range srv.conns {
+		c.Close()
+	}
+	srv.conns = nil
+}
+
+func (srv *testSshServer) stop() {
+	srv.listener.Close()
+	srv.dropConnections()
+}
+
+func (srv *testSshServer) endpt() SshEndpt {
+	host, port, _ := net.SplitHostPort(srv.listener.Addr().String())
+	return SshEndpt{Dest: SshHop{User: "test", Host: host, Port: port}}
+}
+
+// useTestSshClientCache makes the ssh client cache a new one that connects to test servers, and returns it
+// along with the channel that the editor receives work from.
+func useTestSshClientCache(t *testing.T) (*SshClientCache, chan Work) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	oldSettings := settings.Ssh
+	settings.Ssh.ConfigFile = "none"
+	settings.Ssh.KeepaliveInterval = 0
+
+	verifier := sshHostKeyVerifier()
+	oldPolicy := verifier.Policy()
+	verifier.SetPolicy(hostkeys.PolicyInsecure)
+
+	oldCache, oldEditor := sshClientCache, editor
+	work := make(chan Work, 10)
+	sshClientCache = NewSshClientCache(5)
+	editor = &Editor{work: work}
+	// The tests check the connections themselves rather than in the background
+	sshClientCache.keepaliveOnce.Do(func() {})
+
+	t.Cleanup(func() {
+		for _, e := range sshClientCache.Entries() {
+			e.client.Close()
+		}
+		settings.Ssh = oldSettings
+		verifier.SetPolicy(oldPolicy)
+		sshClientCache, editor = oldCache, oldEditor
+	})
+	return sshClientCache, work
+}
+
+func forwardIds(forwards []*SshForward) (ids []int) {
+	for _, f := range forwards {
+		ids = append(ids, f.Id)
+	}
+	return
+}
+
+func TestSshClientCacheReconnect(t *testing.T) {
+	srv := startTestSshServer(t)
+	cache, _ := useTestSshClientCache(t)
+	endpt := srv.endpt()
+
+	c1, err := cache.Get(endpt, nil)
+	if err != nil {
+		t.Fatalf("connecting failed: %v", err)
+	}
+	if c, _ := cache.Get(endpt, nil); c != c1 {
+		t.Fatalf("a working connection was not reused")
+	}
+
+	f1, err := c1.Forward(false, "127.0.0.1:0", "localhost:1")
+	if err != nil {
+		t.Fatalf("forwarding failed: %v", err)
+	}
+
+	srv.dropConnections()
+	c2, err := cache.Get(endpt, nil)
+	if err != nil {
+		t.Fatalf("re-opening the lost connection failed: %v", err)
+	}
+	if c2 == c1 || c2.id != c1.id {
+		t.Fatalf("expected a new connection with the number %d but got connection %d", c1.id, c2.id)
+	}
+	if ids := forwardIds(c2.Forwards()); len(ids) != 1 || ids[0] != f1.Id {
+		t.Fatalf("expected forward %d to be moved to the new connection but it has %v", f1.Id, ids)
+	}
+	if len(c1.Forwards()) != 0 {
+		t.Fatalf("the old connection still has forwards")
+	}
+
+	// A forward made through the old connection after it was replaced ends up on the new one
+	f2, err := c1.Forward(false, "127.0.0.1:0", "localhost:2")
+	if err != nil {
+		t.Fatalf("forwarding through the replaced connection failed: %v", err)
+	}
+	if ids := forwardIds(c2.Forwards()); len(ids) != 2 || ids[1] != f2.Id {
+		t.Fatalf("expected forward %d to be made on the new connection but it has %v", f2.Id, ids)
+	}
+
+	// Reconnecting a connection that was already replaced returns the replacement
+	if c, err := cache.Reconnect(c1); err != nil || c != c2 {
+		t.Fatalf("reconnecting the replaced connection returned %v, %v", c, err)
+	}
+}
+
+func TestSshClientCacheReconnectDoesNotLockCache(t *testing.T) {
+	srv := startTestSshServer(t)
+	other := startTestSshServer(t)
+	cache, _ := useTestSshClientCache(t)
+
+	c1, err := cache.Get(srv.endpt(), nil)
+	if err != nil {
+		t.Fatalf("connecting failed: %v", err)
+	}
+	<-srv.accepted
+
+	release := srv.holdHandshakes()
+	type result struct {
+		client *SshClient
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := cache.Reconnect(c1)
+		done <- result{c, err}
+	}()
+
+	// Wait until the new connection is being made
+	select {
+	case <-srv.accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the connection was not re-opened")
+	}
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := cache.Get(other.endpt(), nil)
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Fatalf("connecting to another server failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connecting to another server was blocked while re-opening a connection")
+	}
+
+	release()
+	r := <-done
+	if r.err != nil || r.client == c1 || cache.Cached(srv.endpt()) != r.client {
+		t.Fatalf("reconnecting returned %v, %v", r.client, r.err)
+	}
+}
+
+func TestSshClientCacheKeepalive(t *testing.T) {
+	srv := startTestSshServer(t)
+	cache, work := useTestSshClientCache(t)
+	endpt := srv.endpt()
+
+	c1, err := cache.Get(endpt, nil)
+	if err != nil {
+		t.Fatalf("connecting failed: %v", err)
+	}
+
+	cache.checkConnections()
+	if cache.Cached(endpt) != c1 {
+		t.Fatalf("a working connection was replaced")
+	}
+
+	srv.dropConnections()
+	cache.checkConnections()
+	c2 := cache.Cached(endpt)
+	if c2 == nil || c2 == c1 || c2.id != c1.id {
+		t.Fatalf("the lost connection was not re-opened")
+	}
+
+	if _, err := c2.Forward(false, "127.0.0.1:0", "localhost:1"); err != nil {
+		t.Fatalf("forwarding failed: %v", err)
+	}
+
+	srv.stop()
+	cache.checkConnections()
+	if c := cache.Cached(endpt); c != nil {
+		t.Fatalf("the connection that could not be re-opened is still cached")
+	}
+	if len(c2.Forwards()) != 0 {
+		t.Fatalf("the forwards of the closed connection are still open")
+	}
+
+	select {
+	case <-work:
+	default:
+		t.Fatalf("the lost connection was not reported")
+	}
+}
+
+func TestRetryIfDisconnected(t *testing.T) {
+	srv := startTestSshServer(t)
+	cache, _ := useTestSshClientCache(t)
+	endpt := srv.endpt()
+	path := fmt.Sprintf("%s@%s:%s:/tmp", endpt.Dest.User, endpt.Dest.Host, endpt.Dest.Port)
+
+	c1, err := cache.Get(endpt, nil)
+	if err != nil {
+		t.Fatalf("connecting failed: %v", err)
+	}
+
+	var clients []*SshClient
+	op := func() error {
+		c := cache.Cached(endpt)
+		clients = append(clients, c)
+		_, _, err := c.Client().SendRequest("test", true, nil)
+		return err
+	}
+
+	f := NewSshFs(sshFsOpts{})
+	srv.dropConnections()
+	if err := f.retryIfDisconnected(path, op); err != nil {
+		t.Fatalf("the operation was not retried on a new connection: %v", err)
+	}
+	if len(clients) != 2 || clients[0] != c1 || clients[1] == c1 {
+		t.Fatalf("expected the operation to be run on the lost and then the new connection")
+	}
+
+	// Failures that aren't due to a lost connection are not retried
+	calls := 0
+	failed := errors.New("failed")
+	err = f.retryIfDisconnected(path, func() error {
+		calls++
+		return failed
+	})
+	if err != failed || calls != 1 {
+		t.Fatalf("expected one failed call but got %d calls returning %v", calls, err)
+	}
+}
@@ -62,6 +62,8 @@ type EditorState struct {
 	Cols        []*ColState
 	RecentFiles []string
 	Marks       MarkState
+	Jumps       *JumpListState
+	Breakpoints map[string][]int
 }
 
 func (e *Editor) State() *EditorState {
@@ -80,6 +82,8 @@ func (e *Editor) State() *EditorState {
 		Cols:        cols,
 		RecentFiles: editor.recentFiles.All(),
 		Marks:       editor.Marks.State(),
+		Jumps:       editor.Jumps.State(),
+		Breakpoints: editor.Debugger.Breakpoints.State(),
 	}
 
 	// e.focusedEditable
@@ -119,6 +123,8 @@ func (e *Editor) SetState(state *EditorState) error {
 	}
 
 	editor.Marks.SetState(state.Marks)
+	editor.Jumps.SetState(state.Jumps)
+	editor.Debugger.Breakpoints.SetState(state.Breakpoints)
 
 	return nil
 }
@@ -184,6 +190,8 @@ type WindowState struct {
 	Id                 int
 	CloneIds           []int
 	ManualHighlighting []ManualHighlightingInterval
+	WrapMode           wrapMode
+	WrapColumn         int
 }
 
 type ManualHighlightingInterval struct {
@@ -220,6 +228,8 @@ func (w *Window) State() *WindowState {
 		Id:                 w.Id,
 		CloneIds:           cloneIds,
 		ManualHighlighting: manualHighlighting,
+		WrapMode:           w.Body.WrapMode(),
+		WrapColumn:         w.Body.WrapColumn(),
 	}
 }
 
@@ -232,6 +242,7 @@ func (w *Window) SetState(state *WindowState) error {
 	w.initialTagUserArea = ""
 	w.SetFilenameAndTag(state.File, state.FileType)
 	w.Body.SetState(state.Body)
+	w.Body.SetWrap(state.WrapMode, state.WrapColumn)
 	if state.Body.Text == "" {
 		w.GetWithSelect(dontSelectText, dontGrowBodyIfTooSmall)
 	}
@@ -348,11 +359,15 @@ type CommandHistoryState struct {
 }
 
 type CommandHistoryEntryState struct {
-	Cmd     string
-	Started time.Time
-	Ended   time.Time
-	State   RunState
-	Dir     string
+	Id          int
+	Cmd         string
+	Started     time.Time
+	Ended       time.Time
+	State       RunState
+	Dir         string
+	ExitCode    int
+	ExitCodeSet bool
+	Pinned      bool
 }
 
 func (c CommandHistory) State() *CommandHistoryState {
@@ -360,14 +375,18 @@ func (c CommandHistory) State() *CommandHistoryState {
 		Cmds: []CommandHistoryEntryState{},
 	}
 
-	c.cmds.Each(func(v *CommandHistoryEntry) {
+	c.each(func(v *CommandHistoryEntry) {
 		log(LogCatgApp, "CommandHistory.State: found a cmd entry\n")
 		st := CommandHistoryEntryState{
-			Cmd:     v.cmd,
-			Started: v.started,
-			Ended:   v.ended,
-			State:   v.state,
-			Dir:     v.dir,
+			Id:          v.id,
+			Cmd:         v.cmd,
+			Started:     v.started,
+			Ended:       v.ended,
+			State:       v.state,
+			Dir:         v.dir,
+			ExitCode:    v.exitCode,
+			ExitCodeSet: v.exitCodeSet,
+			Pinned:      v.pinned,
 		}
 
 		state.Cmds = append(state.Cmds, st)
@@ -383,17 +402,30 @@ func (c *CommandHistory) SetState(state *CommandHistoryState) {
 
 	for _, scmd := range state.Cmds {
 		e := &CommandHistoryEntry{
-			cmd:     scmd.Cmd,
-			started: scmd.Started,
-			ended:   scmd.Ended,
-			state:   scmd.State,
-			dir:     scmd.Dir,
+			id:          scmd.Id,
+			cmd:         scmd.Cmd,
+			started:     scmd.Started,
+			ended:       scmd.Ended,
+			state:       scmd.State,
+			dir:         scmd.Dir,
+			exitCode:    scmd.ExitCode,
+			exitCodeSet: scmd.ExitCodeSet,
+			pinned:      scmd.Pinned,
 		}
 
+		// State saved by older versions has no ids
+		if e.id <= c.nextId {
+			e.id = c.nextId + 1
+		}
+		c.nextId = e.id
+
 		if e.state == Running {
 			e.state = Orphaned
 		}
 
 		c.cmds.Add(e)
+		if e.pinned {
+			c.addPinned(e)
+		}
 	}
 }
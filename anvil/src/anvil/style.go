@@ -43,6 +43,12 @@ type Style struct {
 	Ansi                      AnsiStyle
 	LineSpacing               int
 	TextLeftPadding           int
+	MarkColor                 Color
+	BreakpointColor           Color
+	DebugLineColor            Color
+	TestPassColor             Color
+	TestFailColor             Color
+	TestOtherColor            Color
 }
 
 type FontStyle struct {
@@ -63,6 +69,25 @@ type SyntaxStyle struct {
 	SubheadingColor   Color
 	InsertedColor     Color
 	DeletedColor      Color
+	// Theme maps the names of classes of syntax tokens, such as "Keyword", "LiteralString" or
+	// "NameFunction", to the style used for them. A token uses the style of its own class if there is
+	// one, and otherwise the style of the class it is a subclass of. Tokens with no style in the theme
+	// use the colors above.
+	Theme map[string]TokenStyle `json:",omitempty"`
+}
+
+// TokenStyle is the style of a class of syntax tokens. If Color is not set the token is drawn
+// using the color it would have had without the style.
+type TokenStyle struct {
+	Color *Color `json:",omitempty"`
+	TextDecoration
+}
+
+// TextDecoration is how text is drawn in addition to its color.
+type TextDecoration struct {
+	Bold      bool `json:",omitempty"`
+	Italic    bool `json:",omitempty"`
+	Underline bool `json:",omitempty"`
 }
 
 type AnsiStyle struct {
@@ -96,6 +121,9 @@ func (s Style) tagEditableStyle() editableStyle {
 		},
 		TabStopInterval: s.TabStopInterval,
 		TextLeftPadding: s.TextLeftPadding,
+		MarkColor:       s.MarkColor,
+		BreakpointColor: s.BreakpointColor,
+		DebugLineColor:  s.DebugLineColor,
 	}
 }
 
@@ -133,6 +161,9 @@ func (s Style) bodyEditableStyle() editableStyle {
 		},
 		TabStopInterval: s.TabStopInterval,
 		TextLeftPadding: s.TextLeftPadding,
+		MarkColor:       s.MarkColor,
+		BreakpointColor: s.BreakpointColor,
+		DebugLineColor:  s.DebugLineColor,
 	}
 }
 
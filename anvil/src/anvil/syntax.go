@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 	"unicode/utf8"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/alecthomas/chroma/lexers"
 	"github.com/ddkwork/golibrary/mylog"
 
+	"github.com/jeffwilliams/anvil/internal/inclex"
 	"github.com/jeffwilliams/anvil/internal/intvl"
 	"github.com/jeffwilliams/syn"
 	synlexers "github.com/jeffwilliams/syn/lexers"
@@ -18,10 +20,25 @@ import (
 type SyntaxInterval struct {
 	start, end int
 	color      Color
+	// plain is true if the text is drawn in the normal text color rather than color
+	plain      bool
+	decoration TextDecoration
 }
 
 func NewSyntaxInterval(start, end int, color Color) *SyntaxInterval {
-	return &SyntaxInterval{start, end, color}
+	return &SyntaxInterval{start: start, end: end, color: color}
+}
+
+// NewStyledSyntaxInterval returns a SyntaxInterval for text drawn with the style. If the style has
+// no color the text is drawn using the normal text color.
+func NewStyledSyntaxInterval(start, end int, style TokenStyle) *SyntaxInterval {
+	s := &SyntaxInterval{start: start, end: end, decoration: style.TextDecoration}
+	if style.Color != nil {
+		s.color = *style.Color
+	} else {
+		s.plain = true
+	}
+	return s
 }
 
 func (s SyntaxInterval) Start() int {
@@ -36,14 +53,23 @@ func (s SyntaxInterval) Color() Color {
 	return s.color
 }
 
+// Plain returns true if the text is drawn using the normal text color.
+func (s SyntaxInterval) Plain() bool {
+	return s.plain
+}
+
+func (s SyntaxInterval) Decoration() TextDecoration {
+	return s.decoration
+}
+
 func NewSyntaxHighlighter(style SyntaxStyle) Highlighter {
 	/*
 		return &chromaHighlighter{
 			style: style,
 		}*/
-	return &synHighlighter{
-		style: style,
-	}
+	h := &synHighlighter{}
+	h.SetStyle(style)
+	return h
 }
 
 type Highlighter interface {
@@ -57,10 +83,18 @@ type AnalyzingHighlighter interface {
 	SetAnalyse(analyse bool)
 }
 
-type StatableHighlighter interface {
-	Next() (intvl.Interval, error)
-	State() interface{}
-	SetState(state interface{})
+// IncrementalHighlighter is a Highlighter that only highlights the text again from around where it was
+// changed, and that can highlight the start of the text before the rest of it.
+type IncrementalHighlighter interface {
+	Highlighter
+	// TextChanged records a change made to the text since it was last passed to SetText.
+	TextChanged(c TextChange)
+	// SetText sets the text to highlight.
+	SetText(text string)
+	// HighlightUntil highlights the text set using SetText up to at least the rune index until, or all of
+	// it if until is negative. The intervals returned cover all of the text, but past the part highlighted
+	// they are the ones from before the text was changed. complete is true if the whole text is highlighted.
+	HighlightUntil(until int, ctx context.Context) (seq []intvl.Interval, complete bool, err error)
 }
 
 type chromaHighlighter struct {
@@ -208,9 +242,26 @@ type synHighlighter struct {
 	style    SyntaxStyle
 	filename string
 	language string
+
+	// theme is style.Theme keyed by token type
+	theme map[syn.TokenType]TokenStyle
+
+	// inc is the incremental lexer for the text last set using SetText. It's replaced when the
+	// language changes, and is guarded by incLock since it's used by the background highlighter.
+	incLock sync.Mutex
+	inc     *inclex.Lexer
 }
 
-func (s synHighlighter) Highlight(text string, ctx context.Context) (seq []intvl.Interval, err error) {
+const (
+	// syntaxCheckpointInterval is the number of lines between the points the lexer state is saved at
+	// so that highlighting can resume from there when the text is changed.
+	syntaxCheckpointInterval = 100
+	// syntaxLookbehind is the number of lines before a change that are highlighted again, since a
+	// change may affect how the text a bit before it is lexed.
+	syntaxLookbehind = 50
+)
+
+func (s *synHighlighter) Highlight(text string, ctx context.Context) (seq []intvl.Interval, err error) {
 	deadline, deadlineDefined := ctx.Deadline()
 	started := time.Now()
 	log(LogCatgSyntax, "synHighlighter.Highlight: called\n")
@@ -239,71 +290,77 @@ LOOP:
 			break LOOP
 		default:
 		}
-		var color *Color
-		// log(LogCatgSyntax,"SyntaxHighlighter.Highlight: token category %s, subcat %s, '%s'\n", tok.Type.Category(), tok.Type.SubCategory(), tok)
-		switch tok.Type.Category() {
-		case syn.Keyword:
-			color = &s.style.KeywordColor
-		case syn.Name:
-			color = &s.style.NameColor
-		case syn.Literal:
-			switch tok.Type.SubCategory() {
-			case syn.LiteralString:
-				color = &s.style.StringColor
-			case syn.LiteralNumber:
-				color = &s.style.NumberColor
-			}
-		case syn.Operator:
-			color = &s.style.OperatorColor
-		case syn.Comment:
-			color = &s.style.CommentColor
-			if tok.Type.SubCategory() == syn.CommentPreproc {
-				color = &s.style.PreprocessorColor
-			}
-		case syn.Generic:
-			switch tok.Type {
-			case syn.GenericHeading:
-				color = &s.style.HeadingColor
-			case syn.GenericSubheading:
-				color = &s.style.SubheadingColor
-			case syn.GenericInserted:
-				color = &s.style.InsertedColor
-			case syn.GenericDeleted:
-				color = &s.style.DeletedColor
-			}
-		}
-
-		if color == nil {
+		style, ok := s.styleOf(tok.Type)
+		if !ok {
 			// Just normal text
 			continue
 		}
 
-		si := &SyntaxInterval{
-			start: tok.Start,
-			end:   tok.End,
-			color: *color,
-		}
-		seq = append(seq, si)
+		seq = append(seq, NewStyledSyntaxInterval(tok.Start, tok.End, style))
 	}
 	log(LogCatgSyntax, "synHighlighter.Highlight: done (took %s)\n", time.Now().Sub(started))
 	return
 }
 
-func (s synHighlighter) lexer(text string) *syn.Lexer {
-	if s.language == "" && s.filename == "" {
-		return nil
+// styleOf returns the style for tokens of type typ. It returns false if they are drawn as normal text.
+func (s *synHighlighter) styleOf(typ syn.TokenType) (style TokenStyle, ok bool) {
+	for _, t := range []syn.TokenType{typ, typ.SubCategory(), typ.Category()} {
+		style, ok = s.theme[t]
+		if ok {
+			break
+		}
 	}
 
-	var lexer *syn.Lexer
-	if s.language != "" {
-		lexer = synlexers.Get(s.language)
+	color := s.colorOf(typ)
+	if style.Color == nil {
+		style.Color = color
 	}
+	ok = ok || color != nil
+	return
+}
 
-	if lexer == nil && s.filename != "" {
-		lexer = synlexers.Match(s.filename)
+func (s *synHighlighter) colorOf(typ syn.TokenType) (color *Color) {
+	// log(LogCatgSyntax,"SyntaxHighlighter.Highlight: token category %s, subcat %s\n", typ.Category(), typ.SubCategory())
+	switch typ.Category() {
+	case syn.Keyword:
+		color = &s.style.KeywordColor
+	case syn.Name:
+		color = &s.style.NameColor
+	case syn.Literal:
+		switch typ.SubCategory() {
+		case syn.LiteralString:
+			color = &s.style.StringColor
+		case syn.LiteralNumber:
+			color = &s.style.NumberColor
+		}
+	case syn.Operator:
+		color = &s.style.OperatorColor
+	case syn.Comment:
+		color = &s.style.CommentColor
+		if typ.SubCategory() == syn.CommentPreproc {
+			color = &s.style.PreprocessorColor
+		}
+	case syn.Generic:
+		switch typ {
+		case syn.GenericHeading:
+			color = &s.style.HeadingColor
+		case syn.GenericSubheading:
+			color = &s.style.SubheadingColor
+		case syn.GenericInserted:
+			color = &s.style.InsertedColor
+		case syn.GenericDeleted:
+			color = &s.style.DeletedColor
+		}
 	}
+	return
+}
 
-	return lexer
+func (s *synHighlighter) lexer(text string) *syn.Lexer {
+	if s.language == "" && s.filename == "" {
+		return nil
+	}
+
+	return syntaxLexer(s.language, s.filename)
 }
 
 func (s *synHighlighter) SetFilename(filename string) {
@@ -315,7 +372,82 @@ func (s *synHighlighter) SetLanguage(language string) {
 }
 
 func (s *synHighlighter) SetStyle(style SyntaxStyle) {
+	theme := map[syn.TokenType]TokenStyle{}
+	for name, ts := range style.Theme {
+		t, err := syn.TokenTypeString(name)
+		if err != nil {
+			log(LogCatgSyntax, "synHighlighter.SetStyle: the syntax theme has a style for the unknown token class %s\n", name)
+			continue
+		}
+		theme[t] = ts
+	}
+
+	s.incLock.Lock()
+	defer s.incLock.Unlock()
 	s.style = style
+	s.theme = theme
+}
+
+func (s *synHighlighter) TextChanged(c TextChange) {
+	s.incLock.Lock()
+	inc := s.inc
+	s.incLock.Unlock()
+
+	if inc != nil {
+		inc.Changed(c.Offset, c.Length)
+	}
+}
+
+func (s *synHighlighter) SetText(text string) {
+	lexer := s.lexer(text)
+	if lexer == nil {
+		lexer = synlexers.Get("go")
+	}
+
+	s.incLock.Lock()
+	if s.inc == nil || s.inc.SynLexer() != lexer {
+		s.inc = inclex.New(lexer, syntaxCheckpointInterval, syntaxLookbehind)
+	}
+	inc := s.inc
+	s.incLock.Unlock()
+
+	inc.SetText([]rune(text))
+}
+
+func (s *synHighlighter) HighlightUntil(until int, ctx context.Context) (seq []intvl.Interval, complete bool, err error) {
+	s.incLock.Lock()
+	inc := s.inc
+	h := synHighlighter{style: s.style, theme: s.theme}
+	s.incLock.Unlock()
+
+	if inc == nil {
+		return
+	}
+
+	started := time.Now()
+	err = inc.Lex(ctx, until)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			log(LogCatgSyntax, "synHighlighter.HighlightUntil: exiting due to deadline\n")
+			err = ErrTimeout
+		} else if errors.Is(err, context.Canceled) {
+			log(LogCatgSyntax, "synHighlighter.HighlightUntil: exiting due to cancellation\n")
+			err = ErrCancel
+		}
+		return
+	}
+
+	for _, tok := range inc.Tokens() {
+		style, ok := h.styleOf(tok.Type)
+		if !ok {
+			// Just normal text
+			continue
+		}
+		seq = append(seq, NewStyledSyntaxInterval(tok.Start, tok.End, style))
+	}
+	complete = inc.Done()
+	log(LogCatgSyntax, "synHighlighter.HighlightUntil: highlighted until %d (complete: %v, took %s)\n", until, complete, time.Now().Sub(started))
+	return
 }
 
 type AsyncHighlighter struct {
@@ -336,11 +468,19 @@ func NewAsyncHighlighter(h Highlighter, timeout time.Duration, done func(seq []i
 // Highlight tries to highlight the text, but if it takes longer than blockingLimit then
 // it Highlight returns with the error ErrTimeout and continues in the background. If
 // it is continued in the background, and when it's finished the function `done` is called
-// with the result. Done is called from a separate goroutine
-func (ah *AsyncHighlighter) Highlight(text string) (seq []intvl.Interval, e error) {
+// with the result. Done is called from a separate goroutine.
+//
+// If the highlighter is an IncrementalHighlighter the text before the rune index visibleEnd,
+// which is what is visible, is highlighted first. Highlight returns once that is done and
+// the rest is highlighted in the background.
+func (ah *AsyncHighlighter) Highlight(text string, visibleEnd int) (seq []intvl.Interval, e error) {
 	// stop any background job by closing c
 	ah.Cancel()
 
+	if ih, ok := ah.h.(IncrementalHighlighter); ok {
+		return ah.highlightIncrementally(ih, text, visibleEnd)
+	}
+
 	// try and highlight
 	ctx := context.Background()
 	ctx, _ = context.WithDeadline(ctx, time.Now().Add(ah.timeout))
@@ -357,6 +497,32 @@ func (ah *AsyncHighlighter) Highlight(text string) (seq []intvl.Interval, e erro
 	return
 }
 
+func (ah *AsyncHighlighter) highlightIncrementally(ih IncrementalHighlighter, text string, visibleEnd int) (seq []intvl.Interval, e error) {
+	ih.SetText(text)
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(ah.timeout))
+	defer cancel()
+
+	seq, complete, e := ih.HighlightUntil(visibleEnd, ctx)
+	if complete || (e != nil && !errors.Is(e, ErrTimeout)) {
+		return
+	}
+
+	log(LogCatgSyntax, "AsyncHighlighter.Highlight: highlighting the rest of the text in the background\n")
+	bctx := context.Background()
+	bctx, ah.cancel = context.WithCancel(bctx)
+	go ah.continueInBackground(ih, bctx)
+	return
+}
+
+// TextChanged tells the highlighter about a change to the text so that an IncrementalHighlighter
+// only needs to highlight the text again from around the change.
+func (ah *AsyncHighlighter) TextChanged(c TextChange) {
+	if ih, ok := ah.h.(IncrementalHighlighter); ok {
+		ih.TextChanged(c)
+	}
+}
+
 func (ah *AsyncHighlighter) Cancel() {
 	if ah.cancel != nil {
 		log(LogCatgSyntax, "AsyncHighlighter.Highlight: cancelling background highlighter\n")
@@ -371,6 +537,15 @@ func (ah AsyncHighlighter) highlightInBackground(text string, ctx context.Contex
 	return
 }
 
+func (ah AsyncHighlighter) continueInBackground(ih IncrementalHighlighter, ctx context.Context) {
+	seq, _, err := ih.HighlightUntil(-1, ctx)
+	if errors.Is(err, ErrCancel) {
+		// The text was changed and is being highlighted again
+		return
+	}
+	ah.done(seq, err)
+}
+
 /*func init() {
 	syn.DebugLogger = log.New(os.Stdout, "", 0)
 }*/
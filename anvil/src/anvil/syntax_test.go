@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jeffwilliams/syn"
+)
+
+func TestSyntaxTheme(t *testing.T) {
+	red := Color{R: 0xff, A: 0xff}
+	syntaxStyle := SyntaxStyle{
+		KeywordColor: Color{B: 0xff, A: 0xff},
+		StringColor:  Color{G: 0xff, A: 0xff},
+		Theme: map[string]TokenStyle{
+			"Keyword":           {Color: &red, TextDecoration: TextDecoration{Bold: true}},
+			"LiteralString":     {TextDecoration: TextDecoration{Italic: true}},
+			"LiteralStringChar": {TextDecoration: TextDecoration{Underline: true}},
+			"NoSuchTokenClass":  {TextDecoration: TextDecoration{Bold: true}},
+		},
+	}
+
+	var h synHighlighter
+	h.SetStyle(syntaxStyle)
+
+	tests := []struct {
+		name       string
+		typ        syn.TokenType
+		expectOk   bool
+		color      Color
+		decoration TextDecoration
+	}{
+		{name: "class", typ: syn.Keyword, expectOk: true, color: red, decoration: TextDecoration{Bold: true}},
+		{name: "subclass", typ: syn.KeywordType, expectOk: true, color: red, decoration: TextDecoration{Bold: true}},
+		{name: "subclass without color", typ: syn.LiteralStringDouble, expectOk: true, color: syntaxStyle.StringColor, decoration: TextDecoration{Italic: true}},
+		{name: "own style", typ: syn.LiteralStringChar, expectOk: true, color: syntaxStyle.StringColor, decoration: TextDecoration{Underline: true}},
+		{name: "not in theme", typ: syn.NameFunction, expectOk: true, color: syntaxStyle.NameColor},
+		{name: "normal text", typ: syn.Text},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			style, ok := h.styleOf(tc.typ)
+			if ok != tc.expectOk {
+				t.Fatalf("expected ok to be %v but got %v", tc.expectOk, ok)
+			}
+			if !ok {
+				return
+			}
+			if style.Color == nil || *style.Color != tc.color {
+				t.Fatalf("expected color %v but got %v", tc.color, style.Color)
+			}
+			if style.TextDecoration != tc.decoration {
+				t.Fatalf("expected decoration %v but got %v", tc.decoration, style.TextDecoration)
+			}
+		})
+	}
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"gioui.org/io/clipboard"
+	"gioui.org/io/event"
+	"gioui.org/io/key"
+	"gioui.org/layout"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jeffwilliams/anvil/internal/ansi"
+	"github.com/jeffwilliams/anvil/internal/linediff"
+	"github.com/jeffwilliams/anvil/internal/runes"
+	"github.com/jeffwilliams/anvil/internal/vt"
+)
+
+// termProcess is a program running in a pseudo-terminal.
+type termProcess interface {
+	io.ReadWriter
+	// Resize tells the program that the terminal has a new size.
+	Resize(rows, cols int) error
+	Kill()
+	// Wait waits for the program to exit and releases the pseudo-terminal.
+	Wait() error
+}
+
+// terminalName is the name that terminal windows have, after the directory they were started in.
+const terminalName = "+Term"
+
+// terminal connects the body of a window to a shell running in a pseudo-terminal. The screen of the
+// terminal is kept at the end of the body. Lines that scroll off the top of the screen are added before it,
+// and stay in the body as ordinary text that can be edited, searched and executed.
+//
+// While the cursor is on the screen, keys and typed text are sent to the shell; when it's moved into the
+// scrollback the body is edited as usual.
+type terminal struct {
+	win  *Window
+	proc termProcess
+	vt   *vt.Terminal
+	dir  string
+	// screenStart is the index in the body of the first rune of the screen.
+	screenStart int
+	// screenHighlights are the highlights that color the text of the screen. They are replaced each time
+	// the screen is drawn, while those for the scrollback are left alone.
+	screenHighlights []*SyntaxInterval
+	// rendering is set while the body is being changed to match the screen.
+	rendering bool
+	exited    bool
+	// inputReady is signalled when input is queued for the shell or the shell exits.
+	inputReady chan struct{}
+
+	lock            sync.Mutex
+	output          []byte
+	outputScheduled bool
+	input           []byte
+	inputClosed     bool
+}
+
+const (
+	initialTerminalRows = 24
+	initialTerminalCols = 80
+)
+
+// StartTerminal starts a shell in dir, or on the remote host if dir is remote, and makes the body of the
+// window its terminal.
+func (w *Window) StartTerminal(dir string) error {
+	sfs, err := GetFs(dir)
+	if err != nil {
+		return err
+	}
+
+	proc, err := sfs.startTerm(dir, initialTerminalRows, initialTerminalCols)
+	if err != nil {
+		return err
+	}
+
+	t := &terminal{
+		win:        w,
+		proc:       proc,
+		vt:         vt.New(initialTerminalRows, initialTerminalCols),
+		dir:        dir,
+		inputReady: make(chan struct{}, 1),
+	}
+	w.term = t
+
+	w.Body.AddTextChangeListener(t.textChanged)
+	w.Body.SetPreDrawHook(t.preDrawHook)
+	w.Body.SetInputHook(t.handleInput)
+
+	go t.read()
+	go t.write()
+	return nil
+}
+
+// stopTerminal kills the shell of the window if it is a terminal.
+func (w *Window) stopTerminal() {
+	if w.term == nil || w.term.exited {
+		return
+	}
+	w.term.proc.Kill()
+}
+
+func (t *terminal) read() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.proc.Read(buf)
+		if n > 0 {
+			t.queueOutput(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	err := t.proc.Wait()
+	log(LogCatgWin, "terminal in %s exited: %v\n", t.dir, err)
+	editor.WorkChan() <- basicWork{func() {
+		t.processExited(err)
+	}}
+}
+
+func (t *terminal) write() {
+	for range t.inputReady {
+		t.lock.Lock()
+		b := t.input
+		t.input = nil
+		closed := t.inputClosed
+		t.lock.Unlock()
+
+		if closed {
+			return
+		}
+		if len(b) == 0 {
+			continue
+		}
+		if _, err := t.proc.Write(b); err != nil {
+			log(LogCatgWin, "error writing to terminal in %s: %v\n", t.dir, err)
+		}
+	}
+}
+
+// queueOutput saves output from the shell until it's drawn. Output that arrives while it waits to be
+// drawn is drawn with it.
+func (t *terminal) queueOutput(b []byte) {
+	t.lock.Lock()
+	t.output = append(t.output, b...)
+	scheduled := t.outputScheduled
+	t.outputScheduled = true
+	t.lock.Unlock()
+
+	if !scheduled {
+		editor.WorkChan() <- basicWork{t.drawOutput}
+	}
+}
+
+func (t *terminal) drawOutput() {
+	t.lock.Lock()
+	output := t.output
+	t.output = nil
+	t.outputScheduled = false
+	t.lock.Unlock()
+
+	if t.windowClosed() {
+		return
+	}
+
+	t.vt.Write(output)
+	if replies := t.vt.TakeReplies(); len(replies) > 0 {
+		t.send(replies)
+	}
+	t.render()
+}
+
+func (t *terminal) windowClosed() bool {
+	return editor.FindWindowForId(t.win.Id) != t.win
+}
+
+func (t *terminal) processExited(err error) {
+	t.exited = true
+	t.lock.Lock()
+	t.inputClosed = true
+	t.lock.Unlock()
+	t.signalInput()
+	t.win.Body.SetInputHook(nil)
+	t.win.Body.SetPreDrawHook(nil)
+
+	if err != nil && !t.windowClosed() {
+		editor.AppendError(t.dir, fmt.Sprintf("Terminal in %s exited: %v", t.dir, err))
+	}
+}
+
+// send queues the bytes to be written to the shell as input. It doesn't block the editor while the
+// shell is slow to read its input; input queued while it waits is written along with it.
+func (t *terminal) send(b []byte) {
+	if t.exited {
+		return
+	}
+	t.lock.Lock()
+	t.input = append(t.input, b...)
+	t.lock.Unlock()
+	t.signalInput()
+}
+
+func (t *terminal) signalInput() {
+	select {
+	case t.inputReady <- struct{}{}:
+	default:
+		// The writer has yet to take the input signalled before, so it will take this input as well
+	}
+}
+
+// textChanged moves the start of the screen when the scrollback before it is edited.
+func (t *terminal) textChanged(c *TextChange) {
+	if t.rendering || c.Offset >= t.screenStart {
+		return
+	}
+	if c.Length >= 0 {
+		t.screenStart += c.Length
+		return
+	}
+	t.screenStart = max(c.Offset, t.screenStart+c.Length)
+}
+
+// cursorOnScreen returns true if the cursor of the body is on the screen of the terminal rather than in the scrollback.
+func (t *terminal) cursorOnScreen() bool {
+	return t.win.Body.firstCursorIndex() >= t.screenStart
+}
+
+// handleInput sends keys, typed text and pasted text to the shell while the cursor is on the screen.
+func (t *terminal) handleInput(ev event.Event) bool {
+	if t.exited || !t.cursorOnScreen() {
+		return false
+	}
+
+	switch e := ev.(type) {
+	case key.Event:
+		if e.State != key.Press {
+			return false
+		}
+		// Ctrl-C copies text if it is selected rather than interrupting.
+		if e.Name == "C" && e.Modifiers == key.ModCtrl && t.win.Body.SelectionsPresent() {
+			return false
+		}
+		seq := terminalKeySequence(e.Name, e.Modifiers, t.vt.AppCursorKeys())
+		if seq == nil {
+			return false
+		}
+		t.send(seq)
+		return true
+	case key.EditEvent:
+		t.send([]byte(e.Text))
+		return true
+	case clipboard.Event:
+		text := strings.ReplaceAll(fixLineEndings(e.Text), "\n", "\r")
+		if t.vt.BracketedPaste() {
+			text = "\x1b[200~" + text + "\x1b[201~"
+		}
+		t.send([]byte(text))
+		return true
+	}
+	return false
+}
+
+// preDrawHook resizes the terminal to fit the body.
+func (t *terminal) preDrawHook(e *editable, gtx layout.Context) {
+	rows := e.heightInLines(gtx)
+	cols := (gtx.Constraints.Max.X - e.style.TextLeftPadding) / e.widthOfSpace()
+	if rows < 1 || cols < 1 {
+		return
+	}
+
+	if r, c := t.vt.Size(); r == rows && c == cols {
+		return
+	}
+
+	t.vt.Resize(rows, cols)
+	if err := t.proc.Resize(rows, cols); err != nil {
+		log(LogCatgWin, "error resizing terminal in %s: %v\n", t.dir, err)
+	}
+	t.render()
+}
+
+// render changes the body to show the screen of the terminal, and adds the lines that scrolled off the
+// screen before it.
+func (t *terminal) render() {
+	e := &t.win.Body.editable
+	doc := e.Bytes()
+	t.screenStart = min(t.screenStart, utf8.RuneCount(doc))
+	followCursor := t.cursorOnScreen()
+
+	w := runes.NewWalker(doc)
+	w.SetRunePosCache(t.screenStart, &e.runeOffsetCache)
+	old := string(doc[w.BytePos():])
+
+	scrollback, scrollbackRuns, _ := terminalText(t.vt.TakeScrollback(), true, -1, 0)
+	row, col := t.vt.Cursor()
+	screen, screenRuns, cursor := terminalText(t.vt.Lines(), false, row, col)
+
+	t.rendering = true
+	e.removeManualHighlights(t.screenHighlights)
+	e.applyEdits(t.screenStart, linediff.Edits(old, scrollback+screen))
+
+	for _, r := range scrollbackRuns {
+		e.manualHighlighting = append(e.manualHighlighting, r.highlight(t.screenStart))
+	}
+	t.screenStart += utf8.RuneCountInString(scrollback)
+
+	t.screenHighlights = t.screenHighlights[:0]
+	for _, r := range screenRuns {
+		h := r.highlight(t.screenStart)
+		t.screenHighlights = append(t.screenHighlights, h)
+		e.manualHighlighting = append(e.manualHighlighting, h)
+	}
+	t.rendering = false
+
+	if followCursor {
+		e.setToOneCursorIndex(t.screenStart + cursor)
+		if e.TopLeftIndex != t.screenStart {
+			e.SetTopLeft(t.screenStart)
+		}
+	}
+	e.invalidateLayedoutText()
+}
+
+// terminalRun is a run of text in the terminal with the same attributes.
+type terminalRun struct {
+	start, end int
+	attr       vt.Attr
+}
+
+// highlight returns the highlight that draws the run, which starts at offset in the body.
+func (r terminalRun) highlight(offset int) *SyntaxInterval {
+	a := r.attr
+	fg := a.Fg
+	if a.Reverse {
+		// Backgrounds aren't drawn, so reversed text uses the background color, or is underlined if
+		// that's the default.
+		fg = a.Bg
+	}
+
+	s := &SyntaxInterval{
+		start:      offset + r.start,
+		end:        offset + r.end,
+		decoration: TextDecoration{Bold: a.Bold, Italic: a.Italic, Underline: a.Underline},
+	}
+	if c, ok := terminalColor(fg); ok {
+		s.color = c
+	} else {
+		s.plain = true
+		if a.Reverse {
+			s.decoration.Underline = true
+		}
+	}
+	return s
+}
+
+func (r terminalRun) drawn() bool {
+	a := r.attr
+	return a.Fg.Kind != vt.DefaultColor || a.Bold || a.Italic || a.Underline || a.Reverse
+}
+
+// terminalColor returns the color of a cell, or false if it's the default color.
+func terminalColor(c vt.Color) (Color, bool) {
+	switch c.Kind {
+	case vt.IndexedColor:
+		return Color(ansi.PaletteColor(c.Index)), true
+	case vt.RGBColor:
+		return Color{R: c.R, G: c.G, B: c.B, A: 0xff}, true
+	}
+	return Color{}, false
+}
+
+// terminalText returns the text of the lines of a terminal, with lines that wrapped joined to the next,
+// and the runs of text that are colored or have attributes. If terminate is set each line ends with a
+// newline; otherwise the last doesn't and blank lines at the end are left out. cursor is the offset in
+// the text of cursorRow and cursorCol, which are kept in the text even if they are past the end of the line.
+func terminalText(lines []vt.Line, terminate bool, cursorRow, cursorCol int) (text string, runs []terminalRun, cursor int) {
+	if !terminate {
+		last := len(lines) - 1
+		for last > 0 && last > cursorRow && lines[last].String() == "" {
+			last--
+		}
+		lines = lines[:last+1]
+	}
+
+	var b strings.Builder
+	pos := 0
+	addRun := func(attr vt.Attr) {
+		if n := len(runs); n > 0 && runs[n-1].end == pos && runs[n-1].attr == attr {
+			runs[n-1].end++
+			return
+		}
+		r := terminalRun{start: pos, end: pos + 1, attr: attr}
+		if r.drawn() {
+			runs = append(runs, r)
+		}
+	}
+
+	for i, l := range lines {
+		cells := l.Cells
+		if !l.Wrapped {
+			n := len(cells)
+			for n > 0 && (cells[n-1].Rune == 0 || cells[n-1].Rune == ' ') && (i != cursorRow || n > cursorCol) {
+				n--
+			}
+			cells = cells[:n]
+		}
+
+		if i == cursorRow {
+			cursor = pos + min(cursorCol, len(cells))
+		}
+
+		for _, c := range cells {
+			r := c.Rune
+			if r == 0 {
+				r = ' '
+			}
+			b.WriteRune(r)
+			addRun(c.Attr)
+			pos++
+		}
+
+		if !l.Wrapped && (terminate || i < len(lines)-1) {
+			b.WriteByte('\n')
+			pos++
+		}
+	}
+
+	text = b.String()
+	return
+}
+
+// terminalKeySequence returns what an xterm sends to the program for the key, or nil if it sends nothing.
+// If appCursorKeys is set the cursor keys send the sequences programs ask for in application mode.
+func terminalKeySequence(name string, mods key.Modifiers, appCursorKeys bool) []byte {
+	ctrl := mods.Contain(key.ModCtrl)
+	alt := mods.Contain(key.ModAlt)
+	shift := mods.Contain(key.ModShift)
+
+	// The modifiers are encoded as a parameter of the sequences for special keys.
+	modParam := 1
+	if shift {
+		modParam += 1
+	}
+	if alt {
+		modParam += 2
+	}
+	if ctrl {
+		modParam += 4
+	}
+
+	cursorKey := func(c byte) []byte {
+		switch {
+		case modParam > 1:
+			return []byte("\x1b[1;" + strconv.Itoa(modParam) + string(c))
+		case appCursorKeys:
+			return []byte{0x1b, 'O', c}
+		}
+		return []byte{0x1b, '[', c}
+	}
+	functionKey := func(c byte) []byte {
+		if modParam > 1 {
+			return []byte("\x1b[1;" + strconv.Itoa(modParam) + string(c))
+		}
+		return []byte{0x1b, 'O', c}
+	}
+	tildeKey := func(n int) []byte {
+		if modParam > 1 {
+			return []byte("\x1b[" + strconv.Itoa(n) + ";" + strconv.Itoa(modParam) + "~")
+		}
+		return []byte("\x1b[" + strconv.Itoa(n) + "~")
+	}
+
+	switch name {
+	case key.NameUpArrow:
+		return cursorKey('A')
+	case key.NameDownArrow:
+		return cursorKey('B')
+	case key.NameRightArrow:
+		return cursorKey('C')
+	case key.NameLeftArrow:
+		return cursorKey('D')
+	case key.NameHome:
+		return cursorKey('H')
+	case key.NameEnd:
+		return cursorKey('F')
+	case key.NameDeleteForward:
+		return tildeKey(3)
+	case key.NamePageUp:
+		return tildeKey(5)
+	case key.NamePageDown:
+		return tildeKey(6)
+	case key.NameF1:
+		return functionKey('P')
+	case key.NameF2:
+		return functionKey('Q')
+	case key.NameF3:
+		return functionKey('R')
+	case key.NameF4:
+		return functionKey('S')
+	case key.NameF5:
+		return tildeKey(15)
+	case key.NameF6:
+		return tildeKey(17)
+	case key.NameF7:
+		return tildeKey(18)
+	case key.NameF8:
+		return tildeKey(19)
+	case key.NameF9:
+		return tildeKey(20)
+	case key.NameF10:
+		return tildeKey(21)
+	case key.NameF11:
+		return tildeKey(23)
+	case key.NameF12:
+		return tildeKey(24)
+	case key.NameReturn, key.NameEnter:
+		return []byte{'\r'}
+	case key.NameEscape:
+		return []byte{0x1b}
+	case key.NameTab:
+		if shift {
+			return []byte("\x1b[Z")
+		}
+		return []byte{'\t'}
+	case key.NameDeleteBackward:
+		switch {
+		case ctrl:
+			return []byte{0x08}
+		case alt:
+			return []byte{0x1b, 0x7f}
+		}
+		return []byte{0x7f}
+	case key.NameSpace:
+		if ctrl {
+			return []byte{0}
+		}
+		return nil
+	}
+
+	if len(name) != 1 || name[0] < 'A' || name[0] > 'Z' {
+		return nil
+	}
+	c := name[0]
+	switch {
+	case ctrl:
+		c = c - 'A' + 1
+	case alt:
+		if !shift {
+			c = c - 'A' + 'a'
+		}
+	default:
+		return nil
+	}
+	if alt {
+		return []byte{0x1b, c}
+	}
+	return []byte{c}
+}
+
+// terminalKeySet are the keys that are sent to the shell of a terminal in addition to those an editable handles.
+const terminalKeySet = "Ctrl-[A,B,C,D,E,F,G,H,I,J,K,L,M,N,O,P,Q,R,S,T,U,V,W,X,Y,Z]|Ctrl-Space|Alt-[B,D,F]"
+
+func terminalEnv() []string {
+	env := append(os.Environ(), "TERM=xterm-256color", fmt.Sprintf("ANVIL_API_PORT=%d", LocalAPIPort()))
+	if LocalAPISocket() != "" {
+		env = append(env, fmt.Sprintf("ANVIL_API_SOCK=%s", LocalAPISocket()))
+	}
+	return env
+}
+
+func (f localFs) startTerm(dir string, rows, cols int) (p termProcess, err error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "bash"
+	}
+
+	apiSess, err := createApiSession(shell)
+	if err != nil {
+		return
+	}
+
+	cmd := exec.Command(shell)
+	cmd.Dir = dir
+	cmd.Env = append(terminalEnv(), fmt.Sprintf("ANVIL_API_SESS=%s", apiSess.Id()))
+
+	pty, err := startPty(cmd, rows, cols)
+	if err != nil {
+		deleteApiSession(apiSess.Id())
+		return
+	}
+
+	p = &localTermProcess{cmd: cmd, pty: pty, apiSess: apiSess}
+	return
+}
+
+type localTermProcess struct {
+	cmd     *exec.Cmd
+	pty     *os.File
+	apiSess *ApiSession
+}
+
+func (p *localTermProcess) Read(b []byte) (int, error) {
+	return p.pty.Read(b)
+}
+
+func (p *localTermProcess) Write(b []byte) (int, error) {
+	return p.pty.Write(b)
+}
+
+func (p *localTermProcess) Resize(rows, cols int) error {
+	return setPtySize(p.pty, rows, cols)
+}
+
+func (p *localTermProcess) Kill() {
+	KillProcess(p.cmd.Process)
+}
+
+func (p *localTermProcess) Wait() error {
+	err := p.cmd.Wait()
+	p.pty.Close()
+	deleteApiSession(p.apiSess.Id())
+	return err
+}
+
+func (f sshFs) startTerm(path string, rows, cols int) (p termProcess, err error) {
+	dir, session, client, err := f.splitFilenameAndMakeSession(path, nil)
+	if err != nil {
+		return
+	}
+
+	fail := func(e error) (termProcess, error) {
+		session.Close()
+		return nil, e
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 38400,
+		ssh.TTY_OP_OSPEED: 38400,
+	}
+	if err = session.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+		return fail(err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return fail(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fail(err)
+	}
+
+	if err = f.maybeServeAPIOverSshClient(client); err != nil {
+		return fail(err)
+	}
+	apiSess, err := createApiSession(f.getShell())
+	if err != nil {
+		return fail(err)
+	}
+	session.Setenv("ANVIL_API_PORT", strconv.Itoa(client.ListenerPort()))
+	session.Setenv("ANVIL_API_SESS", string(apiSess.Id()))
+	if client.UnixListenerPath() != "" {
+		session.Setenv("ANVIL_API_SOCK", client.UnixListenerPath())
+	}
+
+	cmd := fmt.Sprintf(`%s -c 'cd "%s" && exec "${SHELL:-%s}" -l'`, f.getShell(), dir, f.getShell())
+	log(LogCatgFS, "sshFs.startTerm: running command: %s\n", cmd)
+	if err = session.Start(cmd); err != nil {
+		deleteApiSession(apiSess.Id())
+		return fail(err)
+	}
+
+	p = &sshTermProcess{session: session, stdin: stdin, stdout: stdout, apiSess: apiSess}
+	return
+}
+
+type sshTermProcess struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	apiSess *ApiSession
+}
+
+func (p *sshTermProcess) Read(b []byte) (int, error) {
+	return p.stdout.Read(b)
+}
+
+func (p *sshTermProcess) Write(b []byte) (int, error) {
+	return p.stdin.Write(b)
+}
+
+func (p *sshTermProcess) Resize(rows, cols int) error {
+	return p.session.WindowChange(rows, cols)
+}
+
+func (p *sshTermProcess) Kill() {
+	p.session.Signal(ssh.SIGKILL)
+	p.session.Close()
+}
+
+func (p *sshTermProcess) Wait() error {
+	err := p.session.Wait()
+	p.session.Close()
+	deleteApiSession(p.apiSess.Id())
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// startPty starts the command with its standard input, output and error connected to a new
+// pseudo-terminal of the given size, and returns the controlling side of the pseudo-terminal.
+func startPty(cmd *exec.Cmd, rows, cols int) (pty *os.File, err error) {
+	pty, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+
+	fail := func(e error) (*os.File, error) {
+		pty.Close()
+		return nil, e
+	}
+
+	var unlock int32
+	if err = ioctl(pty.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		return fail(err)
+	}
+	var n uint32
+	if err = ioctl(pty.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		return fail(err)
+	}
+
+	tty, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return fail(err)
+	}
+	defer tty.Close()
+
+	if err = setPtySize(pty, rows, cols); err != nil {
+		return fail(err)
+	}
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	// Make the program the leader of a new session with the terminal as its controlling terminal,
+	// so that it gets signals like SIGINT and SIGWINCH from it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err = cmd.Start(); err != nil {
+		return fail(err)
+	}
+	return
+}
+
+// setPtySize sets the size of the pseudo-terminal. The program running in it is sent SIGWINCH.
+func setPtySize(pty *os.File, rows, cols int) error {
+	size := struct {
+		rows, cols, x, y uint16
+	}{rows: uint16(rows), cols: uint16(cols)}
+	return ioctl(pty.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&size)))
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
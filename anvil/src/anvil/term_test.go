@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gioui.org/io/key"
+	"github.com/jeffwilliams/anvil/internal/vt"
+)
+
+func TestTerminalKeySequence(t *testing.T) {
+	tests := []struct {
+		name      string
+		mods      key.Modifiers
+		appCursor bool
+		expected  string
+	}{
+		{key.NameReturn, 0, false, "\r"},
+		{key.NameDeleteBackward, 0, false, "\x7f"},
+		{key.NameUpArrow, 0, false, "\x1b[A"},
+		{key.NameUpArrow, 0, true, "\x1bOA"},
+		{key.NameLeftArrow, key.ModCtrl, true, "\x1b[1;5D"},
+		{key.NameTab, key.ModShift, false, "\x1b[Z"},
+		{key.NamePageDown, 0, false, "\x1b[6~"},
+		{key.NameDeleteForward, key.ModShift, false, "\x1b[3;2~"},
+		{key.NameF1, 0, false, "\x1bOP"},
+		{key.NameF12, 0, false, "\x1b[24~"},
+		{"C", key.ModCtrl, false, "\x03"},
+		{"B", key.ModAlt, false, "\x1bb"},
+		{"A", 0, false, ""},
+		{key.NameCtrl, key.ModCtrl, false, ""},
+	}
+
+	for _, tc := range tests {
+		seq := terminalKeySequence(tc.name, tc.mods, tc.appCursor)
+		if string(seq) != tc.expected {
+			t.Errorf("%s with modifiers %v: expected %q but got %q", tc.name, tc.mods, tc.expected, seq)
+		}
+	}
+}
+
+func TestTerminalText(t *testing.T) {
+	term := vt.New(5, 4)
+	term.Write([]byte("abcdef\r\n\x1b[31mx\x1b[0m\r\n$ "))
+	row, col := term.Cursor()
+
+	text, runs, cursor := terminalText(term.Lines(), false, row, col)
+	if text != "abcdef\nx\n$ " {
+		t.Fatalf("unexpected text %q", text)
+	}
+	if cursor != 11 {
+		t.Fatalf("expected cursor at 11 but it is at %d", cursor)
+	}
+	expected := []terminalRun{{start: 7, end: 8, attr: vt.Attr{Fg: vt.Color{Kind: vt.IndexedColor, Index: 1}}}}
+	if !reflect.DeepEqual(runs, expected) {
+		t.Fatalf("expected runs %v but got %v", expected, runs)
+	}
+
+	text, _, _ = terminalText(term.Lines()[2:3], true, -1, 0)
+	if text != "x\n" {
+		t.Fatalf("unexpected scrollback text %q", text)
+	}
+}
+
+// slowTermProcess is a shell that doesn't read its input until it is released.
+type slowTermProcess struct {
+	release chan struct{}
+	lock    sync.Mutex
+	written bytes.Buffer
+}
+
+func (p *slowTermProcess) Read(b []byte) (int, error)  { select {} }
+func (p *slowTermProcess) Resize(rows, cols int) error { return nil }
+func (p *slowTermProcess) Kill()                       {}
+func (p *slowTermProcess) Wait() error                 { return nil }
+
+func (p *slowTermProcess) Write(b []byte) (int, error) {
+	<-p.release
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.written.Write(b)
+}
+
+func (p *slowTermProcess) String() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.written.String()
+}
+
+func TestTerminalSendDoesNotBlock(t *testing.T) {
+	proc := &slowTermProcess{release: make(chan struct{})}
+	term := &terminal{proc: proc, inputReady: make(chan struct{}, 1)}
+	go term.write()
+
+	var expected bytes.Buffer
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			b := []byte{'a' + byte(i%26)}
+			expected.Write(b)
+			term.send(b)
+		}
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sending input blocked while the shell wasn't reading")
+	}
+
+	close(proc.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for proc.String() != expected.String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the shell to get %q but got %q", expected.String(), proc.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	term.lock.Lock()
+	term.inputClosed = true
+	term.lock.Unlock()
+	term.signalInput()
+}
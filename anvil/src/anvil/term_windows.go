@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+var errPtyUnsupported = errors.New("terminal windows are not supported on Windows")
+
+func startPty(cmd *exec.Cmd, rows, cols int) (pty *os.File, err error) {
+	return nil, errPtyUnsupported
+}
+
+func setPtySize(pty *os.File, rows, cols int) error {
+	return errPtyUnsupported
+}
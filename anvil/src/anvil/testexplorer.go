@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// testsWindowName is the name of the window that lists the tests of the Go package in a directory.
+const testsWindowName = "+Tests"
+
+// testSuites are the tests of the packages that are shown in Tests windows, by directory. They are only
+// accessed from the main goroutine.
+var testSuites = map[string]*testSuite{}
+
+// testSuite is the tests of a Go package and the results of running them.
+type testSuite struct {
+	dir string
+	// tests are the top-level tests of the package in the order go test lists them
+	tests   []string
+	results map[string]*testResult
+	// output is the output of the last run that is not from a test, such as build errors
+	output string
+}
+
+type testStatus string
+
+const (
+	testNotRun  testStatus = "-"
+	testRunning testStatus = "run"
+	testPassed  testStatus = "pass"
+	testFailed  testStatus = "FAIL"
+	testSkipped testStatus = "skip"
+)
+
+type testResult struct {
+	status  testStatus
+	elapsed float64
+	output  string
+}
+
+// testEvent is a line of the output of go test -json
+type testEvent struct {
+	Action  string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+var (
+	testListRe = regexp.MustCompile(`^(Test|Example|Fuzz)\w*$`)
+	// testFuncRe matches the declaration of a test function in a _test.go file
+	testFuncRe = regexp.MustCompile(`(?m)^func ((?:Test|Example|Fuzz)\w*)\(`)
+	// testLineRe matches the line of a test in the Tests window
+	testLineRe = regexp.MustCompile(`(?m)^((?:Test|Example|Fuzz)\S*)`)
+)
+
+func newTestSuite(dir string) *testSuite {
+	return &testSuite{dir: dir, results: map[string]*testResult{}}
+}
+
+// parseTestList returns the tests listed by go test -list.
+func parseTestList(out string) (tests []string) {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if testListRe.MatchString(line) {
+			tests = append(tests, line)
+		}
+	}
+	return
+}
+
+// testRunPattern returns the argument to go test -run that runs exactly the tests. A subtest can only
+// be run on its own; when there are several tests their top-level tests are run.
+func testRunPattern(tests []string) string {
+	if len(tests) == 1 && strings.Contains(tests[0], "/") {
+		parts := strings.Split(tests[0], "/")
+		for i, p := range parts {
+			parts[i] = "^" + regexp.QuoteMeta(p) + "$"
+		}
+		return strings.Join(parts, "/")
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for _, t := range tests {
+		t, _, _ = strings.Cut(t, "/")
+		if !seen[t] {
+			names = append(names, regexp.QuoteMeta(t))
+			seen[t] = true
+		}
+	}
+	return "^(" + strings.Join(names, "|") + ")$"
+}
+
+// testCommand is the shell command that runs the tests, or all the tests if there are none.
+func testCommand(tests []string) string {
+	if len(tests) == 0 {
+		return "go test -json ."
+	}
+	return fmt.Sprintf("go test -json -run '%s' .", testRunPattern(tests))
+}
+
+// setRunning marks the tests, or all the tests if there are none, as running.
+func (s *testSuite) setRunning(tests []string) {
+	if len(tests) == 0 {
+		tests = s.tests
+		s.results = map[string]*testResult{}
+	}
+	for _, t := range tests {
+		s.results[t] = &testResult{status: testRunning}
+	}
+}
+
+// update records the results of a run from the output of go test -json. Tests that were marked as
+// running but have no result are marked as not run.
+func (s *testSuite) update(out string) {
+	var other bytes.Buffer
+	for _, line := range strings.Split(out, "\n") {
+		var ev testEvent
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &ev) != nil {
+			if line != "" {
+				fmt.Fprintf(&other, "%s\n", line)
+			}
+			continue
+		}
+
+		if ev.Test == "" {
+			if ev.Action == "output" {
+				other.WriteString(ev.Output)
+			}
+			continue
+		}
+
+		r, ok := s.results[ev.Test]
+		if !ok {
+			r = &testResult{}
+			s.results[ev.Test] = r
+		}
+
+		switch ev.Action {
+		case "run":
+			r.status = testRunning
+			r.output = ""
+		case "output":
+			// Skip the lines that go test writes around the output of the test itself
+			if o := strings.TrimSpace(ev.Output); strings.HasPrefix(o, "=== ") || strings.HasPrefix(o, "--- ") {
+				break
+			}
+			r.output += ev.Output
+		case "pass":
+			r.status, r.elapsed = testPassed, ev.Elapsed
+		case "fail":
+			r.status, r.elapsed = testFailed, ev.Elapsed
+		case "skip":
+			r.status, r.elapsed = testSkipped, ev.Elapsed
+		}
+	}
+
+	for _, r := range s.results {
+		if r.status == testRunning {
+			r.status = testNotRun
+		}
+	}
+
+	for t := range s.results {
+		if top, _, _ := strings.Cut(t, "/"); !s.has(top) {
+			s.tests = append(s.tests, top)
+		}
+	}
+	s.output = other.String()
+}
+
+func (s *testSuite) has(test string) bool {
+	for _, t := range s.tests {
+		if t == test {
+			return true
+		}
+	}
+	return false
+}
+
+// failed returns the top-level tests that failed in the last run.
+func (s *testSuite) failed() (tests []string) {
+	for _, t := range s.tests {
+		if r, ok := s.results[t]; ok && r.status == testFailed {
+			tests = append(tests, t)
+		}
+	}
+	return
+}
+
+// quickfixItems returns the locations in the output of the failed tests and of the package.
+func (s *testSuite) quickfixItems() []QuickfixItem {
+	var out strings.Builder
+	for _, t := range s.sortedResults() {
+		if r := s.results[t]; r.status == testFailed {
+			out.WriteString(r.output)
+		}
+	}
+	out.WriteString(s.output)
+	return resolveQuickfixItems(s.dir, parseQuickfixItems(out.String()))
+}
+
+// sortedResults returns the names of the tests with results, with subtests following their parent.
+func (s *testSuite) sortedResults() (names []string) {
+	for t := range s.results {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	return
+}
+
+// testTint is the part of the text of a Tests window that is shown in the color of a status.
+type testTint struct {
+	start, end int
+	status     testStatus
+}
+
+// format returns the text of the Tests window: a line for each test with its status and how long it
+// took, followed by the output of the tests that failed. The lines of the tests are tinted by status.
+func (s *testSuite) format() (text string, tints []testTint) {
+	width := 0
+	for _, t := range s.tests {
+		width = max(width, len(t))
+	}
+	for t := range s.results {
+		width = max(width, len(t))
+	}
+
+	var buf strings.Builder
+	pos := 0
+	write := func(name string, r *testResult) {
+		status, elapsed := testNotRun, ""
+		if r != nil {
+			status = r.status
+			if status != testNotRun && status != testRunning {
+				elapsed = fmt.Sprintf("%.2fs", r.elapsed)
+			}
+		}
+
+		line := strings.TrimRight(fmt.Sprintf("%-*s  %-4s  %s", width, name, status, elapsed), " ")
+		n := utf8.RuneCountInString(line)
+		if status != testNotRun {
+			tints = append(tints, testTint{start: pos, end: pos + n, status: status})
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+		pos += n + 1
+
+		if r != nil && r.status == testFailed && r.output != "" {
+			buf.WriteString(r.output)
+			pos += utf8.RuneCountInString(r.output)
+		}
+	}
+
+	names := s.sortedResults()
+	for _, t := range s.tests {
+		write(t, s.results[t])
+		for _, sub := range names {
+			if strings.HasPrefix(sub, t+"/") {
+				write(sub, s.results[sub])
+			}
+		}
+	}
+
+	if s.output != "" {
+		buf.WriteString("\n")
+		buf.WriteString(s.output)
+	}
+	return buf.String(), tints
+}
+
+// testAtCursor returns the test whose declaration in a _test.go file, or whose line in a Tests window,
+// is at or before the end of the line the cursor is on. text is the text of the window.
+func testAtCursor(text string, cursor int, inTestsWindow bool) string {
+	runes := []rune(text)
+	if cursor > len(runes) {
+		cursor = len(runes)
+	}
+	end := cursor
+	for end < len(runes) && runes[end] != '\n' {
+		end++
+	}
+	before := string(runes[:end])
+
+	re := testFuncRe
+	if inTestsWindow {
+		re = testLineRe
+	}
+	m := re.FindAllStringSubmatch(before, -1)
+	if m == nil {
+		return ""
+	}
+	return m[len(m)-1][1]
+}
+
+// showTests shows the tests of the suite in its Tests window, creating the window if needed.
+func (e *Editor) showTests(s *testSuite) {
+	name := s.dir + testsWindowName
+	w := e.FindWindowForFile(name)
+	if w == nil {
+		w = e.FindOrCreateWindow(name)
+		if w == nil {
+			return
+		}
+		w.SetFilenameAndTag(name, typeFile)
+		appendToWindowTag(w, "◊Tests all◊ ◊Tests failed◊ ◊Tests here◊")
+	}
+
+	text, tints := s.format()
+	cursor := w.Body.firstCursorIndex()
+	w.Body.SetTextString(text)
+	w.Body.SetCursorIndices([]int{min(cursor, w.Body.Len())})
+	w.Body.ClearManualHighlights()
+	for _, t := range tints {
+		w.Body.AddManualHighlight(t.start, t.end, e.testStatusColor(t.status))
+	}
+	w.markTextAsUnchanged()
+	w.GrowIfBodyTooSmall()
+}
+
+func (e *Editor) testStatusColor(status testStatus) Color {
+	switch status {
+	case testPassed:
+		return WindowStyle.TestPassColor
+	case testFailed:
+		return WindowStyle.TestFailColor
+	}
+	return WindowStyle.TestOtherColor
+}
+
+// testSuite returns the suite for the directory, creating it if needed.
+func (e *Editor) testSuite(dir string) *testSuite {
+	s, ok := testSuites[dir]
+	if !ok {
+		s = newTestSuite(dir)
+		testSuites[dir] = s
+	}
+	return s
+}
+
+// listTests finds the tests of the Go package in dir using go test -list and shows them in the Tests
+// window. It runs in the background.
+func (e *Editor) listTests(dir string) {
+	s := e.testSuite(dir)
+	e.showTests(s)
+
+	go func() {
+		sfs, err := GetFs(dir)
+		if err != nil {
+			e.reportTestError(dir, err)
+			return
+		}
+		stdout, stderr, err := sfs.filter(dir, "go test -list .", nil)
+		tests := parseTestList(string(stdout))
+
+		e.WorkChan() <- basicWork{func() {
+			s.tests = tests
+			s.output = ""
+			if err != nil {
+				s.output = string(stdout) + string(stderr)
+			}
+			e.showTests(s)
+		}}
+	}()
+}
+
+// runTests runs the tests of the package in dir, or all of them if tests is empty, and shows the results
+// in the Tests window. The locations in the output of the failed tests replace the quickfix list. It
+// runs in the background.
+func (e *Editor) runTests(dir string, tests []string) {
+	s := e.testSuite(dir)
+	s.setRunning(tests)
+	e.showTests(s)
+
+	cmd := testCommand(tests)
+	go func() {
+		sfs, err := GetFs(dir)
+		if err != nil {
+			e.reportTestError(dir, err)
+			return
+		}
+
+		c, arg, _ := strings.Cut(cmd, " ")
+		hist := addCommandToHistory(dir, c, arg)
+		stdout, stderr, err := sfs.filter(dir, cmd, nil)
+		if code, ok := exitCodeOfError(err); ok {
+			setExitCodeInHistory(hist, code)
+		}
+		markCommandCompletedInHistory(hist)
+
+		e.WorkChan() <- basicWork{func() {
+			s.update(string(stdout) + string(stderr))
+			e.Quickfix.Set(s.quickfixItems())
+			e.showTests(s)
+		}}
+	}()
+}
+
+func (e *Editor) reportTestError(dir string, err error) {
+	e.WorkChan() <- basicWork{func() {
+		e.AppendError(dir, fmt.Sprintf("Tests: %v", err))
+	}}
+}
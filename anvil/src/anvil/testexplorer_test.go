@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTestList(t *testing.T) {
+	out := "TestA\nExampleB\nBenchmarkC\nFuzzD\nok  \texample.com/pkg\t0.002s\n"
+	if tests := parseTestList(out); !reflect.DeepEqual(tests, []string{"TestA", "ExampleB", "FuzzD"}) {
+		t.Fatalf("unexpected tests %v", tests)
+	}
+}
+
+func TestTestCommand(t *testing.T) {
+	tests := []struct {
+		tests    []string
+		expected string
+	}{
+		{nil, "go test -json ."},
+		{[]string{"TestA"}, "go test -json -run '^(TestA)$' ."},
+		{[]string{"TestA", "TestB/sub", "TestA/x"}, "go test -json -run '^(TestA|TestB)$' ."},
+		{[]string{"TestB/sub_1"}, "go test -json -run '^TestB$/^sub_1$' ."},
+	}
+
+	for _, tc := range tests {
+		if c := testCommand(tc.tests); c != tc.expected {
+			t.Errorf("tests %v: expected %q but got %q", tc.tests, tc.expected, c)
+		}
+	}
+}
+
+const testJsonOutput = `{"Action":"run","Package":"p","Test":"TestA"}
+{"Action":"output","Package":"p","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Action":"output","Package":"p","Test":"TestA","Output":"--- PASS: TestA (0.01s)\n"}
+{"Action":"pass","Package":"p","Test":"TestA","Elapsed":0.01}
+{"Action":"run","Package":"p","Test":"TestB"}
+{"Action":"run","Package":"p","Test":"TestB/sub"}
+{"Action":"output","Package":"p","Test":"TestB/sub","Output":"    b_test.go:12: expected 1 but got 2\n"}
+{"Action":"fail","Package":"p","Test":"TestB/sub","Elapsed":0}
+{"Action":"fail","Package":"p","Test":"TestB","Elapsed":0.02}
+{"Action":"output","Package":"p","Output":"FAIL\n"}
+{"Action":"fail","Package":"p","Elapsed":0.03}
+`
+
+func TestTestSuite(t *testing.T) {
+	s := newTestSuite("/src/p/")
+	s.tests = []string{"TestA", "TestB", "TestC"}
+
+	s.setRunning(nil)
+	if s.results["TestC"].status != testRunning {
+		t.Fatalf("test was not marked as running")
+	}
+
+	s.update(testJsonOutput)
+
+	status := func(test string) testStatus {
+		if r, ok := s.results[test]; ok {
+			return r.status
+		}
+		return ""
+	}
+	if status("TestA") != testPassed || status("TestB") != testFailed || status("TestB/sub") != testFailed || status("TestC") != testNotRun {
+		t.Fatalf("unexpected results: A %s, B %s, B/sub %s, C %s", status("TestA"), status("TestB"), status("TestB/sub"), status("TestC"))
+	}
+
+	if f := s.failed(); !reflect.DeepEqual(f, []string{"TestB"}) {
+		t.Fatalf("unexpected failed tests %v", f)
+	}
+
+	items := s.quickfixItems()
+	if len(items) != 1 || items[0].Location() != "/src/p/b_test.go:12" {
+		t.Fatalf("unexpected quickfix items %+v", items)
+	}
+
+	text, tints := s.format()
+	expected := "TestA      pass  0.01s\n" +
+		"TestB      FAIL  0.02s\n" +
+		"TestB/sub  FAIL  0.00s\n" +
+		"    b_test.go:12: expected 1 but got 2\n" +
+		"TestC      -\n" +
+		"\nFAIL\n"
+	if text != expected {
+		t.Fatalf("expected text\n%s\nbut got\n%s", expected, text)
+	}
+
+	if len(tints) != 3 {
+		t.Fatalf("expected 3 tinted lines but got %d", len(tints))
+	}
+	runes := []rune(text)
+	if tint := tints[2]; string(runes[tint.start:tint.end]) != "TestB/sub  FAIL  0.00s" || tint.status != testFailed {
+		t.Fatalf("unexpected tint %+v covering %q", tint, string(runes[tint.start:tint.end]))
+	}
+}
+
+func TestTestAtCursor(t *testing.T) {
+	src := "package p\n\nfunc TestA(t *testing.T) {\n\tx()\n}\n\nfunc helper() {}\n\nfunc TestB(t *testing.T) {\n}\n"
+
+	tests := []struct {
+		marker   string
+		expected string
+	}{
+		{"package", ""},
+		{"func TestA", "TestA"},
+		{"x()", "TestA"},
+		{"func TestB", "TestB"},
+	}
+
+	for _, tc := range tests {
+		cursor := len([]rune(src[:strings.Index(src, tc.marker)]))
+		if name := testAtCursor(src, cursor, false); name != tc.expected {
+			t.Errorf("at %q: expected %q but got %q", tc.marker, tc.expected, name)
+		}
+	}
+
+	window := "TestA  pass  0.01s\nTestB/sub  FAIL  0.00s\n    b_test.go:12: bad\n"
+	if name := testAtCursor(window, strings.Index(window, "b_test"), true); name != "TestB/sub" {
+		t.Fatalf("unexpected test in the Tests window %q", name)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"image"
 	"image/color"
 
+	"gioui.org/f32"
 	"gioui.org/layout"
 	"gioui.org/op"
 	"gioui.org/op/clip"
@@ -32,6 +33,7 @@ type TextRenderer struct {
 	fgColor                  Color
 	bgColor                  Color
 	drawBgColor              bool
+	decoration               TextDecoration
 	tabStopInterval          int
 	shaper                   *text.Shaper
 	cachedTextColumnLayouter cachedTextColumnLayouter
@@ -86,17 +88,30 @@ func (tr *TextRenderer) SetDrawBg(b bool) {
 	tr.drawBgColor = b
 }
 
+func (tr *TextRenderer) SetDecoration(d TextDecoration) {
+	tr.decoration = d
+}
+
 func (tr *TextRenderer) SetTabStopInterval(i int) {
 	tr.tabStopInterval = i
 }
 
+// DrawTextline draws the line. The glyphs of the line are positioned relative to the start of the line
+// they were split from, so all the parts of a line split by Line.Split are drawn at the same offset.
 func (tr *TextRenderer) DrawTextline(gtx layout.Context, line *typeset.Line) {
 	tr.drawTextBackground(gtx, line)
 	tr.drawTextForeground(gtx, line)
 }
 
 func (tr *TextRenderer) drawTextBackground(gtx layout.Context, line *typeset.Line) {
-	tr.DrawTextBgRect(gtx, line.Width().Round())
+	if !tr.drawBgColor {
+		return
+	}
+	for _, s := range line.Spans() {
+		stack := op.Offset(image.Point{s.Left.Round(), 0}).Push(gtx.Ops)
+		tr.DrawTextBgRect(gtx, s.Right.Round()-s.Left.Round())
+		stack.Pop()
+	}
 }
 
 func (tr *TextRenderer) DrawTextBgRect(gtx layout.Context, width int) {
@@ -109,6 +124,9 @@ func (tr *TextRenderer) DrawTextBgRect(gtx layout.Context, width int) {
 	stack.Pop()
 }
 
+// italicShear is the angle in radians that glyphs are slanted by to draw italic text.
+const italicShear = -0.2
+
 func (tr *TextRenderer) drawTextForeground(gtx layout.Context, line *typeset.Line) {
 	ascent := line.Ascent().Round()
 	paint.ColorOp{Color: color.NRGBA(tr.fgColor)}.Add(gtx.Ops)
@@ -116,18 +134,60 @@ func (tr *TextRenderer) drawTextForeground(gtx layout.Context, line *typeset.Lin
 	// The layed-out text is clipped relative to the baseline. This means the Ascent is
 	// drawn above the current offset; i.e. if the y offset is 0, the ascent is clipped
 	// off the top of the screen (negative). So we need to move it down as needed.
-	op.Offset(image.Point{0, ascent}).Add(gtx.Ops)
+	defer op.Offset(image.Point{0, ascent}).Push(gtx.Ops).Pop()
+
+	if tr.decoration.Underline {
+		tr.drawUnderline(gtx, line)
+	}
+
+	// Bold and italic text is drawn by changing the glyphs of the regular font rather than by using
+	// a different font, so that the layout of the text is the same whatever the decoration.
+	if tr.decoration.Italic {
+		defer op.Affine(f32.Affine2D{}.Shear(f32.Point{}, italicShear, 0)).Push(gtx.Ops).Pop()
+	}
+
+	glyphs := line.DrawGlyphs()
+	if len(glyphs) == 0 {
+		return
+	}
+	// The shaper draws the glyphs relative to the first one.
+	defer op.Affine(f32.Affine2D{}.Offset(f32.Pt(fixedToFloat(glyphs[0].X), 0))).Push(gtx.Ops).Pop()
+
 	path := tr.shape(line)
+	tr.paintPath(gtx, path)
+	if tr.decoration.Bold {
+		stack := op.Offset(image.Point{1, 0}).Push(gtx.Ops)
+		tr.paintPath(gtx, path)
+		stack.Pop()
+	}
+}
 
+func (tr *TextRenderer) paintPath(gtx layout.Context, path clip.PathSpec) {
 	stack := clip.Outline{Path: path}.Op().Push(gtx.Ops)
-	op.Offset(image.Point{0, -ascent}).Add(gtx.Ops)
-
 	paint.PaintOp{}.Add(gtx.Ops)
 	stack.Pop()
 }
 
+// drawUnderline draws a line under the text. The current offset must be at the baseline.
+func (tr *TextRenderer) drawUnderline(gtx layout.Context, line *typeset.Line) {
+	thickness := tr.fontSize / 14
+	if thickness < 1 {
+		thickness = 1
+	}
+	y := thickness + 1
+	for _, s := range line.Spans() {
+		stack := clip.Rect{Min: image.Pt(s.Left.Round(), y), Max: image.Pt(s.Right.Round(), y+thickness)}.Push(gtx.Ops)
+		paint.PaintOp{}.Add(gtx.Ops)
+		stack.Pop()
+	}
+}
+
+func fixedToFloat(i fixed.Int26_6) float32 {
+	return float32(i) / 64
+}
+
 func (tr *TextRenderer) shape(line *typeset.Line) clip.PathSpec {
-	return tr.shaper.Shape(line.Glyphs())
+	return tr.shaper.Shape(line.DrawGlyphs())
 }
 
 func (tr *TextRenderer) LayoutItemsInColumns(gtx layout.Context, items []string) []byte {
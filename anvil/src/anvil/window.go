@@ -45,6 +45,10 @@ type Window struct {
 	allowDirtyDelete              bool
 	packingCoordChangedListeners  []func(oldVal, newVal int)
 	customEdCommands              string
+	// term is set if the window is a terminal
+	term *terminal
+	// jobStatus is the exit status of the last job that wrote to the window, as shown in the tag
+	jobStatus string
 }
 
 type fileType int
@@ -414,25 +418,38 @@ func (w *Window) Put() error {
 		return fmt.Errorf("Can't Put with an empty filename")
 	}
 
+	w.Body.formatForSave()
+
+	pre, post := w.saveHooks()
+	if len(pre) > 0 {
+		w.runPreSaveHooks(pre, post)
+		return nil
+	}
+
+	w.save(post)
+	return nil
+}
+
+// save writes the body of the window to its file, and runs the post-save hooks once it's written.
+func (w *Window) save(postHooks []string) {
 	var ldr FileLoader
-	b := w.Body.Bytes()
+	b := convertLineEndings(w.Body.Bytes(), w.Body.indent.endOfLine)
 
 	// err := ldr.Save(w.file, b)
 	save := mylog.Check2(ldr.SaveAsync(w.file, b))
 
 	ws := &WindowDataSave{
-		Jobname: filepath.Base(w.file),
-		Win:     w,
-		errs:    save.Errs,
-		kill:    save.Kill,
+		Jobname:   filepath.Base(w.file),
+		Win:       w,
+		errs:      save.Errs,
+		kill:      save.Kill,
+		postHooks: postHooks,
 	}
 	ws.Start(editor.WorkChan())
 	editor.AddJob(ws)
 
 	// w.markTextAsUnchanged()
 	// w.SetTag()
-
-	return nil
 }
 
 func (w *Window) Get() error {
@@ -556,6 +573,7 @@ func (c *Window) Zerox() (nw *Window, err error) {
 	nw.Body.text = c.Body.text
 
 	nw.SetFilenameAndTag(c.file, c.fileType)
+	nw.Body.SetIndentation(c.Body.Indentation())
 
 	c.addClone(nw)
 	nw.addClone(c)
@@ -611,7 +629,7 @@ func (w *Window) redrawClonesOnTextChange(ch *TextChange) {
 			if ch.Length != 0 {
 				log(LogCatgWin, "redrawClonesOnTextChange: changing top left index of editable from %d to %d\n", c.Body.TopLeftIndex, c.Body.TopLeftIndex+ch.Length)
 				w.shiftClonesTopLeftDueToTextModification(&c.Body, ch)
-				c.Body.shiftItemsDueToTextModification(ch.Offset, ch.Length)
+				c.Body.shiftOwnItemsDueToTextModification(ch.Offset, ch.Length)
 			}
 			// This is to force a redraw
 			c.Body.invalidateLayedoutText()
@@ -638,18 +656,29 @@ func (w *Window) removeFromAllClones() {
 func (w *Window) maybeEnableSyntax() {
 	if w.fileType == typeFile {
 		w.Body.EnableSyntax(w.file)
+		w.Body.EnableSnippets()
 		w.setBodyCompletionSource()
 		w.Body.BuildCompletions()
 		w.Body.HighlightSyntax()
 	}
 }
 
+// setJobStatus shows the exit status of a job at the end of the tag, replacing the previous one.
+func (w *Window) setJobStatus(status string) {
+	if w.jobStatus != "" {
+		_, start, n := removeJobFromTagString(w.jobStatus, w.Tag.String())
+		w.Tag.deleteFromPieceTable(start, n)
+	}
+	w.jobStatus = status
+	appendToWindowTag(w, status)
+}
+
 func (w *Window) IsErrorsWindow() bool {
 	return strings.HasSuffix(w.file, "+Errors")
 }
 
 func (w *Window) CanDelete() bool {
-	if w.IsErrorsWindow() || w.fileType == typeDir {
+	if w.IsErrorsWindow() || w.fileType == typeDir || w.term != nil {
 		return true
 	}
 
@@ -690,6 +719,32 @@ func (w *Window) notifyApiBodyChanged(c *TextChange) {
 	addApiNotificationToAllSessions(n)
 }
 
+// Execute executes the command as if it was run from the window's tag.
+func (w *Window) Execute(cmd string, args []string) {
+	w.Tag.AddOpForNextLayout(func(gtx layout.Context) {
+		w.Tag.adapter.execute(&w.Tag.blockEditable.editable, gtx, cmd, args)
+	})
+}
+
+func (w *Window) notifyApi(op ApiNotificationOp) {
+	addApiNotificationToAllSessions(ApiNotification{WinId: w.Id, Op: op})
+}
+
+func (w *Window) notifyApiSelectionChanged() {
+	n := ApiNotification{
+		WinId:  w.Id,
+		Op:     ApiNotificationOpSelect,
+		Offset: w.Body.firstCursorIndex(),
+	}
+
+	if w.Body.primarySel != nil {
+		n.Offset = w.Body.primarySel.Start()
+		n.Len = w.Body.primarySel.Len()
+	}
+
+	addApiNotificationToAllSessions(n)
+}
+
 func (w *Window) SetStyle(style Style) {
 	w.layout.style = style
 	w.layout.layouter.fontStyles = style.Fonts
@@ -16,6 +16,8 @@ type WindowDataLoad struct {
 	SelectBehaviour   selectBehaviour
 	GrowBodyBehaviour growBodyBehaviour
 	Job               Job
+	// CmdHistoryId is the id of the external command in the command history that is writing to the window, if any
+	CmdHistoryId int
 }
 
 type WindowHolder struct {
@@ -194,10 +196,21 @@ func (l *WindowDataLoad) Kill() {
 	}
 }
 
+func (l *WindowDataLoad) Interrupt() {
+	select {
+	case l.DataLoad.Interrupt <- struct{}{}:
+	default:
+	}
+}
+
 func (l *WindowDataLoad) Name() string {
 	return l.Jobname
 }
 
+func (l *WindowDataLoad) HistoryId() int {
+	return l.CmdHistoryId
+}
+
 // WindowDataChunk is a chunk of data to be written to a window, or an error
 type winLoadData struct {
 	job               Job
@@ -299,6 +312,7 @@ func (l winLoadDone) Service() (done bool) {
 			})
 		}
 		l.win.maybeEnableSyntax()
+		l.win.loadIndentation()
 	}
 	return true
 }
@@ -336,10 +350,11 @@ func (l winSetFiletype) Job() Job {
 }
 
 type WindowDataSave struct {
-	Jobname string
-	Win     *Window
-	errs    chan error
-	kill    chan struct{}
+	Jobname   string
+	Win       *Window
+	errs      chan error
+	kill      chan struct{}
+	postHooks []string
 }
 
 func (s WindowDataSave) Name() string {
@@ -363,20 +378,26 @@ func (s *WindowDataSave) wait(c chan Work) {
 	e, ok := <-s.errs
 	if !ok {
 		// errors closed
-		c <- &winSaveDone{job: s, win: s.Win}
+		c <- &winSaveDone{job: s, win: s.Win, postHooks: s.postHooks}
 		return
 	}
 	c <- &winLoadErr{job: s, err: e}
 }
 
 type winSaveDone struct {
-	job Job
-	win *Window
+	job       Job
+	win       *Window
+	postHooks []string
 }
 
 func (l winSaveDone) Service() (done bool) {
 	l.win.markTextAsUnchanged()
 	l.win.SetTag()
+	l.win.notifyApi(ApiNotificationOpSave)
+	if len(l.postHooks) > 0 {
+		l.win.runPostSaveHooks(l.postHooks)
+	}
+	maker.MakeOnSave(l.win.file)
 	return true
 }
 
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"gioui.org/layout"
+	"github.com/jeffwilliams/anvil/internal/typeset"
+)
+
+// wrapMode controls how the lines of an editable that are wider than the editable are displayed.
+type wrapMode int
+
+const (
+	// wrapAtChars wraps lines between any two characters. This is the default.
+	wrapAtChars wrapMode = iota
+	// wrapAtWords wraps lines at word boundaries where possible, and indents the continuation lines
+	// to match the leading whitespace of the line.
+	wrapAtWords
+	// noWrap doesn't wrap lines. The editable is scrolled horizontally instead.
+	noWrap
+)
+
+func (m wrapMode) String() string {
+	switch m {
+	case wrapAtWords:
+		return "word"
+	case noWrap:
+		return "none"
+	default:
+		return "char"
+	}
+}
+
+func parseWrapMode(s string) (m wrapMode, ok bool) {
+	switch s {
+	case "char":
+		return wrapAtChars, true
+	case "word":
+		return wrapAtWords, true
+	case "none":
+		return noWrap, true
+	}
+	return
+}
+
+// wrapSettings are the wrap mode of an editable and the column to wrap at.
+type wrapSettings struct {
+	mode wrapMode
+	// column is the column lines are wrapped at, measured in the width of a space. If it is 0, or
+	// the editable is narrower, lines are wrapped at the right edge of the editable.
+	column int
+	// lastWrapping is the mode to return to when wrapping is toggled back on.
+	lastWrapping wrapMode
+}
+
+// horizontalScrollMargin is the number of space widths kept between the cursor and the edge of the
+// editable when it is scrolled horizontally to keep the cursor visible.
+const horizontalScrollMargin = 4
+
+// horizontalScrollStep is the number of space widths the editable is scrolled by when it is scrolled
+// horizontally using the keyboard or mouse wheel.
+const horizontalScrollStep = 8
+
+func (e *editable) SetWrap(mode wrapMode, column int) {
+	if mode != noWrap {
+		e.wrap.lastWrapping = mode
+	}
+	e.wrap.mode = mode
+	e.wrap.column = column
+	if mode != noWrap {
+		e.xScroll = 0
+	}
+	e.invalidateLayedoutText()
+}
+
+// ToggleWrap switches between not wrapping and the last mode that wrapped lines.
+func (e *editable) ToggleWrap() {
+	if e.wrap.mode == noWrap {
+		e.SetWrap(e.wrap.lastWrapping, e.wrap.column)
+		return
+	}
+	e.SetWrap(noWrap, e.wrap.column)
+}
+
+func (e *editable) WrapMode() wrapMode {
+	return e.wrap.mode
+}
+
+func (e *editable) WrapColumn() int {
+	return e.wrap.column
+}
+
+// wrapWidth returns the width in pixels that lines are wrapped at, or 0 if lines are not wrapped.
+func (e *editable) wrapWidth(gtx layout.Context) int {
+	if e.wrap.mode == noWrap {
+		return 0
+	}
+
+	w := gtx.Constraints.Max.X - e.style.TextLeftPadding
+	if e.wrap.column > 0 {
+		w = min(w, e.wrap.column*e.widthOfSpace())
+	}
+	return w
+}
+
+func (e *editable) typesetWrapMode() typeset.WrapMode {
+	if e.wrap.mode == wrapAtWords {
+		return typeset.WrapWords
+	}
+	return typeset.WrapAnywhere
+}
+
+// scrollHorizontally scrolls the editable left or right by a few characters if it is not wrapping lines.
+func (e *editable) scrollHorizontally(d horizontalDirection) {
+	e.scrollHorizontallyBy(d, horizontalScrollStep*e.widthOfSpace())
+}
+
+func (e *editable) scrollHorizontallyBy(d horizontalDirection, pixels int) {
+	if e.wrap.mode != noWrap || e.PreventScrolling {
+		return
+	}
+
+	if d == Left {
+		pixels = -pixels
+	}
+	e.xScroll = max(e.xScroll+pixels, 0)
+}
+
+// makeCursorVisibleByScrollingHorizontally scrolls the editable horizontally so that the first cursor is
+// visible when lines are not wrapped.
+func (e *editable) makeCursorVisibleByScrollingHorizontally(gtx layout.Context) {
+	if e.wrap.mode != noWrap {
+		e.xScroll = 0
+		return
+	}
+
+	cursorIndex := e.firstCursorIndex()
+	lines, lineStarts := e.blockLines(cursorIndex, cursorIndex)
+	if len(lines) == 0 {
+		return
+	}
+
+	x := lines[0].XOfRuneIndex(cursorIndex - lineStarts[0])
+	width := gtx.Constraints.Max.X - e.style.TextLeftPadding
+	margin := min(horizontalScrollMargin*e.widthOfSpace(), width/4)
+
+	if x < e.xScroll+margin {
+		e.xScroll = max(x-margin, 0)
+	} else if x > e.xScroll+width-margin {
+		e.xScroll = x - width + margin
+	}
+}
+
+// parseWrapArgs parses the arguments of the Wrap command: a wrap mode, a column number or both.
+func parseWrapArgs(args []string, settings wrapSettings) (mode wrapMode, column int, err error) {
+	mode, column = settings.mode, settings.column
+	modeGiven := false
+	for _, a := range args {
+		if m, ok := parseWrapMode(a); ok {
+			mode = m
+			modeGiven = true
+			continue
+		}
+
+		n, convErr := strconv.Atoi(a)
+		if convErr != nil || n < 0 {
+			err = fmt.Errorf("Wrap: '%s' is not a wrap mode (none, char or word) or a column number", a)
+			return
+		}
+		column = n
+	}
+
+	// Setting the column turns wrapping back on unless the mode says otherwise.
+	if !modeGiven && mode == noWrap && len(args) > 0 {
+		mode = settings.lastWrapping
+	}
+	return
+}